@@ -0,0 +1,550 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiber
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeaderIdempotencyKey is header which marks request of non idempotent method as safe to retry and hedge
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+// ErrCircuitOpen is returned without sending request while circuit breaker of host is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+var (
+	// methods which are retried and hedged without HeaderIdempotencyKey
+	idempotentMethods = map[string]bool{
+		http.MethodGet:     true,
+		http.MethodHead:    true,
+		http.MethodOptions: true,
+		http.MethodTrace:   true,
+		http.MethodPut:     true,
+		http.MethodDelete:  true,
+	}
+
+	// counters of fiber client entries by prometheus.Registerer
+	clientCounters sync.Map
+)
+
+// RetryPolicy of FiberClientEntry.
+//
+// Requests are retried if transport failed or status code is one of RetryOn, with backoff which grows by Multiplier
+// from InitialBackoff up to MaxBackoff and is randomly reduced by up to Jitter of itself.
+// Retry-After header of response is honored if it is not longer than MaxBackoff, otherwise response is returned
+// without retry since server would not accept request earlier.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+	RetryOn        []int
+}
+
+// backoff returns duration to wait before retry of n-th attempt, false if Retry-After of response is longer
+// than MaxBackoff and request should not be retried
+func (p *RetryPolicy) backoff(attempt int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil {
+		if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && sec >= 0 {
+			after := time.Duration(sec) * time.Second
+			return after, after <= p.MaxBackoff
+		}
+	}
+
+	res := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	if res > float64(p.MaxBackoff) {
+		res = float64(p.MaxBackoff)
+	}
+
+	return time.Duration(res * (1 - p.Jitter*rand.Float64())), true
+}
+
+// retryable returns true if status code of response is one of RetryOn
+func (p *RetryPolicy) retryable(resp *http.Response) bool {
+	for _, code := range p.RetryOn {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BreakerPolicy of FiberClientEntry.
+//
+// Circuit breaker of host opens after FailureThreshold consecutive failures, which are transport errors and 5xx,
+// and rejects requests with ErrCircuitOpen for OpenDuration. After that, up to HalfOpenRequests requests are sent
+// as probes, breaker closes if probe succeeded and opens again if failed.
+type BreakerPolicy struct {
+	FailureThreshold int
+	OpenDuration     time.Duration
+	HalfOpenRequests int
+}
+
+// HedgePolicy of FiberClientEntry.
+//
+// Another request is sent if no response is received within Delay, up to MaxRequests requests in total.
+// First successful response is returned and others are cancelled.
+type HedgePolicy struct {
+	Delay       time.Duration
+	MaxRequests int
+}
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker is circuit breaker of a host.
+//
+// Generation increases on every state change, results of requests allowed in earlier generation are ignored,
+// so that slow request allowed while closed would neither take probe slot nor close half open breaker.
+type breaker struct {
+	policy     *BreakerPolicy
+	lock       sync.Mutex
+	state      int
+	generation uint64
+	failures   int
+	openedAt   time.Time
+	probes     int
+}
+
+// ticket is admission of request by breaker, which is passed back with result
+type ticket struct {
+	generation uint64
+	probe      bool
+}
+
+// allow returns ticket of request and true if request could be sent
+func (b *breaker) allow() (ticket, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.policy.OpenDuration {
+			return ticket{}, false
+		}
+		b.transit(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probes >= b.policy.HalfOpenRequests {
+			return ticket{}, false
+		}
+		b.probes++
+		return ticket{generation: b.generation, probe: true}, true
+	}
+
+	return ticket{generation: b.generation}, true
+}
+
+// report result of allowed request, returns true if breaker opened
+func (b *breaker) report(t ticket, success bool) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// request was allowed before state changed
+	if t.generation != b.generation {
+		return false
+	}
+
+	switch b.state {
+	case breakerClosed:
+		if success {
+			b.failures = 0
+			return false
+		}
+		b.failures++
+		if b.failures < b.policy.FailureThreshold {
+			return false
+		}
+	case breakerHalfOpen:
+		if success {
+			b.transit(breakerClosed)
+			return false
+		}
+	}
+
+	b.transit(breakerOpen)
+	b.openedAt = time.Now()
+	return true
+}
+
+// release probe of request which was cancelled without result
+func (b *breaker) release(t ticket) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if t.probe && t.generation == b.generation {
+		b.probes--
+	}
+}
+
+// transit breaker into state and start a new generation, caller must hold lock
+func (b *breaker) transit(state int) {
+	b.state, b.failures, b.probes = state, 0, 0
+	b.generation++
+}
+
+// breakers of hosts
+type breakers struct {
+	policy *BreakerPolicy
+	hosts  sync.Map
+}
+
+// get breaker of host
+func (b *breakers) get(host string) *breaker {
+	raw, _ := b.hosts.LoadOrStore(host, &breaker{policy: b.policy})
+	return raw.(*breaker)
+}
+
+// clientCounter is counters of resilient behaviors of fiber client entries
+type clientCounter struct {
+	retries  *prometheus.CounterVec
+	hedges   *prometheus.CounterVec
+	rejected *prometheus.CounterVec
+}
+
+// inc counter of client and host, counter is nil if registration failed
+func inc(vec *prometheus.CounterVec, client, host string) {
+	if vec == nil {
+		return
+	}
+
+	if counter, err := vec.GetMetricWithLabelValues(client, host); err == nil {
+		counter.Inc()
+	}
+}
+
+// newClientCounter returns counters registered in registerer
+func newClientCounter(registerer prometheus.Registerer) *clientCounter {
+	if raw, ok := clientCounters.Load(registerer); ok {
+		return raw.(*clientCounter)
+	}
+
+	res := &clientCounter{
+		retries:  registerCounter(registerer, "retries_total", "Total number of retries of outbound HTTP requests."),
+		hedges:   registerCounter(registerer, "hedges_total", "Total number of hedged outbound HTTP requests."),
+		rejected: registerCounter(registerer, "circuit_rejected_total", "Total number of outbound HTTP requests rejected by circuit breaker."),
+	}
+
+	raw, _ := clientCounters.LoadOrStore(registerer, res)
+	return raw.(*clientCounter)
+}
+
+// registerCounter returns counter registered in registerer, nil on failure
+func registerCounter(registerer prometheus.Registerer, name, help string) *prometheus.CounterVec {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "rk",
+		Subsystem: "http_client",
+		Name:      name,
+		Help:      help,
+	}, []string{"client", "host"})
+
+	if err := registerer.Register(vec); err != nil {
+		exist, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil
+		}
+		if vec, ok = exist.ExistingCollector.(*prometheus.CounterVec); !ok {
+			return nil
+		}
+	}
+
+	return vec
+}
+
+// resilientTransport resolves relative URL against base URL, and sends requests through base with retry,
+// circuit breaker and hedging of FiberClientEntry
+type resilientTransport struct {
+	entry   *FiberClientEntry
+	base    http.RoundTripper
+	counter *clientCounter
+	logger  *zap.Logger
+}
+
+// hedgeResult is result of a hedged request
+type hedgeResult struct {
+	resp  *http.Response
+	err   error
+	index int
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = t.resolve(req)
+
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	safe := replayable && (idempotentMethods[req.Method] || len(req.Header.Get(HeaderIdempotencyKey)) > 0)
+
+	attempts := 1
+	if t.entry.Retry != nil && safe && t.entry.Retry.MaxAttempts > 1 {
+		attempts = t.entry.Retry.MaxAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		var resp *http.Response
+		var err error
+		if t.entry.Hedging != nil && safe {
+			resp, err = t.hedge(req)
+		} else {
+			resp, err = t.send(req, req.Context())
+		}
+
+		if attempt >= attempts || req.Context().Err() != nil || !t.retryable(resp, err) {
+			return resp, err
+		}
+
+		wait, ok := t.entry.Retry.backoff(attempt, resp)
+		if !ok {
+			return resp, err
+		}
+		closeBody(resp)
+		inc(t.counter.retries, t.entry.entryName, req.URL.Host)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// resolve URL of request against base URL of entry if URL is relative
+func (t *resilientTransport) resolve(req *http.Request) *http.Request {
+	base := t.entry.baseURL
+	if base == nil || req.URL.IsAbs() {
+		return req
+	}
+
+	u := *base
+	if len(req.URL.Path) > 0 {
+		u.Path = strings.TrimSuffix(base.Path, "/") + "/" + strings.TrimPrefix(req.URL.Path, "/")
+		u.RawPath = ""
+	}
+	u.RawQuery = req.URL.RawQuery
+	if len(u.RawQuery) < 1 {
+		u.RawQuery = base.RawQuery
+	}
+
+	res := req.Clone(req.Context())
+	res.URL = &u
+	res.Host = ""
+	return res
+}
+
+// retryable returns true if result of attempt should be retried
+func (t *resilientTransport) retryable(resp *http.Response, err error) bool {
+	if t.entry.Retry == nil {
+		return false
+	}
+
+	if err != nil {
+		return !errors.Is(err, ErrCircuitOpen)
+	}
+
+	return t.entry.Retry.retryable(resp)
+}
+
+// failed returns true if hedged request should be sent for result
+func (t *resilientTransport) failed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	if t.entry.Retry != nil {
+		return t.entry.Retry.retryable(resp)
+	}
+
+	return resp.StatusCode >= http.StatusInternalServerError
+}
+
+// hedge sends request, and another one if no response received within delay until one succeeded
+func (t *resilientTransport) hedge(req *http.Request) (*http.Response, error) {
+	policy := t.entry.Hedging
+	results := make(chan hedgeResult, policy.MaxRequests)
+	cancels := make([]context.CancelFunc, 0, policy.MaxRequests)
+	pending := 0
+
+	launch := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels = append(cancels, cancel)
+		index := len(cancels) - 1
+		if index > 0 {
+			inc(t.counter.hedges, t.entry.entryName, req.URL.Host)
+		}
+		pending++
+
+		go func() {
+			resp, err := t.send(req, ctx)
+			results <- hedgeResult{resp: resp, err: err, index: index}
+		}()
+	}
+
+	launch()
+	timer := time.NewTimer(policy.Delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if len(cancels) < policy.MaxRequests {
+				launch()
+				timer.Reset(policy.Delay)
+			}
+		case res := <-results:
+			pending--
+			if !t.failed(res.resp, res.err) || (pending < 1 && len(cancels) >= policy.MaxRequests) {
+				// cancel others and close their bodies, context of winner is cancelled once body closed
+				for i := range cancels {
+					if i != res.index {
+						cancels[i]()
+					}
+				}
+				go func(n int) {
+					for ; n > 0; n-- {
+						closeBody((<-results).resp)
+					}
+				}(pending)
+
+				if res.err != nil {
+					cancels[res.index]()
+				} else {
+					res.resp.Body = &cancelBody{ReadCloser: res.resp.Body, cancel: cancels[res.index]}
+				}
+
+				return res.resp, res.err
+			}
+
+			// failed fast, send next one immediately
+			closeBody(res.resp)
+			cancels[res.index]()
+			if len(cancels) < policy.MaxRequests {
+				launch()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(policy.Delay)
+			}
+		}
+	}
+}
+
+// send a copy of request with ctx through circuit breaker of host
+func (t *resilientTransport) send(req *http.Request, ctx context.Context) (*http.Response, error) {
+	host := req.URL.Host
+
+	var b *breaker
+	var tk ticket
+	if t.entry.breakers != nil {
+		b = t.entry.breakers.get(host)
+		allowed := false
+		if tk, allowed = b.allow(); !allowed {
+			inc(t.counter.rejected, t.entry.entryName, host)
+			return nil, fmt.Errorf("%w, host:%s", ErrCircuitOpen, host)
+		}
+	}
+
+	cancel := context.CancelFunc(nil)
+	if t.entry.AttemptTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.entry.AttemptTimeout)
+	}
+
+	attemptReq := req.Clone(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			if cancel != nil {
+				cancel()
+			}
+			if b != nil {
+				b.release(tk)
+			}
+			return nil, err
+		}
+		attemptReq.Body = body
+	}
+
+	resp, err := t.base.RoundTrip(attemptReq)
+
+	if b != nil {
+		// requests cancelled by caller or hedging are not failures of host
+		if err != nil && errors.Is(err, context.Canceled) {
+			b.release(tk)
+		} else if b.report(tk, err == nil && resp.StatusCode < http.StatusInternalServerError) {
+			t.logger.Warn("Circuit breaker opened",
+				zap.String("client", t.entry.entryName),
+				zap.String("host", host))
+		}
+	}
+
+	if cancel != nil {
+		if err != nil {
+			cancel()
+		} else {
+			resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+		}
+	}
+
+	return resp, err
+}
+
+// closeBody drains and closes body of response, so that connection could be reused
+func closeBody(resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+}
+
+// cancelBody cancels context of request once body closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer
+func (body *cancelBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+// parseBaseURL returns nil if raw is empty or invalid
+func parseBaseURL(raw string) *url.URL {
+	if len(raw) < 1 {
+		return nil
+	}
+
+	res, err := url.Parse(raw)
+	if err != nil || !res.IsAbs() {
+		return nil
+	}
+
+	return res
+}
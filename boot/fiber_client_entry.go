@@ -0,0 +1,457 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiber
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// FiberClientEntryType type of entry
+	FiberClientEntryType = "FiberClientEntry"
+)
+
+// This must be declared in order to register registration function into rk context
+// otherwise, rk-boot won't able to bootstrap fiber client entry automatically from boot config file
+func init() {
+	rkentry.RegisterPluginRegFunc(RegisterFiberClientEntryYAML)
+}
+
+// BootFiberClient boot config which is for fiber client entry.
+type BootFiberClient struct {
+	FiberClient []struct {
+		Enabled          bool   `yaml:"enabled" json:"enabled"`
+		Name             string `yaml:"name" json:"name"`
+		Description      string `yaml:"description" json:"description"`
+		BaseUrl          string `yaml:"baseUrl" json:"baseUrl"`
+		TimeoutMs        int    `yaml:"timeoutMs" json:"timeoutMs"`
+		AttemptTimeoutMs int    `yaml:"attemptTimeoutMs" json:"attemptTimeoutMs"`
+		Pool             struct {
+			DialTimeoutMs       int `yaml:"dialTimeoutMs" json:"dialTimeoutMs"`
+			MaxIdleConns        int `yaml:"maxIdleConns" json:"maxIdleConns"`
+			MaxIdleConnsPerHost int `yaml:"maxIdleConnsPerHost" json:"maxIdleConnsPerHost"`
+			MaxConnsPerHost     int `yaml:"maxConnsPerHost" json:"maxConnsPerHost"`
+			IdleConnTimeoutMs   int `yaml:"idleConnTimeoutMs" json:"idleConnTimeoutMs"`
+		} `yaml:"pool" json:"pool"`
+		Retry struct {
+			Enabled          bool    `yaml:"enabled" json:"enabled"`
+			MaxAttempts      int     `yaml:"maxAttempts" json:"maxAttempts"`
+			InitialBackoffMs int     `yaml:"initialBackoffMs" json:"initialBackoffMs"`
+			MaxBackoffMs     int     `yaml:"maxBackoffMs" json:"maxBackoffMs"`
+			Multiplier       float64 `yaml:"multiplier" json:"multiplier"`
+			Jitter           float64 `yaml:"jitter" json:"jitter"`
+			RetryOn          []int   `yaml:"retryOn" json:"retryOn"`
+		} `yaml:"retry" json:"retry"`
+		CircuitBreaker struct {
+			Enabled          bool `yaml:"enabled" json:"enabled"`
+			FailureThreshold int  `yaml:"failureThreshold" json:"failureThreshold"`
+			OpenMs           int  `yaml:"openMs" json:"openMs"`
+			HalfOpenRequests int  `yaml:"halfOpenRequests" json:"halfOpenRequests"`
+		} `yaml:"circuitBreaker" json:"circuitBreaker"`
+		Hedging struct {
+			Enabled     bool `yaml:"enabled" json:"enabled"`
+			DelayMs     int  `yaml:"delayMs" json:"delayMs"`
+			MaxRequests int  `yaml:"maxRequests" json:"maxRequests"`
+		} `yaml:"hedging" json:"hedging"`
+	} `yaml:"fiberClient" json:"fiberClient"`
+}
+
+// FiberClientEntry implements rkentry.Entry interface.
+//
+// It sends outbound HTTP requests of handlers with connection pool, retries, per host circuit breaker and hedging.
+// Spans, latency and logs of requests are integrated with FiberEntry which received the incoming request.
+type FiberClientEntry struct {
+	entryName        string               `yaml:"-" json:"-"`
+	entryType        string               `yaml:"-" json:"-"`
+	entryDescription string               `yaml:"-" json:"-"`
+	baseURL          *url.URL             `yaml:"-" json:"-"`
+	breakers         *breakers            `yaml:"-" json:"-"`
+	Transport        *http.Transport      `yaml:"-" json:"-"`
+	Timeout          time.Duration        `yaml:"-" json:"-"`
+	AttemptTimeout   time.Duration        `yaml:"-" json:"-"`
+	Retry            *RetryPolicy         `yaml:"-" json:"-"`
+	CircuitBreaker   *BreakerPolicy       `yaml:"-" json:"-"`
+	Hedging          *HedgePolicy         `yaml:"-" json:"-"`
+	LoggerEntry      *rkentry.LoggerEntry `yaml:"-" json:"-"`
+}
+
+// RegisterFiberClientEntryYAML register fiber client entries with provided config file (Must YAML file).
+//
+// Currently, support two ways to provide config file path.
+// 1: With function parameters
+// 2: With command line flag "--rkboot" described in rkcommon.BootConfigPathFlagKey (Will override function parameter if exists)
+// Command line flag has high priority which would override function parameter
+//
+// Error handling:
+// Process will shutdown if any errors occur with rkcommon.ShutdownWithError function
+//
+// Override elements in config file:
+// We learned from HELM source code which would override elements in YAML file with "--set" flag as follows:
+// For example:
+// rk-boot --set "fiberClient[0].baseUrl=http://localhost:8081"
+// Overrides are comma separated
+func RegisterFiberClientEntryYAML(raw []byte) map[string]rkentry.Entry {
+	res := make(map[string]rkentry.Entry)
+
+	// 1: Decode config map into boot config struct
+	config := &BootFiberClient{}
+	rkentry.UnmarshalBootYAML(raw, config)
+
+	// 2: Init fiber client entries with boot config
+	for i := range config.FiberClient {
+		element := config.FiberClient[i]
+		if !element.Enabled {
+			continue
+		}
+
+		transport := newClientTransport()
+		pool := element.Pool
+		if pool.DialTimeoutMs > 0 {
+			transport.DialContext = (&net.Dialer{
+				Timeout:   time.Duration(pool.DialTimeoutMs) * time.Millisecond,
+				KeepAlive: 30 * time.Second,
+			}).DialContext
+		}
+		if pool.MaxIdleConns > 0 {
+			transport.MaxIdleConns = pool.MaxIdleConns
+		}
+		if pool.MaxIdleConnsPerHost > 0 {
+			transport.MaxIdleConnsPerHost = pool.MaxIdleConnsPerHost
+		}
+		if pool.MaxConnsPerHost > 0 {
+			transport.MaxConnsPerHost = pool.MaxConnsPerHost
+		}
+		if pool.IdleConnTimeoutMs > 0 {
+			transport.IdleConnTimeout = time.Duration(pool.IdleConnTimeoutMs) * time.Millisecond
+		}
+
+		opts := []FiberClientEntryOption{
+			WithNameFiberClientEntry(element.Name),
+			WithDescriptionFiberClientEntry(element.Description),
+			WithBaseURLFiberClientEntry(element.BaseUrl),
+			WithTransportFiberClientEntry(transport),
+		}
+
+		if element.TimeoutMs > 0 {
+			opts = append(opts, WithTimeoutFiberClientEntry(time.Duration(element.TimeoutMs)*time.Millisecond))
+		}
+
+		if element.AttemptTimeoutMs > 0 {
+			opts = append(opts,
+				WithAttemptTimeoutFiberClientEntry(time.Duration(element.AttemptTimeoutMs)*time.Millisecond))
+		}
+
+		if retry := element.Retry; retry.Enabled {
+			opts = append(opts, WithRetryFiberClientEntry(&RetryPolicy{
+				MaxAttempts:    retry.MaxAttempts,
+				InitialBackoff: time.Duration(retry.InitialBackoffMs) * time.Millisecond,
+				MaxBackoff:     time.Duration(retry.MaxBackoffMs) * time.Millisecond,
+				Multiplier:     retry.Multiplier,
+				Jitter:         retry.Jitter,
+				RetryOn:        retry.RetryOn,
+			}))
+		}
+
+		if breaker := element.CircuitBreaker; breaker.Enabled {
+			opts = append(opts, WithCircuitBreakerFiberClientEntry(&BreakerPolicy{
+				FailureThreshold: breaker.FailureThreshold,
+				OpenDuration:     time.Duration(breaker.OpenMs) * time.Millisecond,
+				HalfOpenRequests: breaker.HalfOpenRequests,
+			}))
+		}
+
+		if hedging := element.Hedging; hedging.Enabled {
+			opts = append(opts, WithHedgingFiberClientEntry(&HedgePolicy{
+				Delay:       time.Duration(hedging.DelayMs) * time.Millisecond,
+				MaxRequests: hedging.MaxRequests,
+			}))
+		}
+
+		entry := RegisterFiberClientEntry(opts...)
+
+		res[entry.GetName()] = entry
+	}
+
+	return res
+}
+
+// RegisterFiberClientEntry register FiberClientEntry with options.
+//
+// Zero values of policies are replaced with defaults.
+func RegisterFiberClientEntry(opts ...FiberClientEntryOption) *FiberClientEntry {
+	entry := &FiberClientEntry{
+		entryType:        FiberClientEntryType,
+		entryDescription: "Internal RK entry which sends outbound HTTP requests.",
+		Timeout:          10 * time.Second,
+		LoggerEntry:      rkentry.LoggerEntryStdout,
+	}
+
+	for i := range opts {
+		opts[i](entry)
+	}
+
+	if len(entry.entryName) < 1 {
+		entry.entryName = "fiberClient"
+	}
+
+	if entry.Transport == nil {
+		entry.Transport = newClientTransport()
+	}
+
+	if p := entry.Retry; p != nil {
+		if p.MaxAttempts < 1 {
+			p.MaxAttempts = 3
+		}
+		if p.InitialBackoff <= 0 {
+			p.InitialBackoff = 100 * time.Millisecond
+		}
+		if p.MaxBackoff < p.InitialBackoff {
+			p.MaxBackoff = 20 * p.InitialBackoff
+		}
+		if p.Multiplier < 1 {
+			p.Multiplier = 2
+		}
+		if p.Jitter <= 0 || p.Jitter > 1 {
+			p.Jitter = 0.2
+		}
+		if len(p.RetryOn) < 1 {
+			p.RetryOn = []int{
+				http.StatusTooManyRequests,
+				http.StatusBadGateway,
+				http.StatusServiceUnavailable,
+				http.StatusGatewayTimeout,
+			}
+		}
+	}
+
+	if p := entry.CircuitBreaker; p != nil {
+		if p.FailureThreshold < 1 {
+			p.FailureThreshold = 5
+		}
+		if p.OpenDuration <= 0 {
+			p.OpenDuration = 30 * time.Second
+		}
+		if p.HalfOpenRequests < 1 {
+			p.HalfOpenRequests = 1
+		}
+		entry.breakers = &breakers{policy: p}
+	}
+
+	if p := entry.Hedging; p != nil {
+		if p.Delay <= 0 {
+			p.Delay = 100 * time.Millisecond
+		}
+		if p.MaxRequests < 2 {
+			p.MaxRequests = 2
+		}
+	}
+
+	rkentry.GlobalAppCtx.AddEntry(entry)
+
+	return entry
+}
+
+// newClientTransport returns http.Transport with larger idle connection pool per host than http.DefaultTransport
+func newClientTransport() *http.Transport {
+	res := http.DefaultTransport.(*http.Transport).Clone()
+	res.DialContext = (&net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	res.MaxIdleConnsPerHost = 10
+
+	return res
+}
+
+// Client returns http.Client which sends requests on behalf of incoming request of ctx.
+//
+// Relative URLs of requests are resolved against base URL. Every attempt is sent through transport of
+// rkfiberctx.WrapTransport, so that it is recorded as client span, metrics and logs of FiberEntry of ctx.
+// Counters of retries, hedged requests and requests rejected by circuit breaker are registered in the same
+// registry. ctx could be nil if request is not sent by handlers.
+func (entry *FiberClientEntry) Client(ctx *fiber.Ctx) *http.Client {
+	logger := entry.LoggerEntry.Logger
+	if ctx != nil {
+		logger = rkfiberctx.GetLogger(ctx)
+	}
+
+	return &http.Client{
+		Timeout: entry.Timeout,
+		Transport: &resilientTransport{
+			entry:   entry,
+			base:    rkfiberctx.WrapTransport(ctx, entry.Transport),
+			counter: newClientCounter(rkfiberctx.GetPromRegisterer(ctx)),
+			logger:  logger,
+		},
+	}
+}
+
+// Bootstrap FiberClientEntry.
+func (entry *FiberClientEntry) Bootstrap(ctx context.Context) {
+	entry.LoggerEntry.Info("Bootstrap fiberClient entry",
+		zap.String("entryName", entry.entryName),
+		zap.String("baseUrl", entry.baseURLString()))
+}
+
+// Interrupt FiberClientEntry, idle connections are closed.
+func (entry *FiberClientEntry) Interrupt(ctx context.Context) {
+	entry.Transport.CloseIdleConnections()
+
+	entry.LoggerEntry.Info("Interrupt fiberClient entry",
+		zap.String("entryName", entry.entryName))
+}
+
+// GetName Get entry name.
+func (entry *FiberClientEntry) GetName() string {
+	return entry.entryName
+}
+
+// GetType Get entry type.
+func (entry *FiberClientEntry) GetType() string {
+	return entry.entryType
+}
+
+// GetDescription Get description of entry.
+func (entry *FiberClientEntry) GetDescription() string {
+	return entry.entryDescription
+}
+
+// String Stringfy entry.
+func (entry *FiberClientEntry) String() string {
+	bytes, _ := json.Marshal(entry)
+	return string(bytes)
+}
+
+// MarshalJSON Marshal entry.
+func (entry *FiberClientEntry) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{
+		"name":           entry.entryName,
+		"type":           entry.entryType,
+		"description":    entry.entryDescription,
+		"baseUrl":        entry.baseURLString(),
+		"timeout":        entry.Timeout.String(),
+		"attemptTimeout": entry.AttemptTimeout.String(),
+		"retry":          entry.Retry,
+		"circuitBreaker": entry.CircuitBreaker,
+		"hedging":        entry.Hedging,
+	}
+
+	return json.Marshal(&m)
+}
+
+// UnmarshalJSON Not supported.
+func (entry *FiberClientEntry) UnmarshalJSON([]byte) error {
+	return nil
+}
+
+// GetFiberClientEntry Get FiberClientEntry from rkentry.GlobalAppCtx.
+func GetFiberClientEntry(name string) *FiberClientEntry {
+	entryRaw := rkentry.GlobalAppCtx.GetEntry(FiberClientEntryType, name)
+	if entryRaw == nil {
+		return nil
+	}
+
+	entry, _ := entryRaw.(*FiberClientEntry)
+	return entry
+}
+
+// baseURLString returns base URL, empty if not set
+func (entry *FiberClientEntry) baseURLString() string {
+	if entry.baseURL == nil {
+		return ""
+	}
+
+	return entry.baseURL.String()
+}
+
+// ***************** Option *****************
+
+// FiberClientEntryOption Fiber client entry option.
+type FiberClientEntryOption func(*FiberClientEntry)
+
+// WithNameFiberClientEntry provide name.
+func WithNameFiberClientEntry(name string) FiberClientEntryOption {
+	return func(entry *FiberClientEntry) {
+		entry.entryName = name
+	}
+}
+
+// WithDescriptionFiberClientEntry provide description.
+func WithDescriptionFiberClientEntry(description string) FiberClientEntryOption {
+	return func(entry *FiberClientEntry) {
+		if len(description) > 0 {
+			entry.entryDescription = description
+		}
+	}
+}
+
+// WithBaseURLFiberClientEntry provide base URL which relative URLs of requests are resolved against,
+// ignored if not absolute.
+func WithBaseURLFiberClientEntry(baseURL string) FiberClientEntryOption {
+	return func(entry *FiberClientEntry) {
+		entry.baseURL = parseBaseURL(baseURL)
+	}
+}
+
+// WithTransportFiberClientEntry provide http.Transport with connection pool.
+func WithTransportFiberClientEntry(transport *http.Transport) FiberClientEntryOption {
+	return func(entry *FiberClientEntry) {
+		entry.Transport = transport
+	}
+}
+
+// WithTimeoutFiberClientEntry provide timeout of request including retries, zero means no timeout.
+func WithTimeoutFiberClientEntry(timeout time.Duration) FiberClientEntryOption {
+	return func(entry *FiberClientEntry) {
+		entry.Timeout = timeout
+	}
+}
+
+// WithAttemptTimeoutFiberClientEntry provide timeout of every attempt.
+func WithAttemptTimeoutFiberClientEntry(timeout time.Duration) FiberClientEntryOption {
+	return func(entry *FiberClientEntry) {
+		entry.AttemptTimeout = timeout
+	}
+}
+
+// WithRetryFiberClientEntry provide RetryPolicy.
+func WithRetryFiberClientEntry(policy *RetryPolicy) FiberClientEntryOption {
+	return func(entry *FiberClientEntry) {
+		entry.Retry = policy
+	}
+}
+
+// WithCircuitBreakerFiberClientEntry provide BreakerPolicy.
+func WithCircuitBreakerFiberClientEntry(policy *BreakerPolicy) FiberClientEntryOption {
+	return func(entry *FiberClientEntry) {
+		entry.CircuitBreaker = policy
+	}
+}
+
+// WithHedgingFiberClientEntry provide HedgePolicy.
+func WithHedgingFiberClientEntry(policy *HedgePolicy) FiberClientEntryOption {
+	return func(entry *FiberClientEntry) {
+		entry.Hedging = policy
+	}
+}
+
+// WithLoggerEntryFiberClientEntry provide rkentry.LoggerEntry used while request is not sent by handlers.
+func WithLoggerEntryFiberClientEntry(loggerEntry *rkentry.LoggerEntry) FiberClientEntryOption {
+	return func(entry *FiberClientEntry) {
+		if loggerEntry != nil {
+			entry.LoggerEntry = loggerEntry
+		}
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiber
+
+import (
+	"context"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const fiberClientConfigStr = `
+---
+fiberClient:
+ - name: ut-client
+   enabled: true
+   description: "ut client"
+   baseUrl: "http://localhost:8080/api"
+   timeoutMs: 3000
+   attemptTimeoutMs: 1000
+   pool:
+     dialTimeoutMs: 500
+     maxIdleConns: 50
+     maxIdleConnsPerHost: 20
+     maxConnsPerHost: 30
+     idleConnTimeoutMs: 60000
+   retry:
+     enabled: true
+     maxAttempts: 4
+     initialBackoffMs: 50
+     maxBackoffMs: 500
+     multiplier: 3
+     jitter: 0.5
+     retryOn: [503]
+   circuitBreaker:
+     enabled: true
+     failureThreshold: 3
+     openMs: 10000
+     halfOpenRequests: 2
+   hedging:
+     enabled: true
+     delayMs: 50
+     maxRequests: 3
+ - name: ut-client-disabled
+   enabled: false
+`
+
+// newClientCtx returns fiber.Ctx of incoming request whose prom middleware uses registry
+func newClientCtx(registry *prometheus.Registry) *fiber.Ctx {
+	ctx := fiber.New().AcquireCtx(&fasthttp.RequestCtx{})
+	ctx.SetUserContext(context.WithValue(context.Background(), rkfiberctx.PromRegistererKey, registry))
+	return ctx
+}
+
+// counterValue returns sum of counter of fiber client entries
+func counterValue(t *testing.T, registry *prometheus.Registry, name string) float64 {
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+
+	res := float64(0)
+	for _, family := range families {
+		if family.GetName() == name {
+			for _, m := range family.Metric {
+				res += m.GetCounter().GetValue()
+			}
+		}
+	}
+	return res
+}
+
+func TestRegisterFiberClientEntryYAML(t *testing.T) {
+	entries := RegisterFiberClientEntryYAML([]byte(fiberClientConfigStr))
+	assert.Len(t, entries, 1)
+
+	entry := GetFiberClientEntry("ut-client")
+	assert.NotNil(t, entry)
+	assert.Nil(t, GetFiberClientEntry("ut-client-disabled"))
+	assert.Equal(t, FiberClientEntryType, entry.GetType())
+	assert.Equal(t, "ut client", entry.GetDescription())
+	assert.Equal(t, 3*time.Second, entry.Timeout)
+	assert.Equal(t, time.Second, entry.AttemptTimeout)
+
+	// pool
+	assert.Equal(t, 50, entry.Transport.MaxIdleConns)
+	assert.Equal(t, 20, entry.Transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 30, entry.Transport.MaxConnsPerHost)
+	assert.Equal(t, time.Minute, entry.Transport.IdleConnTimeout)
+
+	// policies
+	assert.Equal(t, &RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     500 * time.Millisecond,
+		Multiplier:     3,
+		Jitter:         0.5,
+		RetryOn:        []int{http.StatusServiceUnavailable},
+	}, entry.Retry)
+	assert.Equal(t, &BreakerPolicy{
+		FailureThreshold: 3,
+		OpenDuration:     10 * time.Second,
+		HalfOpenRequests: 2,
+	}, entry.CircuitBreaker)
+	assert.Equal(t, &HedgePolicy{Delay: 50 * time.Millisecond, MaxRequests: 3}, entry.Hedging)
+
+	assert.Contains(t, entry.String(), "http://localhost:8080/api")
+
+	defer assertNotPanic(t)
+	entry.Bootstrap(context.TODO())
+	entry.Interrupt(context.TODO())
+}
+
+func TestRegisterFiberClientEntry_Defaults(t *testing.T) {
+	entry := RegisterFiberClientEntry(
+		WithNameFiberClientEntry("ut-client-defaults"),
+		WithBaseURLFiberClientEntry("not-absolute"),
+		WithRetryFiberClientEntry(&RetryPolicy{}),
+		WithCircuitBreakerFiberClientEntry(&BreakerPolicy{}),
+		WithHedgingFiberClientEntry(&HedgePolicy{}))
+
+	assert.Nil(t, entry.baseURL)
+	assert.Equal(t, 10, entry.Transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 3, entry.Retry.MaxAttempts)
+	assert.Equal(t, 100*time.Millisecond, entry.Retry.InitialBackoff)
+	assert.Equal(t, 2*time.Second, entry.Retry.MaxBackoff)
+	assert.Equal(t, []int{429, 502, 503, 504}, entry.Retry.RetryOn)
+	assert.Equal(t, 5, entry.CircuitBreaker.FailureThreshold)
+	assert.Equal(t, 2, entry.Hedging.MaxRequests)
+
+	// backoff grows until max and is reduced by jitter
+	for attempt := 1; attempt < 10; attempt++ {
+		backoff, ok := entry.Retry.backoff(attempt, nil)
+		assert.True(t, ok)
+		assert.True(t, backoff <= entry.Retry.MaxBackoff)
+		assert.True(t, backoff >= time.Duration(0.8*float64(entry.Retry.InitialBackoff)))
+	}
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"1"}}}
+	backoff, ok := entry.Retry.backoff(1, resp)
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, backoff)
+
+	// server would not accept request within max backoff, do not retry
+	resp.Header.Set("Retry-After", "60")
+	_, ok = entry.Retry.backoff(1, resp)
+	assert.False(t, ok)
+}
+
+func TestBreaker_Tickets(t *testing.T) {
+	b := &breaker{policy: &BreakerPolicy{FailureThreshold: 1, OpenDuration: time.Millisecond, HalfOpenRequests: 1}}
+
+	// slow request allowed while closed
+	slow, ok := b.allow()
+	assert.True(t, ok)
+	assert.False(t, slow.probe)
+
+	failed, ok := b.allow()
+	assert.True(t, ok)
+	assert.True(t, b.report(failed, false))
+	time.Sleep(2 * time.Millisecond)
+
+	// half open, only one probe is allowed
+	probe, ok := b.allow()
+	assert.True(t, ok)
+	assert.True(t, probe.probe)
+	_, ok = b.allow()
+	assert.False(t, ok)
+
+	// result of slow request neither releases probe slot nor closes breaker
+	b.release(slow)
+	assert.False(t, b.report(slow, true))
+	assert.Equal(t, breakerHalfOpen, b.state)
+	assert.Equal(t, 1, b.probes)
+	_, ok = b.allow()
+	assert.False(t, ok)
+
+	// probe closes breaker
+	assert.False(t, b.report(probe, true))
+	assert.Equal(t, breakerClosed, b.state)
+
+	// late result of probe after state changed is ignored
+	b.release(probe)
+	assert.Equal(t, 0, b.probes)
+}
+
+func TestFiberClientEntry_BaseURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer server.Close()
+
+	entry := RegisterFiberClientEntry(
+		WithNameFiberClientEntry("ut-client-base"),
+		WithBaseURLFiberClientEntry(server.URL+"/api/"))
+
+	client := entry.Client(nil)
+	for path, expected := range map[string]string{
+		"/v1/users?id=1":            "/api/v1/users?id=1",
+		"v1/users":                  "/api/v1/users",
+		server.URL + "/no-base-url": "/no-base-url",
+	} {
+		resp, err := client.Get(path)
+		assert.Nil(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, expected, string(body))
+	}
+}
+
+func TestFiberClientEntry_Retry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		// every third request succeeds
+		if atomic.AddInt32(&calls, 1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	entry := RegisterFiberClientEntry(
+		WithNameFiberClientEntry("ut-client-retry"),
+		WithBaseURLFiberClientEntry(server.URL),
+		WithRetryFiberClientEntry(&RetryPolicy{InitialBackoff: time.Millisecond}))
+	registry := prometheus.NewRegistry()
+	client := entry.Client(newClientCtx(registry))
+
+	// idempotent method with replayable body is retried
+	req, _ := http.NewRequest(http.MethodPut, "/ut", strings.NewReader("ut-body"))
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ut-body", string(body))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.Equal(t, float64(2), counterValue(t, registry, "rk_http_client_retries_total"))
+
+	// non idempotent method is not retried
+	resp, err = client.Post("/ut", "text/plain", strings.NewReader("ut-body"))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+
+	// unless idempotency key provided
+	req, _ = http.NewRequest(http.MethodPost, "/ut", strings.NewReader("ut-body"))
+	req.Header.Set(HeaderIdempotencyKey, "ut-key")
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(6), atomic.LoadInt32(&calls))
+
+	// body which could not be replayed is not retried
+	req, _ = http.NewRequest(http.MethodPut, "/ut", io.NopCloser(strings.NewReader("ut-body")))
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(7), atomic.LoadInt32(&calls))
+}
+
+func TestFiberClientEntry_CircuitBreaker(t *testing.T) {
+	var calls int32
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&healthy) < 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	entry := RegisterFiberClientEntry(
+		WithNameFiberClientEntry("ut-client-breaker"),
+		WithBaseURLFiberClientEntry(server.URL),
+		WithCircuitBreakerFiberClientEntry(&BreakerPolicy{
+			FailureThreshold: 2,
+			OpenDuration:     100 * time.Millisecond,
+		}))
+	registry := prometheus.NewRegistry()
+	client := entry.Client(newClientCtx(registry))
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("/ut")
+		assert.Nil(t, err)
+		resp.Body.Close()
+	}
+
+	// open, requests are rejected without being sent
+	_, err := client.Get("/ut")
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, float64(1), counterValue(t, registry, "rk_http_client_circuit_rejected_total"))
+
+	// half open, probe succeeded and breaker closed
+	time.Sleep(150 * time.Millisecond)
+	atomic.StoreInt32(&healthy, 1)
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("/ut")
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+}
+
+func TestFiberClientEntry_Hedging(t *testing.T) {
+	var calls int32
+	cancelled := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// first request is slow
+		if atomic.AddInt32(&calls, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+				cancelled <- struct{}{}
+			case <-time.After(500 * time.Millisecond):
+			}
+			w.Write([]byte("slow"))
+			return
+		}
+		w.Write([]byte("fast"))
+	}))
+	defer server.Close()
+
+	entry := RegisterFiberClientEntry(
+		WithNameFiberClientEntry("ut-client-hedging"),
+		WithBaseURLFiberClientEntry(server.URL),
+		WithHedgingFiberClientEntry(&HedgePolicy{Delay: 20 * time.Millisecond}))
+	registry := prometheus.NewRegistry()
+	client := entry.Client(newClientCtx(registry))
+
+	startTime := time.Now()
+	resp, err := client.Get("/ut")
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, "fast", string(body))
+	assert.True(t, time.Since(startTime) < 400*time.Millisecond)
+	assert.Equal(t, float64(1), counterValue(t, registry, "rk_http_client_hedges_total"))
+
+	// slow request is cancelled
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		assert.Fail(t, "slow request is not cancelled")
+	}
+
+	// requests of non idempotent methods are not hedged
+	atomic.StoreInt32(&calls, 0)
+	resp, err = client.Post("/ut", "text/plain", nil)
+	assert.Nil(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "slow", string(body))
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiber
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// BootProm extends rkentry.BootProm with collectors registered into registry of entry
+type BootProm struct {
+	rkentry.BootProm `yaml:",inline" json:",inline" mapstructure:",squash"`
+	Collectors       struct {
+		DisableGo      bool `yaml:"disableGo" json:"disableGo"`
+		DisableProcess bool `yaml:"disableProcess" json:"disableProcess"`
+		DisableServer  bool `yaml:"disableServer" json:"disableServer"`
+	} `yaml:"collectors" json:"collectors"`
+}
+
+// registerCollectors register Go runtime and process collectors into registerer as configured
+func registerCollectors(config *BootProm, registerer prometheus.Registerer) {
+	if !config.Collectors.DisableGo {
+		registerer.Register(collectors.NewGoCollector())
+	}
+
+	if !config.Collectors.DisableProcess {
+		registerer.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+}
+
+// serverCollector is prometheus.Collector of fasthttp server state of FiberEntry.
+//
+// Metrics are labeled with entryName and entryType, so that entries sharing a process are distinguished.
+type serverCollector struct {
+	entry *FiberEntry
+
+	openConnections *prometheus.Desc
+	concurrency     *prometheus.Desc
+	maxConcurrency  *prometheus.Desc
+	readTimeouts    *prometheus.Desc
+	writeTimeouts   *prometheus.Desc
+
+	readTimeoutCount  uint64
+	writeTimeoutCount uint64
+}
+
+// newServerCollector create a new serverCollector of entry
+func newServerCollector(entry *FiberEntry) *serverCollector {
+	labels := prometheus.Labels{
+		"entryName": entry.entryName,
+		"entryType": entry.entryType,
+	}
+
+	return &serverCollector{
+		entry: entry,
+		openConnections: prometheus.NewDesc("rk_fiber_server_open_connections",
+			"Number of open connections of server.", nil, labels),
+		concurrency: prometheus.NewDesc("rk_fiber_server_concurrency",
+			"Number of connections being served currently.", nil, labels),
+		maxConcurrency: prometheus.NewDesc("rk_fiber_server_max_concurrency",
+			"Max number of connections served concurrently.", nil, labels),
+		readTimeouts: prometheus.NewDesc("rk_fiber_server_read_timeouts_total",
+			"Number of connections closed by read timeout while reading request.", nil, labels),
+		writeTimeouts: prometheus.NewDesc("rk_fiber_server_write_timeouts_total",
+			"Number of connections closed by write timeout while writing response.", nil, labels),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.openConnections
+	ch <- c.concurrency
+	ch <- c.maxConcurrency
+	ch <- c.readTimeouts
+	ch <- c.writeTimeouts
+}
+
+// Collect implements prometheus.Collector
+func (c *serverCollector) Collect(ch chan<- prometheus.Metric) {
+	// app is created while bootstrapping
+	if app := c.entry.App; app != nil {
+		server := app.Server()
+
+		// fasthttp reports -1 before server starts serving
+		open := server.GetOpenConnectionsCount()
+		if open < 0 {
+			open = 0
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.openConnections, prometheus.GaugeValue, float64(open))
+		ch <- prometheus.MustNewConstMetric(c.concurrency, prometheus.GaugeValue, float64(server.GetCurrentConcurrency()))
+		ch <- prometheus.MustNewConstMetric(c.maxConcurrency, prometheus.GaugeValue, float64(server.Concurrency))
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.readTimeouts, prometheus.CounterValue, float64(atomic.LoadUint64(&c.readTimeoutCount)))
+	ch <- prometheus.MustNewConstMetric(c.writeTimeouts, prometheus.CounterValue, float64(atomic.LoadUint64(&c.writeTimeoutCount)))
+}
+
+// wrapListener wraps listener whose connections count read and write timeouts
+func (c *serverCollector) wrapListener(ln net.Listener) net.Listener {
+	return &timeoutListener{Listener: ln, collector: c}
+}
+
+// timeoutListener wraps accepted connections with timeoutConn
+type timeoutListener struct {
+	net.Listener
+	collector *serverCollector
+}
+
+// Accept implements net.Listener
+func (ln *timeoutListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+
+	return &timeoutConn{Conn: conn, collector: ln.collector, reading: true}, nil
+}
+
+// timeoutConn counts timeouts of connection.
+//
+// Read timeout on keep-alive connection which is idle after response was written is not counted,
+// since it is closed by idle timeout instead of read timeout.
+type timeoutConn struct {
+	net.Conn
+	collector *serverCollector
+	// reading is true if connection is reading request, connections are read and written by single goroutine
+	reading bool
+}
+
+// Read implements net.Conn
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.reading = true
+	}
+
+	if c.reading && isTimeout(err) {
+		atomic.AddUint64(&c.collector.readTimeoutCount, 1)
+	}
+
+	return n, err
+}
+
+// Write implements net.Conn
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	c.reading = false
+
+	n, err := c.Conn.Write(b)
+	if isTimeout(err) {
+		atomic.AddUint64(&c.collector.writeTimeoutCount, 1)
+	}
+
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom, so that response body of file is written with sendfile of underlying
+// connection through bufio.Writer of fasthttp.
+func (c *timeoutConn) ReadFrom(r io.Reader) (int64, error) {
+	c.reading = false
+
+	var n int64
+	var err error
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		// hide ReadFrom of timeoutConn, otherwise io.Copy calls it recursively
+		n, err = io.Copy(struct{ io.Writer }{c.Conn}, r)
+	}
+
+	if isTimeout(err) {
+		atomic.AddUint64(&c.collector.writeTimeoutCount, 1)
+	}
+
+	return n, err
+}
+
+// isTimeout returns true if err is timeout error
+func isTimeout(err error) bool {
+	netErr := net.Error(nil)
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
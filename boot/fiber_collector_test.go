@@ -0,0 +1,132 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiber
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterCollectors(t *testing.T) {
+	// with default config
+	registry := prometheus.NewRegistry()
+	registerCollectors(&BootProm{}, registry)
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	names := make(map[string]bool)
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	assert.True(t, names["go_goroutines"])
+
+	// with collectors disabled
+	config := &BootProm{}
+	config.Collectors.DisableGo = true
+	config.Collectors.DisableProcess = true
+	registry = prometheus.NewRegistry()
+	registerCollectors(config, registry)
+	families, err = registry.Gather()
+	assert.Nil(t, err)
+	assert.Empty(t, families)
+}
+
+func TestServerCollector(t *testing.T) {
+	entry := RegisterFiberEntry(WithName("ut-collector"))
+	entry.App = fiber.New()
+	collector := newServerCollector(entry)
+
+	registry := prometheus.NewRegistry()
+	assert.Nil(t, registry.Register(collector))
+
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &timeoutConn{Conn: server, collector: collector, reading: true}
+
+	// read timeout while reading request
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	assert.True(t, isTimeout(err))
+
+	// write timeout while writing response
+	conn.SetWriteDeadline(time.Now().Add(time.Millisecond))
+	_, err = conn.Write([]byte("ut-response"))
+	assert.True(t, isTimeout(err))
+
+	// write timeout while writing response with ReadFrom
+	conn.SetWriteDeadline(time.Now().Add(time.Millisecond))
+	_, err = conn.ReadFrom(strings.NewReader("ut-response"))
+	assert.True(t, isTimeout(err))
+
+	// idle keep-alive connection is not counted
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	assert.True(t, isTimeout(err))
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	values := make(map[string]float64)
+	for _, family := range families {
+		metric := family.Metric[0]
+		if metric.Counter != nil {
+			values[family.GetName()] = metric.GetCounter().GetValue()
+		} else {
+			values[family.GetName()] = metric.GetGauge().GetValue()
+		}
+		assert.Equal(t, "ut-collector", metric.Label[0].GetValue())
+	}
+
+	assert.Equal(t, float64(1), values["rk_fiber_server_read_timeouts_total"])
+	assert.Equal(t, float64(2), values["rk_fiber_server_write_timeouts_total"])
+	assert.Equal(t, float64(fiber.DefaultConcurrency), values["rk_fiber_server_max_concurrency"])
+	assert.Equal(t, float64(0), values["rk_fiber_server_open_connections"])
+}
+
+func TestTimeoutConn_ReadFrom(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+
+	entry := RegisterFiberEntry(WithName("ut-collector"))
+	ln = newServerCollector(entry).wrapListener(ln)
+
+	path := filepath.Join(t.TempDir(), "ut-file")
+	assert.Nil(t, os.WriteFile(path, []byte("ut-content"), 0600))
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		file, err := os.Open(path)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+
+		// file is written with ReadFrom of underlying *net.TCPConn, which uses sendfile
+		if rf, ok := conn.(io.ReaderFrom); ok {
+			rf.ReadFrom(file)
+		}
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	bytes, err := io.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, "ut-content", string(bytes))
+}
@@ -21,7 +21,6 @@ import (
 	"github.com/rookie-ninja/rk-entry/v2/middleware/auth"
 	"github.com/rookie-ninja/rk-entry/v2/middleware/cors"
 	"github.com/rookie-ninja/rk-entry/v2/middleware/csrf"
-	"github.com/rookie-ninja/rk-entry/v2/middleware/jwt"
 	"github.com/rookie-ninja/rk-entry/v2/middleware/log"
 	"github.com/rookie-ninja/rk-entry/v2/middleware/meta"
 	"github.com/rookie-ninja/rk-entry/v2/middleware/panic"
@@ -29,17 +28,26 @@ import (
 	"github.com/rookie-ninja/rk-entry/v2/middleware/ratelimit"
 	"github.com/rookie-ninja/rk-entry/v2/middleware/secure"
 	"github.com/rookie-ninja/rk-entry/v2/middleware/timeout"
-	"github.com/rookie-ninja/rk-entry/v2/middleware/tracing"
 	"github.com/rookie-ninja/rk-fiber/middleware/auth"
+	"github.com/rookie-ninja/rk-fiber/middleware/cache"
+	"github.com/rookie-ninja/rk-fiber/middleware/compression"
+	"github.com/rookie-ninja/rk-fiber/middleware/concurrency"
 	rkfibercors "github.com/rookie-ninja/rk-fiber/middleware/cors"
 	"github.com/rookie-ninja/rk-fiber/middleware/csrf"
+	"github.com/rookie-ninja/rk-fiber/middleware/etag"
+	"github.com/rookie-ninja/rk-fiber/middleware/idempotency"
 	"github.com/rookie-ninja/rk-fiber/middleware/jwt"
 	"github.com/rookie-ninja/rk-fiber/middleware/log"
 	"github.com/rookie-ninja/rk-fiber/middleware/meta"
+	"github.com/rookie-ninja/rk-fiber/middleware/oidc"
+	"github.com/rookie-ninja/rk-fiber/middleware/otelmetric"
 	"github.com/rookie-ninja/rk-fiber/middleware/panic"
 	rkfiberprom "github.com/rookie-ninja/rk-fiber/middleware/prom"
 	"github.com/rookie-ninja/rk-fiber/middleware/ratelimit"
 	"github.com/rookie-ninja/rk-fiber/middleware/secure"
+	"github.com/rookie-ninja/rk-fiber/middleware/session"
+	"github.com/rookie-ninja/rk-fiber/middleware/singleflight"
+	"github.com/rookie-ninja/rk-fiber/middleware/slo"
 	"github.com/rookie-ninja/rk-fiber/middleware/timeout"
 	"github.com/rookie-ninja/rk-fiber/middleware/tracing"
 	"github.com/rookie-ninja/rk-query"
@@ -78,24 +86,34 @@ type BootFiber struct {
 		SW            rkentry.BootSW                `yaml:"sw" json:"sw"`
 		Docs          rkentry.BootDocs              `yaml:"docs" json:"docs"`
 		CommonService rkentry.BootCommonService     `yaml:"commonService" json:"commonService"`
-		Prom          rkentry.BootProm              `yaml:"prom" json:"prom"`
+		Prom          BootProm                      `yaml:"prom" json:"prom"`
 		Static        rkentry.BootStaticFileHandler `yaml:"static" json:"static"`
 		PProf         rkentry.BootPProf             `yaml:"pprof" json:"pprof"`
+		SLO           rkfiberslo.BootConfig         `yaml:"slo" json:"slo"`
 
 		Middleware struct {
-			Ignore     []string                `yaml:"ignore" json:"ignore"`
-			ErrorModel string                  `yaml:"errorModel" json:"errorModel"`
-			Logging    rkmidlog.BootConfig     `yaml:"logging" json:"logging"`
-			Prom       rkmidprom.BootConfig    `yaml:"prom" json:"prom"`
-			Auth       rkmidauth.BootConfig    `yaml:"auth" json:"auth"`
-			Cors       rkmidcors.BootConfig    `yaml:"cors" json:"cors"`
-			Meta       rkmidmeta.BootConfig    `yaml:"meta" json:"meta"`
-			Jwt        rkmidjwt.BootConfig     `yaml:"jwt" json:"jwt"`
-			Secure     rkmidsec.BootConfig     `yaml:"secure" json:"secure"`
-			Csrf       rkmidcsrf.BootConfig    `yaml:"csrf" yaml:"csrf"`
-			RateLimit  rkmidlimit.BootConfig   `yaml:"rateLimit" json:"rateLimit"`
-			Timeout    rkmidtimeout.BootConfig `yaml:"timeout" json:"timeout"`
-			Trace      rkmidtrace.BootConfig   `yaml:"trace" json:"trace"`
+			Ignore       []string                       `yaml:"ignore" json:"ignore"`
+			ErrorModel   string                         `yaml:"errorModel" json:"errorModel"`
+			Logging      rkmidlog.BootConfig            `yaml:"logging" json:"logging"`
+			Prom         rkfiberprom.BootConfig         `yaml:"prom" json:"prom"`
+			OtelMetric   rkfiberotelmetric.BootConfig   `yaml:"otelMetric" json:"otelMetric"`
+			Auth         rkmidauth.BootConfig           `yaml:"auth" json:"auth"`
+			Cors         rkmidcors.BootConfig           `yaml:"cors" json:"cors"`
+			Meta         rkmidmeta.BootConfig           `yaml:"meta" json:"meta"`
+			Jwt          rkfiberjwt.BootConfig          `yaml:"jwt" json:"jwt"`
+			Oidc         rkfiberoidc.BootConfig         `yaml:"oidc" json:"oidc"`
+			Secure       rkmidsec.BootConfig            `yaml:"secure" json:"secure"`
+			Csrf         rkmidcsrf.BootConfig           `yaml:"csrf" yaml:"csrf"`
+			Session      rkfibersession.BootConfig      `yaml:"session" json:"session"`
+			RateLimit    rkfiberlimit.BootConfig        `yaml:"rateLimit" json:"rateLimit"`
+			Concurrency  rkfiberconcurrency.BootConfig  `yaml:"concurrency" json:"concurrency"`
+			Compression  rkfibercompression.BootConfig  `yaml:"compression" json:"compression"`
+			Idempotency  rkfiberidempotency.BootConfig  `yaml:"idempotency" json:"idempotency"`
+			Etag         rkfiberetag.BootConfig         `yaml:"etag" json:"etag"`
+			Cache        rkfibercache.BootConfig        `yaml:"cache" json:"cache"`
+			Singleflight rkfibersingleflight.BootConfig `yaml:"singleflight" json:"singleflight"`
+			Timeout      rkmidtimeout.BootConfig        `yaml:"timeout" json:"timeout"`
+			Trace        rkfibertrace.BootConfig        `yaml:"trace" json:"trace"`
 		} `yaml:"middleware" json:"middleware"`
 	} `yaml:"fiber" json:"fiber"`
 }
@@ -119,7 +137,8 @@ type FiberEntry struct {
 	DocsEntry          *rkentry.DocsEntry              `json:"-" yaml:"-"`
 	PProfEntry         *rkentry.PProfEntry             `json:"-" yaml:"-"`
 
-	bootstrapLogOnce sync.Once `json:"-" yaml:"-"`
+	bootstrapLogOnce sync.Once        `json:"-" yaml:"-"`
+	serverCollector  *serverCollector `json:"-" yaml:"-"`
 }
 
 // RegisterFiberEntryYAML register fiber entries with provided config file (Must YAML file).
@@ -179,7 +198,8 @@ func RegisterFiberEntryYAML(raw []byte) map[string]rkentry.Entry {
 
 		// Register prometheus entry
 		promRegistry := prometheus.NewRegistry()
-		promEntry := rkentry.RegisterPromEntry(&element.Prom, rkentry.WithRegistryPromEntry(promRegistry))
+		promEntry := rkentry.RegisterPromEntry(&element.Prom.BootProm, rkentry.WithRegistryPromEntry(promRegistry))
+		registerCollectors(&element.Prom, promRegistry)
 
 		// Register common service entry
 		commonServiceEntry := rkentry.RegisterCommonServiceEntry(&element.CommonService)
@@ -215,16 +235,67 @@ func RegisterFiberEntryYAML(raw []byte) map[string]rkentry.Entry {
 			rkmidpanic.WithEntryNameAndType(element.Name, FiberEntryType)))
 
 		// metrics middleware
+		// baggage of request is extracted by tracing middleware
+		baggage := element.Middleware.Trace.Baggage
+		baggageLabels := element.Middleware.Trace.Enabled && baggage.MetricLabels
+
 		if element.Middleware.Prom.Enabled {
-			inters = append(inters, rkfiberprom.Middleware(
-				rkmidprom.ToOptions(&element.Middleware.Prom, element.Name, FiberEntryType,
-					promRegistry, rkmidprom.LabelerTypeHttp)...))
+			opts := rkfiberprom.ToOptions(&element.Middleware.Prom, element.Name, FiberEntryType, promRegistry)
+			if baggageLabels {
+				opts = append(opts, rkfiberprom.WithBaggageLabels(baggage.Keys...))
+			}
+			inters = append(inters, rkfiberprom.MiddlewareWithOptions(
+				rkmidprom.ToOptions(&element.Middleware.Prom.BootConfig, element.Name, FiberEntryType,
+					promRegistry, rkmidprom.LabelerTypeHttp),
+				opts...))
+		}
+
+		// OpenTelemetry metrics middleware, it could be enabled together with or instead of prom middleware
+		if element.Middleware.OtelMetric.Enabled {
+			opts := rkfiberotelmetric.ToOptions(&element.Middleware.OtelMetric, element.Name, FiberEntryType)
+			if baggageLabels {
+				opts = append(opts, rkfiberotelmetric.WithBaggageAttributes(baggage.Keys...))
+			}
+			inters = append(inters, rkfiberotelmetric.Middleware(opts...))
+		}
+
+		// slo middleware, it is placed in front and matches objectives by path, so that requests rejected by
+		// other middlewares before routing are counted
+		if element.SLO.Enabled {
+			inters = append(inters, rkfiberslo.Middleware(
+				rkfiberslo.ToOptions(&element.SLO, element.Name, FiberEntryType, promRegistry)...))
+		}
+
+		// concurrency middleware, health and metrics paths are exempt.
+		// It sheds load in front of other middlewares, unless priority rules match jwt claims, then it is placed
+		// after jwt middleware which validates token.
+		var concurrency fiber.Handler
+		if element.Middleware.Concurrency.Enabled {
+			opts := rkfiberconcurrency.ToOptions(&element.Middleware.Concurrency, element.Name, FiberEntryType, promRegistry)
+			if promEntry != nil {
+				opts = append(opts, rkfiberconcurrency.WithPathToIgnore(promEntry.Path))
+			}
+			if commonServiceEntry != nil {
+				opts = append(opts, rkfiberconcurrency.WithPathToIgnore(commonServiceEntry.ReadyPath, commonServiceEntry.AlivePath))
+			}
+			concurrency = rkfiberconcurrency.Middleware(opts...)
+		}
+		afterJwt := element.Middleware.Jwt.Enabled && rkfiberconcurrency.RequiresJwt(&element.Middleware.Concurrency)
+		if concurrency != nil && !afterJwt {
+			inters = append(inters, concurrency)
+		}
+
+		// compression middleware, placed before middlewares which read request body or reuse responses
+		if element.Middleware.Compression.Enabled {
+			inters = append(inters, rkfibercompression.Middleware(
+				rkfibercompression.ToOptions(&element.Middleware.Compression, element.Name, FiberEntryType, promRegistry)...))
 		}
 
 		// tracing middleware
 		if element.Middleware.Trace.Enabled {
-			inters = append(inters, rkfibertrace.Middleware(
-				rkmidtrace.ToOptions(&element.Middleware.Trace, element.Name, FiberEntryType)...))
+			inters = append(inters, rkfibertrace.MiddlewareWithOptions(
+				rkfibertrace.ToOptions(&element.Middleware.Trace, element.Name, FiberEntryType),
+				rkfibertrace.BaggageOptions(&element.Middleware.Trace.Baggage)...))
 		}
 
 		// cors middleware
@@ -233,10 +304,19 @@ func RegisterFiberEntryYAML(raw []byte) map[string]rkentry.Entry {
 				rkmidcors.ToOptions(&element.Middleware.Cors, element.Name, FiberEntryType)...))
 		}
 
+		// oidc middleware
+		if element.Middleware.Oidc.Enabled {
+			inters = append(inters, rkfiberoidc.Middleware(
+				rkfiberoidc.ToOptions(&element.Middleware.Oidc, element.Name, FiberEntryType, promRegistry)...))
+		}
+
 		// jwt middleware
 		if element.Middleware.Jwt.Enabled {
 			inters = append(inters, rkfiberjwt.Middleware(
-				rkmidjwt.ToOptions(&element.Middleware.Jwt, element.Name, FiberEntryType)...))
+				rkfiberjwt.ToOptions(&element.Middleware.Jwt, element.Name, FiberEntryType, promRegistry)...))
+		}
+		if concurrency != nil && afterJwt {
+			inters = append(inters, concurrency)
 		}
 
 		// secure middleware
@@ -251,6 +331,12 @@ func RegisterFiberEntryYAML(raw []byte) map[string]rkentry.Entry {
 				rkmidcsrf.ToOptions(&element.Middleware.Csrf, element.Name, FiberEntryType)...))
 		}
 
+		// session middleware
+		if element.Middleware.Session.Enabled {
+			inters = append(inters, rkfibersession.Middleware(
+				rkfibersession.ToOptions(&element.Middleware.Session, element.Name, FiberEntryType)...))
+		}
+
 		// meta middleware
 		if element.Middleware.Meta.Enabled {
 			inters = append(inters, rkfibermeta.Middleware(
@@ -272,7 +358,42 @@ func RegisterFiberEntryYAML(raw []byte) map[string]rkentry.Entry {
 		// rate limit middleware
 		if element.Middleware.RateLimit.Enabled {
 			inters = append(inters, rkfiberlimit.Middleware(
-				rkmidlimit.ToOptions(&element.Middleware.RateLimit, element.Name, FiberEntryType)...))
+				rkmidlimit.ToOptions(&element.Middleware.RateLimit.BootConfig, element.Name, FiberEntryType)...))
+
+			if element.Middleware.RateLimit.Keyed.Enabled {
+				inters = append(inters, rkfiberlimit.KeyedMiddleware(
+					rkfiberlimit.ToOptions(&element.Middleware.RateLimit, element.Name, FiberEntryType, promRegistry)...))
+			}
+		}
+
+		// idempotency middleware
+		if element.Middleware.Idempotency.Enabled {
+			inters = append(inters, rkfiberidempotency.Middleware(
+				rkfiberidempotency.ToOptions(&element.Middleware.Idempotency, element.Name, FiberEntryType)...))
+		}
+
+		// etag middleware, placed before cache, so that cached responses are answered with 304 as well
+		if element.Middleware.Etag.Enabled {
+			inters = append(inters, rkfiberetag.Middleware(
+				rkfiberetag.ToOptions(&element.Middleware.Etag, element.Name, FiberEntryType)...))
+		}
+
+		// cache middleware, health and metrics paths are never cached
+		if element.Middleware.Cache.Enabled {
+			opts := rkfibercache.ToOptions(&element.Middleware.Cache, element.Name, FiberEntryType, promRegistry)
+			if promEntry != nil {
+				opts = append(opts, rkfibercache.WithPathToIgnore(promEntry.Path))
+			}
+			if commonServiceEntry != nil {
+				opts = append(opts, rkfibercache.WithPathToIgnore(commonServiceEntry.ReadyPath, commonServiceEntry.AlivePath))
+			}
+			inters = append(inters, rkfibercache.Middleware(opts...))
+		}
+
+		// singleflight middleware
+		if element.Middleware.Singleflight.Enabled {
+			inters = append(inters, rkfibersingleflight.Middleware(
+				rkfibersingleflight.ToOptions(&element.Middleware.Singleflight, element.Name, FiberEntryType, promRegistry)...))
 		}
 
 		entry := RegisterFiberEntry(
@@ -291,6 +412,12 @@ func RegisterFiberEntryYAML(raw []byte) map[string]rkentry.Entry {
 
 			WithMiddleware(inters...))
 
+		// server collector reads state of fasthttp server of entry
+		if !element.Prom.Collectors.DisableServer {
+			entry.serverCollector = newServerCollector(entry)
+			promRegistry.Register(entry.serverCollector)
+		}
+
 		res[name] = entry
 	}
 
@@ -382,8 +509,10 @@ func (entry *FiberEntry) Bootstrap(ctx context.Context) {
 
 	// Is prometheus enabled?
 	if entry.IsPromEnabled() {
-		// Register prom path into Router.
-		entry.App.Get(entry.PromEntry.Path, adaptor.HTTPHandler(promhttp.HandlerFor(entry.PromEntry.Gatherer, promhttp.HandlerOpts{})))
+		// Register prom path into Router, OpenMetrics format is negotiated so that exemplars are exposed.
+		entry.App.Get(entry.PromEntry.Path, adaptor.HTTPHandler(promhttp.HandlerFor(entry.PromEntry.Gatherer, promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+		})))
 
 		// don't start with http handler, we will handle it by ourselves
 		entry.PromEntry.Bootstrap(ctx)
@@ -464,7 +593,7 @@ func (entry *FiberEntry) startServer(event rkquery.Event, logger *zap.Logger) {
 				rkentry.ShutdownWithError(err)
 			}
 
-			err = entry.App.Server().Serve(tls.NewListener(conn, &tls.Config{
+			err = entry.App.Server().Serve(tls.NewListener(entry.wrapListener(conn), &tls.Config{
 				Certificates: []tls.Certificate{*entry.CertEntry.Certificate},
 			}))
 
@@ -473,6 +602,18 @@ func (entry *FiberEntry) startServer(event rkquery.Event, logger *zap.Logger) {
 				logger.Error("Error occurs while starting fiber server with tls.", event.ListPayloads()...)
 				rkentry.ShutdownWithError(err)
 			}
+		} else if entry.serverCollector != nil && !entry.App.Config().Prefork {
+			// listen by ourselves so that timeouts of connections are counted
+			conn, err := net.Listen(entry.App.Config().Network, ":"+strconv.FormatUint(entry.Port, 10))
+			if err == nil {
+				err = entry.App.Listener(entry.wrapListener(conn))
+			}
+
+			if err != nil && err != http.ErrServerClosed {
+				event.AddErr(err)
+				logger.Error("Error occurs while starting fiber server.", event.ListPayloads()...)
+				rkentry.ShutdownWithError(err)
+			}
 		} else {
 			err := entry.App.Listen(":" + strconv.FormatUint(entry.Port, 10))
 
@@ -485,6 +626,15 @@ func (entry *FiberEntry) startServer(event rkquery.Event, logger *zap.Logger) {
 	}
 }
 
+// wrapListener wraps listener so that timeouts of connections are counted by server collector if enabled
+func (entry *FiberEntry) wrapListener(ln net.Listener) net.Listener {
+	if entry.serverCollector == nil {
+		return ln
+	}
+
+	return entry.serverCollector.wrapListener(ln)
+}
+
 // Interrupt FiberEntry.
 func (entry *FiberEntry) Interrupt(ctx context.Context) {
 	event, logger := entry.logBasicInfo("Interrupt", ctx)
@@ -13,13 +13,17 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/rookie-ninja/rk-entry/v2/entry"
 	"github.com/rookie-ninja/rk-fiber/middleware/meta"
 	"github.com/stretchr/testify/assert"
 	"math/big"
 	"net"
+	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -246,6 +250,75 @@ func TestRegisterFiberEntryYAML(t *testing.T) {
 	assert.Nil(t, greeter3)
 }
 
+func TestRegisterFiberEntryYAML_ConcurrencyJwtPriority(t *testing.T) {
+	defer assertNotPanic(t)
+
+	entries := RegisterFiberEntryYAML([]byte(`
+---
+fiber:
+ - name: ut-concurrency-jwt
+   port: 2030
+   enabled: true
+   prom:
+     enabled: true
+   middleware:
+     jwt:
+       enabled: true
+       symmetric:
+         algorithm: HS256
+         token: ut-key
+     concurrency:
+       enabled: true
+       limit: 10
+       priority:
+         enabled: true
+         default: standard
+         classes:
+           - name: gold
+           - name: standard
+         rules:
+           - class: gold
+             match: "jwt:tier=gold"
+`))
+	entry := entries["ut-concurrency-jwt"].(*FiberEntry)
+	defer rkentry.GlobalAppCtx.RemoveEntry(entry)
+
+	app := fiber.New()
+	for _, m := range entry.Middlewares {
+		app.Use(m)
+	}
+	app.Get("/ut", func(ctx *fiber.Ctx) error {
+		return ctx.SendString("ok")
+	})
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"tier": "gold"}).SignedString([]byte("ut-key"))
+	assert.Nil(t, err)
+
+	req := httptest.NewRequest(fiber.MethodGet, "/ut", nil)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	resp, err := app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	// request is classified with claim of validated token
+	families, err := entry.PromEntry.Gatherer.Gather()
+	assert.Nil(t, err)
+	classes := make([]string, 0)
+	for _, family := range families {
+		if !strings.HasSuffix(family.GetName(), "class_latency_seconds") {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "class" {
+					classes = append(classes, label.GetValue())
+				}
+			}
+		}
+	}
+	assert.Equal(t, []string{"gold"}, classes)
+}
+
 func generateCerts() ([]byte, []byte) {
 	// Create certs and return as []byte
 	ca := &x509.Certificate{
@@ -0,0 +1,146 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+// Package rkfibermemstore is an in memory key value store with ttl shared by stores of middlewares
+package rkfibermemstore
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DefaultSweepEvery is min interval between sweeps of expired records
+const DefaultSweepEvery = time.Minute
+
+// record is a value stored in Store
+type record struct {
+	key       string
+	data      []byte
+	expiresAt time.Time
+}
+
+// Store keeps records in memory of current process.
+//
+// Expired records are dropped while reading, and swept at most once per sweepEvery while writing,
+// so that records which are never read again do not grow memory without bound.
+// If limits are provided, least recently used records are evicted once number of records or total size
+// of keys and data exceeds them.
+type Store struct {
+	lock       sync.Mutex
+	records    map[string]*list.Element
+	lru        *list.List
+	bytes      int
+	maxEntries int
+	maxBytes   int
+	sweepEvery time.Duration
+	lastSweep  time.Time
+}
+
+// New create Store with max number of records and max total size in bytes, not limited if not positive
+func New(maxEntries, maxBytes int) *Store {
+	return &Store{
+		records:    make(map[string]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		sweepEvery: DefaultSweepEvery,
+		lastSweep:  time.Now(),
+	}
+}
+
+// Get returns data of key and marks it as recently used, nil if missing or expired
+func (s *Store) Get(key string) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	elem, ok := s.records[key]
+	if !ok {
+		return nil
+	}
+
+	rec := elem.Value.(*record)
+	if time.Now().After(rec.expiresAt) {
+		s.remove(elem)
+		return nil
+	}
+
+	s.lru.MoveToFront(elem)
+	return rec.data
+}
+
+// Add stores data with ttl only if key is missing or expired, returns false if key exists
+func (s *Store) Add(key string, data []byte, ttl time.Duration) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	if elem, ok := s.records[key]; ok && !now.After(elem.Value.(*record).expiresAt) {
+		return false
+	}
+
+	s.set(key, data, ttl, now)
+	return true
+}
+
+// Set stores data with ttl
+func (s *Store) Set(key string, data []byte, ttl time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.set(key, data, ttl, time.Now())
+}
+
+// Delete removes key
+func (s *Store) Delete(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if elem, ok := s.records[key]; ok {
+		s.remove(elem)
+	}
+}
+
+// Len returns number of records including expired ones which are not swept yet, and total size in bytes
+func (s *Store) Len() (entries, bytes int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.lru.Len(), s.bytes
+}
+
+// set stores record, sweeps expired ones and evicts least recently used ones, caller must hold lock
+func (s *Store) set(key string, data []byte, ttl time.Duration, now time.Time) {
+	if now.Sub(s.lastSweep) > s.sweepEvery {
+		for _, elem := range s.records {
+			if now.After(elem.Value.(*record).expiresAt) {
+				s.remove(elem)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if elem, ok := s.records[key]; ok {
+		s.remove(elem)
+	}
+
+	s.records[key] = s.lru.PushFront(&record{
+		key:       key,
+		data:      data,
+		expiresAt: now.Add(ttl),
+	})
+	s.bytes += len(key) + len(data)
+
+	for (s.maxEntries > 0 && s.lru.Len() > s.maxEntries) || (s.maxBytes > 0 && s.bytes > s.maxBytes) {
+		s.remove(s.lru.Back())
+	}
+}
+
+// remove element from store, caller must hold lock
+func (s *Store) remove(elem *list.Element) {
+	rec := s.lru.Remove(elem).(*record)
+	delete(s.records, rec.key)
+	s.bytes -= len(rec.key) + len(rec.data)
+}
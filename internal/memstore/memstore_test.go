@@ -0,0 +1,72 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibermemstore
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	store := New(0, 0)
+
+	// missing
+	assert.Nil(t, store.Get("ut-key"))
+
+	// add only if missing
+	assert.True(t, store.Add("ut-key", []byte("ut-value"), time.Minute))
+	assert.False(t, store.Add("ut-key", []byte("ut-other"), time.Minute))
+	assert.Equal(t, "ut-value", string(store.Get("ut-key")))
+
+	// expired key is dropped while reading and could be added again
+	store.Set("ut-key", []byte("ut-new"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	assert.Nil(t, store.Get("ut-key"))
+	assert.True(t, store.Add("ut-key", []byte("ut-value"), time.Minute))
+
+	store.Delete("ut-key")
+	assert.Nil(t, store.Get("ut-key"))
+}
+
+func TestStore_Sweep(t *testing.T) {
+	store := New(0, 0)
+	store.sweepEvery = time.Millisecond
+
+	store.Set("ut-expired", []byte("ut-value"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	// expired record which is never read again is swept while writing
+	store.Set("ut-key", []byte("ut-value"), time.Minute)
+	entries, _ := store.Len()
+	assert.Equal(t, 1, entries)
+}
+
+func TestStore_Evict(t *testing.T) {
+	// max entries
+	store := New(2, 0)
+	store.Set("ut-a", []byte("ut-value"), time.Minute)
+	store.Set("ut-b", []byte("ut-value"), time.Minute)
+	store.Get("ut-a")
+	store.Set("ut-c", []byte("ut-value"), time.Minute)
+	assert.NotNil(t, store.Get("ut-a"))
+	assert.Nil(t, store.Get("ut-b"))
+	assert.NotNil(t, store.Get("ut-c"))
+
+	// max bytes
+	store = New(0, 20)
+	store.Set("ut-a", []byte("0123456789"), time.Minute)
+	store.Set("ut-b", []byte("0123456789"), time.Minute)
+	assert.Nil(t, store.Get("ut-a"))
+	assert.NotNil(t, store.Get("ut-b"))
+	entries, bytes := store.Len()
+	assert.Equal(t, 1, entries)
+	assert.Equal(t, 14, bytes)
+
+	// record larger than max bytes is not kept
+	store.Set("ut-c", make([]byte, 32), time.Minute)
+	assert.Nil(t, store.Get("ut-c"))
+}
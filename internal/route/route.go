@@ -0,0 +1,95 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+// Package rkfiberroute resolves matched route and status of request for middlewares which run around router
+package rkfiberroute
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+	"sync"
+)
+
+// endpoints of apps by *fiber.App
+var endpointsByApp sync.Map
+
+// endpoints keeps first handler of every route which is not registered by App.Use, route of request is identified
+// by its handlers since routes are copied while listing.
+type endpoints struct {
+	lock     sync.RWMutex
+	handlers uint32
+	first    map[*fiber.Handler]bool
+}
+
+// Matched returns route which handled request after Next(), nil if no route matched.
+//
+// Route of request is the last one called by router, which is a middleware registered by App.Use if no route
+// matched, no matter which error is returned by handlers.
+func Matched(ctx *fiber.Ctx) *fiber.Route {
+	route := ctx.Route()
+	if route == nil || len(route.Handlers) < 1 {
+		return nil
+	}
+
+	if endpointsOf(ctx.App()).contains(ctx.App(), &route.Handlers[0]) {
+		return route
+	}
+
+	return nil
+}
+
+// StatusOf returns status code of response, error is not written to response until it reaches error handler
+func StatusOf(ctx *fiber.Ctx, err error) int {
+	if err == nil {
+		return ctx.Response().StatusCode()
+	}
+
+	fiberErr := &fiber.Error{}
+	if errors.As(err, &fiberErr) {
+		return fiberErr.Code
+	}
+
+	return http.StatusInternalServerError
+}
+
+// endpointsOf returns endpoints of app
+func endpointsOf(app *fiber.App) *endpoints {
+	if raw, ok := endpointsByApp.Load(app); ok {
+		return raw.(*endpoints)
+	}
+
+	raw, _ := endpointsByApp.LoadOrStore(app, &endpoints{})
+	return raw.(*endpoints)
+}
+
+// contains returns true if handler is first handler of a route of app which is not registered by App.Use
+func (e *endpoints) contains(app *fiber.App, handler *fiber.Handler) bool {
+	e.lock.RLock()
+	fresh := e.first != nil && e.handlers == app.HandlersCount()
+	res := e.first[handler]
+	e.lock.RUnlock()
+
+	if fresh {
+		return res
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	// routes registered after last listing invalidates endpoints
+	if e.first == nil || e.handlers != app.HandlersCount() {
+		e.handlers = app.HandlersCount()
+		e.first = make(map[*fiber.Handler]bool)
+		routes := app.GetRoutes(true)
+		for i := range routes {
+			if len(routes[i].Handlers) > 0 {
+				e.first[&routes[i].Handlers[0]] = true
+			}
+		}
+	}
+
+	return e.first[handler]
+}
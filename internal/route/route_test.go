@@ -0,0 +1,76 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberroute
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatched(t *testing.T) {
+	var matched *fiber.Route
+	var status int
+
+	app := fiber.New()
+	app.Use(func(ctx *fiber.Ctx) error {
+		err := ctx.Next()
+		matched, status = Matched(ctx), StatusOf(ctx, err)
+		return err
+	})
+	// middleware after outer one which is the last route called if no route matched
+	app.Use(func(ctx *fiber.Ctx) error {
+		return ctx.Next()
+	})
+	app.Get("/ut-orders/:id", func(ctx *fiber.Ctx) error {
+		// same message as router generates
+		return fiber.NewError(http.StatusNotFound, "Cannot find order")
+	})
+	app.Get("/ut-ok", func(ctx *fiber.Ctx) error {
+		return ctx.SendStatus(http.StatusAccepted)
+	})
+
+	// not found error returned by handler keeps route
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-orders/1", nil))
+	assert.NotNil(t, matched)
+	assert.Equal(t, "/ut-orders/:id", matched.Path)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-ok", nil))
+	assert.Equal(t, "/ut-ok", matched.Path)
+	assert.Equal(t, http.StatusAccepted, status)
+
+	// no route matched
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-unknown", nil))
+	assert.Nil(t, matched)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	app.Test(httptest.NewRequest(http.MethodPost, "/ut-ok", nil))
+	assert.Nil(t, matched)
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+
+	// routes registered later are resolved
+	app.Get("/ut-later", func(ctx *fiber.Ctx) error {
+		return nil
+	})
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-later", nil))
+	assert.Equal(t, "/ut-later", matched.Path)
+}
+
+func TestStatusOf(t *testing.T) {
+	app := fiber.New()
+	ctx := app.AcquireCtx(&fasthttp.RequestCtx{})
+	defer app.ReleaseCtx(ctx)
+
+	ctx.Status(http.StatusCreated)
+	assert.Equal(t, http.StatusCreated, StatusOf(ctx, nil))
+	assert.Equal(t, http.StatusForbidden, StatusOf(ctx, fiber.ErrForbidden))
+	assert.Equal(t, http.StatusInternalServerError, StatusOf(ctx, errors.New("ut-error")))
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibercache
+
+import (
+	"sync"
+	"time"
+)
+
+// inflight tracks keys which are being filled, so that concurrent misses of same key wait for the first one
+type inflight struct {
+	lock  sync.Mutex
+	calls map[string]chan struct{}
+}
+
+// newInflight create inflight
+func newInflight() *inflight {
+	return &inflight{
+		calls: make(map[string]chan struct{}),
+	}
+}
+
+// join returns true if caller is the first one of key and must call leave once done,
+// otherwise returns function which waits up to timeout for the first one and returns false on timeout.
+func (f *inflight) join(key string) (func(time.Duration) bool, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if done, ok := f.calls[key]; ok {
+		return func(timeout time.Duration) bool {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+
+			select {
+			case <-done:
+				return true
+			case <-timer.C:
+				return false
+			}
+		}, false
+	}
+
+	f.calls[key] = make(chan struct{})
+	return nil, true
+}
+
+// leave key and wake up waiters
+func (f *inflight) leave(key string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if done, ok := f.calls[key]; ok {
+		close(done)
+		delete(f.calls, key)
+	}
+}
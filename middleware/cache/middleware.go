@@ -0,0 +1,391 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+// Package rkfibercache is a middleware of fiber framework for caching responses of GET requests
+package rkfibercache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// revalidateKey is the key of flag of background revalidation request, stored in locals of request
+type revalidateKey struct{}
+
+// headers which are not cached since they are generated per response
+var skippedHeaders = map[string]bool{
+	fiber.HeaderContentLength: true,
+	fiber.HeaderDate:          true,
+	fiber.HeaderConnection:    true,
+	fiber.HeaderSetCookie:     true,
+	fiber.HeaderAge:           true,
+	HeaderCache:               true,
+	rkmid.HeaderRequestId:     true,
+}
+
+// request headers which carry credentials, responses of such requests are private unless explicitly allowed
+var credentialHeaders = []string{
+	fiber.HeaderAuthorization,
+	fiber.HeaderCookie,
+	rkmid.HeaderApiKey,
+}
+
+// status codes which are cacheable by default, see RFC 7231 section 6.1
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// entry is a cached response, or a marker with Vary headers of responses cached by variant keys
+type entry struct {
+	Status   int                 `json:"status,omitempty"`
+	Headers  map[string][]string `json:"headers,omitempty"`
+	Body     []byte              `json:"body,omitempty"`
+	StoredAt int64               `json:"storedAt"`
+	Ttl      time.Duration       `json:"ttl"`
+	Stale    time.Duration       `json:"stale,omitempty"`
+	Vary     []string            `json:"vary,omitempty"`
+}
+
+// Middleware caches responses of GET and HEAD requests.
+//
+// Cache key is composed of method, host, path, sorted query and configured headers, and headers listed in Vary of
+// response. Responses are fresh for max-age or s-maxage of Cache-Control, or ttl of group if absent, responses
+// with no-store, private, no-cache, Set-Cookie or Vary: * are not cached.
+// Within stale-while-revalidate window, expired response is served while it is refreshed in background.
+// Concurrent misses of same key wait for the first one instead of reaching handler together.
+// Requests with Cache-Control no-store bypass cache, and no-cache skips lookup but refreshes entry.
+func Middleware(opts ...Option) fiber.Handler {
+	set := newOptionSet(opts...)
+
+	return func(ctx *fiber.Ctx) error {
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, set.entryName))
+
+		g := set.groupOf(ctx.Method(), ctx.Path())
+		if g == nil {
+			return ctx.Next()
+		}
+
+		key := set.key(ctx, g)
+
+		// background revalidation issued by middleware
+		if revalidating, _ := ctx.Locals(revalidateKey{}).(bool); revalidating {
+			return set.fill(ctx, g, key)
+		}
+
+		directives := parseCacheControl(ctx.Get(fiber.HeaderCacheControl))
+		if _, ok := directives["no-store"]; ok {
+			set.observe(g, resultBypass)
+			return ctx.Next()
+		}
+
+		if _, ok := directives["no-cache"]; !ok {
+			if e := set.lookup(ctx, key); e != nil {
+				age := time.Since(time.Unix(0, e.StoredAt))
+				if age <= e.Ttl {
+					return set.serve(ctx, g, e, age, resultHit)
+				}
+
+				if age <= e.Ttl+e.Stale {
+					set.revalidate(ctx, key)
+					return set.serve(ctx, g, e, age, resultStale)
+				}
+			}
+
+			// wait for concurrent miss of same key and look it up again
+			if wait, leader := set.inflight.join(key); !leader {
+				if wait(set.coalesceTimeout) {
+					if e := set.lookup(ctx, key); e != nil && time.Since(time.Unix(0, e.StoredAt)) <= e.Ttl {
+						return set.serve(ctx, g, e, time.Since(time.Unix(0, e.StoredAt)), resultHit)
+					}
+				}
+			} else {
+				defer set.inflight.leave(key)
+			}
+		}
+
+		set.observe(g, resultMiss)
+		return set.fill(ctx, g, key)
+	}
+}
+
+// key returns base cache key of request
+func (set *optionSet) key(ctx *fiber.Ctx, g *group) string {
+	args := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(args)
+	ctx.Request().URI().QueryArgs().CopyTo(args)
+	args.Sort(bytes.Compare)
+
+	hash := sha256.New()
+	hash.Write([]byte(ctx.Method()))
+	hash.Write([]byte{0})
+	hash.Write(ctx.Request().Host())
+	hash.Write([]byte{0})
+	hash.Write([]byte(ctx.Path()))
+	hash.Write([]byte{0})
+	hash.Write(args.QueryString())
+	writeHeaders(hash, ctx, g.keyHeaders)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// variantKey returns cache key of response which varies on headers
+func variantKey(ctx *fiber.Ctx, key string, vary []string) string {
+	hash := sha256.New()
+	hash.Write([]byte(key))
+	writeHeaders(hash, ctx, vary)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// writeHeaders writes names and values of request headers into hash
+func writeHeaders(hash interface{ Write([]byte) (int, error) }, ctx *fiber.Ctx, headers []string) {
+	for i := range headers {
+		hash.Write([]byte{0})
+		hash.Write([]byte(strings.ToLower(headers[i])))
+		hash.Write([]byte{':'})
+		hash.Write(ctx.Request().Header.Peek(headers[i]))
+	}
+}
+
+// lookup returns cached response of request, nil if missing
+func (set *optionSet) lookup(ctx *fiber.Ctx, key string) *entry {
+	e := set.get(key)
+	if e != nil && len(e.Vary) > 0 {
+		e = set.get(variantKey(ctx, key, e.Vary))
+	}
+
+	return e
+}
+
+// get returns entry with key from store, nil if missing or unavailable
+func (set *optionSet) get(key string) *entry {
+	data, err := set.store.Get(key)
+	if err != nil {
+		set.logger().Warn("Failed to get cached response.", zap.Error(err))
+		return nil
+	}
+
+	e := &entry{}
+	if data == nil || json.Unmarshal(data, e) != nil {
+		return nil
+	}
+
+	return e
+}
+
+// serve writes cached response
+func (set *optionSet) serve(ctx *fiber.Ctx, g *group, e *entry, age time.Duration, result string) error {
+	set.observe(g, result)
+
+	for k, values := range e.Headers {
+		ctx.Response().Header.Del(k)
+		for i := range values {
+			ctx.Response().Header.Add(k, values[i])
+		}
+	}
+	ctx.Set(fiber.HeaderAge, strconv.Itoa(int(age/time.Second)))
+	ctx.Set(HeaderCache, strings.ToUpper(result))
+	ctx.Response().SetStatusCode(e.Status)
+	ctx.Response().SetBodyRaw(e.Body)
+
+	return nil
+}
+
+// fill calls handler and stores response if cacheable
+func (set *optionSet) fill(ctx *fiber.Ctx, g *group, key string) error {
+	if err := ctx.Next(); err != nil {
+		return err
+	}
+
+	ctx.Set(HeaderCache, strings.ToUpper(resultMiss))
+
+	resp := ctx.Response()
+	if !cacheableStatus[resp.StatusCode()] || len(resp.Header.Peek(fiber.HeaderSetCookie)) > 0 {
+		return nil
+	}
+
+	directives := parseCacheControl(string(resp.Header.Peek(fiber.HeaderCacheControl)))
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[d]; ok {
+			return nil
+		}
+	}
+
+	// shared cache must not store response of authorized request unless explicitly allowed, see RFC 7234 section 3.2,
+	// requests authorized by session cookie or API key are treated same as Authorization header
+	_, public := directives["public"]
+	_, sharedMaxAge := directives["s-maxage"]
+	if hasCredentials(ctx) && !public && !sharedMaxAge {
+		return nil
+	}
+
+	ttl, stale := g.ttl, g.stale
+	if v, ok := seconds(directives, "s-maxage"); ok {
+		ttl = v
+	} else if v, ok := seconds(directives, "max-age"); ok {
+		ttl = v
+	}
+	if v, ok := seconds(directives, "stale-while-revalidate"); ok {
+		stale = v
+	}
+	if ttl <= 0 {
+		return nil
+	}
+
+	vary := parseVary(string(resp.Header.Peek(fiber.HeaderVary)))
+	for i := range vary {
+		if vary[i] == "*" {
+			return nil
+		}
+	}
+
+	e := &entry{
+		Status:   resp.StatusCode(),
+		Headers:  make(map[string][]string),
+		Body:     append([]byte{}, resp.Body()...),
+		StoredAt: time.Now().UnixNano(),
+		Ttl:      ttl,
+		Stale:    stale,
+	}
+	resp.Header.VisitAll(func(k, v []byte) {
+		name := string(k)
+		if !skippedHeaders[name] {
+			e.Headers[name] = append(e.Headers[name], string(v))
+		}
+	})
+
+	if len(vary) > 0 {
+		set.put(key, &entry{StoredAt: e.StoredAt, Ttl: ttl, Stale: stale, Vary: vary})
+		key = variantKey(ctx, key, vary)
+	}
+	set.put(key, e)
+
+	return nil
+}
+
+// hasCredentials returns true if request carries any of credentialHeaders
+func hasCredentials(ctx *fiber.Ctx) bool {
+	for i := range credentialHeaders {
+		if len(ctx.Request().Header.Peek(credentialHeaders[i])) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// put stores entry until end of stale window
+func (set *optionSet) put(key string, e *entry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	if err := set.store.Set(key, data, e.Ttl+e.Stale); err != nil {
+		set.logger().Warn("Failed to store cached response.", zap.Error(err))
+	}
+}
+
+// revalidate refreshes entry of request in background by sending copy of request through app,
+// skipped if key is already being refreshed or missed.
+//
+// Copy is marked as internal request, so that logging, metrics, tracing, concurrency and rate limit
+// middlewares in front of cache skip it, since they were already applied to the original request.
+func (set *optionSet) revalidate(ctx *fiber.Ctx, key string) {
+	if _, leader := set.inflight.join(key); !leader {
+		return
+	}
+
+	req := &fasthttp.Request{}
+	ctx.Request().CopyTo(req)
+	req.Header.Del(fiber.HeaderCacheControl)
+	remoteAddr := ctx.Context().RemoteAddr()
+	handler := ctx.App().Handler()
+
+	go func() {
+		defer set.inflight.leave(key)
+
+		reqCtx := &fasthttp.RequestCtx{}
+		reqCtx.Init(req, remoteAddr, nil)
+		reqCtx.SetUserValue(revalidateKey{}, true)
+		rkfiberctx.MarkInternalRequest(reqCtx)
+		handler(reqCtx)
+	}()
+}
+
+// logger returns default logger
+func (set *optionSet) logger() *zap.Logger {
+	return rkentry.GlobalAppCtx.GetLoggerEntryDefault().Logger
+}
+
+// parseCacheControl returns directives of Cache-Control header with lower case names
+func parseCacheControl(header string) map[string]string {
+	res := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) < 1 {
+			continue
+		}
+
+		name, value := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			name, value = part[:i], strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+		}
+		res[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+
+	return res
+}
+
+// parseVary returns sorted header names of Vary header
+func parseVary(header string) []string {
+	res := make([]string, 0)
+	for _, part := range strings.Split(header, ",") {
+		if part = strings.TrimSpace(part); len(part) > 0 {
+			res = append(res, http.CanonicalHeaderKey(part))
+		}
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+// seconds returns duration of directive in seconds
+func seconds(directives map[string]string, name string) (time.Duration, bool) {
+	v, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return time.Duration(n) * time.Second, true
+}
@@ -0,0 +1,350 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibercache
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newCountingApp create app whose handlers return number of calls as body
+func newCountingApp(counter *int32, cacheControl string, opts ...Option) *fiber.App {
+	app := fiber.New()
+	app.Use(Middleware(opts...))
+	handler := func(ctx *fiber.Ctx) error {
+		n := atomic.AddInt32(counter, 1)
+		if len(cacheControl) > 0 {
+			ctx.Set(fiber.HeaderCacheControl, cacheControl)
+		}
+		ctx.Set(fiber.HeaderVary, ctx.Get("X-Ut-Vary"))
+		return ctx.SendString(strconv.Itoa(int(n)))
+	}
+	app.Get("/ut-path", handler)
+	app.Get("/ut-group/ut-path", handler)
+	app.Post("/ut-path", handler)
+	return app
+}
+
+func send(t *testing.T, app *fiber.App, method, path string, headers ...string) (string, *http.Response) {
+	req := httptest.NewRequest(method, path, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := app.Test(req, -1)
+	assert.Nil(t, err)
+	bytes, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return string(bytes), resp
+}
+
+func TestMiddleware(t *testing.T) {
+	var counter int32
+	registry := prometheus.NewRegistry()
+	app := newCountingApp(&counter, "", WithKeyHeaders("X-Ut-Tenant"), WithRegisterer(registry))
+
+	body, resp := send(t, app, http.MethodGet, "/ut-path?a=1&b=2")
+	assert.Equal(t, "1", body)
+	assert.Equal(t, "MISS", resp.Header.Get(HeaderCache))
+
+	// query order does not matter
+	body, resp = send(t, app, http.MethodGet, "/ut-path?b=2&a=1")
+	assert.Equal(t, "1", body)
+	assert.Equal(t, "HIT", resp.Header.Get(HeaderCache))
+	assert.Equal(t, "0", resp.Header.Get(fiber.HeaderAge))
+
+	// different query and key header
+	body, _ = send(t, app, http.MethodGet, "/ut-path?a=2")
+	assert.Equal(t, "2", body)
+	body, _ = send(t, app, http.MethodGet, "/ut-path?a=1&b=2", "X-Ut-Tenant", "ut-tenant")
+	assert.Equal(t, "3", body)
+
+	// request no-store bypasses cache, no-cache refreshes entry
+	body, _ = send(t, app, http.MethodGet, "/ut-path?a=1&b=2", fiber.HeaderCacheControl, "no-store")
+	assert.Equal(t, "4", body)
+	body, _ = send(t, app, http.MethodGet, "/ut-path?a=1&b=2", fiber.HeaderCacheControl, "no-cache")
+	assert.Equal(t, "5", body)
+	body, _ = send(t, app, http.MethodGet, "/ut-path?a=1&b=2")
+	assert.Equal(t, "5", body)
+
+	// POST is not cached
+	send(t, app, http.MethodPost, "/ut-path")
+	body, _ = send(t, app, http.MethodPost, "/ut-path")
+	assert.Equal(t, "7", body)
+
+	// authorized request is not cached
+	send(t, app, http.MethodGet, "/ut-path?auth", fiber.HeaderAuthorization, "Bearer ut")
+	body, _ = send(t, app, http.MethodGet, "/ut-path?auth", fiber.HeaderAuthorization, "Bearer ut")
+	assert.Equal(t, "9", body)
+
+	// requests with different cookies or API keys do not share response
+	body, _ = send(t, app, http.MethodGet, "/ut-path?session", fiber.HeaderCookie, "rk_session=ut-user-a")
+	assert.Equal(t, "10", body)
+	body, _ = send(t, app, http.MethodGet, "/ut-path?session", fiber.HeaderCookie, "rk_session=ut-user-b")
+	assert.Equal(t, "11", body)
+	body, _ = send(t, app, http.MethodGet, "/ut-path?apiKey", rkmid.HeaderApiKey, "ut-key-a")
+	assert.Equal(t, "12", body)
+	body, _ = send(t, app, http.MethodGet, "/ut-path?apiKey", rkmid.HeaderApiKey, "ut-key-b")
+	assert.Equal(t, "13", body)
+
+	assert.Equal(t, float64(2), counterValue(registry, resultHit))
+	assert.Equal(t, float64(1), counterValue(registry, resultBypass))
+}
+
+// counterValue returns value of requests counter with result
+func counterValue(registry *prometheus.Registry, result string) float64 {
+	families, _ := registry.Gather()
+	for _, family := range families {
+		if family.GetName() != "rk_cache_requests_total" {
+			continue
+		}
+		for _, m := range family.Metric {
+			for _, label := range m.Label {
+				if label.GetName() == "result" && label.GetValue() == result {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestMiddleware_CacheControl(t *testing.T) {
+	// not cacheable
+	for _, cacheControl := range []string{"no-store", "private, max-age=60", "max-age=0"} {
+		var counter int32
+		app := newCountingApp(&counter, cacheControl, WithRegisterer(prometheus.NewRegistry()))
+		send(t, app, http.MethodGet, "/ut-path")
+		body, _ := send(t, app, http.MethodGet, "/ut-path")
+		assert.Equal(t, "2", body, cacheControl)
+	}
+
+	// max-age overrides ttl
+	var counter int32
+	app := newCountingApp(&counter, "public, max-age=1", WithTtl(time.Hour), WithRegisterer(prometheus.NewRegistry()))
+	send(t, app, http.MethodGet, "/ut-path")
+	body, _ := send(t, app, http.MethodGet, "/ut-path")
+	assert.Equal(t, "1", body)
+	time.Sleep(1100 * time.Millisecond)
+	body, _ = send(t, app, http.MethodGet, "/ut-path")
+	assert.Equal(t, "2", body)
+}
+
+func TestMiddleware_Vary(t *testing.T) {
+	var counter int32
+	app := newCountingApp(&counter, "", WithRegisterer(prometheus.NewRegistry()))
+	vary := "X-Ut-Vary"
+
+	body, _ := send(t, app, http.MethodGet, "/ut-path", vary, fiber.HeaderAcceptLanguage, fiber.HeaderAcceptLanguage, "en")
+	assert.Equal(t, "1", body)
+	body, _ = send(t, app, http.MethodGet, "/ut-path", vary, fiber.HeaderAcceptLanguage, fiber.HeaderAcceptLanguage, "en")
+	assert.Equal(t, "1", body)
+	body, _ = send(t, app, http.MethodGet, "/ut-path", vary, fiber.HeaderAcceptLanguage, fiber.HeaderAcceptLanguage, "fr")
+	assert.Equal(t, "2", body)
+
+	// Vary: * is not cached
+	send(t, app, http.MethodGet, "/ut-path?all", vary, "*")
+	body, _ = send(t, app, http.MethodGet, "/ut-path?all", vary, "*")
+	assert.Equal(t, "4", body)
+}
+
+func TestMiddleware_StaleWhileRevalidate(t *testing.T) {
+	var counter int32
+	app := newCountingApp(&counter, "max-age=1, stale-while-revalidate=60", WithRegisterer(prometheus.NewRegistry()))
+
+	send(t, app, http.MethodGet, "/ut-path")
+	time.Sleep(1100 * time.Millisecond)
+
+	// stale response is served and refreshed in background
+	body, resp := send(t, app, http.MethodGet, "/ut-path")
+	assert.Equal(t, "1", body)
+	assert.Equal(t, "STALE", resp.Header.Get(HeaderCache))
+
+	assert.Eventually(t, func() bool {
+		body, resp = send(t, app, http.MethodGet, "/ut-path")
+		return body == "2" && resp.Header.Get(HeaderCache) == "HIT"
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&counter))
+}
+
+func TestMiddleware_RevalidateSkipsOuterMiddlewares(t *testing.T) {
+	var counter, outer, internal int32
+	app := fiber.New()
+	// outer middleware like logging or rate limit
+	app.Use(func(ctx *fiber.Ctx) error {
+		if rkfiberctx.IsInternalRequest(ctx) {
+			atomic.AddInt32(&internal, 1)
+		} else {
+			atomic.AddInt32(&outer, 1)
+		}
+		return ctx.Next()
+	})
+	app.Use(Middleware(WithRegisterer(prometheus.NewRegistry())))
+	app.Get("/ut-path", func(ctx *fiber.Ctx) error {
+		n := atomic.AddInt32(&counter, 1)
+		ctx.Set(fiber.HeaderCacheControl, "max-age=1, stale-while-revalidate=60")
+		return ctx.SendString(strconv.Itoa(int(n)))
+	})
+
+	send(t, app, http.MethodGet, "/ut-path")
+	time.Sleep(1100 * time.Millisecond)
+
+	body, _ := send(t, app, http.MethodGet, "/ut-path")
+	assert.Equal(t, "1", body)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&counter) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// refresh is marked as internal request, client requests are not
+	assert.Equal(t, int32(2), atomic.LoadInt32(&outer))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&internal))
+}
+
+func TestMiddleware_KeyHost(t *testing.T) {
+	var counter int32
+	app := newCountingApp(&counter, "", WithRegisterer(prometheus.NewRegistry()))
+
+	body, _ := send(t, app, http.MethodGet, "http://ut-a.example.com/ut-path")
+	assert.Equal(t, "1", body)
+	body, _ = send(t, app, http.MethodGet, "http://ut-a.example.com/ut-path")
+	assert.Equal(t, "1", body)
+
+	// same path on another virtual host is cached separately
+	body, resp := send(t, app, http.MethodGet, "http://ut-b.example.com/ut-path")
+	assert.Equal(t, "2", body)
+	assert.Equal(t, "MISS", resp.Header.Get(HeaderCache))
+}
+
+func TestMiddleware_Coalesce(t *testing.T) {
+	var counter int32
+	release := make(chan struct{})
+	app := fiber.New()
+	app.Use(Middleware(WithRegisterer(prometheus.NewRegistry())))
+	app.Get("/ut-path", func(ctx *fiber.Ctx) error {
+		atomic.AddInt32(&counter, 1)
+		<-release
+		return ctx.SendString("ut-body")
+	})
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, _ := send(t, app, http.MethodGet, "/ut-path")
+			assert.Equal(t, "ut-body", body)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&counter))
+}
+
+func TestMiddleware_Group(t *testing.T) {
+	var counter int32
+	registry := prometheus.NewRegistry()
+	app := newCountingApp(&counter, "", WithGroup("/ut-group", time.Hour, 0), WithRegisterer(registry))
+
+	// path out of groups is not cached
+	send(t, app, http.MethodGet, "/ut-path")
+	body, _ := send(t, app, http.MethodGet, "/ut-path")
+	assert.Equal(t, "2", body)
+
+	send(t, app, http.MethodGet, "/ut-group/ut-path")
+	body, _ = send(t, app, http.MethodGet, "/ut-group/ut-path")
+	assert.Equal(t, "3", body)
+	assert.Equal(t, 2, testutil.CollectAndCount(registry, "rk_cache_requests_total"))
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore(2, 15)
+
+	assert.Nil(t, store.Set("k1", []byte("v1"), time.Minute))
+	assert.Nil(t, store.Set("k2", []byte("v2"), time.Minute))
+	// k1 is recently used
+	data, _ := store.Get("k1")
+	assert.Equal(t, "v1", string(data))
+
+	// max entries evicts least recently used one
+	assert.Nil(t, store.Set("k3", []byte("v3"), time.Minute))
+	data, _ = store.Get("k2")
+	assert.Nil(t, data)
+	entries, bytes := store.Len()
+	assert.Equal(t, 2, entries)
+	assert.Equal(t, 8, bytes)
+
+	// max bytes
+	assert.Nil(t, store.Set("k4", []byte("0123456789"), time.Minute))
+	entries, bytes = store.Len()
+	assert.Equal(t, 1, entries)
+	assert.Equal(t, 12, bytes)
+
+	// entry larger than limit is not stored
+	assert.Nil(t, store.Set("k5", make([]byte, 20), time.Minute))
+	data, _ = store.Get("k5")
+	assert.Nil(t, data)
+
+	// expired
+	assert.Nil(t, store.Set("k6", []byte("v6"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	data, _ = store.Get("k6")
+	assert.Nil(t, data)
+
+	assert.Nil(t, store.Delete("k4"))
+	entries, bytes = store.Len()
+	assert.Equal(t, 0, entries)
+	assert.Equal(t, 0, bytes)
+}
+
+func TestToOptions(t *testing.T) {
+	// disabled
+	assert.Empty(t, ToOptions(&BootConfig{}, "ut-entry", "ut-type", nil))
+
+	// enabled
+	config := &BootConfig{
+		Enabled:                 true,
+		TtlSec:                  30,
+		StaleWhileRevalidateSec: 10,
+		KeyHeaders:              []string{"X-Ut-Tenant"},
+		CoalesceTimeoutMs:       100,
+		Groups: []GroupConfig{
+			{Prefix: "/ut-group", TtlSec: 60},
+			{Prefix: "/ut-group/ut-sub", KeyHeaders: []string{"X-Ut-Other"}},
+		},
+		Memory: MemoryConfig{MaxEntries: 10},
+	}
+
+	set := newOptionSet(ToOptions(config, "ut-entry", "ut-type", prometheus.NewRegistry())...)
+	assert.Equal(t, "ut-entry", set.entryName)
+	assert.Equal(t, 100*time.Millisecond, set.coalesceTimeout)
+	assert.Equal(t, 10, set.store.(*MemoryStore).maxEntries)
+	assert.Equal(t, DefaultMaxBytes, set.store.(*MemoryStore).maxBytes)
+
+	g := set.groupOf(http.MethodGet, "/ut-group/ut-path")
+	assert.Equal(t, time.Minute, g.ttl)
+	assert.Equal(t, 10*time.Second, g.stale)
+	assert.Equal(t, []string{"X-Ut-Tenant"}, g.keyHeaders)
+
+	g = set.groupOf(http.MethodHead, "/ut-group/ut-sub/ut-path")
+	assert.Equal(t, 30*time.Second, g.ttl)
+	assert.Equal(t, []string{"X-Ut-Other"}, g.keyHeaders)
+
+	assert.Nil(t, set.groupOf(http.MethodGet, "/ut-path"))
+	assert.Nil(t, set.groupOf(http.MethodPost, "/ut-group/ut-path"))
+}
@@ -0,0 +1,301 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibercache
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-entry/v2/middleware/prom"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// HeaderCache is set to HIT, STALE or MISS on cacheable responses
+	HeaderCache = "X-Cache"
+	// DefaultTtl is duration for which response without max-age is fresh
+	DefaultTtl = time.Minute
+	// DefaultCoalesceTimeout is max duration a request waits for concurrent miss of same key
+	DefaultCoalesceTimeout = 5 * time.Second
+
+	// groupAll is group label while no group is provided
+	groupAll = "*"
+
+	resultHit    = "hit"
+	resultStale  = "stale"
+	resultMiss   = "miss"
+	resultBypass = "bypass"
+
+	metricsNameRequests = "requests_total"
+)
+
+// ***************** OptionSet *****************
+
+// group is cache settings of requests with path prefix
+type group struct {
+	prefix     string
+	ttl        time.Duration
+	stale      time.Duration
+	keyHeaders []string
+}
+
+// optionSet which is used for middleware implementation
+type optionSet struct {
+	entryName    string
+	entryType    string
+	pathToIgnore []string
+
+	ttl             time.Duration
+	stale           time.Duration
+	keyHeaders      []string
+	groups          []*group
+	coalesceTimeout time.Duration
+	store           Store
+
+	registerer prometheus.Registerer
+	metricsSet *rkmidprom.MetricsSet
+
+	inflight *inflight
+}
+
+// newOptionSet Create new optionSet with options.
+func newOptionSet(opts ...Option) *optionSet {
+	set := &optionSet{
+		entryName:       "fake-entry",
+		entryType:       "",
+		pathToIgnore:    []string{},
+		ttl:             DefaultTtl,
+		keyHeaders:      []string{},
+		groups:          []*group{},
+		coalesceTimeout: DefaultCoalesceTimeout,
+		inflight:        newInflight(),
+	}
+
+	for i := range opts {
+		opts[i](set)
+	}
+
+	if set.store == nil {
+		set.store = NewMemoryStore(DefaultMaxEntries, DefaultMaxBytes)
+	}
+
+	// all paths are cached with entry settings unless groups are provided
+	if len(set.groups) < 1 {
+		set.groups = append(set.groups, &group{prefix: groupAll})
+	}
+
+	for _, g := range set.groups {
+		if g.ttl <= 0 {
+			g.ttl = set.ttl
+		}
+		if g.stale <= 0 {
+			g.stale = set.stale
+		}
+		if len(g.keyHeaders) < 1 {
+			g.keyHeaders = set.keyHeaders
+		}
+	}
+
+	// longest prefix matches first
+	sort.Slice(set.groups, func(i, j int) bool {
+		return len(set.groups[i].prefix) > len(set.groups[j].prefix)
+	})
+
+	set.metricsSet = rkmidprom.NewMetricsSet("rk", "cache", set.registerer)
+	// metrics may already be registered by another middleware with same registerer, ignore error
+	set.metricsSet.RegisterCounter(metricsNameRequests, "entryName", "entryType", "group", "result")
+
+	return set
+}
+
+// ShouldIgnore determine whether cache should be ignored based on path
+func (set *optionSet) ShouldIgnore(path string) bool {
+	for i := range set.pathToIgnore {
+		if strings.HasPrefix(path, set.pathToIgnore[i]) {
+			return true
+		}
+	}
+
+	return rkmid.ShouldIgnoreGlobal(path)
+}
+
+// groupOf returns group which request belongs to, nil if request is not cacheable
+func (set *optionSet) groupOf(method, path string) *group {
+	if (method != http.MethodGet && method != http.MethodHead) || set.ShouldIgnore(path) {
+		return nil
+	}
+
+	for _, g := range set.groups {
+		if g.prefix == groupAll || strings.HasPrefix(path, g.prefix) {
+			return g
+		}
+	}
+
+	return nil
+}
+
+// observe increases counter of request with result
+func (set *optionSet) observe(g *group, result string) {
+	if counter := set.metricsSet.GetCounterWithValues(metricsNameRequests, set.entryName, set.entryType, g.prefix, result); counter != nil {
+		counter.Inc()
+	}
+}
+
+// ***************** BootConfig *****************
+
+// BootConfig for YAML
+type BootConfig struct {
+	Enabled                 bool          `yaml:"enabled" json:"enabled"`
+	Ignore                  []string      `yaml:"ignore" json:"ignore"`
+	TtlSec                  int           `yaml:"ttlSec" json:"ttlSec"`
+	StaleWhileRevalidateSec int           `yaml:"staleWhileRevalidateSec" json:"staleWhileRevalidateSec"`
+	KeyHeaders              []string      `yaml:"keyHeaders" json:"keyHeaders"`
+	CoalesceTimeoutMs       int           `yaml:"coalesceTimeoutMs" json:"coalesceTimeoutMs"`
+	Groups                  []GroupConfig `yaml:"groups" json:"groups"`
+	Memory                  MemoryConfig  `yaml:"memory" json:"memory"`
+}
+
+// GroupConfig for YAML, cache settings of route group with path prefix
+type GroupConfig struct {
+	Prefix                  string   `yaml:"prefix" json:"prefix"`
+	TtlSec                  int      `yaml:"ttlSec" json:"ttlSec"`
+	StaleWhileRevalidateSec int      `yaml:"staleWhileRevalidateSec" json:"staleWhileRevalidateSec"`
+	KeyHeaders              []string `yaml:"keyHeaders" json:"keyHeaders"`
+}
+
+// MemoryConfig for YAML, size limits of MemoryStore
+type MemoryConfig struct {
+	MaxEntries int `yaml:"maxEntries" json:"maxEntries"`
+	MaxBytes   int `yaml:"maxBytes" json:"maxBytes"`
+}
+
+// ToOptions convert BootConfig into Option list
+func ToOptions(config *BootConfig, entryName, entryType string, registerer prometheus.Registerer) []Option {
+	opts := make([]Option, 0)
+
+	if config.Enabled {
+		opts = append(opts,
+			WithEntryNameAndType(entryName, entryType),
+			WithPathToIgnore(config.Ignore...),
+			WithTtl(time.Duration(config.TtlSec)*time.Second),
+			WithStaleWhileRevalidate(time.Duration(config.StaleWhileRevalidateSec)*time.Second),
+			WithKeyHeaders(config.KeyHeaders...),
+			WithCoalesceTimeout(time.Duration(config.CoalesceTimeoutMs)*time.Millisecond),
+			WithStore(NewMemoryStore(config.Memory.MaxEntries, config.Memory.MaxBytes)),
+			WithRegisterer(registerer))
+
+		for _, g := range config.Groups {
+			opts = append(opts, WithGroup(g.Prefix,
+				time.Duration(g.TtlSec)*time.Second,
+				time.Duration(g.StaleWhileRevalidateSec)*time.Second,
+				g.KeyHeaders...))
+		}
+	}
+
+	return opts
+}
+
+// ***************** Option *****************
+
+// Option if for middleware options while creating middleware
+type Option func(*optionSet)
+
+// WithEntryNameAndType provide entry name and entry type.
+func WithEntryNameAndType(entryName, entryType string) Option {
+	return func(opt *optionSet) {
+		opt.entryName = entryName
+		opt.entryType = entryType
+	}
+}
+
+// WithPathToIgnore provide paths prefix that will ignore.
+func WithPathToIgnore(paths ...string) Option {
+	return func(set *optionSet) {
+		for i := range paths {
+			if len(paths[i]) > 0 {
+				set.pathToIgnore = append(set.pathToIgnore, paths[i])
+			}
+		}
+	}
+}
+
+// WithTtl provide duration for which response without max-age or s-maxage is fresh, default is one minute.
+func WithTtl(ttl time.Duration) Option {
+	return func(opt *optionSet) {
+		if ttl > 0 {
+			opt.ttl = ttl
+		}
+	}
+}
+
+// WithStaleWhileRevalidate provide duration for which expired response is served while it is refreshed in background,
+// stale-while-revalidate directive of response takes precedence, disabled by default.
+func WithStaleWhileRevalidate(stale time.Duration) Option {
+	return func(opt *optionSet) {
+		if stale > 0 {
+			opt.stale = stale
+		}
+	}
+}
+
+// WithKeyHeaders provide request headers which are part of cache key in addition to method, path and query.
+func WithKeyHeaders(headers ...string) Option {
+	return func(opt *optionSet) {
+		for i := range headers {
+			if len(headers[i]) > 0 {
+				opt.keyHeaders = append(opt.keyHeaders, headers[i])
+			}
+		}
+	}
+}
+
+// WithGroup provide cache settings of route group with path prefix, settings of entry are used if not provided.
+//
+// Once any group is provided, only requests of groups are cached.
+func WithGroup(prefix string, ttl, stale time.Duration, keyHeaders ...string) Option {
+	return func(opt *optionSet) {
+		if len(prefix) < 1 {
+			return
+		}
+
+		g := &group{prefix: prefix, ttl: ttl, stale: stale}
+		for i := range keyHeaders {
+			if len(keyHeaders[i]) > 0 {
+				g.keyHeaders = append(g.keyHeaders, keyHeaders[i])
+			}
+		}
+		opt.groups = append(opt.groups, g)
+	}
+}
+
+// WithCoalesceTimeout provide max duration a request waits for concurrent miss of same key, default is five seconds.
+func WithCoalesceTimeout(timeout time.Duration) Option {
+	return func(opt *optionSet) {
+		if timeout > 0 {
+			opt.coalesceTimeout = timeout
+		}
+	}
+}
+
+// WithStore provide Store, MemoryStore with default size limits would be used by default.
+func WithStore(store Store) Option {
+	return func(opt *optionSet) {
+		if store != nil {
+			opt.store = store
+		}
+	}
+}
+
+// WithRegisterer provide prometheus.Registerer, prometheus.DefaultRegisterer would be used by default.
+func WithRegisterer(registerer prometheus.Registerer) Option {
+	return func(opt *optionSet) {
+		if registerer != nil {
+			opt.registerer = registerer
+		}
+	}
+}
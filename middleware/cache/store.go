@@ -0,0 +1,147 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibercache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxEntries is max number of entries kept by MemoryStore
+	DefaultMaxEntries = 10000
+	// DefaultMaxBytes is max total size of entries kept by MemoryStore
+	DefaultMaxBytes = 64 * 1024 * 1024
+)
+
+// Store persists serialized responses by cache key.
+//
+// Implementations must be safe for concurrent use. Entries must be expired by implementation after ttl,
+// which already includes stale-while-revalidate window, and may be evicted earlier to bound memory.
+type Store interface {
+	// Get returns serialized entry, nil without error if missing or expired
+	Get(key string) ([]byte, error)
+
+	// Set stores serialized entry with ttl
+	Set(key string, data []byte, ttl time.Duration) error
+
+	// Delete removes entry, no error if missing
+	Delete(key string) error
+}
+
+// ***************** MemoryStore *****************
+
+// memoryEntry is an entry stored in MemoryStore
+type memoryEntry struct {
+	key       string
+	data      []byte
+	expiresAt time.Time
+}
+
+// MemoryStore is a Store which keeps entries in memory, least recently used entries are evicted
+// once number of entries or total size of keys and data exceeds limits.
+type MemoryStore struct {
+	lock       sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	bytes      int
+	maxEntries int
+	maxBytes   int
+}
+
+// NewMemoryStore create MemoryStore with max number of entries and max total size in bytes,
+// DefaultMaxEntries and DefaultMaxBytes would be used if not positive.
+func NewMemoryStore(maxEntries, maxBytes int) *MemoryStore {
+	if maxEntries < 1 {
+		maxEntries = DefaultMaxEntries
+	}
+
+	if maxBytes < 1 {
+		maxBytes = DefaultMaxBytes
+	}
+
+	return &MemoryStore{
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+}
+
+// Get returns serialized entry and marks it as recently used
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+
+	entry := elem.Value.(*memoryEntry)
+	if time.Now().After(entry.expiresAt) {
+		s.remove(elem)
+		return nil, nil
+	}
+
+	s.lru.MoveToFront(elem)
+	return entry.data, nil
+}
+
+// Set stores serialized entry with ttl, entry larger than max size is not stored
+func (s *MemoryStore) Set(key string, data []byte, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+
+	if len(key)+len(data) > s.maxBytes {
+		return nil
+	}
+
+	s.entries[key] = s.lru.PushFront(&memoryEntry{
+		key:       key,
+		data:      data,
+		expiresAt: time.Now().Add(ttl),
+	})
+	s.bytes += len(key) + len(data)
+
+	for s.lru.Len() > s.maxEntries || s.bytes > s.maxBytes {
+		s.remove(s.lru.Back())
+	}
+
+	return nil
+}
+
+// Delete removes entry
+func (s *MemoryStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+
+	return nil
+}
+
+// Len returns number of entries and total size in bytes
+func (s *MemoryStore) Len() (entries, bytes int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.lru.Len(), s.bytes
+}
+
+// remove element from store, caller must hold lock
+func (s *MemoryStore) remove(elem *list.Element) {
+	entry := s.lru.Remove(elem).(*memoryEntry)
+	delete(s.entries, entry.key)
+	s.bytes -= len(entry.key) + len(entry.data)
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibercompression
+
+import (
+	"bytes"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"sync"
+)
+
+// writer is a compressing writer which could be reused
+type writer interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// compressor compresses data with content coding, writers are pooled since they are expensive to create
+type compressor struct {
+	pool sync.Pool
+}
+
+// newCompressor create compressor of content coding with level, default level would be used if level is zero.
+//
+// Level is resolved once before pool is built, since New of pool may be called concurrently.
+func newCompressor(encoding string, level int) *compressor {
+	res := &compressor{}
+
+	switch encoding {
+	case EncodingBrotli:
+		level = clampLevel(level, brotli.DefaultCompression, brotli.BestCompression)
+		res.pool.New = func() interface{} {
+			return brotli.NewWriterLevel(nil, level)
+		}
+	case EncodingZstd:
+		encoderLevel := zstd.SpeedDefault
+		if level > 0 {
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		res.pool.New = func() interface{} {
+			w, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel), zstd.WithEncoderConcurrency(1))
+			return w
+		}
+	case EncodingDeflate:
+		// deflate content coding is zlib format, see RFC 9110 section 8.4.1.2
+		level = clampLevel(level, zlib.DefaultCompression, zlib.BestCompression)
+		res.pool.New = func() interface{} {
+			w, _ := zlib.NewWriterLevel(nil, level)
+			return w
+		}
+	default:
+		level = clampLevel(level, gzip.DefaultCompression, gzip.BestCompression)
+		res.pool.New = func() interface{} {
+			w, _ := gzip.NewWriterLevel(nil, level)
+			return w
+		}
+	}
+
+	return res
+}
+
+// clampLevel returns def if level is not positive, and best if level exceeds it
+func clampLevel(level, def, best int) int {
+	if level < 1 {
+		return def
+	}
+	if level > best {
+		return best
+	}
+	return level
+}
+
+// compress returns compressed data
+func (c *compressor) compress(data []byte) ([]byte, error) {
+	w := c.pool.Get().(writer)
+	defer c.pool.Put(w)
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+	w.Reset(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+// Package rkfibercompression is a middleware of fiber framework for compressing responses and decompressing requests
+package rkfibercompression
+
+import (
+	"bytes"
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"github.com/klauspost/compress/gzip"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Middleware compresses response bodies with content coding negotiated with Accept-Encoding,
+// and decompresses gzip encoded request bodies.
+//
+// Responses smaller than min size, with content type out of allow list, SSE, streamed body,
+// Content-Encoding already set or Cache-Control no-transform are not compressed.
+// Strong ETag of compressed response is weakened since body differs from identity one.
+func Middleware(opts ...Option) fiber.Handler {
+	set := newOptionSet(opts...)
+
+	return func(ctx *fiber.Ctx) error {
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, set.entryName))
+
+		if set.ShouldIgnore(ctx.Path()) {
+			return ctx.Next()
+		}
+
+		if strings.EqualFold(strings.TrimSpace(string(ctx.Request().Header.Peek(fiber.HeaderContentEncoding))), EncodingGzip) {
+			if err := set.decompress(ctx); err != nil {
+				return err
+			}
+		}
+
+		if err := ctx.Next(); err != nil {
+			return err
+		}
+
+		set.compress(ctx)
+		return nil
+	}
+}
+
+// decompress gzip encoded request body, request is rejected if body is invalid or too large
+func (set *optionSet) decompress(ctx *fiber.Ctx) error {
+	reader, err := gzip.NewReader(bytes.NewReader(ctx.Request().Body()))
+	if err != nil {
+		return set.reject(ctx, http.StatusBadRequest, "invalid gzip request body")
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, int64(set.maxDecompressedSize)+1))
+	if err != nil {
+		return set.reject(ctx, http.StatusBadRequest, "invalid gzip request body")
+	}
+
+	if len(data) > set.maxDecompressedSize {
+		return set.reject(ctx, http.StatusRequestEntityTooLarge, "decompressed request body is too large")
+	}
+
+	ctx.Request().Header.Del(fiber.HeaderContentEncoding)
+	ctx.Request().SetBody(data)
+	ctx.Request().Header.SetContentLength(len(data))
+	set.observe(metricsNameDecompressed, EncodingGzip, 1)
+
+	return nil
+}
+
+// compress response body if eligible
+func (set *optionSet) compress(ctx *fiber.Ctx) {
+	resp := ctx.Response()
+	status := resp.StatusCode()
+	if status == http.StatusNoContent || status == http.StatusNotModified || status < http.StatusOK ||
+		resp.IsBodyStream() ||
+		len(resp.Header.Peek(fiber.HeaderContentEncoding)) > 0 ||
+		!set.isCompressible(string(resp.Header.ContentType())) ||
+		strings.Contains(strings.ToLower(string(resp.Header.Peek(fiber.HeaderCacheControl))), "no-transform") {
+		return
+	}
+
+	// representation varies on Accept-Encoding even if body is not compressed for this request
+	if !strings.Contains(strings.ToLower(string(resp.Header.Peek(fiber.HeaderVary))), "accept-encoding") {
+		ctx.Vary(fiber.HeaderAcceptEncoding)
+	}
+
+	body := resp.Body()
+	if len(body) < set.minSize {
+		return
+	}
+
+	encoding := set.negotiate(ctx.Get(fiber.HeaderAcceptEncoding))
+	if len(encoding) < 1 {
+		return
+	}
+
+	compressed, err := set.compressors[encoding].compress(body)
+	if err != nil || len(compressed) >= len(body) {
+		return
+	}
+
+	set.observe(metricsNameResponses, encoding, 1)
+	set.observe(metricsNameSavedBytes, encoding, float64(len(body)-len(compressed)))
+
+	resp.SetBodyRaw(compressed)
+	resp.Header.Set(fiber.HeaderContentEncoding, encoding)
+	if etag := string(resp.Header.Peek(fiber.HeaderETag)); strings.HasPrefix(etag, `"`) {
+		resp.Header.Set(fiber.HeaderETag, "W/"+etag)
+	}
+}
+
+// negotiate returns supported content coding with highest quality in Accept-Encoding,
+// preference of server breaks ties, empty if none is acceptable
+func (set *optionSet) negotiate(acceptEncoding string) string {
+	if len(acceptEncoding) < 1 {
+		return ""
+	}
+
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if len(name) < 1 {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		qualities[name] = quality
+	}
+
+	res, best := "", 0.0
+	for _, encoding := range set.encodings {
+		quality, ok := qualities[encoding]
+		if !ok {
+			quality = qualities["*"]
+		}
+
+		if quality > best {
+			res, best = encoding, quality
+		}
+	}
+
+	return res
+}
+
+// reject request with code and message
+func (set *optionSet) reject(ctx *fiber.Ctx, code int, msg string) error {
+	resp := rkmid.GetErrorBuilder().New(code, msg)
+	ctx.Response().SetStatusCode(resp.Code())
+	return ctx.JSON(resp)
+}
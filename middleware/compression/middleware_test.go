@@ -0,0 +1,210 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibercompression
+
+import (
+	"bytes"
+	"compress/zlib"
+	"github.com/andybalholm/brotli"
+	"github.com/gofiber/fiber/v2"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var largeBody = strings.Repeat("rk-fiber compression ", 100)
+
+// newApp create app which returns body with content type of query
+func newApp(opts ...Option) *fiber.App {
+	app := fiber.New()
+	app.Use(Middleware(opts...))
+	app.Get("/ut-path", func(ctx *fiber.Ctx) error {
+		ctx.Set(fiber.HeaderContentType, ctx.Query("type", fiber.MIMEApplicationJSON))
+		ctx.Set(fiber.HeaderETag, `"ut-etag"`)
+		return ctx.SendString(ctx.Query("body", largeBody))
+	})
+	app.Post("/ut-path", func(ctx *fiber.Ctx) error {
+		return ctx.Send(ctx.Body())
+	})
+	return app
+}
+
+func send(t *testing.T, app *fiber.App, path, acceptEncoding string) (*http.Response, []byte) {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if len(acceptEncoding) > 0 {
+		req.Header.Set(fiber.HeaderAcceptEncoding, acceptEncoding)
+	}
+	resp, err := app.Test(req, -1)
+	assert.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return resp, body
+}
+
+// decode returns decompressed body with content coding
+func decode(t *testing.T, encoding string, body []byte) string {
+	var reader io.Reader
+	switch encoding {
+	case EncodingBrotli:
+		reader = brotli.NewReader(bytes.NewReader(body))
+	case EncodingZstd:
+		decoder, err := zstd.NewReader(bytes.NewReader(body))
+		assert.Nil(t, err)
+		defer decoder.Close()
+		reader = decoder
+	case EncodingDeflate:
+		zlibReader, err := zlib.NewReader(bytes.NewReader(body))
+		assert.Nil(t, err)
+		reader = zlibReader
+	default:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+		assert.Nil(t, err)
+		reader = gzipReader
+	}
+
+	res, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	return string(res)
+}
+
+func TestMiddleware(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	app := newApp(WithLevel(EncodingGzip, 20), WithRegisterer(registry))
+
+	for _, encoding := range DefaultEncodings {
+		resp, body := send(t, app, "/ut-path", encoding)
+		assert.Equal(t, encoding, resp.Header.Get(fiber.HeaderContentEncoding))
+		assert.Equal(t, fiber.HeaderAcceptEncoding, resp.Header.Get(fiber.HeaderVary))
+		assert.Equal(t, `W/"ut-etag"`, resp.Header.Get(fiber.HeaderETag))
+		assert.True(t, len(body) < len(largeBody))
+		assert.Equal(t, largeBody, decode(t, encoding, body))
+	}
+	assert.Equal(t, 4, testutil.CollectAndCount(registry, "rk_compression_responses_total"))
+	assert.Equal(t, 4, testutil.CollectAndCount(registry, "rk_compression_saved_bytes_total"))
+
+	// quality and preference of server
+	resp, _ := send(t, app, "/ut-path", "gzip;q=0.5, deflate;q=0.8, br;q=0")
+	assert.Equal(t, EncodingDeflate, resp.Header.Get(fiber.HeaderContentEncoding))
+	resp, _ = send(t, app, "/ut-path", "gzip, *")
+	assert.Equal(t, EncodingBrotli, resp.Header.Get(fiber.HeaderContentEncoding))
+
+	// not acceptable
+	resp, body := send(t, app, "/ut-path", "identity")
+	assert.Empty(t, resp.Header.Get(fiber.HeaderContentEncoding))
+	assert.Equal(t, fiber.HeaderAcceptEncoding, resp.Header.Get(fiber.HeaderVary))
+	assert.Equal(t, largeBody, string(body))
+}
+
+func TestMiddleware_Skipped(t *testing.T) {
+	app := newApp(WithEncodings("gzip", "unknown"), WithRegisterer(prometheus.NewRegistry()))
+
+	for _, path := range []string{
+		"/ut-path?body=small",
+		"/ut-path?type=text/event-stream",
+		"/ut-path?type=image/png",
+		"/ut-path?type=application/octet-stream",
+	} {
+		resp, body := send(t, app, path, "gzip, br")
+		assert.Empty(t, resp.Header.Get(fiber.HeaderContentEncoding), path)
+		assert.NotEmpty(t, body)
+	}
+
+	// svg is compressed
+	resp, _ := send(t, app, "/ut-path?type=image/svg%2Bxml", "gzip, br")
+	assert.Equal(t, EncodingGzip, resp.Header.Get(fiber.HeaderContentEncoding))
+
+	// content types allow list
+	app = newApp(WithContentTypes("text/html"), WithRegisterer(prometheus.NewRegistry()))
+	resp, _ = send(t, app, "/ut-path", "gzip")
+	assert.Empty(t, resp.Header.Get(fiber.HeaderContentEncoding))
+	resp, _ = send(t, app, "/ut-path?type=text/html;%20charset=utf-8", "gzip")
+	assert.Equal(t, EncodingGzip, resp.Header.Get(fiber.HeaderContentEncoding))
+}
+
+func TestMiddleware_Decompress(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	app := newApp(WithMaxDecompressedSize(len(largeBody)), WithRegisterer(registry))
+
+	compressed := func(data string) io.Reader {
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		w.Write([]byte(data))
+		w.Close()
+		return buf
+	}
+	post := func(body io.Reader) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/ut-path", body)
+		req.Header.Set(fiber.HeaderContentEncoding, "gzip")
+		resp, err := app.Test(req, -1)
+		assert.Nil(t, err)
+		res, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(res)
+	}
+
+	code, body := post(compressed(largeBody))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, largeBody, body)
+	assert.Equal(t, 1, testutil.CollectAndCount(registry, "rk_compression_decompressed_requests_total"))
+
+	// too large
+	code, _ = post(compressed(largeBody + "!"))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+
+	// invalid
+	code, _ = post(strings.NewReader("ut-body"))
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestCompressor_Concurrent(t *testing.T) {
+	for _, encoding := range DefaultEncodings {
+		c := newCompressor(encoding, 0)
+
+		// writers of pool are created concurrently
+		wg := sync.WaitGroup{}
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				data, err := c.compress([]byte(largeBody))
+				assert.Nil(t, err)
+				assert.Equal(t, largeBody, decode(t, encoding, data))
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func TestToOptions(t *testing.T) {
+	// disabled
+	assert.Empty(t, ToOptions(&BootConfig{}, "ut-entry", "ut-type", nil))
+
+	// enabled
+	set := newOptionSet(ToOptions(&BootConfig{
+		Enabled:             true,
+		Encodings:           []string{"GZIP", "br"},
+		Levels:              map[string]int{"gzip": 9},
+		MinSize:             10,
+		ContentTypes:        []string{"text/"},
+		MaxDecompressedSize: 100,
+	}, "ut-entry", "ut-type", prometheus.NewRegistry())...)
+
+	assert.Equal(t, "ut-entry", set.entryName)
+	assert.Equal(t, []string{EncodingGzip, EncodingBrotli}, set.encodings)
+	assert.Equal(t, 9, set.levels[EncodingGzip])
+	assert.Len(t, set.compressors, 2)
+	assert.Equal(t, 10, set.minSize)
+	assert.Equal(t, 100, set.maxDecompressedSize)
+	assert.True(t, set.isCompressible("text/plain"))
+	assert.False(t, set.isCompressible("application/json"))
+}
@@ -0,0 +1,288 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibercompression
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-entry/v2/middleware/prom"
+	"strings"
+)
+
+const (
+	// EncodingBrotli is brotli content coding
+	EncodingBrotli = "br"
+	// EncodingZstd is zstd content coding
+	EncodingZstd = "zstd"
+	// EncodingGzip is gzip content coding
+	EncodingGzip = "gzip"
+	// EncodingDeflate is deflate content coding
+	EncodingDeflate = "deflate"
+
+	// DefaultMinSize is min size of response body which is compressed
+	DefaultMinSize = 1024
+	// DefaultMaxDecompressedSize is max size of decompressed request body
+	DefaultMaxDecompressedSize = 10 * 1024 * 1024
+
+	metricsNameResponses    = "responses_total"
+	metricsNameSavedBytes   = "saved_bytes_total"
+	metricsNameDecompressed = "decompressed_requests_total"
+)
+
+var (
+	// DefaultEncodings are supported content codings in order of preference
+	DefaultEncodings = []string{EncodingBrotli, EncodingZstd, EncodingGzip, EncodingDeflate}
+
+	// DefaultContentTypes are prefixes of content types which are compressed
+	DefaultContentTypes = []string{
+		"text/",
+		"application/json",
+		"application/javascript",
+		"application/xml",
+		"application/x-yaml",
+		"application/problem+json",
+		"image/svg+xml",
+	}
+
+	// excludedContentTypes are never compressed since they are streamed or compressed already
+	excludedContentTypes = []string{
+		"text/event-stream",
+		"image/",
+		"video/",
+		"audio/",
+		"font/woff",
+		"application/zip",
+		"application/gzip",
+		"application/x-gzip",
+		"application/zstd",
+		"application/octet-stream",
+	}
+)
+
+// ***************** OptionSet *****************
+
+// optionSet which is used for middleware implementation
+type optionSet struct {
+	entryName    string
+	entryType    string
+	pathToIgnore []string
+
+	encodings           []string
+	levels              map[string]int
+	minSize             int
+	contentTypes        []string
+	maxDecompressedSize int
+
+	registerer prometheus.Registerer
+	metricsSet *rkmidprom.MetricsSet
+
+	compressors map[string]*compressor
+}
+
+// newOptionSet Create new optionSet with options.
+func newOptionSet(opts ...Option) *optionSet {
+	set := &optionSet{
+		entryName:           "fake-entry",
+		entryType:           "",
+		pathToIgnore:        []string{},
+		encodings:           DefaultEncodings,
+		levels:              make(map[string]int),
+		minSize:             DefaultMinSize,
+		contentTypes:        DefaultContentTypes,
+		maxDecompressedSize: DefaultMaxDecompressedSize,
+		compressors:         make(map[string]*compressor),
+	}
+
+	for i := range opts {
+		opts[i](set)
+	}
+
+	for _, encoding := range set.encodings {
+		set.compressors[encoding] = newCompressor(encoding, set.levels[encoding])
+	}
+
+	set.metricsSet = rkmidprom.NewMetricsSet("rk", "compression", set.registerer)
+	// metrics may already be registered by another middleware with same registerer, ignore error
+	set.metricsSet.RegisterCounter(metricsNameResponses, "entryName", "entryType", "encoding")
+	set.metricsSet.RegisterCounter(metricsNameSavedBytes, "entryName", "entryType", "encoding")
+	set.metricsSet.RegisterCounter(metricsNameDecompressed, "entryName", "entryType", "encoding")
+
+	return set
+}
+
+// ShouldIgnore determine whether compression should be ignored based on path
+func (set *optionSet) ShouldIgnore(path string) bool {
+	for i := range set.pathToIgnore {
+		if strings.HasPrefix(path, set.pathToIgnore[i]) {
+			return true
+		}
+	}
+
+	return rkmid.ShouldIgnoreGlobal(path)
+}
+
+// isCompressible returns true if response with content type could be compressed
+func (set *optionSet) isCompressible(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	if len(mediaType) < 1 {
+		return false
+	}
+
+	for i := range excludedContentTypes {
+		if strings.HasPrefix(mediaType, excludedContentTypes[i]) && mediaType != "image/svg+xml" {
+			return false
+		}
+	}
+
+	for i := range set.contentTypes {
+		if strings.HasPrefix(mediaType, set.contentTypes[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// observe increases counter with value
+func (set *optionSet) observe(name, encoding string, value float64) {
+	if counter := set.metricsSet.GetCounterWithValues(name, set.entryName, set.entryType, encoding); counter != nil {
+		counter.Add(value)
+	}
+}
+
+// ***************** BootConfig *****************
+
+// BootConfig for YAML
+type BootConfig struct {
+	Enabled             bool           `yaml:"enabled" json:"enabled"`
+	Ignore              []string       `yaml:"ignore" json:"ignore"`
+	Encodings           []string       `yaml:"encodings" json:"encodings"`
+	Levels              map[string]int `yaml:"levels" json:"levels"`
+	MinSize             int            `yaml:"minSize" json:"minSize"`
+	ContentTypes        []string       `yaml:"contentTypes" json:"contentTypes"`
+	MaxDecompressedSize int            `yaml:"maxDecompressedSize" json:"maxDecompressedSize"`
+}
+
+// ToOptions convert BootConfig into Option list
+func ToOptions(config *BootConfig, entryName, entryType string, registerer prometheus.Registerer) []Option {
+	opts := make([]Option, 0)
+
+	if config.Enabled {
+		opts = append(opts,
+			WithEntryNameAndType(entryName, entryType),
+			WithPathToIgnore(config.Ignore...),
+			WithEncodings(config.Encodings...),
+			WithMinSize(config.MinSize),
+			WithContentTypes(config.ContentTypes...),
+			WithMaxDecompressedSize(config.MaxDecompressedSize),
+			WithRegisterer(registerer))
+
+		for encoding, level := range config.Levels {
+			opts = append(opts, WithLevel(encoding, level))
+		}
+	}
+
+	return opts
+}
+
+// ***************** Option *****************
+
+// Option if for middleware options while creating middleware
+type Option func(*optionSet)
+
+// WithEntryNameAndType provide entry name and entry type.
+func WithEntryNameAndType(entryName, entryType string) Option {
+	return func(opt *optionSet) {
+		opt.entryName = entryName
+		opt.entryType = entryType
+	}
+}
+
+// WithPathToIgnore provide paths prefix that will ignore.
+func WithPathToIgnore(paths ...string) Option {
+	return func(set *optionSet) {
+		for i := range paths {
+			if len(paths[i]) > 0 {
+				set.pathToIgnore = append(set.pathToIgnore, paths[i])
+			}
+		}
+	}
+}
+
+// WithEncodings provide supported content codings in order of preference, unknown ones are dropped.
+// Options: br, zstd, gzip, deflate, all of them would be supported by default.
+func WithEncodings(encodings ...string) Option {
+	return func(set *optionSet) {
+		res := make([]string, 0)
+		for i := range encodings {
+			encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+			switch encoding {
+			case EncodingBrotli, EncodingZstd, EncodingGzip, EncodingDeflate:
+				res = append(res, encoding)
+			}
+		}
+
+		if len(res) > 0 {
+			set.encodings = res
+		}
+	}
+}
+
+// WithLevel provide compression level of content coding, default level of each library would be used by default.
+//
+// Ranges: br 0-11, zstd 1-22, gzip and deflate 1-9.
+func WithLevel(encoding string, level int) Option {
+	return func(set *optionSet) {
+		if level > 0 {
+			set.levels[strings.ToLower(encoding)] = level
+		}
+	}
+}
+
+// WithMinSize provide min size of response body which is compressed, default is 1024 bytes.
+func WithMinSize(size int) Option {
+	return func(set *optionSet) {
+		if size > 0 {
+			set.minSize = size
+		}
+	}
+}
+
+// WithContentTypes provide prefixes of content types which are compressed, DefaultContentTypes would be used by default.
+// SSE and compressed content types like images are never compressed.
+func WithContentTypes(contentTypes ...string) Option {
+	return func(set *optionSet) {
+		res := make([]string, 0)
+		for i := range contentTypes {
+			if len(contentTypes[i]) > 0 {
+				res = append(res, strings.ToLower(contentTypes[i]))
+			}
+		}
+
+		if len(res) > 0 {
+			set.contentTypes = res
+		}
+	}
+}
+
+// WithMaxDecompressedSize provide max size of decompressed request body, default is 10MB.
+// Request exceeding it is rejected with 413.
+func WithMaxDecompressedSize(size int) Option {
+	return func(set *optionSet) {
+		if size > 0 {
+			set.maxDecompressedSize = size
+		}
+	}
+}
+
+// WithRegisterer provide prometheus.Registerer, prometheus.DefaultRegisterer would be used by default.
+func WithRegisterer(registerer prometheus.Registerer) Option {
+	return func(opt *optionSet) {
+		if registerer != nil {
+			opt.registerer = registerer
+		}
+	}
+}
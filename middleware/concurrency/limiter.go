@@ -0,0 +1,249 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberconcurrency
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// smoothing of limit changes in adaptive mode
+	adaptiveSmoothing = 0.2
+	// tolerance of latency increase before limit is reduced in adaptive mode
+	adaptiveTolerance = 1.5
+	// number of samples of long term latency average in adaptive mode
+	adaptiveWindow = 600
+)
+
+// waiter is a request waiting in queue, admission result is sent to ch
+type waiter struct {
+	class int
+	ch    chan bool
+}
+
+// limiter caps number of in-flight requests, requests exceeding limit wait in a bounded queue.
+//
+// Requests are classified with priority, class 0 is the highest one. Each class may occupy a share of limit,
+// waiters are ordered by class and FIFO within class, and a full queue evicts lower class waiter for higher one.
+//
+// In adaptive mode, limit is adjusted with gradient of latency, long term average latency is compared
+// with latest one, limit shrinks while latency grows and grows while latency is stable.
+type limiter struct {
+	lock     sync.Mutex
+	limit    float64
+	inFlight int
+	maxQueue int
+	waiters  *list.List
+
+	shares        []float64
+	classInFlight []int
+
+	adaptive bool
+	minLimit float64
+	maxLimit float64
+	longRtt  float64
+	samples  int
+
+	// observer is notified with limit, in-flight and queued requests on every change
+	observer func(limit, inFlight, queued int)
+}
+
+// newLimiter create limiter with initial limit and max queue size, all requests are in one class
+func newLimiter(limit, maxQueue int) *limiter {
+	return &limiter{
+		limit:         float64(limit),
+		maxQueue:      maxQueue,
+		waiters:       list.New(),
+		shares:        []float64{1},
+		classInFlight: []int{0},
+		minLimit:      float64(limit),
+		maxLimit:      float64(limit),
+	}
+}
+
+// withShares provide share of limit each class may occupy, index is class
+func (l *limiter) withShares(shares []float64) *limiter {
+	if len(shares) > 0 {
+		l.shares = shares
+		l.classInFlight = make([]int, len(shares))
+	}
+	return l
+}
+
+// withAdaptive enable adaptive mode which keeps limit in [minLimit, maxLimit]
+func (l *limiter) withAdaptive(minLimit, maxLimit int) *limiter {
+	l.adaptive = true
+	l.minLimit = math.Max(1, float64(minLimit))
+	l.maxLimit = math.Max(l.minLimit, float64(maxLimit))
+	l.limit = math.Min(math.Max(l.limit, l.minLimit), l.maxLimit)
+	return l
+}
+
+// acquire a slot for class, wait up to maxWait in queue if limit is reached.
+// Returns false if queue is full, wait timed out or evicted by higher class.
+func (l *limiter) acquire(class int, maxWait time.Duration) bool {
+	l.lock.Lock()
+	if l.admits(class) {
+		l.admit(class)
+		l.notify()
+		l.lock.Unlock()
+		return true
+	}
+
+	if maxWait <= 0 || !l.makeRoom(class) {
+		l.lock.Unlock()
+		return false
+	}
+
+	w := &waiter{class: class, ch: make(chan bool, 1)}
+	elem := l.enqueue(w)
+	l.notify()
+	l.lock.Unlock()
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+
+	select {
+	case ok := <-w.ch:
+		return ok
+	case <-timer.C:
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		// result may be sent right before timeout
+		select {
+		case ok := <-w.ch:
+			return ok
+		default:
+			l.waiters.Remove(elem)
+			l.notify()
+			return false
+		}
+	}
+}
+
+// release slot of class with latency of request, slot is handed over to waiters if any
+func (l *limiter) release(class int, rtt time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.adaptive {
+		l.update(rtt)
+	}
+
+	l.inFlight--
+	l.classInFlight[class]--
+	l.wake()
+	l.notify()
+}
+
+// admits returns true if class could be admitted immediately, caller must hold lock
+func (l *limiter) admits(class int) bool {
+	limit := l.currentLimit()
+	return l.inFlight < limit && float64(l.classInFlight[class]) < math.Max(1, l.shares[class]*float64(limit))
+}
+
+// admit occupies slot of class, caller must hold lock
+func (l *limiter) admit(class int) {
+	l.inFlight++
+	l.classInFlight[class]++
+}
+
+// makeRoom returns true if waiter of class could be queued, lowest class waiter is evicted
+// if queue is full and class is higher than it, caller must hold lock
+func (l *limiter) makeRoom(class int) bool {
+	if l.waiters.Len() < l.maxQueue {
+		return true
+	}
+
+	last := l.waiters.Back()
+	if last == nil || last.Value.(*waiter).class <= class {
+		return false
+	}
+
+	l.waiters.Remove(last)
+	last.Value.(*waiter).ch <- false
+	return true
+}
+
+// enqueue waiter after waiters with same or higher class, caller must hold lock
+func (l *limiter) enqueue(w *waiter) *list.Element {
+	for elem := l.waiters.Back(); elem != nil; elem = elem.Prev() {
+		if elem.Value.(*waiter).class <= w.class {
+			return l.waiters.InsertAfter(w, elem)
+		}
+	}
+
+	return l.waiters.PushFront(w)
+}
+
+// wake admits waiters in order while limit allows, caller must hold lock
+func (l *limiter) wake() {
+	for elem := l.waiters.Front(); elem != nil && l.inFlight < l.currentLimit(); {
+		next := elem.Next()
+		w := elem.Value.(*waiter)
+		if l.admits(w.class) {
+			l.waiters.Remove(elem)
+			l.admit(w.class)
+			w.ch <- true
+		}
+		elem = next
+	}
+}
+
+// update limit with latency sample, caller must hold lock
+func (l *limiter) update(rtt time.Duration) {
+	sample := rtt.Seconds()
+	if sample <= 0 {
+		return
+	}
+
+	// warm up with plain average, then exponential moving average
+	l.samples++
+	if l.samples <= 10 {
+		l.longRtt += (sample - l.longRtt) / float64(l.samples)
+	} else {
+		l.longRtt += (sample - l.longRtt) / adaptiveWindow
+	}
+
+	// drift long term latency down quickly once latency recovers
+	if l.longRtt/sample > 2 {
+		l.longRtt *= 0.95
+	}
+
+	// do not grow limit if it is not utilized
+	if float64(l.inFlight) < l.limit/2 {
+		return
+	}
+
+	gradient := math.Max(0.5, math.Min(1, adaptiveTolerance*l.longRtt/sample))
+	newLimit := l.limit*gradient + math.Sqrt(l.limit)
+	newLimit = l.limit*(1-adaptiveSmoothing) + newLimit*adaptiveSmoothing
+
+	l.limit = math.Min(math.Max(newLimit, l.minLimit), l.maxLimit)
+}
+
+// notify observer with current state, caller must hold lock
+func (l *limiter) notify() {
+	if l.observer != nil {
+		l.observer(l.currentLimit(), l.inFlight, l.waiters.Len())
+	}
+}
+
+// currentLimit returns limit as integer, caller must hold lock
+func (l *limiter) currentLimit() int {
+	return int(l.limit)
+}
+
+// stats returns limit, in-flight and queued requests
+func (l *limiter) stats() (limit, inFlight, queued int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.currentLimit(), l.inFlight, l.waiters.Len()
+}
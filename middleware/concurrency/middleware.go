@@ -0,0 +1,91 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+// Package rkfiberconcurrency is a middleware of fiber framework for limiting in-flight requests and shedding load
+package rkfiberconcurrency
+
+import (
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"net/http"
+	"time"
+)
+
+// Middleware limits in-flight requests of entry and route groups.
+//
+// Requests exceeding limit wait in queues up to max wait in total, then rejected with 503.
+// Route group limiter is acquired before entry limiter, so that a busy group would not hold slots of entry.
+//
+// Requests are classified with priority rules, lower classes are rejected first during overload.
+func Middleware(opts ...Option) fiber.Handler {
+	set := newOptionSet(opts...)
+
+	return func(ctx *fiber.Ctx) error {
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, set.entryName))
+
+		// request issued by middleware was already admitted as original request
+		if set.ShouldIgnore(ctx.Path()) || rkfiberctx.IsInternalRequest(ctx) {
+			return ctx.Next()
+		}
+
+		class := set.classify(ctx)
+		// time waited in group queue is deducted from max wait in entry queue
+		deadline := time.Now().Add(set.maxWait)
+		g := set.groupOf(ctx.Path())
+		if g != nil {
+			if !set.acquire(g.prefix, g.limiter, class, time.Until(deadline)) {
+				return set.reject(ctx, class)
+			}
+		}
+
+		if !set.acquire(groupEntry, set.entryLimiter, class, time.Until(deadline)) {
+			if g != nil {
+				g.limiter.release(class, 0)
+			}
+			return set.reject(ctx, class)
+		}
+
+		start := time.Now()
+		defer func() {
+			elapsed := time.Since(start)
+			set.entryLimiter.release(class, elapsed)
+			if g != nil {
+				g.limiter.release(class, elapsed)
+			}
+
+			if observer := set.metricsSet.GetHistogramWithValues(metricsNameClassLatency, set.entryName, set.entryType, set.classes[class].Name); observer != nil {
+				observer.Observe(elapsed.Seconds())
+			}
+		}()
+
+		return ctx.Next()
+	}
+}
+
+// acquire slot of limiter for class waiting up to maxWait, rejection of group is recorded
+func (set *optionSet) acquire(group string, l *limiter, class int, maxWait time.Duration) bool {
+	if l.acquire(class, maxWait) {
+		return true
+	}
+
+	if counter := set.metricsSet.GetCounterWithValues(metricsNameRejected, set.entryName, set.entryType, group); counter != nil {
+		counter.Inc()
+	}
+
+	return false
+}
+
+// reject request of class with 503
+func (set *optionSet) reject(ctx *fiber.Ctx, class int) error {
+	if counter := set.metricsSet.GetCounterWithValues(metricsNameClassRejected, set.entryName, set.entryType, set.classes[class].Name); counter != nil {
+		counter.Inc()
+	}
+
+	resp := rkmid.GetErrorBuilder().New(http.StatusServiceUnavailable, "server is overloaded")
+	ctx.Response().SetStatusCode(resp.Code())
+	return ctx.JSON(resp)
+}
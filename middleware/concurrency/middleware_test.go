@@ -0,0 +1,211 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberconcurrency
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newBlockingApp create app whose handlers block until release is closed
+func newBlockingApp(release chan struct{}, opts ...Option) *fiber.App {
+	app := fiber.New()
+	app.Use(Middleware(opts...))
+	handler := func(*fiber.Ctx) error {
+		<-release
+		return nil
+	}
+	app.Get("/ut-path", handler)
+	app.Get("/ut-group/ut-path", handler)
+	app.Get("/metrics", handler)
+	return app
+}
+
+// metricValue returns value of gauge or counter with single series
+func metricValue(t *testing.T, registry *prometheus.Registry, name string) float64 {
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		assert.Len(t, family.Metric, 1)
+		if gauge := family.Metric[0].GetGauge(); gauge != nil {
+			return gauge.GetValue()
+		}
+		return family.Metric[0].GetCounter().GetValue()
+	}
+	return -1
+}
+
+func send(t *testing.T, app *fiber.App, path string) int {
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil), -1)
+	assert.Nil(t, err)
+	return resp.StatusCode
+}
+
+// sendAsync sends requests in background and returns status codes once all of them returned
+func sendAsync(t *testing.T, app *fiber.App, path string, count int) func() []int {
+	wg := &sync.WaitGroup{}
+	res := make([]int, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res[i] = send(t, app, path)
+		}(i)
+	}
+
+	return func() []int {
+		wg.Wait()
+		return res
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	release := make(chan struct{})
+	app := newBlockingApp(release,
+		WithLimit(2),
+		WithMaxQueue(0),
+		WithRegisterer(registry))
+
+	wait := sendAsync(t, app, "/ut-path", 2)
+	time.Sleep(50 * time.Millisecond)
+
+	// limit reached
+	assert.Equal(t, http.StatusServiceUnavailable, send(t, app, "/ut-path"))
+	assert.Equal(t, float64(2), metricValue(t, registry, "rk_concurrency_in_flight"))
+	assert.Equal(t, float64(2), metricValue(t, registry, "rk_concurrency_limit"))
+	assert.Equal(t, float64(1), metricValue(t, registry, "rk_concurrency_rejected_total"))
+
+	// metrics paths are exempt
+	close(release)
+	assert.Equal(t, http.StatusOK, send(t, app, "/metrics"))
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK}, wait())
+	assert.Equal(t, http.StatusOK, send(t, app, "/ut-path"))
+}
+
+func TestMiddleware_Queue(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	release := make(chan struct{})
+	app := newBlockingApp(release,
+		WithLimit(1),
+		WithMaxQueue(1),
+		WithMaxWait(time.Second),
+		WithRegisterer(registry))
+
+	first := sendAsync(t, app, "/ut-path", 1)
+	time.Sleep(50 * time.Millisecond)
+	queued := sendAsync(t, app, "/ut-path", 1)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, float64(1), metricValue(t, registry, "rk_concurrency_queued"))
+
+	// queue is full
+	assert.Equal(t, http.StatusServiceUnavailable, send(t, app, "/ut-path"))
+
+	// queued request proceeds once slot is released
+	close(release)
+	assert.Equal(t, []int{http.StatusOK}, first())
+	assert.Equal(t, []int{http.StatusOK}, queued())
+}
+
+func TestMiddleware_QueueTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	app := newBlockingApp(release,
+		WithLimit(1),
+		WithMaxWait(20*time.Millisecond),
+		WithRegisterer(prometheus.NewRegistry()))
+
+	sendAsync(t, app, "/ut-path", 1)
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	assert.Equal(t, http.StatusServiceUnavailable, send(t, app, "/ut-path"))
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+}
+
+func TestMiddleware_Group(t *testing.T) {
+	release := make(chan struct{})
+	app := newBlockingApp(release,
+		WithLimit(10),
+		WithGroup("/ut-group", 1),
+		WithMaxQueue(0),
+		WithRegisterer(prometheus.NewRegistry()))
+
+	wait := sendAsync(t, app, "/ut-group/ut-path", 1)
+	time.Sleep(50 * time.Millisecond)
+
+	// group is full while entry is not
+	assert.Equal(t, http.StatusServiceUnavailable, send(t, app, "/ut-group/ut-path"))
+	other := sendAsync(t, app, "/ut-path", 1)
+
+	close(release)
+	assert.Equal(t, []int{http.StatusOK}, wait())
+	assert.Equal(t, []int{http.StatusOK}, other())
+}
+
+func TestLimiter_Adaptive(t *testing.T) {
+	l := newLimiter(100, 0).withAdaptive(10, 200)
+
+	// stable latency grows limit while it is utilized
+	for i := 0; i < 50; i++ {
+		l.inFlight, l.classInFlight[0] = l.currentLimit(), l.currentLimit()
+		l.release(0, 10*time.Millisecond)
+	}
+	limit, _, _ := l.stats()
+	assert.True(t, limit > 100)
+
+	// latency spike shrinks limit
+	for i := 0; i < 50; i++ {
+		l.inFlight, l.classInFlight[0] = l.currentLimit(), l.currentLimit()
+		l.release(0, 100*time.Millisecond)
+	}
+	limit, _, _ = l.stats()
+	assert.True(t, limit < 100)
+	assert.True(t, limit >= 10)
+}
+
+func TestToOptions(t *testing.T) {
+	// disabled
+	assert.Empty(t, ToOptions(&BootConfig{}, "ut-entry", "ut-type", nil))
+
+	// enabled
+	maxQueue, maxWaitMs := 0, 10
+	config := &BootConfig{
+		Enabled:   true,
+		Limit:     50,
+		MaxQueue:  &maxQueue,
+		MaxWaitMs: &maxWaitMs,
+	}
+	config.Groups = []GroupConfig{{Prefix: "/ut-group", Limit: 5}}
+	config.Adaptive.Enabled = true
+	config.Adaptive.MinLimit = 5
+	config.Priority.Enabled = true
+	config.Priority.Default = "normal"
+	config.Priority.Classes = []ClassConfig{{Name: "critical"}, {Name: "normal", MaxShare: 0.8}, {Name: "low", MaxShare: 0.5}}
+	config.Priority.Rules = []RuleConfig{{Class: "critical", Match: "path:/v1/checkout"}, {Class: "missing", Match: "path:/"}}
+
+	set := newOptionSet(ToOptions(config, "ut-entry", "ut-type", prometheus.NewRegistry())...)
+	assert.Equal(t, "ut-entry", set.entryName)
+	assert.Equal(t, 0, set.maxQueue)
+	assert.Equal(t, 10*time.Millisecond, set.maxWait)
+	assert.True(t, set.entryLimiter.adaptive)
+	assert.Equal(t, float64(50), set.entryLimiter.maxLimit)
+	assert.Equal(t, "/ut-group", set.groupOf("/ut-group/ut-path").prefix)
+	assert.Nil(t, set.groupOf("/ut-path"))
+	assert.Equal(t, []float64{1, 0.8, 0.5}, set.entryLimiter.shares)
+	assert.Equal(t, 1, set.defaultClass)
+	// rule with unknown class is dropped
+	assert.Len(t, set.rules, 1)
+}
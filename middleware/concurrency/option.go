@@ -0,0 +1,406 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberconcurrency
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-entry/v2/middleware/prom"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultLimit is max in-flight requests of entry
+	DefaultLimit = 1000
+	// DefaultMaxWait is max duration a request waits in queue
+	DefaultMaxWait = 100 * time.Millisecond
+
+	// groupEntry is group label of entry level limiter
+	groupEntry = "*"
+
+	metricsNameInFlight = "in_flight"
+	metricsNameQueued   = "queued"
+	metricsNameLimit    = "limit"
+	metricsNameRejected = "rejected_total"
+
+	metricsNameClassLatency  = "class_latency_seconds"
+	metricsNameClassRejected = "class_rejected_total"
+)
+
+// DefaultPathToIgnore are health and metrics paths with default config of common service and prom entry
+var DefaultPathToIgnore = []string{"/rk/v1/ready", "/rk/v1/alive", "/metrics"}
+
+// classLatencyBuckets are buckets of class latency histogram in seconds
+var classLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// ***************** OptionSet *****************
+
+// group is limiter of requests with path prefix
+type group struct {
+	prefix  string
+	limiter *limiter
+}
+
+// optionSet which is used for middleware implementation
+type optionSet struct {
+	entryName    string
+	entryType    string
+	pathToIgnore []string
+
+	limit    int
+	maxQueue int
+	maxWait  time.Duration
+	groups   map[string]int
+	adaptive bool
+	minLimit int
+	maxLimit int
+
+	classes          []Class
+	defaultClassName string
+	ruleSpecs        []ruleSpec
+
+	registerer prometheus.Registerer
+	metricsSet *rkmidprom.MetricsSet
+
+	entryLimiter  *limiter
+	groupLimiters []*group
+	rules         []rule
+	defaultClass  int
+}
+
+// ruleSpec is rule with class name, which is resolved after all options applied
+type ruleSpec struct {
+	className string
+	matcher   Matcher
+}
+
+// newOptionSet Create new optionSet with options.
+func newOptionSet(opts ...Option) *optionSet {
+	set := &optionSet{
+		entryName:    "fake-entry",
+		entryType:    "",
+		pathToIgnore: append([]string{}, DefaultPathToIgnore...),
+		limit:        DefaultLimit,
+		maxQueue:     -1,
+		maxWait:      DefaultMaxWait,
+		groups:       make(map[string]int),
+		classes:      []Class{{Name: DefaultClass, MaxShare: 1}},
+	}
+
+	for i := range opts {
+		opts[i](set)
+	}
+
+	// unmatched requests fall into lowest class unless provided
+	set.defaultClass = len(set.classes) - 1
+	if i := set.classIndex(set.defaultClassName); i >= 0 {
+		set.defaultClass = i
+	}
+
+	for i := range set.ruleSpecs {
+		if class := set.classIndex(set.ruleSpecs[i].className); class >= 0 {
+			set.rules = append(set.rules, rule{class: class, matcher: set.ruleSpecs[i].matcher})
+		}
+	}
+
+	set.metricsSet = rkmidprom.NewMetricsSet("rk", "concurrency", set.registerer)
+	// metrics may already be registered by another middleware with same registerer, ignore error
+	set.metricsSet.RegisterGauge(metricsNameInFlight, "entryName", "entryType", "group")
+	set.metricsSet.RegisterGauge(metricsNameQueued, "entryName", "entryType", "group")
+	set.metricsSet.RegisterGauge(metricsNameLimit, "entryName", "entryType", "group")
+	set.metricsSet.RegisterCounter(metricsNameRejected, "entryName", "entryType", "group")
+	set.metricsSet.RegisterHistogram(metricsNameClassLatency, classLatencyBuckets, "entryName", "entryType", "class")
+	set.metricsSet.RegisterCounter(metricsNameClassRejected, "entryName", "entryType", "class")
+
+	set.entryLimiter = set.newLimiter(groupEntry, set.limit)
+	for prefix, limit := range set.groups {
+		set.groupLimiters = append(set.groupLimiters, &group{
+			prefix:  prefix,
+			limiter: set.newLimiter(prefix, limit),
+		})
+	}
+	// longest prefix matches first
+	sort.Slice(set.groupLimiters, func(i, j int) bool {
+		return len(set.groupLimiters[i].prefix) > len(set.groupLimiters[j].prefix)
+	})
+
+	return set
+}
+
+// newLimiter create limiter of group with limit, queue size equals to limit unless provided
+func (set *optionSet) newLimiter(group string, limit int) *limiter {
+	maxQueue := set.maxQueue
+	if maxQueue < 0 {
+		maxQueue = limit
+	}
+
+	res := newLimiter(limit, maxQueue).withShares(set.shares())
+	if set.adaptive {
+		minLimit, maxLimit := set.minLimit, set.maxLimit
+		if minLimit < 1 {
+			minLimit = 1
+		}
+		if maxLimit < 1 {
+			maxLimit = limit
+		}
+		res.withAdaptive(minLimit, maxLimit)
+	}
+
+	inFlightGauge := set.metricsSet.GetGaugeWithValues(metricsNameInFlight, set.entryName, set.entryType, group)
+	queuedGauge := set.metricsSet.GetGaugeWithValues(metricsNameQueued, set.entryName, set.entryType, group)
+	limitGauge := set.metricsSet.GetGaugeWithValues(metricsNameLimit, set.entryName, set.entryType, group)
+	res.observer = func(limit, inFlight, queued int) {
+		if inFlightGauge != nil {
+			inFlightGauge.Set(float64(inFlight))
+		}
+		if queuedGauge != nil {
+			queuedGauge.Set(float64(queued))
+		}
+		if limitGauge != nil {
+			limitGauge.Set(float64(limit))
+		}
+	}
+	res.notify()
+
+	return res
+}
+
+// groupOf returns limiter of route group which path belongs to, nil if none
+func (set *optionSet) groupOf(path string) *group {
+	for i := range set.groupLimiters {
+		if strings.HasPrefix(path, set.groupLimiters[i].prefix) {
+			return set.groupLimiters[i]
+		}
+	}
+
+	return nil
+}
+
+// ShouldIgnore determine whether concurrency limit should be ignored based on path
+func (set *optionSet) ShouldIgnore(path string) bool {
+	for i := range set.pathToIgnore {
+		if strings.HasPrefix(path, set.pathToIgnore[i]) {
+			return true
+		}
+	}
+
+	return rkmid.ShouldIgnoreGlobal(path)
+}
+
+// ***************** BootConfig *****************
+
+// BootConfig for YAML
+type BootConfig struct {
+	Enabled   bool          `yaml:"enabled" json:"enabled"`
+	Ignore    []string      `yaml:"ignore" json:"ignore"`
+	Limit     int           `yaml:"limit" json:"limit"`
+	MaxQueue  *int          `yaml:"maxQueue" json:"maxQueue"`
+	MaxWaitMs *int          `yaml:"maxWaitMs" json:"maxWaitMs"`
+	Groups    []GroupConfig `yaml:"groups" json:"groups"`
+	Adaptive  struct {
+		Enabled  bool `yaml:"enabled" json:"enabled"`
+		MinLimit int  `yaml:"minLimit" json:"minLimit"`
+		MaxLimit int  `yaml:"maxLimit" json:"maxLimit"`
+	} `yaml:"adaptive" json:"adaptive"`
+	Priority struct {
+		Enabled bool          `yaml:"enabled" json:"enabled"`
+		Default string        `yaml:"default" json:"default"`
+		Classes []ClassConfig `yaml:"classes" json:"classes"`
+		Rules   []RuleConfig  `yaml:"rules" json:"rules"`
+	} `yaml:"priority" json:"priority"`
+}
+
+// ClassConfig for YAML, priority class, classes are ordered from highest priority to lowest
+type ClassConfig struct {
+	Name     string  `yaml:"name" json:"name"`
+	MaxShare float64 `yaml:"maxShare" json:"maxShare"`
+}
+
+// RuleConfig for YAML, assign class to requests matching lookup scheme
+type RuleConfig struct {
+	Class string `yaml:"class" json:"class"`
+	Match string `yaml:"match" json:"match"`
+}
+
+// GroupConfig for YAML, limit of route group with path prefix
+type GroupConfig struct {
+	Prefix string `yaml:"prefix" json:"prefix"`
+	Limit  int    `yaml:"limit" json:"limit"`
+}
+
+// ToOptions convert BootConfig into Option list
+func ToOptions(config *BootConfig, entryName, entryType string, registerer prometheus.Registerer) []Option {
+	opts := make([]Option, 0)
+
+	if config.Enabled {
+		opts = append(opts,
+			WithEntryNameAndType(entryName, entryType),
+			WithPathToIgnore(config.Ignore...),
+			WithLimit(config.Limit),
+			WithRegisterer(registerer))
+
+		if config.MaxQueue != nil {
+			opts = append(opts, WithMaxQueue(*config.MaxQueue))
+		}
+
+		if config.MaxWaitMs != nil {
+			opts = append(opts, WithMaxWait(time.Duration(*config.MaxWaitMs)*time.Millisecond))
+		}
+
+		for i := range config.Groups {
+			opts = append(opts, WithGroup(config.Groups[i].Prefix, config.Groups[i].Limit))
+		}
+
+		if config.Adaptive.Enabled {
+			opts = append(opts, WithAdaptive(config.Adaptive.MinLimit, config.Adaptive.MaxLimit))
+		}
+
+		if config.Priority.Enabled {
+			classes := make([]Class, 0)
+			for _, e := range config.Priority.Classes {
+				classes = append(classes, Class{Name: e.Name, MaxShare: e.MaxShare})
+			}
+			opts = append(opts, WithClasses(classes...), WithDefaultClass(config.Priority.Default))
+
+			for _, e := range config.Priority.Rules {
+				opts = append(opts, WithClassRule(e.Class, MatcherFromLookup(e.Match)))
+			}
+		}
+	}
+
+	return opts
+}
+
+// RequiresJwt returns true if priority rules of config match jwt claims, middleware must be placed after jwt
+// middleware in that case since claims are read from token validated by it.
+func RequiresJwt(config *BootConfig) bool {
+	if !config.Enabled || !config.Priority.Enabled {
+		return false
+	}
+
+	for _, e := range config.Priority.Rules {
+		if strings.HasPrefix(strings.TrimSpace(e.Match), MatchJwt+":") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ***************** Option *****************
+
+// Option if for middleware options while creating middleware
+type Option func(*optionSet)
+
+// WithEntryNameAndType provide entry name and entry type.
+func WithEntryNameAndType(entryName, entryType string) Option {
+	return func(opt *optionSet) {
+		opt.entryName = entryName
+		opt.entryType = entryType
+	}
+}
+
+// WithPathToIgnore provide paths prefix that will ignore.
+func WithPathToIgnore(paths ...string) Option {
+	return func(set *optionSet) {
+		for i := range paths {
+			if len(paths[i]) > 0 {
+				set.pathToIgnore = append(set.pathToIgnore, paths[i])
+			}
+		}
+	}
+}
+
+// WithLimit provide max in-flight requests of entry, default is 1000.
+func WithLimit(limit int) Option {
+	return func(opt *optionSet) {
+		if limit > 0 {
+			opt.limit = limit
+		}
+	}
+}
+
+// WithMaxQueue provide max requests waiting in queue of every limiter, default equals to limit.
+// Zero rejects requests immediately once limit is reached.
+func WithMaxQueue(size int) Option {
+	return func(opt *optionSet) {
+		if size >= 0 {
+			opt.maxQueue = size
+		}
+	}
+}
+
+// WithMaxWait provide max duration a request waits in queue, default is 100ms.
+// Zero rejects requests immediately once limit is reached.
+func WithMaxWait(wait time.Duration) Option {
+	return func(opt *optionSet) {
+		if wait >= 0 {
+			opt.maxWait = wait
+		}
+	}
+}
+
+// WithGroup provide max in-flight requests of route group with path prefix.
+func WithGroup(prefix string, limit int) Option {
+	return func(opt *optionSet) {
+		if len(prefix) > 0 && limit > 0 {
+			opt.groups[prefix] = limit
+		}
+	}
+}
+
+// WithAdaptive adjust limits from observed latency, limit would stay in [minLimit, maxLimit].
+// Configured limit is the initial one, maxLimit defaults to configured limit.
+func WithAdaptive(minLimit, maxLimit int) Option {
+	return func(opt *optionSet) {
+		opt.adaptive = true
+		opt.minLimit = minLimit
+		opt.maxLimit = maxLimit
+	}
+}
+
+// WithClasses provide priority classes ordered from highest priority to lowest.
+func WithClasses(classes ...Class) Option {
+	return func(opt *optionSet) {
+		res := make([]Class, 0)
+		for i := range classes {
+			if len(classes[i].Name) > 0 {
+				res = append(res, classes[i])
+			}
+		}
+
+		if len(res) > 0 {
+			opt.classes = res
+		}
+	}
+}
+
+// WithDefaultClass provide class of requests matching no rule, lowest class would be used by default.
+func WithDefaultClass(name string) Option {
+	return func(opt *optionSet) {
+		opt.defaultClassName = name
+	}
+}
+
+// WithClassRule assign class to requests matching, rules are evaluated in order and first match wins.
+func WithClassRule(class string, matcher Matcher) Option {
+	return func(opt *optionSet) {
+		if len(class) > 0 && matcher != nil {
+			opt.ruleSpecs = append(opt.ruleSpecs, ruleSpec{className: class, matcher: matcher})
+		}
+	}
+}
+
+// WithRegisterer provide prometheus.Registerer, prometheus.DefaultRegisterer would be used by default.
+func WithRegisterer(registerer prometheus.Registerer) Option {
+	return func(opt *optionSet) {
+		if registerer != nil {
+			opt.registerer = registerer
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberconcurrency
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"strings"
+)
+
+const (
+	// MatchPath matches requests with path prefix, format: path:<prefix>
+	MatchPath = "path"
+	// MatchHeader matches requests with header, format: header:<name> or header:<name>=<value>
+	MatchHeader = "header"
+	// MatchJwt matches requests with claim of jwt token validated by jwt middleware, format: jwt:<claim> or jwt:<claim>=<value>
+	MatchJwt = "jwt"
+
+	// DefaultClass is class of requests when priority is disabled
+	DefaultClass = "default"
+)
+
+// Class is a priority class, classes are ordered from highest priority to lowest.
+//
+// MaxShare is share of limit in (0, 1] requests of class may occupy, lower classes with smaller share
+// are rejected first while higher classes still have headroom.
+type Class struct {
+	Name     string
+	MaxShare float64
+}
+
+// Matcher returns true if request matches
+type Matcher func(ctx *fiber.Ctx) bool
+
+// rule assigns class to requests matching
+type rule struct {
+	class   int
+	matcher Matcher
+}
+
+// MatcherFromLookup create Matcher from lookup scheme.
+//
+// Possible values:
+// - "path:<prefix>"
+// - "header:<name>" or "header:<name>=<value>"
+// - "jwt:<claim>" or "jwt:<claim>=<value>"
+//
+// Unknown scheme matches nothing.
+func MatcherFromLookup(lookup string) Matcher {
+	parts := strings.SplitN(strings.TrimSpace(lookup), ":", 2)
+	if len(parts) < 2 || len(strings.TrimSpace(parts[1])) < 1 {
+		return func(*fiber.Ctx) bool {
+			return false
+		}
+	}
+
+	scheme, name := parts[0], strings.TrimSpace(parts[1])
+	value, hasValue := "", false
+	if scheme != MatchPath {
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value, hasValue = strings.TrimSpace(name[:i]), strings.TrimSpace(name[i+1:]), true
+		}
+	}
+
+	equals := func(v string) bool {
+		if hasValue {
+			return v == value
+		}
+		return len(v) > 0
+	}
+
+	switch scheme {
+	case MatchPath:
+		return func(ctx *fiber.Ctx) bool {
+			return strings.HasPrefix(ctx.Path(), name)
+		}
+	case MatchHeader:
+		return func(ctx *fiber.Ctx) bool {
+			return equals(ctx.Get(name))
+		}
+	case MatchJwt:
+		return func(ctx *fiber.Ctx) bool {
+			token := rkfiberctx.GetJwtToken(ctx)
+			if token == nil {
+				return false
+			}
+			if claims, ok := token.Claims.(jwt.MapClaims); ok && claims[name] != nil {
+				return equals(fmt.Sprintf("%v", claims[name]))
+			}
+			return false
+		}
+	default:
+		return func(*fiber.Ctx) bool {
+			return false
+		}
+	}
+}
+
+// classify returns class of request, first matched rule wins
+func (set *optionSet) classify(ctx *fiber.Ctx) int {
+	for i := range set.rules {
+		if set.rules[i].matcher(ctx) {
+			return set.rules[i].class
+		}
+	}
+
+	return set.defaultClass
+}
+
+// classIndex returns index of class with name, -1 if missing
+func (set *optionSet) classIndex(name string) int {
+	for i := range set.classes {
+		if set.classes[i].Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// shares returns max share of every class
+func (set *optionSet) shares() []float64 {
+	res := make([]float64, len(set.classes))
+	for i := range set.classes {
+		res[i] = set.classes[i].MaxShare
+		if res[i] <= 0 || res[i] > 1 {
+			res[i] = 1
+		}
+	}
+
+	return res
+}
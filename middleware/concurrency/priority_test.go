@@ -0,0 +1,144 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberconcurrency
+
+import (
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMiddleware_Priority(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	release := make(chan struct{})
+	app := newBlockingApp(release,
+		WithLimit(4),
+		WithMaxQueue(0),
+		WithClasses(Class{Name: "critical"}, Class{Name: "low", MaxShare: 0.5}),
+		WithClassRule("critical", MatcherFromLookup("path:/ut-group")),
+		WithRegisterer(registry))
+
+	// low class occupies half of limit at most
+	low := sendAsync(t, app, "/ut-path", 2)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, http.StatusServiceUnavailable, send(t, app, "/ut-path"))
+
+	// critical class still has headroom
+	critical := sendAsync(t, app, "/ut-group/ut-path", 2)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, http.StatusServiceUnavailable, send(t, app, "/ut-group/ut-path"))
+
+	close(release)
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK}, low())
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK}, critical())
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	series := make(map[string]int)
+	for _, family := range families {
+		series[family.GetName()] = len(family.Metric)
+	}
+	assert.Equal(t, 2, series["rk_concurrency_class_latency_seconds"])
+	assert.Equal(t, 2, series["rk_concurrency_class_rejected_total"])
+}
+
+func TestLimiter_Priority(t *testing.T) {
+	l := newLimiter(1, 1).withShares([]float64{1, 1})
+	assert.True(t, l.acquire(1, time.Second))
+
+	// low class waiter is evicted by critical one once queue is full
+	lowRes := make(chan bool)
+	go func() {
+		lowRes <- l.acquire(1, time.Second)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	criticalRes := make(chan bool)
+	go func() {
+		criticalRes <- l.acquire(0, time.Second)
+	}()
+	assert.False(t, <-lowRes)
+
+	// low class could not evict critical one
+	assert.False(t, l.acquire(1, time.Second))
+
+	l.release(1, 0)
+	assert.True(t, <-criticalRes)
+	_, inFlight, queued := l.stats()
+	assert.Equal(t, 1, inFlight)
+	assert.Equal(t, 0, queued)
+}
+
+func TestLimiter_QueueOrder(t *testing.T) {
+	l := newLimiter(1, 10).withShares([]float64{1, 1})
+	assert.True(t, l.acquire(0, time.Second))
+
+	order := make(chan int, 3)
+	for _, class := range []int{1, 1, 0} {
+		go func(class int) {
+			if l.acquire(class, time.Second) {
+				order <- class
+				l.release(class, 0)
+			}
+		}(class)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// higher class is admitted first
+	l.release(0, 0)
+	assert.Equal(t, 0, <-order)
+	assert.Equal(t, 1, <-order)
+	assert.Equal(t, 1, <-order)
+}
+
+func TestMatcherFromLookup(t *testing.T) {
+	app := fiber.New()
+	reqCtx := &fasthttp.RequestCtx{}
+	reqCtx.Request.SetRequestURI("/v1/checkout/pay")
+	ctx := app.AcquireCtx(reqCtx)
+	defer app.ReleaseCtx(ctx)
+
+	ctx.Request().Header.Set("X-Batch", "true")
+
+	assert.True(t, MatcherFromLookup("path:/v1/checkout")(ctx))
+	assert.False(t, MatcherFromLookup("path:/v1/export")(ctx))
+	assert.True(t, MatcherFromLookup("header:X-Batch")(ctx))
+	assert.True(t, MatcherFromLookup("header:X-Batch=true")(ctx))
+	assert.False(t, MatcherFromLookup("header:X-Batch=false")(ctx))
+	assert.False(t, MatcherFromLookup("header:X-Missing")(ctx))
+	assert.False(t, MatcherFromLookup("unknown:value")(ctx))
+	assert.False(t, MatcherFromLookup("path")(ctx))
+
+	// without jwt token
+	assert.False(t, MatcherFromLookup("jwt:sub")(ctx))
+
+	// with jwt token
+	ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.JwtTokenKey,
+		&jwt.Token{Claims: jwt.MapClaims{"sub": "ut-user", "plan": "premium"}}))
+	assert.True(t, MatcherFromLookup("jwt:sub")(ctx))
+	assert.True(t, MatcherFromLookup("jwt:plan=premium")(ctx))
+	assert.False(t, MatcherFromLookup("jwt:plan=free")(ctx))
+}
+
+func TestRequiresJwt(t *testing.T) {
+	config := &BootConfig{Enabled: true}
+	config.Priority.Enabled = true
+	config.Priority.Rules = []RuleConfig{{Class: "batch", Match: "header:X-Batch"}}
+	assert.False(t, RequiresJwt(config))
+
+	config.Priority.Rules = append(config.Priority.Rules, RuleConfig{Class: "premium", Match: " jwt:plan=premium"})
+	assert.True(t, RequiresJwt(config))
+
+	config.Priority.Enabled = false
+	assert.False(t, RequiresJwt(config))
+}
@@ -0,0 +1,332 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberctx
+
+import (
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-logger"
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderTimeoutMs is header of remaining time of incoming request in milliseconds, sent to outbound requests
+	// if user context has deadline
+	HeaderTimeoutMs = "X-Timeout-Ms"
+
+	// resCodeError is resCode label of outbound requests which failed without response
+	resCodeError = "error"
+)
+
+// attribute keys of OpenTelemetry HTTP client semantic conventions
+const (
+	attrMethod        = attribute.Key("http.request.method")
+	attrStatusCode    = attribute.Key("http.response.status_code")
+	attrServerAddress = attribute.Key("server.address")
+	attrServerPort    = attribute.Key("server.port")
+	attrUrlFull       = attribute.Key("url.full")
+	attrErrorType     = attribute.Key("error.type")
+)
+
+var (
+	defaultPropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	defaultFastClient = &fasthttp.Client{}
+
+	// durations of outbound requests by prometheus.Registerer
+	clientDurations sync.Map
+)
+
+// HTTPClient returns http.Client which sends requests on behalf of incoming request.
+//
+// Trace context, baggage and request id of incoming request are propagated to outbound requests, and outbound
+// requests are bound by deadline of user context whose remaining time is sent with HeaderTimeoutMs.
+// Every request is recorded as client span, latency is recorded in rk_http_client_request_duration_seconds of
+// registerer of prom middleware, and failures are logged with logger returned by GetLogger.
+//
+// Values of ctx are captured while creating, client could be used by goroutines of handler until handler returned.
+func HTTPClient(ctx *fiber.Ctx) *http.Client {
+	return &http.Client{
+		Transport: WrapTransport(ctx, http.DefaultTransport),
+	}
+}
+
+// WrapTransport wraps http.RoundTripper as same as transport of HTTPClient, http.DefaultTransport would be used if
+// base is nil.
+func WrapTransport(ctx *fiber.Ctx, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &transport{
+		base:     base,
+		outbound: newOutbound(ctx),
+	}
+}
+
+// FastHTTPClient returns client which sends fasthttp requests on behalf of incoming request as same as HTTPClient.
+func FastHTTPClient(ctx *fiber.Ctx) *FastClient {
+	return &FastClient{
+		Client:   defaultFastClient,
+		outbound: newOutbound(ctx),
+	}
+}
+
+// FastClient sends fasthttp requests with trace context, baggage, request id and deadline of incoming request.
+type FastClient struct {
+	// Client sends requests, a shared fasthttp.Client is used by default
+	Client *fasthttp.Client
+
+	outbound *outbound
+}
+
+// Do send request and wait for response, request is bound by deadline of user context if exists.
+func (c *FastClient) Do(req *fasthttp.Request, resp *fasthttp.Response) error {
+	client := c.Client
+	if client == nil {
+		client = defaultFastClient
+	}
+
+	uri := req.URI()
+	method := string(req.Header.Method())
+	host := string(uri.Host())
+	span, startTime := c.outbound.start(method, string(uri.Scheme()), host, string(uri.Path()),
+		&fastHeaderCarrier{header: &req.Header})
+
+	var err error
+	if deadline, ok := c.outbound.ctx.Deadline(); ok {
+		err = client.DoDeadline(req, resp, deadline)
+	} else {
+		err = client.Do(req, resp)
+	}
+
+	c.outbound.finish(span, startTime, method, host, resp.StatusCode(), err)
+	return err
+}
+
+// transport is http.RoundTripper of HTTPClient
+type transport struct {
+	base     http.RoundTripper
+	outbound *outbound
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqCtx, cancel := req.Context(), context.CancelFunc(nil)
+	if deadline, ok := t.outbound.ctx.Deadline(); ok {
+		reqCtx, cancel = context.WithDeadline(reqCtx, deadline)
+	}
+
+	// request must not be modified by RoundTripper
+	req = req.Clone(reqCtx)
+	span, startTime := t.outbound.start(req.Method, req.URL.Scheme, req.URL.Host, req.URL.Path,
+		propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.base.RoundTrip(req)
+
+	code := 0
+	if resp != nil {
+		code = resp.StatusCode
+	}
+	t.outbound.finish(span, startTime, req.Method, req.URL.Host, code, err)
+
+	if cancel != nil {
+		if err != nil {
+			cancel()
+		} else {
+			resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+		}
+	}
+
+	return resp, err
+}
+
+// cancelBody cancels context of request once body closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer
+func (body *cancelBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+// fastHeaderCarrier is propagation.TextMapCarrier of fasthttp.RequestHeader
+type fastHeaderCarrier struct {
+	header *fasthttp.RequestHeader
+}
+
+// Get implements propagation.TextMapCarrier
+func (c *fastHeaderCarrier) Get(key string) string {
+	return string(c.header.Peek(key))
+}
+
+// Set implements propagation.TextMapCarrier
+func (c *fastHeaderCarrier) Set(key, value string) {
+	c.header.Set(key, value)
+}
+
+// Keys implements propagation.TextMapCarrier
+func (c *fastHeaderCarrier) Keys() []string {
+	res := make([]string, 0)
+	c.header.VisitAll(func(k, _ []byte) {
+		res = append(res, string(k))
+	})
+	return res
+}
+
+// outbound keeps values of incoming request used by outbound requests
+type outbound struct {
+	ctx        context.Context
+	entryName  string
+	requestId  string
+	logger     *zap.Logger
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	duration   *prometheus.HistogramVec
+}
+
+// newOutbound captures values of ctx, since fiber.Ctx is reused after request
+func newOutbound(ctx *fiber.Ctx) *outbound {
+	res := &outbound{
+		ctx:        context.Background(),
+		logger:     rklogger.NoopLogger,
+		tracer:     GetTracer(ctx),
+		propagator: GetTracerPropagator(ctx),
+	}
+
+	if ctx != nil {
+		res.ctx = ctx.UserContext()
+		res.entryName = GetEntryName(ctx)
+		res.requestId = GetRequestId(ctx)
+		res.logger = GetLogger(ctx)
+	}
+
+	if res.propagator == nil {
+		res.propagator = defaultPropagator
+	}
+
+	res.duration = clientDuration(GetPromRegisterer(ctx))
+
+	return res
+}
+
+// start client span, and inject trace context, baggage, request id and remaining time into carrier
+func (o *outbound) start(method, scheme, host, path string, carrier propagation.TextMapCarrier) (trace.Span, time.Time) {
+	attrs := []attribute.KeyValue{
+		attrMethod.String(method),
+		attrUrlFull.String(scheme + "://" + host + path),
+	}
+	if hostname, port, err := net.SplitHostPort(host); err == nil {
+		attrs = append(attrs, attrServerAddress.String(hostname))
+		if v, err := strconv.Atoi(port); err == nil {
+			attrs = append(attrs, attrServerPort.Int(v))
+		}
+	} else {
+		attrs = append(attrs, attrServerAddress.String(host))
+	}
+
+	spanCtx, span := o.tracer.Start(o.ctx, method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+
+	o.propagator.Inject(spanCtx, carrier)
+
+	if len(o.requestId) > 0 && len(carrier.Get(rkmid.HeaderRequestId)) < 1 {
+		carrier.Set(rkmid.HeaderRequestId, o.requestId)
+	}
+
+	if deadline, ok := o.ctx.Deadline(); ok {
+		remaining := time.Until(deadline).Milliseconds()
+		if remaining < 0 {
+			remaining = 0
+		}
+		carrier.Set(HeaderTimeoutMs, strconv.FormatInt(remaining, 10))
+	}
+
+	return span, time.Now()
+}
+
+// finish ends client span, records latency and logs failure
+func (o *outbound) finish(span trace.Span, startTime time.Time, method, host string, code int, err error) {
+	elapsed := time.Since(startTime)
+
+	resCode := resCodeError
+	if err == nil {
+		resCode = strconv.Itoa(code)
+		span.SetAttributes(attrStatusCode.Int(code))
+	}
+
+	if o.duration != nil {
+		if observer, e := o.duration.GetMetricWithLabelValues(o.entryName, method, host, resCode); e == nil {
+			observer.Observe(elapsed.Seconds())
+		}
+	}
+
+	// client spans are failed with 4xx and 5xx
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetAttributes(attrErrorType.String(resCodeError))
+		span.SetStatus(otelcodes.Error, err.Error())
+	case code >= http.StatusBadRequest:
+		span.SetAttributes(attrErrorType.String(resCode))
+		span.SetStatus(otelcodes.Error, http.StatusText(code))
+	}
+	span.End()
+
+	if err != nil || code >= http.StatusInternalServerError {
+		o.logger.Warn("Outbound request failed",
+			zap.String("method", method),
+			zap.String("host", host),
+			zap.String("resCode", resCode),
+			zap.Duration("elapsed", elapsed),
+			zap.Error(err))
+	}
+}
+
+// clientDuration returns latency histogram of outbound requests registered in registerer, nil on failure
+func clientDuration(registerer prometheus.Registerer) *prometheus.HistogramVec {
+	if raw, ok := clientDurations.Load(registerer); ok {
+		return raw.(*prometheus.HistogramVec)
+	}
+
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "rk",
+		Subsystem: "http_client",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of outbound HTTP requests in seconds.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"entryName", "restMethod", "host", "resCode"})
+
+	if err := registerer.Register(vec); err != nil {
+		exist, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil
+		}
+		if vec, ok = exist.ExistingCollector.(*prometheus.HistogramVec); !ok {
+			return nil
+		}
+	}
+
+	raw, _ := clientDurations.LoadOrStore(registerer, vec)
+	return raw.(*prometheus.HistogramVec)
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberctx
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	rkmid "github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// downstream is a server which keeps headers of last request and responds with status of path
+func downstream() (*httptest.Server, chan http.Header) {
+	headers := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		if r.URL.Path == "/ut-fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	return server, headers
+}
+
+// outboundFixture keeps clients created with incoming request and observers of them
+type outboundFixture struct {
+	client     *http.Client
+	fastClient *FastClient
+	serverSpan trace.Span
+	recorder   *tracetest.SpanRecorder
+	logs       *observer.ObservedLogs
+	registry   *prometheus.Registry
+	cancel     context.CancelFunc
+}
+
+// newOutboundFixture create clients with incoming request which has tracer, request id, deadline, baggage,
+// logger and registry
+func newOutboundFixture(t *testing.T) *outboundFixture {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	core, logs := observer.New(zap.WarnLevel)
+	registry := prometheus.NewRegistry()
+
+	ctx, _ := newCtx()
+	parent, span := provider.Tracer("ut-tracer").Start(context.Background(), "ut-server")
+	deadline, cancel := context.WithTimeout(parent, time.Minute)
+	ctx.SetUserContext(deadline)
+	ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, "ut-entry"))
+	ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.TracerKey, provider.Tracer("ut-tracer")))
+	ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.PropagatorKey, defaultPropagator))
+	ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.LoggerKey, zap.New(core)))
+	ctx.SetUserContext(context.WithValue(ctx.UserContext(), PromRegistererKey, registry))
+	ctx.Response().Header.Set(rkmid.HeaderRequestId, "ut-request-id")
+	assert.Nil(t, SetBaggage(ctx, "tenant", "acme"))
+
+	return &outboundFixture{
+		client:     HTTPClient(ctx),
+		fastClient: FastHTTPClient(ctx),
+		serverSpan: span,
+		recorder:   recorder,
+		logs:       logs,
+		registry:   registry,
+		cancel:     cancel,
+	}
+}
+
+// assertPropagated asserts headers of outbound request
+func assertPropagated(t *testing.T, serverSpan trace.Span, headers http.Header) {
+	assert.Equal(t, "ut-request-id", headers.Get(rkmid.HeaderRequestId))
+	assert.Equal(t, "tenant=acme", headers.Get("baggage"))
+	assert.Contains(t, headers.Get("traceparent"), serverSpan.SpanContext().TraceID().String())
+
+	remaining, err := strconv.Atoi(headers.Get(HeaderTimeoutMs))
+	assert.Nil(t, err)
+	assert.True(t, remaining > 0 && remaining <= 60000)
+}
+
+// durationCount returns number of latency observations by resCode
+func durationCount(t *testing.T, registry *prometheus.Registry) map[string]uint64 {
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+
+	res := make(map[string]uint64)
+	for _, family := range families {
+		if family.GetName() != "rk_http_client_request_duration_seconds" {
+			continue
+		}
+		for _, m := range family.Metric {
+			for _, pair := range m.Label {
+				if pair.GetName() == "resCode" {
+					res[pair.GetValue()] += m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return res
+}
+
+func TestHTTPClient(t *testing.T) {
+	server, headers := downstream()
+	defer server.Close()
+
+	f := newOutboundFixture(t)
+	defer f.cancel()
+
+	// happy case
+	resp, err := f.client.Get(server.URL + "/ut-ok")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+	assertPropagated(t, f.serverSpan, <-headers)
+
+	// request id provided by caller is kept
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/ut-ok", nil)
+	req.Header.Set(rkmid.HeaderRequestId, "ut-own-id")
+	resp, err = f.client.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "ut-own-id", (<-headers).Get(rkmid.HeaderRequestId))
+	assert.Empty(t, req.Header.Get("traceparent"))
+
+	// failure is logged
+	resp, err = f.client.Get(server.URL + "/ut-fail")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	<-headers
+	_, err = f.client.Get("http://127.0.0.1:1/ut-refused")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, 2, f.logs.Len())
+	assert.Equal(t, "503", f.logs.All()[0].ContextMap()["resCode"])
+	assert.Equal(t, "ut-request-id", f.logs.All()[0].ContextMap()["requestId"])
+	assert.Equal(t, "error", f.logs.All()[1].ContextMap()["resCode"])
+
+	// client spans are children of server span
+	spans := f.recorder.Ended()
+	assert.Len(t, spans, 4)
+	for i := range spans {
+		assert.Equal(t, trace.SpanKindClient, spans[i].SpanKind())
+		assert.Equal(t, f.serverSpan.SpanContext().SpanID(), spans[i].Parent().SpanID())
+	}
+	assert.Equal(t, http.MethodGet, spans[0].Name())
+	assert.Equal(t, otelcodes.Unset, spans[0].Status().Code)
+	assert.Equal(t, otelcodes.Error, spans[2].Status().Code)
+	assert.Equal(t, otelcodes.Error, spans[3].Status().Code)
+
+	assert.Equal(t, map[string]uint64{"200": 2, "503": 1, "error": 1}, durationCount(t, f.registry))
+}
+
+func TestHTTPClient_Deadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	ctx, _ := newCtx()
+	deadline, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ctx.SetUserContext(deadline)
+
+	startTime := time.Now()
+	_, err := HTTPClient(ctx).Get(server.URL)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(startTime) < time.Second)
+}
+
+func TestFastHTTPClient(t *testing.T) {
+	server, headers := downstream()
+	defer server.Close()
+
+	f := newOutboundFixture(t)
+	defer f.cancel()
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(server.URL + "/ut-ok")
+	assert.Nil(t, f.fastClient.Do(req, resp))
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assertPropagated(t, f.serverSpan, <-headers)
+
+	req.SetRequestURI(server.URL + "/ut-fail")
+	assert.Nil(t, f.fastClient.Do(req, resp))
+	<-headers
+	assert.Equal(t, 1, f.logs.Len())
+
+	spans := f.recorder.Ended()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, f.serverSpan.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, otelcodes.Error, spans[1].Status().Code)
+
+	assert.Equal(t, map[string]uint64{"200": 1, "503": 1}, durationCount(t, f.registry))
+}
+
+func TestHTTPClient_WithoutMiddleware(t *testing.T) {
+	server, headers := downstream()
+	defer server.Close()
+
+	// nil context uses noop tracer and logger
+	resp, err := HTTPClient(nil).Get(server.URL)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	got := <-headers
+	assert.Empty(t, got.Get(rkmid.HeaderRequestId))
+	assert.Empty(t, got.Get(HeaderTimeoutMs))
+	assert.Empty(t, got.Get("traceparent"))
+
+	assert.NotNil(t, WrapTransport(nil, nil))
+	assert.Equal(t, defaultPropagator, newOutbound(nil).propagator)
+}
@@ -8,21 +8,42 @@ package rkfiberctx
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus"
 	rkcursor "github.com/rookie-ninja/rk-entry/v2/cursor"
 	"github.com/rookie-ninja/rk-entry/v2/middleware"
 	"github.com/rookie-ninja/rk-logger"
 	"github.com/rookie-ninja/rk-query"
 	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel/baggage"
 	otelcodes "go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
 var (
+	// OidcUserKey is the key of *OidcUser stored in user context
+	OidcUserKey = &oidcUserKey{}
+	// SessionKey is the key of Session stored in user context
+	SessionKey = &sessionKey{}
+	// PreconditionKey is the key of Precondition stored in user context
+	PreconditionKey = &preconditionKey{}
+	// BaggageKeysKey is the key of baggage keys which are copied into logger, stored in user context
+	BaggageKeysKey = &baggageKeysKey{}
+	// PromRegistererKey is the key of prometheus.Registerer of prom middleware stored in user context
+	PromRegistererKey = &promRegistererKey{}
+
+	// internalRequestKey is the key of flag of request issued by middleware, stored in locals of request
+	internalRequestKey = &internalKey{}
+
 	noopTracerProvider = trace.NewNoopTracerProvider()
 	noopEvent          = rkquery.NewEventFactory().CreateEventNoop()
 	pointerCreator     rkcursor.PointerCreator
@@ -101,6 +122,7 @@ func GetLogger(ctx *fiber.Ctx) *zap.Logger {
 		if len(traceId) > 0 {
 			fields = append(fields, zap.String("traceId", traceId))
 		}
+		fields = append(fields, baggageFields(ctx)...)
 
 		return raw.(*zap.Logger).With(fields...)
 	}
@@ -204,13 +226,14 @@ func GetTracerPropagator(ctx *fiber.Ctx) propagation.TextMapPropagator {
 	return nil
 }
 
-// InjectSpanToHttpRequest inject span to http request
+// InjectSpanToHttpRequest inject span and baggage to http request
 func InjectSpanToHttpRequest(ctx *fiber.Ctx, req *http.Request) {
 	if req == nil {
 		return
 	}
 
 	newCtx := trace.ContextWithRemoteSpanContext(req.Context(), GetTraceSpan(ctx).SpanContext())
+	newCtx = baggage.ContextWithBaggage(newCtx, GetBaggage(ctx))
 
 	if propagator := GetTracerPropagator(ctx); propagator != nil {
 		propagator.Inject(newCtx, propagation.HeaderCarrier(req.Header))
@@ -239,6 +262,130 @@ func EndTraceSpan(ctx *fiber.Ctx, span trace.Span, success bool) {
 	span.End()
 }
 
+// GetBaggage extract baggage from context, baggage of request is extracted by tracing middleware.
+func GetBaggage(ctx *fiber.Ctx) baggage.Baggage {
+	if ctx == nil {
+		return baggage.Baggage{}
+	}
+
+	return baggage.FromContext(ctx.UserContext())
+}
+
+// GetBaggageValue returns value of baggage member, empty string if not exists.
+func GetBaggageValue(ctx *fiber.Ctx, key string) string {
+	return GetBaggage(ctx).Member(key).Value()
+}
+
+// SetBaggage set baggage member into context, value is plain text and will be encoded while propagated.
+//
+// Baggage would be propagated to outbound requests by InjectSpanToHttpRequest.
+func SetBaggage(ctx *fiber.Ctx, key, value string) error {
+	if ctx == nil {
+		return nil
+	}
+
+	// value may be string of fiber.Ctx which is reused after request
+	member, err := baggage.NewMember(utils.CopyString(key), url.QueryEscape(utils.CopyString(value)))
+	if err != nil {
+		return err
+	}
+
+	bag, err := GetBaggage(ctx).SetMember(member)
+	if err != nil {
+		return err
+	}
+
+	ctx.SetUserContext(baggage.ContextWithBaggage(ctx.UserContext(), bag))
+	return nil
+}
+
+// GetBaggageKeys returns baggage keys which are copied into logger, event and span.
+func GetBaggageKeys(ctx *fiber.Ctx) []string {
+	if ctx == nil {
+		return []string{}
+	}
+
+	if raw := ctx.UserContext().Value(BaggageKeysKey); raw != nil {
+		if res, ok := raw.([]string); ok {
+			return res
+		}
+	}
+
+	return []string{}
+}
+
+// baggageFields returns fields of baggage members whose key is configured
+func baggageFields(ctx *fiber.Ctx) []zap.Field {
+	fields := make([]zap.Field, 0)
+
+	keys := GetBaggageKeys(ctx)
+	if len(keys) < 1 {
+		return fields
+	}
+
+	bag := GetBaggage(ctx)
+	for _, key := range keys {
+		if member := bag.Member(key); len(member.Key()) > 0 {
+			fields = append(fields, zap.String(key, member.Value()))
+		}
+	}
+
+	return fields
+}
+
+type baggageKeysKey struct{}
+
+func (key *baggageKeysKey) String() string {
+	return "baggageKeysKeyRk"
+}
+
+// GetPromRegisterer extract prometheus.Registerer of prom middleware from context,
+// prometheus.DefaultRegisterer would be returned if prom middleware is not enabled.
+func GetPromRegisterer(ctx *fiber.Ctx) prometheus.Registerer {
+	if ctx == nil {
+		return prometheus.DefaultRegisterer
+	}
+
+	if raw := ctx.UserContext().Value(PromRegistererKey); raw != nil {
+		if res, ok := raw.(prometheus.Registerer); ok {
+			return res
+		}
+	}
+
+	return prometheus.DefaultRegisterer
+}
+
+type promRegistererKey struct{}
+
+func (key *promRegistererKey) String() string {
+	return "promRegistererKeyRk"
+}
+
+// MarkInternalRequest marks request issued by middleware itself, like background refresh of cached response.
+// Logging, metrics, tracing, concurrency and rate limit middlewares skip marked requests since they were
+// already applied to the original request. Clients could not mark requests since flag is not a header.
+func MarkInternalRequest(reqCtx *fasthttp.RequestCtx) {
+	if reqCtx != nil {
+		reqCtx.SetUserValue(internalRequestKey, true)
+	}
+}
+
+// IsInternalRequest returns true if request is marked with MarkInternalRequest
+func IsInternalRequest(ctx *fiber.Ctx) bool {
+	if ctx == nil {
+		return false
+	}
+
+	marked, _ := ctx.Locals(internalRequestKey).(bool)
+	return marked
+}
+
+type internalKey struct{}
+
+func (key *internalKey) String() string {
+	return "internalRequestKeyRk"
+}
+
 // GetJwtToken return jwt.Token if exists
 func GetJwtToken(ctx *fiber.Ctx) *jwt.Token {
 	if ctx == nil {
@@ -254,6 +401,33 @@ func GetJwtToken(ctx *fiber.Ctx) *jwt.Token {
 	return nil
 }
 
+// GetJwtClaims return claims of validated jwt token decoded into T.
+//
+// T could be jwt.MapClaims, or any struct which could be decoded from JSON claims.
+func GetJwtClaims[T any](ctx *fiber.Ctx) (T, bool) {
+	var res T
+
+	token := GetJwtToken(ctx)
+	if token == nil || token.Claims == nil {
+		return res, false
+	}
+
+	if claims, ok := token.Claims.(T); ok {
+		return claims, true
+	}
+
+	bytes, err := json.Marshal(token.Claims)
+	if err != nil {
+		return res, false
+	}
+
+	if err := json.Unmarshal(bytes, &res); err != nil {
+		return res, false
+	}
+
+	return res, true
+}
+
 // GetCsrfToken return csrf token if exists
 func GetCsrfToken(ctx *fiber.Ctx) string {
 	if ctx == nil {
@@ -268,3 +442,135 @@ func GetCsrfToken(ctx *fiber.Ctx) string {
 
 	return ""
 }
+
+// OidcUser is the user logged in with OIDC login flow.
+type OidcUser struct {
+	Subject     string                 `json:"sub"`
+	Email       string                 `json:"email"`
+	Name        string                 `json:"name"`
+	Claims      map[string]interface{} `json:"claims"`
+	AccessToken string                 `json:"accessToken"`
+	ExpiresAt   time.Time              `json:"expiresAt"`
+}
+
+// GetOidcUser return user logged in with OIDC login flow if exists
+func GetOidcUser(ctx *fiber.Ctx) *OidcUser {
+	if ctx == nil {
+		return nil
+	}
+
+	if raw := ctx.UserContext().Value(OidcUserKey); raw != nil {
+		if res, ok := raw.(*OidcUser); ok {
+			return res
+		}
+	}
+
+	return nil
+}
+
+type oidcUserKey struct{}
+
+func (key *oidcUserKey) String() string {
+	return "oidcUserKeyRk"
+}
+
+// Session is server side session bound to a cookie.
+//
+// Values are serialized as JSON by session middleware, as a result, numbers would be float64
+// and structs would be map[string]interface{} after reloaded from store.
+type Session interface {
+	// ID returns session id
+	ID() string
+
+	// Get returns value of key, nil if missing
+	Get(key string) interface{}
+
+	// Set value of key
+	Set(key string, val interface{})
+
+	// Delete value of key
+	Delete(key string)
+
+	// Keys returns all keys in session
+	Keys() []string
+
+	// Regenerate rotates session id and keeps values, should be called on privilege change like login
+	Regenerate()
+
+	// Destroy removes session from store and clears cookie
+	Destroy()
+}
+
+// GetSession return session created by session middleware if exists
+func GetSession(ctx *fiber.Ctx) Session {
+	if ctx == nil {
+		return nil
+	}
+
+	if raw := ctx.UserContext().Value(SessionKey); raw != nil {
+		if res, ok := raw.(Session); ok {
+			return res
+		}
+	}
+
+	return nil
+}
+
+type sessionKey struct{}
+
+func (key *sessionKey) String() string {
+	return "sessionKeyRk"
+}
+
+// Precondition evaluates conditional headers of request against current ETag and Last-Modified of resource,
+// returns error if handler should stop. It is stored in user context by etag middleware.
+type Precondition func(etag string, lastModified time.Time) error
+
+// SetETag sets ETag header of response, etag is quoted and prefixed with W/ if weak unless quoted already.
+//
+// If etag middleware is enabled, conditional headers of request are evaluated with current validators,
+// error is returned if If-Match or If-Unmodified-Since fails (412) or If-None-Match or If-Modified-Since
+// shows client copy is fresh (304). Handler should return error as is before modifying or rendering resource.
+func SetETag(ctx *fiber.Ctx, etag string, weak bool) error {
+	if ctx == nil || len(etag) < 1 {
+		return nil
+	}
+
+	if !strings.HasPrefix(etag, `"`) && !strings.HasPrefix(etag, `W/"`) {
+		etag = `"` + etag + `"`
+		if weak {
+			etag = "W/" + etag
+		}
+	}
+
+	ctx.Set(fiber.HeaderETag, etag)
+	return checkPrecondition(ctx)
+}
+
+// SetLastModified sets Last-Modified header of response, see SetETag for returned error.
+func SetLastModified(ctx *fiber.Ctx, lastModified time.Time) error {
+	if ctx == nil || lastModified.IsZero() {
+		return nil
+	}
+
+	ctx.Set(fiber.HeaderLastModified, lastModified.UTC().Format(http.TimeFormat))
+	return checkPrecondition(ctx)
+}
+
+// checkPrecondition evaluates Precondition in user context with validators of response
+func checkPrecondition(ctx *fiber.Ctx) error {
+	if raw := ctx.UserContext().Value(PreconditionKey); raw != nil {
+		if precondition, ok := raw.(Precondition); ok {
+			lastModified, _ := http.ParseTime(string(ctx.Response().Header.Peek(fiber.HeaderLastModified)))
+			return precondition(string(ctx.Response().Header.Peek(fiber.HeaderETag)), lastModified)
+		}
+	}
+
+	return nil
+}
+
+type preconditionKey struct{}
+
+func (key *preconditionKey) String() string {
+	return "preconditionKeyRk"
+}
@@ -17,8 +17,11 @@ import (
 	"github.com/valyala/fasthttp"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 	"net/http"
 	"testing"
+	"time"
 )
 
 func newCtx() (*fiber.Ctx, *fasthttp.RequestCtx) {
@@ -263,6 +266,73 @@ func TestGetJwtToken(t *testing.T) {
 	assert.NotNil(t, GetJwtToken(ctx))
 }
 
+func TestGetJwtClaims(t *testing.T) {
+	type utClaims struct {
+		Subject string `json:"sub"`
+		Tenant  string `json:"tenant"`
+	}
+
+	ctx, _ := newCtx()
+
+	// with nil context
+	_, ok := GetJwtClaims[jwt.MapClaims](nil)
+	assert.False(t, ok)
+
+	// without jwt token
+	_, ok = GetJwtClaims[utClaims](ctx)
+	assert.False(t, ok)
+
+	// happy case
+	ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.JwtTokenKey, &jwt.Token{
+		Claims: jwt.MapClaims{"sub": "ut-user", "tenant": "ut-tenant"},
+	}))
+
+	mapClaims, ok := GetJwtClaims[jwt.MapClaims](ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "ut-user", mapClaims["sub"])
+
+	claims, ok := GetJwtClaims[utClaims](ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "ut-user", claims.Subject)
+	assert.Equal(t, "ut-tenant", claims.Tenant)
+}
+
+func TestGetOidcUser(t *testing.T) {
+	ctx, _ := newCtx()
+
+	// with nil context
+	assert.Nil(t, GetOidcUser(nil))
+
+	// without user
+	assert.Nil(t, GetOidcUser(ctx))
+
+	// happy case
+	ctx.SetUserContext(context.WithValue(ctx.UserContext(), OidcUserKey, &OidcUser{Subject: "ut-user"}))
+	assert.Equal(t, "ut-user", GetOidcUser(ctx).Subject)
+}
+
+func TestGetSession(t *testing.T) {
+	ctx, _ := newCtx()
+
+	// with nil context
+	assert.Nil(t, GetSession(nil))
+
+	// without session
+	assert.Nil(t, GetSession(ctx))
+
+	// happy case
+	ctx.SetUserContext(context.WithValue(ctx.UserContext(), SessionKey, &fakeSession{}))
+	assert.Equal(t, "ut-session", GetSession(ctx).ID())
+}
+
+type fakeSession struct {
+	Session
+}
+
+func (s *fakeSession) ID() string {
+	return "ut-session"
+}
+
 func TestGetCsrfToken(t *testing.T) {
 	ctx, _ := newCtx()
 
@@ -277,6 +347,31 @@ func TestGetCsrfToken(t *testing.T) {
 	assert.NotEmpty(t, GetCsrfToken(ctx))
 }
 
+func TestSetETag(t *testing.T) {
+	ctx, _ := newCtx()
+
+	// with nil context
+	assert.Nil(t, SetETag(nil, "ut-etag", false))
+
+	// without precondition
+	assert.Nil(t, SetETag(ctx, "ut-etag", true))
+	assert.Equal(t, `W/"ut-etag"`, string(ctx.Response().Header.Peek(fiber.HeaderETag)))
+	assert.Nil(t, SetETag(ctx, `"ut-etag"`, true))
+	assert.Equal(t, `"ut-etag"`, string(ctx.Response().Header.Peek(fiber.HeaderETag)))
+
+	// with precondition
+	lastModified := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx.SetUserContext(context.WithValue(ctx.UserContext(), PreconditionKey, Precondition(func(etag string, t time.Time) error {
+		if etag == `"ut-etag"` && t.Equal(lastModified) {
+			return fiber.ErrPreconditionFailed
+		}
+		return nil
+	})))
+	assert.Nil(t, SetETag(ctx, "ut-etag", false))
+	assert.Equal(t, fiber.ErrPreconditionFailed, SetLastModified(ctx, lastModified))
+	assert.Equal(t, "Fri, 01 Jan 2021 00:00:00 GMT", string(ctx.Response().Header.Peek(fiber.HeaderLastModified)))
+}
+
 func TestSetPointerCreator(t *testing.T) {
 	assert.Nil(t, pointerCreator)
 
@@ -315,3 +410,56 @@ func assertNotPanic(t *testing.T) {
 		assert.True(t, true)
 	}
 }
+
+func TestSetBaggage(t *testing.T) {
+	// With nil context
+	assert.Nil(t, SetBaggage(nil, "ut-key", "ut-value"))
+	assert.Equal(t, 0, GetBaggage(nil).Len())
+
+	ctx, _ := newCtx()
+
+	// With no baggage in context
+	assert.Equal(t, 0, GetBaggage(ctx).Len())
+	assert.Empty(t, GetBaggageValue(ctx, "ut-key"))
+
+	// With invalid key
+	assert.NotNil(t, SetBaggage(ctx, "ut key", "ut-value"))
+
+	// Happy case, value is encoded while propagated
+	assert.Nil(t, SetBaggage(ctx, "ut-key", "ut value"))
+	assert.Nil(t, SetBaggage(ctx, "ut-other", "ut-other-value"))
+	assert.Equal(t, "ut value", GetBaggageValue(ctx, "ut-key"))
+	assert.Equal(t, 2, GetBaggage(ctx).Len())
+
+	ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.PropagatorKey, propagation.Baggage{}))
+	req := &http.Request{Header: http.Header{}}
+	InjectSpanToHttpRequest(ctx, req)
+	assert.Contains(t, req.Header.Get("baggage"), "ut-key=ut+value")
+	assert.Contains(t, req.Header.Get("baggage"), "ut-other=ut-other-value")
+}
+
+func TestGetLogger_WithBaggage(t *testing.T) {
+	ctx, _ := newCtx()
+
+	core, logs := observer.New(zap.InfoLevel)
+	ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.LoggerKey, zap.New(core)))
+	ctx.SetUserContext(context.WithValue(ctx.UserContext(), BaggageKeysKey, []string{"tenant", "ut-missing"}))
+	assert.Equal(t, []string{"tenant", "ut-missing"}, GetBaggageKeys(ctx))
+
+	assert.Nil(t, SetBaggage(ctx, "tenant", "acme"))
+	assert.Nil(t, SetBaggage(ctx, "experiment", "blue"))
+
+	GetLogger(ctx).Info("ut-message")
+	assert.Equal(t, 1, logs.Len())
+	assert.Equal(t, map[string]interface{}{"tenant": "acme"}, logs.All()[0].ContextMap())
+}
+
+func TestIsInternalRequest(t *testing.T) {
+	ctx, reqCtx := newCtx()
+
+	assert.False(t, IsInternalRequest(nil))
+	assert.False(t, IsInternalRequest(ctx))
+
+	MarkInternalRequest(reqCtx)
+	assert.True(t, IsInternalRequest(ctx))
+}
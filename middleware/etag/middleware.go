@@ -0,0 +1,194 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+// Package rkfiberetag is a middleware of fiber framework for ETag generation and conditional requests
+package rkfiberetag
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// errNotModified is returned by precondition if client copy is fresh
+	errNotModified = fiber.NewError(http.StatusNotModified)
+	// errPreconditionFailed is returned by precondition if client copy is outdated
+	errPreconditionFailed = fiber.NewError(http.StatusPreconditionFailed, "precondition failed")
+)
+
+// Middleware generates ETag of responses and handles conditional requests.
+//
+// ETag is generated from body of successful GET and HEAD responses unless provided by handler,
+// If-None-Match and If-Modified-Since are answered with 304.
+// If-Match and If-Unmodified-Since of PUT, PATCH and DELETE are checked once handler supplies current ETag
+// or Last-Modified of resource with rkfiberctx.SetETag() or rkfiberctx.SetLastModified(), and rejected with 412.
+func Middleware(opts ...Option) fiber.Handler {
+	set := newOptionSet(opts...)
+
+	return func(ctx *fiber.Ctx) error {
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, set.entryName))
+
+		if set.ShouldIgnore(ctx.Path()) {
+			return ctx.Next()
+		}
+
+		// preconditions are decided once, so that handler could set ETag of modified resource afterwards
+		decided := false
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkfiberctx.PreconditionKey,
+			rkfiberctx.Precondition(func(etag string, lastModified time.Time) error {
+				if decided {
+					return nil
+				}
+				ok, err := set.evaluate(ctx, etag, lastModified)
+				decided = ok
+				return err
+			})))
+
+		// errors of precondition may be wrapped by handler
+		err := ctx.Next()
+		switch {
+		case err == nil:
+		case errors.Is(err, errNotModified):
+			return set.notModified(ctx)
+		case errors.Is(err, errPreconditionFailed):
+			return set.reject(ctx)
+		default:
+			return err
+		}
+
+		method := ctx.Method()
+		if (method != http.MethodGet && method != http.MethodHead) || ctx.Response().StatusCode() != http.StatusOK {
+			return nil
+		}
+
+		etag := string(ctx.Response().Header.Peek(fiber.HeaderETag))
+		if len(etag) < 1 {
+			etag = set.generate(ctx)
+		}
+
+		lastModified, _ := http.ParseTime(string(ctx.Response().Header.Peek(fiber.HeaderLastModified)))
+		if _, err := set.evaluate(ctx, etag, lastModified); errors.Is(err, errNotModified) {
+			return set.notModified(ctx)
+		}
+
+		return nil
+	}
+}
+
+// generate ETag from response body and set it to response, empty if body is streamed or too large
+func (set *optionSet) generate(ctx *fiber.Ctx) string {
+	resp := ctx.Response()
+	if resp.IsBodyStream() || len(resp.Body()) > set.maxBodySize {
+		return ""
+	}
+
+	sum := sha256.Sum256(resp.Body())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	if set.weak {
+		etag = "W/" + etag
+	}
+
+	ctx.Set(fiber.HeaderETag, etag)
+	return etag
+}
+
+// evaluate conditional headers of request with current validators of resource, see RFC 7232 section 6.
+// Returns false if no condition could be evaluated with provided validators.
+func (set *optionSet) evaluate(ctx *fiber.Ctx, etag string, lastModified time.Time) (bool, error) {
+	method := ctx.Method()
+	safe := method == http.MethodGet || method == http.MethodHead
+	decided := false
+
+	// If-Match and If-Unmodified-Since of unsafe methods
+	if set.methods[method] {
+		if ifMatch := ctx.Get(fiber.HeaderIfMatch); len(ifMatch) > 0 {
+			if len(etag) > 0 {
+				if !matches(ifMatch, etag, false) {
+					return true, errPreconditionFailed
+				}
+				decided = true
+			}
+		} else if since, err := http.ParseTime(ctx.Get(fiber.HeaderIfUnmodifiedSince)); err == nil && !lastModified.IsZero() {
+			if lastModified.Truncate(time.Second).After(since) {
+				return true, errPreconditionFailed
+			}
+			decided = true
+		}
+	}
+
+	// If-None-Match and If-Modified-Since
+	if ifNoneMatch := ctx.Get(fiber.HeaderIfNoneMatch); len(ifNoneMatch) > 0 {
+		if len(etag) > 0 {
+			if matches(ifNoneMatch, etag, true) {
+				if safe {
+					return true, errNotModified
+				}
+				if set.methods[method] {
+					return true, errPreconditionFailed
+				}
+			}
+			decided = true
+		}
+	} else if since, err := http.ParseTime(ctx.Get(fiber.HeaderIfModifiedSince)); err == nil && safe && !lastModified.IsZero() {
+		if !lastModified.Truncate(time.Second).After(since) {
+			return true, errNotModified
+		}
+		decided = true
+	}
+
+	return decided, nil
+}
+
+// notModified replaces response with 304 which keeps validators and cache headers only
+func (set *optionSet) notModified(ctx *fiber.Ctx) error {
+	resp := ctx.Response()
+	resp.SetStatusCode(http.StatusNotModified)
+	resp.ResetBody()
+	resp.Header.Del(fiber.HeaderContentType)
+	resp.Header.Del(fiber.HeaderContentLength)
+	resp.Header.Del(fiber.HeaderContentEncoding)
+
+	return nil
+}
+
+// reject request with 412
+func (set *optionSet) reject(ctx *fiber.Ctx) error {
+	resp := rkmid.GetErrorBuilder().New(http.StatusPreconditionFailed, errPreconditionFailed.Message)
+	ctx.Response().SetStatusCode(resp.Code())
+	return ctx.JSON(resp)
+}
+
+// matches returns true if list of If-Match or If-None-Match contains etag, with weak or strong comparison
+func matches(list, etag string, weak bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+
+	// strong comparison never matches weak ETag
+	if !weak && strings.HasPrefix(etag, "W/") {
+		return false
+	}
+
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if !weak && strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
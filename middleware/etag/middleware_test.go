@@ -0,0 +1,184 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberetag
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var lastModified = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newApp create app with handlers which generate or supply validators
+func newApp(version *string, opts ...Option) *fiber.App {
+	app := fiber.New()
+	app.Use(Middleware(opts...))
+	app.Get("/ut-generated", func(ctx *fiber.Ctx) error {
+		return ctx.SendString("ut-body")
+	})
+	app.Get("/ut-large", func(ctx *fiber.Ctx) error {
+		return ctx.SendString(strings.Repeat("b", 16))
+	})
+	app.Get("/ut-resource", func(ctx *fiber.Ctx) error {
+		if err := rkfiberctx.SetLastModified(ctx, lastModified); err != nil {
+			return err
+		}
+		if err := rkfiberctx.SetETag(ctx, *version, false); err != nil {
+			return err
+		}
+		return ctx.SendString("ut-resource-" + *version)
+	})
+	app.Patch("/ut-resource", func(ctx *fiber.Ctx) error {
+		if err := rkfiberctx.SetETag(ctx, *version, false); err != nil {
+			return fmt.Errorf("load resource: %w", err)
+		}
+		return nil
+	})
+	app.Put("/ut-resource", func(ctx *fiber.Ctx) error {
+		if err := rkfiberctx.SetETag(ctx, *version, false); err != nil {
+			return err
+		}
+		*version = *version + "+"
+		return rkfiberctx.SetETag(ctx, *version, false)
+	})
+	return app
+}
+
+func send(t *testing.T, app *fiber.App, method, path string, headers ...string) (string, *http.Response) {
+	req := httptest.NewRequest(method, path, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := app.Test(req, -1)
+	assert.Nil(t, err)
+	bytes, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return string(bytes), resp
+}
+
+func TestMiddleware_Generated(t *testing.T) {
+	version := "v1"
+	app := newApp(&version, WithMaxBodySize(10))
+
+	body, resp := send(t, app, http.MethodGet, "/ut-generated")
+	assert.Equal(t, "ut-body", body)
+	etag := resp.Header.Get(fiber.HeaderETag)
+	assert.Len(t, etag, 34)
+
+	// fresh
+	body, resp = send(t, app, http.MethodGet, "/ut-generated", fiber.HeaderIfNoneMatch, `"other", `+etag)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Empty(t, body)
+	assert.Equal(t, etag, resp.Header.Get(fiber.HeaderETag))
+
+	// weak comparison
+	_, resp = send(t, app, http.MethodGet, "/ut-generated", fiber.HeaderIfNoneMatch, "W/"+etag)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// outdated
+	_, resp = send(t, app, http.MethodGet, "/ut-generated", fiber.HeaderIfNoneMatch, `"other"`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// body exceeds max size
+	_, resp = send(t, app, http.MethodGet, "/ut-large")
+	assert.Empty(t, resp.Header.Get(fiber.HeaderETag))
+
+	// weak
+	app = newApp(&version, WithWeak(true))
+	_, resp = send(t, app, http.MethodGet, "/ut-generated")
+	assert.Equal(t, "W/"+etag, resp.Header.Get(fiber.HeaderETag))
+}
+
+func TestMiddleware_Supplied(t *testing.T) {
+	version := "v1"
+	app := newApp(&version)
+
+	body, resp := send(t, app, http.MethodGet, "/ut-resource")
+	assert.Equal(t, "ut-resource-v1", body)
+	assert.Equal(t, `"v1"`, resp.Header.Get(fiber.HeaderETag))
+	assert.Equal(t, "Fri, 01 Jan 2021 00:00:00 GMT", resp.Header.Get(fiber.HeaderLastModified))
+
+	// handler stops once If-None-Match matches
+	_, resp = send(t, app, http.MethodGet, "/ut-resource", fiber.HeaderIfNoneMatch, `"v1"`)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// If-Modified-Since
+	_, resp = send(t, app, http.MethodGet, "/ut-resource", fiber.HeaderIfModifiedSince, lastModified.Format(http.TimeFormat))
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	_, resp = send(t, app, http.MethodGet, "/ut-resource", fiber.HeaderIfModifiedSince, lastModified.Add(-time.Hour).Format(http.TimeFormat))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// If-None-Match takes precedence over If-Modified-Since
+	_, resp = send(t, app, http.MethodGet, "/ut-resource",
+		fiber.HeaderIfNoneMatch, `"v0"`,
+		fiber.HeaderIfModifiedSince, lastModified.Format(http.TimeFormat))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestMiddleware_IfMatch(t *testing.T) {
+	version := "v1"
+	app := newApp(&version)
+
+	// current version
+	_, resp := send(t, app, http.MethodPut, "/ut-resource", fiber.HeaderIfMatch, `"v1"`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"v1+"`, resp.Header.Get(fiber.HeaderETag))
+
+	// outdated version
+	_, resp = send(t, app, http.MethodPut, "/ut-resource", fiber.HeaderIfMatch, `"v1"`)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	assert.Equal(t, "v1+", version)
+
+	// weak ETag never matches If-Match
+	_, resp = send(t, app, http.MethodPut, "/ut-resource", fiber.HeaderIfMatch, `W/"v1+"`)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	// any version
+	_, resp = send(t, app, http.MethodPut, "/ut-resource", fiber.HeaderIfMatch, "*")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// If-None-Match: * rejects existing resource
+	_, resp = send(t, app, http.MethodPut, "/ut-resource", fiber.HeaderIfNoneMatch, "*")
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	// error of precondition wrapped by handler
+	_, resp = send(t, app, http.MethodPatch, "/ut-resource", fiber.HeaderIfMatch, `"v0"`)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	assert.Equal(t, fiber.MIMEApplicationJSON, resp.Header.Get(fiber.HeaderContentType))
+
+	// method not configured
+	app = newApp(&version, WithMethods(http.MethodDelete))
+	_, resp = send(t, app, http.MethodPut, "/ut-resource", fiber.HeaderIfMatch, `"v0"`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestToOptions(t *testing.T) {
+	// disabled
+	assert.Empty(t, ToOptions(&BootConfig{}, "ut-entry", "ut-type"))
+
+	// enabled
+	set := newOptionSet(ToOptions(&BootConfig{
+		Enabled:     true,
+		Ignore:      []string{"/ut-ignore"},
+		Weak:        true,
+		MaxBodySize: 10,
+		Methods:     []string{"put"},
+	}, "ut-entry", "ut-type")...)
+
+	assert.Equal(t, "ut-entry", set.entryName)
+	assert.True(t, set.weak)
+	assert.Equal(t, 10, set.maxBodySize)
+	assert.Equal(t, map[string]bool{http.MethodPut: true}, set.methods)
+	assert.True(t, set.ShouldIgnore("/ut-ignore"))
+}
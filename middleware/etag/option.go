@@ -0,0 +1,145 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberetag
+
+import (
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"net/http"
+	"strings"
+)
+
+const (
+	// DefaultMaxBodySize is max size of response body for which ETag is generated
+	DefaultMaxBodySize = 1024 * 1024
+)
+
+// ***************** OptionSet *****************
+
+// optionSet which is used for middleware implementation
+type optionSet struct {
+	entryName    string
+	entryType    string
+	pathToIgnore []string
+
+	weak        bool
+	maxBodySize int
+	methods     map[string]bool
+}
+
+// newOptionSet Create new optionSet with options.
+func newOptionSet(opts ...Option) *optionSet {
+	set := &optionSet{
+		entryName:    "fake-entry",
+		entryType:    "",
+		pathToIgnore: []string{},
+		maxBodySize:  DefaultMaxBodySize,
+		methods: map[string]bool{
+			http.MethodPut:    true,
+			http.MethodPatch:  true,
+			http.MethodDelete: true,
+		},
+	}
+
+	for i := range opts {
+		opts[i](set)
+	}
+
+	return set
+}
+
+// ShouldIgnore determine whether etag should be ignored based on path
+func (set *optionSet) ShouldIgnore(path string) bool {
+	for i := range set.pathToIgnore {
+		if strings.HasPrefix(path, set.pathToIgnore[i]) {
+			return true
+		}
+	}
+
+	return rkmid.ShouldIgnoreGlobal(path)
+}
+
+// ***************** BootConfig *****************
+
+// BootConfig for YAML
+type BootConfig struct {
+	Enabled     bool     `yaml:"enabled" json:"enabled"`
+	Ignore      []string `yaml:"ignore" json:"ignore"`
+	Weak        bool     `yaml:"weak" json:"weak"`
+	MaxBodySize int      `yaml:"maxBodySize" json:"maxBodySize"`
+	Methods     []string `yaml:"methods" json:"methods"`
+}
+
+// ToOptions convert BootConfig into Option list
+func ToOptions(config *BootConfig, entryName, entryType string) []Option {
+	opts := make([]Option, 0)
+
+	if config.Enabled {
+		opts = append(opts,
+			WithEntryNameAndType(entryName, entryType),
+			WithPathToIgnore(config.Ignore...),
+			WithWeak(config.Weak),
+			WithMaxBodySize(config.MaxBodySize),
+			WithMethods(config.Methods...))
+	}
+
+	return opts
+}
+
+// ***************** Option *****************
+
+// Option if for middleware options while creating middleware
+type Option func(*optionSet)
+
+// WithEntryNameAndType provide entry name and entry type.
+func WithEntryNameAndType(entryName, entryType string) Option {
+	return func(opt *optionSet) {
+		opt.entryName = entryName
+		opt.entryType = entryType
+	}
+}
+
+// WithPathToIgnore provide paths prefix that will ignore.
+func WithPathToIgnore(paths ...string) Option {
+	return func(set *optionSet) {
+		for i := range paths {
+			if len(paths[i]) > 0 {
+				set.pathToIgnore = append(set.pathToIgnore, paths[i])
+			}
+		}
+	}
+}
+
+// WithWeak generate weak ETag instead of strong one.
+func WithWeak(weak bool) Option {
+	return func(opt *optionSet) {
+		opt.weak = weak
+	}
+}
+
+// WithMaxBodySize provide max size of response body for which ETag is generated, default is 1MB.
+func WithMaxBodySize(size int) Option {
+	return func(opt *optionSet) {
+		if size > 0 {
+			opt.maxBodySize = size
+		}
+	}
+}
+
+// WithMethods provide methods whose If-Match and If-Unmodified-Since are checked, PUT, PATCH and DELETE would be applied by default.
+func WithMethods(methods ...string) Option {
+	return func(set *optionSet) {
+		res := make(map[string]bool)
+		for i := range methods {
+			if len(methods[i]) > 0 {
+				res[strings.ToUpper(methods[i])] = true
+			}
+		}
+
+		if len(res) > 0 {
+			set.methods = res
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+// Package rkfiberidempotency is a middleware of fiber framework for replaying responses of retried requests with Idempotency-Key
+package rkfiberidempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// headers which are not replayed since they are generated per response
+var skippedHeaders = map[string]bool{
+	fiber.HeaderContentLength: true,
+	fiber.HeaderDate:          true,
+	fiber.HeaderConnection:    true,
+	fiber.HeaderSetCookie:     true,
+	rkmid.HeaderRequestId:     true,
+}
+
+// record is state of idempotency key, Status is zero while request is in progress
+type record struct {
+	Fingerprint string              `json:"fingerprint"`
+	Status      int                 `json:"status"`
+	Headers     map[string][]string `json:"headers,omitempty"`
+	Body        []byte              `json:"body,omitempty"`
+}
+
+// Middleware replays stored response of request with same idempotency key.
+//
+// Keys are scoped by principal of caller, method and path, so that same key from other clients or on other
+// routes would never replay response of another request.
+// The first request holds key while in progress, concurrent duplicate is rejected with 409,
+// and same key with different method, path, query or body is rejected with 422.
+// Responses of failed requests (error or 5xx) are not stored, so that clients could retry.
+// Requests are passed through if store is unavailable.
+func Middleware(opts ...Option) fiber.Handler {
+	set := newOptionSet(opts...)
+
+	return func(ctx *fiber.Ctx) error {
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, set.entryName))
+
+		if !set.isApplied(ctx.Method(), ctx.Path()) {
+			return ctx.Next()
+		}
+
+		key := ctx.Get(set.header)
+		if len(key) < 1 {
+			if set.required {
+				return set.reject(ctx, http.StatusBadRequest, "missing "+set.header+" header")
+			}
+			return ctx.Next()
+		}
+
+		if len(key) > DefaultMaxKeyLength {
+			return set.reject(ctx, http.StatusBadRequest, "invalid "+set.header+" header")
+		}
+
+		key = set.scopedKey(ctx, key)
+		fingerprint := set.fingerprint(ctx)
+
+		// hold key, or handle existing one
+		inProgress, _ := json.Marshal(&record{Fingerprint: fingerprint})
+		added, err := set.store.Add(key, inProgress, set.lockTtl)
+		if err != nil {
+			set.logger().Warn("Failed to add idempotency key.", zap.Error(err))
+			return ctx.Next()
+		}
+
+		if !added {
+			return set.handleExisting(ctx, key, fingerprint)
+		}
+
+		// headers written by outer middlewares like rate limit and tracing belong to this request only
+		outer := make(map[string]bool)
+		ctx.Response().Header.VisitAll(func(k, v []byte) {
+			outer[string(k)+"\x00"+string(v)] = true
+		})
+
+		if err := ctx.Next(); err != nil {
+			set.release(key)
+			return err
+		}
+
+		status := ctx.Response().StatusCode()
+		if status >= http.StatusInternalServerError {
+			set.release(key)
+			return nil
+		}
+
+		completed := &record{
+			Fingerprint: fingerprint,
+			Status:      status,
+			Headers:     make(map[string][]string),
+			Body:        append([]byte{}, ctx.Response().Body()...),
+		}
+		ctx.Response().Header.VisitAll(func(k, v []byte) {
+			name := string(k)
+			if !skippedHeaders[name] && !outer[name+"\x00"+string(v)] {
+				completed.Headers[name] = append(completed.Headers[name], string(v))
+			}
+		})
+
+		if data, err := json.Marshal(completed); err == nil {
+			if err := set.store.Set(key, data, set.ttl); err != nil {
+				set.logger().Warn("Failed to store idempotent response.", zap.Error(err))
+			}
+		}
+
+		return nil
+	}
+}
+
+// handleExisting replays completed response, or rejects conflicting request
+func (set *optionSet) handleExisting(ctx *fiber.Ctx, key, fingerprint string) error {
+	data, err := set.store.Get(key)
+	if err != nil {
+		set.logger().Warn("Failed to get idempotency key.", zap.Error(err))
+		return ctx.Next()
+	}
+
+	existing := &record{}
+	if data == nil || json.Unmarshal(data, existing) != nil {
+		// key expired or released right after Add, treat it as in progress, client would retry
+		return set.reject(ctx, http.StatusConflict, "request with same "+set.header+" is in progress")
+	}
+
+	if existing.Fingerprint != fingerprint {
+		return set.reject(ctx, http.StatusUnprocessableEntity, set.header+" was used with different request")
+	}
+
+	if existing.Status == 0 {
+		return set.reject(ctx, http.StatusConflict, "request with same "+set.header+" is in progress")
+	}
+
+	for k, values := range existing.Headers {
+		ctx.Response().Header.Del(k)
+		for i := range values {
+			ctx.Response().Header.Add(k, values[i])
+		}
+	}
+	ctx.Set(HeaderReplayed, "true")
+	ctx.Response().SetStatusCode(existing.Status)
+	ctx.Response().SetBodyRaw(existing.Body)
+
+	return nil
+}
+
+// scopedKey returns hash of principal, method, path and idempotency key, which is used as key of store
+func (set *optionSet) scopedKey(ctx *fiber.Ctx, key string) string {
+	hash := sha256.New()
+	hash.Write([]byte(set.principalFunc(ctx)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(ctx.Method()))
+	hash.Write([]byte{0})
+	hash.Write([]byte(ctx.Path()))
+	hash.Write([]byte{0})
+	hash.Write([]byte(key))
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// defaultPrincipal returns subject of jwt token, or API key, or credential in Authorization header,
+// falls back to client IP for anonymous requests
+func defaultPrincipal(ctx *fiber.Ctx) string {
+	if token := rkfiberctx.GetJwtToken(ctx); token != nil {
+		if claims, ok := token.Claims.(jwt.MapClaims); ok && claims["sub"] != nil {
+			return fmt.Sprintf("jwt:%v", claims["sub"])
+		}
+	}
+
+	if apiKey := ctx.Get(rkmid.HeaderApiKey); len(apiKey) > 0 {
+		return "apiKey:" + apiKey
+	}
+
+	if auth := ctx.Get(fiber.HeaderAuthorization); len(auth) > 0 {
+		return "auth:" + auth
+	}
+
+	return "ip:" + ctx.IP()
+}
+
+// fingerprint returns hash of method, path, query and body of request
+func (set *optionSet) fingerprint(ctx *fiber.Ctx) string {
+	hash := sha256.New()
+	hash.Write([]byte(ctx.Method()))
+	hash.Write([]byte{0})
+	hash.Write([]byte(ctx.Path()))
+	hash.Write([]byte{0})
+	hash.Write(ctx.Request().URI().QueryString())
+	hash.Write([]byte{0})
+	hash.Write(ctx.Body())
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// release key so that request could be retried
+func (set *optionSet) release(key string) {
+	if err := set.store.Delete(key); err != nil {
+		set.logger().Warn("Failed to release idempotency key.", zap.Error(err))
+	}
+}
+
+// reject request with code and message
+func (set *optionSet) reject(ctx *fiber.Ctx, code int, msg string) error {
+	resp := rkmid.GetErrorBuilder().New(code, msg)
+	ctx.Response().SetStatusCode(resp.Code())
+	return ctx.JSON(resp)
+}
+
+// logger returns default logger
+func (set *optionSet) logger() *zap.Logger {
+	return rkentry.GlobalAppCtx.GetLoggerEntryDefault().Logger
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberidempotency
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func sendWithKey(t *testing.T, app *fiber.App, method, path, key, body string) *http.Response {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if len(key) > 0 {
+		req.Header.Set(DefaultHeader, key)
+	}
+	resp, err := app.Test(req, -1)
+	assert.Nil(t, err)
+	return resp
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	bytes, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return string(bytes)
+}
+
+func TestMiddleware(t *testing.T) {
+	var counter int32
+	app := fiber.New()
+	app.Use(Middleware(WithPaths("/ut-order")))
+	app.Post("/ut-order", func(ctx *fiber.Ctx) error {
+		n := atomic.AddInt32(&counter, 1)
+		ctx.Set("X-Order", strconv.Itoa(int(n)))
+		ctx.Status(http.StatusCreated)
+		return ctx.SendString("order-" + strconv.Itoa(int(n)))
+	})
+	app.Post("/ut-other", func(ctx *fiber.Ctx) error {
+		atomic.AddInt32(&counter, 1)
+		return nil
+	})
+
+	// first request
+	resp := sendWithKey(t, app, http.MethodPost, "/ut-order", "ut-key", "ut-body")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "order-1", readBody(t, resp))
+	assert.Empty(t, resp.Header.Get(HeaderReplayed))
+
+	// replayed
+	resp = sendWithKey(t, app, http.MethodPost, "/ut-order", "ut-key", "ut-body")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "order-1", readBody(t, resp))
+	assert.Equal(t, "1", resp.Header.Get("X-Order"))
+	assert.Equal(t, "true", resp.Header.Get(HeaderReplayed))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&counter))
+
+	// same key with different body
+	resp = sendWithKey(t, app, http.MethodPost, "/ut-order", "ut-key", "ut-other-body")
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	// different key
+	resp = sendWithKey(t, app, http.MethodPost, "/ut-order", "ut-key-2", "ut-body")
+	assert.Equal(t, "order-2", readBody(t, resp))
+
+	// without key
+	resp = sendWithKey(t, app, http.MethodPost, "/ut-order", "", "ut-body")
+	assert.Equal(t, "order-3", readBody(t, resp))
+
+	// path not configured
+	sendWithKey(t, app, http.MethodPost, "/ut-other", "ut-key-3", "")
+	sendWithKey(t, app, http.MethodPost, "/ut-other", "ut-key-3", "")
+	assert.Equal(t, int32(5), atomic.LoadInt32(&counter))
+}
+
+func TestMiddleware_KeyCopied(t *testing.T) {
+	var counter int32
+	app := fiber.New()
+	app.Use(Middleware())
+	app.Post("/ut-order", func(ctx *fiber.Ctx) error {
+		return ctx.SendString("order-" + strconv.Itoa(int(atomic.AddInt32(&counter, 1))))
+	})
+
+	// buffers of request are reused by following requests, stored key must not be lost
+	assert.Equal(t, "order-1", readBody(t, sendWithKey(t, app, http.MethodPost, "/ut-order", "ut-key-a", "ut-body")))
+	for i := 0; i < 10; i++ {
+		sendWithKey(t, app, http.MethodPost, "/ut-order", "ut-key-"+string(rune('b'+i)), "ut-body")
+	}
+	assert.Equal(t, "order-1", readBody(t, sendWithKey(t, app, http.MethodPost, "/ut-order", "ut-key-a", "ut-body")))
+}
+
+func TestMiddleware_OuterHeaders(t *testing.T) {
+	var counter int32
+	app := fiber.New()
+	app.Use(func(ctx *fiber.Ctx) error {
+		n := strconv.Itoa(int(atomic.AddInt32(&counter, 1)))
+		ctx.Set("RateLimit-Remaining", n)
+		ctx.Set("X-Trace-Id", "ut-trace-"+n)
+		return ctx.Next()
+	})
+	app.Use(Middleware())
+	app.Post("/ut-order", func(ctx *fiber.Ctx) error {
+		ctx.Set("X-Order", "ut-order")
+		return ctx.SendString("ut-body")
+	})
+
+	sendWithKey(t, app, http.MethodPost, "/ut-order", "ut-key", "")
+
+	// headers of outer middlewares are not replayed from original request
+	resp := sendWithKey(t, app, http.MethodPost, "/ut-order", "ut-key", "")
+	assert.Equal(t, "true", resp.Header.Get(HeaderReplayed))
+	assert.Equal(t, "ut-order", resp.Header.Get("X-Order"))
+	assert.Equal(t, "2", resp.Header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "ut-trace-2", resp.Header.Get("X-Trace-Id"))
+}
+
+func TestMiddleware_Scope(t *testing.T) {
+	var counter int32
+	app := fiber.New()
+	app.Use(Middleware())
+	handler := func(ctx *fiber.Ctx) error {
+		return ctx.SendString("order-" + strconv.Itoa(int(atomic.AddInt32(&counter, 1))))
+	}
+	app.Post("/ut-order", handler)
+	app.Post("/ut-refund", handler)
+
+	send := func(path, apiKey string) string {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set(DefaultHeader, "ut-key")
+		req.Header.Set(rkmid.HeaderApiKey, apiKey)
+		resp, err := app.Test(req, -1)
+		assert.Nil(t, err)
+		return readBody(t, resp)
+	}
+
+	assert.Equal(t, "order-1", send("/ut-order", "ut-client-a"))
+	assert.Equal(t, "order-1", send("/ut-order", "ut-client-a"))
+
+	// same key from other client would not replay response of client a
+	assert.Equal(t, "order-2", send("/ut-order", "ut-client-b"))
+
+	// same key on other route
+	assert.Equal(t, "order-3", send("/ut-refund", "ut-client-a"))
+
+	// custom principal
+	app = fiber.New()
+	app.Use(Middleware(WithPrincipalFunc(func(ctx *fiber.Ctx) string {
+		return "ut-tenant"
+	})))
+	app.Post("/ut-order", handler)
+	assert.Equal(t, "order-4", send("/ut-order", "ut-client-a"))
+	assert.Equal(t, "order-4", send("/ut-order", "ut-client-b"))
+}
+
+func TestMiddleware_InProgress(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	app := fiber.New()
+	app.Use(Middleware())
+	app.Post("/ut-order", func(ctx *fiber.Ctx) error {
+		close(started)
+		<-release
+		return ctx.SendString("ut-order")
+	})
+
+	done := make(chan *http.Response)
+	go func() {
+		done <- sendWithKey(t, app, http.MethodPost, "/ut-order", "ut-key", "")
+	}()
+	<-started
+
+	// concurrent duplicate
+	resp := sendWithKey(t, app, http.MethodPost, "/ut-order", "ut-key", "")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	close(release)
+	assert.Equal(t, http.StatusOK, (<-done).StatusCode)
+}
+
+func TestMiddleware_Failure(t *testing.T) {
+	var counter int32
+	app := fiber.New()
+	app.Use(Middleware(WithRequired(true)))
+	app.Post("/ut-order", func(ctx *fiber.Ctx) error {
+		if atomic.AddInt32(&counter, 1) == 1 {
+			return fiber.NewError(http.StatusInternalServerError, "ut-error")
+		}
+		return ctx.SendString("ut-order")
+	})
+
+	// failed request releases key
+	resp := sendWithKey(t, app, http.MethodPost, "/ut-order", "ut-key", "")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	resp = sendWithKey(t, app, http.MethodPost, "/ut-order", "ut-key", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get(HeaderReplayed))
+
+	// required
+	resp = sendWithKey(t, app, http.MethodPost, "/ut-order", "", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = sendWithKey(t, app, http.MethodPost, "/ut-order", strings.Repeat("k", DefaultMaxKeyLength+1), "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// method not configured
+	app.Get("/ut-order", func(ctx *fiber.Ctx) error {
+		return nil
+	})
+	resp = sendWithKey(t, app, http.MethodGet, "/ut-order", "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore(0, 0)
+
+	added, err := store.Add("ut-key", []byte("ut-value"), time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, added)
+
+	added, _ = store.Add("ut-key", []byte("ut-other"), time.Minute)
+	assert.False(t, added)
+
+	data, _ := store.Get("ut-key")
+	assert.Equal(t, "ut-value", string(data))
+
+	assert.Nil(t, store.Set("ut-key", []byte("ut-new"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	data, _ = store.Get("ut-key")
+	assert.Nil(t, data)
+
+	// expired key could be added again
+	assert.Nil(t, store.Set("ut-key", []byte("ut-value"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	added, _ = store.Add("ut-key", []byte("ut-value"), time.Minute)
+	assert.True(t, added)
+
+	assert.Nil(t, store.Delete("ut-key"))
+	data, _ = store.Get("ut-key")
+	assert.Nil(t, data)
+
+	// least recently used records are evicted
+	store = NewMemoryStore(2, 0)
+	for _, key := range []string{"ut-a", "ut-b", "ut-c"} {
+		added, _ = store.Add(key, []byte("ut-value"), time.Minute)
+		assert.True(t, added)
+	}
+	entries, _ := store.Len()
+	assert.Equal(t, 2, entries)
+	data, _ = store.Get("ut-a")
+	assert.Nil(t, data)
+}
+
+func TestToOptions(t *testing.T) {
+	// disabled
+	assert.Empty(t, ToOptions(&BootConfig{}, "ut-entry", "ut-type"))
+
+	// enabled
+	set := newOptionSet(ToOptions(&BootConfig{
+		Enabled:    true,
+		Paths:      []string{"/ut-order"},
+		Methods:    []string{"put"},
+		Header:     "X-Idempotency-Key",
+		Required:   true,
+		TtlSec:     60,
+		LockTtlSec: 10,
+		Memory:     MemoryConfig{MaxEntries: 5},
+	}, "ut-entry", "ut-type")...)
+
+	assert.Equal(t, "ut-entry", set.entryName)
+	assert.Equal(t, "X-Idempotency-Key", set.header)
+	assert.True(t, set.required)
+	assert.Equal(t, time.Minute, set.ttl)
+	assert.Equal(t, 10*time.Second, set.lockTtl)
+	for i := 0; i < 10; i++ {
+		set.store.Add("ut-key-"+strconv.Itoa(i), []byte("ut-value"), time.Minute)
+	}
+	entries, _ := set.store.(*MemoryStore).Len()
+	assert.Equal(t, 5, entries)
+	assert.True(t, set.isApplied(http.MethodPut, "/ut-order/1"))
+	assert.False(t, set.isApplied(http.MethodPost, "/ut-order/1"))
+	assert.False(t, set.isApplied(http.MethodPut, "/ut-other"))
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberidempotency
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultHeader is header of idempotency key
+	DefaultHeader = "Idempotency-Key"
+	// HeaderReplayed is set to true on replayed responses
+	HeaderReplayed = "Idempotent-Replayed"
+	// DefaultTtl is duration for which completed response is replayed
+	DefaultTtl = 24 * time.Hour
+	// DefaultLockTtl is max duration a request holds key while in progress
+	DefaultLockTtl = time.Minute
+	// DefaultMaxKeyLength is max length of idempotency key
+	DefaultMaxKeyLength = 255
+)
+
+// ***************** OptionSet *****************
+
+// optionSet which is used for middleware implementation
+type optionSet struct {
+	entryName    string
+	entryType    string
+	pathToIgnore []string
+
+	paths    []string
+	methods  map[string]bool
+	header   string
+	required bool
+	ttl      time.Duration
+	lockTtl  time.Duration
+	store    Store
+
+	// principalFunc returns caller which scopes idempotency keys
+	principalFunc func(ctx *fiber.Ctx) string
+}
+
+// newOptionSet Create new optionSet with options.
+func newOptionSet(opts ...Option) *optionSet {
+	set := &optionSet{
+		entryName:     "fake-entry",
+		entryType:     "",
+		pathToIgnore:  []string{},
+		paths:         []string{},
+		methods:       map[string]bool{http.MethodPost: true, http.MethodPatch: true},
+		header:        DefaultHeader,
+		ttl:           DefaultTtl,
+		lockTtl:       DefaultLockTtl,
+		principalFunc: defaultPrincipal,
+	}
+
+	for i := range opts {
+		opts[i](set)
+	}
+
+	if set.store == nil {
+		set.store = NewMemoryStore(DefaultMaxEntries, DefaultMaxBytes)
+	}
+
+	return set
+}
+
+// ShouldIgnore determine whether idempotency should be ignored based on path
+func (set *optionSet) ShouldIgnore(path string) bool {
+	for i := range set.pathToIgnore {
+		if strings.HasPrefix(path, set.pathToIgnore[i]) {
+			return true
+		}
+	}
+
+	return rkmid.ShouldIgnoreGlobal(path)
+}
+
+// isApplied returns true if request with method and path should honor idempotency key
+func (set *optionSet) isApplied(method, path string) bool {
+	if !set.methods[method] || set.ShouldIgnore(path) {
+		return false
+	}
+
+	if len(set.paths) < 1 {
+		return true
+	}
+
+	for i := range set.paths {
+		if strings.HasPrefix(path, set.paths[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ***************** BootConfig *****************
+
+// BootConfig for YAML
+type BootConfig struct {
+	Enabled    bool         `yaml:"enabled" json:"enabled"`
+	Ignore     []string     `yaml:"ignore" json:"ignore"`
+	Paths      []string     `yaml:"paths" json:"paths"`
+	Methods    []string     `yaml:"methods" json:"methods"`
+	Header     string       `yaml:"header" json:"header"`
+	Required   bool         `yaml:"required" json:"required"`
+	TtlSec     int          `yaml:"ttlSec" json:"ttlSec"`
+	LockTtlSec int          `yaml:"lockTtlSec" json:"lockTtlSec"`
+	Memory     MemoryConfig `yaml:"memory" json:"memory"`
+}
+
+// MemoryConfig for YAML, size limits of MemoryStore, least recently used records are evicted once exceeded
+type MemoryConfig struct {
+	MaxEntries int `yaml:"maxEntries" json:"maxEntries"`
+	MaxBytes   int `yaml:"maxBytes" json:"maxBytes"`
+}
+
+// ToOptions convert BootConfig into Option list
+func ToOptions(config *BootConfig, entryName, entryType string) []Option {
+	opts := make([]Option, 0)
+
+	if config.Enabled {
+		opts = append(opts,
+			WithEntryNameAndType(entryName, entryType),
+			WithPathToIgnore(config.Ignore...),
+			WithPaths(config.Paths...),
+			WithMethods(config.Methods...),
+			WithHeader(config.Header),
+			WithRequired(config.Required),
+			WithTtl(time.Duration(config.TtlSec)*time.Second),
+			WithLockTtl(time.Duration(config.LockTtlSec)*time.Second),
+			WithStore(NewMemoryStore(config.Memory.MaxEntries, config.Memory.MaxBytes)))
+	}
+
+	return opts
+}
+
+// ***************** Option *****************
+
+// Option if for middleware options while creating middleware
+type Option func(*optionSet)
+
+// WithEntryNameAndType provide entry name and entry type.
+func WithEntryNameAndType(entryName, entryType string) Option {
+	return func(opt *optionSet) {
+		opt.entryName = entryName
+		opt.entryType = entryType
+	}
+}
+
+// WithPathToIgnore provide paths prefix that will ignore.
+func WithPathToIgnore(paths ...string) Option {
+	return func(set *optionSet) {
+		for i := range paths {
+			if len(paths[i]) > 0 {
+				set.pathToIgnore = append(set.pathToIgnore, paths[i])
+			}
+		}
+	}
+}
+
+// WithPaths provide path prefixes which honor idempotency key, all paths would be applied by default.
+func WithPaths(paths ...string) Option {
+	return func(set *optionSet) {
+		for i := range paths {
+			if len(paths[i]) > 0 {
+				set.paths = append(set.paths, paths[i])
+			}
+		}
+	}
+}
+
+// WithMethods provide methods which honor idempotency key, POST and PATCH would be applied by default.
+func WithMethods(methods ...string) Option {
+	return func(set *optionSet) {
+		res := make(map[string]bool)
+		for i := range methods {
+			if len(methods[i]) > 0 {
+				res[strings.ToUpper(methods[i])] = true
+			}
+		}
+
+		if len(res) > 0 {
+			set.methods = res
+		}
+	}
+}
+
+// WithHeader provide header of idempotency key, default is Idempotency-Key.
+func WithHeader(header string) Option {
+	return func(opt *optionSet) {
+		if len(header) > 0 {
+			opt.header = header
+		}
+	}
+}
+
+// WithRequired reject requests without idempotency key with 400.
+func WithRequired(required bool) Option {
+	return func(opt *optionSet) {
+		opt.required = required
+	}
+}
+
+// WithTtl provide duration for which completed response is replayed, default is 24 hours.
+func WithTtl(ttl time.Duration) Option {
+	return func(opt *optionSet) {
+		if ttl > 0 {
+			opt.ttl = ttl
+		}
+	}
+}
+
+// WithLockTtl provide max duration a request holds key while in progress, default is one minute.
+// Key is released after it in case the process crashed before response was stored.
+func WithLockTtl(ttl time.Duration) Option {
+	return func(opt *optionSet) {
+		if ttl > 0 {
+			opt.lockTtl = ttl
+		}
+	}
+}
+
+// WithStore provide Store, MemoryStore would be used by default.
+func WithStore(store Store) Option {
+	return func(opt *optionSet) {
+		if store != nil {
+			opt.store = store
+		}
+	}
+}
+
+// WithPrincipalFunc provide function which returns caller of request, idempotency keys are scoped by it.
+// Subject of jwt token, API key, Authorization header or client IP would be used by default.
+func WithPrincipalFunc(f func(ctx *fiber.Ctx) string) Option {
+	return func(opt *optionSet) {
+		if f != nil {
+			opt.principalFunc = f
+		}
+	}
+}
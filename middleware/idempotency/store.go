@@ -0,0 +1,89 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberidempotency
+
+import (
+	"github.com/rookie-ninja/rk-fiber/internal/memstore"
+	"time"
+)
+
+const (
+	// DefaultMaxEntries is max number of records kept by MemoryStore
+	DefaultMaxEntries = 10000
+	// DefaultMaxBytes is max total size of records kept by MemoryStore
+	DefaultMaxBytes = 64 * 1024 * 1024
+)
+
+// Store persists serialized records by idempotency key.
+//
+// Implementations must be safe for concurrent use. Records must be expired by implementation after ttl,
+// Add maps naturally to SET with NX and PX in Redis like backends.
+type Store interface {
+	// Get returns serialized record, nil without error if missing or expired
+	Get(key string) ([]byte, error)
+
+	// Add stores serialized record with ttl only if key is missing, returns false if key exists
+	Add(key string, data []byte, ttl time.Duration) (bool, error)
+
+	// Set stores serialized record with ttl
+	Set(key string, data []byte, ttl time.Duration) error
+
+	// Delete removes record, no error if missing
+	Delete(key string) error
+}
+
+// ***************** MemoryStore *****************
+
+// MemoryStore is a Store which keeps records in memory of current process, which is not shared by replicas.
+//
+// Records hold full response bodies, least recently used records are evicted once number of records or
+// total size of keys and records exceeds limits, so that clients could not grow memory with fresh keys.
+type MemoryStore struct {
+	store *rkfibermemstore.Store
+}
+
+// NewMemoryStore create MemoryStore with max number of records and max total size in bytes,
+// DefaultMaxEntries and DefaultMaxBytes would be used if not positive.
+func NewMemoryStore(maxEntries, maxBytes int) *MemoryStore {
+	if maxEntries < 1 {
+		maxEntries = DefaultMaxEntries
+	}
+
+	if maxBytes < 1 {
+		maxBytes = DefaultMaxBytes
+	}
+
+	return &MemoryStore{
+		store: rkfibermemstore.New(maxEntries, maxBytes),
+	}
+}
+
+// Len returns number of records and total size in bytes
+func (s *MemoryStore) Len() (entries, bytes int) {
+	return s.store.Len()
+}
+
+// Get returns serialized record
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	return s.store.Get(key), nil
+}
+
+// Add stores serialized record with ttl only if key is missing
+func (s *MemoryStore) Add(key string, data []byte, ttl time.Duration) (bool, error) {
+	return s.store.Add(key, data, ttl), nil
+}
+
+// Set stores serialized record with ttl
+func (s *MemoryStore) Set(key string, data []byte, ttl time.Duration) error {
+	s.store.Set(key, data, ttl)
+	return nil
+}
+
+// Delete removes record
+func (s *MemoryStore) Delete(key string) error {
+	s.store.Delete(key)
+	return nil
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberjwt
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"github.com/rookie-ninja/rk-entry/v2/middleware/prom"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	// ReasonInvalidToken token is malformed or signature is invalid
+	ReasonInvalidToken = "invalidToken"
+	// ReasonExpired token is expired
+	ReasonExpired = "expired"
+	// ReasonNotYetValid token is used before nbf
+	ReasonNotYetValid = "notYetValid"
+	// ReasonIssuedInFuture token is used before iat
+	ReasonIssuedInFuture = "issuedInFuture"
+	// ReasonBadIssuer iss of token is not accepted
+	ReasonBadIssuer = "badIssuer"
+	// ReasonBadAudience aud of token does not contain any of accepted audiences
+	ReasonBadAudience = "badAudience"
+	// ReasonMissingClaim required claim is missing
+	ReasonMissingClaim = "missingClaim"
+
+	// metrics name of rejected jwt counter
+	metricsNameRejected = "rejected_total"
+
+	// validation errors of registered time claims, which would be validated again with leeway
+	timeValidationErrors = jwt.ValidationErrorExpired | jwt.ValidationErrorNotValidYet | jwt.ValidationErrorIssuedAt
+)
+
+// ClaimsError is returned when jwt token is rejected, Reason is one of Reason* constants.
+type ClaimsError struct {
+	Reason string
+	Inner  error
+}
+
+// Error returns error message with reason
+func (e *ClaimsError) Error() string {
+	if e.Inner != nil {
+		return fmt.Sprintf("jwt rejected, reason:%s, %v", e.Reason, e.Inner)
+	}
+
+	return fmt.Sprintf("jwt rejected, reason:%s", e.Reason)
+}
+
+// Unwrap returns inner error
+func (e *ClaimsError) Unwrap() error {
+	return e.Inner
+}
+
+// ClaimsValidator validates claims of jwt token whose signature was verified.
+type ClaimsValidator struct {
+	// accepted iss, any issuer would be accepted if empty
+	issuers []string
+
+	// accepted aud, token must contain at least one of them, any audience would be accepted if empty
+	audiences []string
+
+	// claims which must exist in token
+	required []string
+
+	// leeway applied to exp, nbf and iat
+	leeway time.Duration
+}
+
+// ClaimsOption option for ClaimsValidator
+type ClaimsOption func(*ClaimsValidator)
+
+// WithIssuers provide accepted issuers.
+func WithIssuers(issuers ...string) ClaimsOption {
+	return func(v *ClaimsValidator) {
+		for i := range issuers {
+			if len(issuers[i]) > 0 {
+				v.issuers = append(v.issuers, issuers[i])
+			}
+		}
+	}
+}
+
+// WithAudiences provide accepted audiences.
+func WithAudiences(audiences ...string) ClaimsOption {
+	return func(v *ClaimsValidator) {
+		for i := range audiences {
+			if len(audiences[i]) > 0 {
+				v.audiences = append(v.audiences, audiences[i])
+			}
+		}
+	}
+}
+
+// WithRequiredClaims provide claims which must exist in token.
+func WithRequiredClaims(claims ...string) ClaimsOption {
+	return func(v *ClaimsValidator) {
+		for i := range claims {
+			if len(claims[i]) > 0 {
+				v.required = append(v.required, claims[i])
+			}
+		}
+	}
+}
+
+// WithLeeway provide leeway applied to exp, nbf and iat.
+func WithLeeway(leeway time.Duration) ClaimsOption {
+	return func(v *ClaimsValidator) {
+		if leeway > 0 {
+			v.leeway = leeway
+		}
+	}
+}
+
+// NewClaimsValidator create ClaimsValidator with options.
+func NewClaimsValidator(opts ...ClaimsOption) *ClaimsValidator {
+	res := &ClaimsValidator{
+		issuers:   make([]string, 0),
+		audiences: make([]string, 0),
+		required:  make([]string, 0),
+	}
+
+	for i := range opts {
+		opts[i](res)
+	}
+
+	return res
+}
+
+// Validate claims at given time, returns *ClaimsError if any rule is violated.
+func (v *ClaimsValidator) Validate(claims jwt.MapClaims, now time.Time) *ClaimsError {
+	leeway := int64(v.leeway.Seconds())
+	unix := now.Unix()
+
+	if !claims.VerifyExpiresAt(unix-leeway, false) {
+		return &ClaimsError{Reason: ReasonExpired}
+	}
+
+	if !claims.VerifyNotBefore(unix+leeway, false) {
+		return &ClaimsError{Reason: ReasonNotYetValid}
+	}
+
+	if !claims.VerifyIssuedAt(unix+leeway, false) {
+		return &ClaimsError{Reason: ReasonIssuedInFuture}
+	}
+
+	if len(v.issuers) > 0 {
+		accepted := false
+		for i := range v.issuers {
+			if claims.VerifyIssuer(v.issuers[i], true) {
+				accepted = true
+				break
+			}
+		}
+
+		if !accepted {
+			return &ClaimsError{Reason: ReasonBadIssuer, Inner: fmt.Errorf("unexpected iss=%v", claims["iss"])}
+		}
+	}
+
+	if len(v.audiences) > 0 {
+		accepted := false
+		for i := range v.audiences {
+			if claims.VerifyAudience(v.audiences[i], true) {
+				accepted = true
+				break
+			}
+		}
+
+		if !accepted {
+			return &ClaimsError{Reason: ReasonBadAudience, Inner: fmt.Errorf("unexpected aud=%v", claims["aud"])}
+		}
+	}
+
+	for i := range v.required {
+		if val, ok := claims[v.required[i]]; !ok || val == nil {
+			return &ClaimsError{Reason: ReasonMissingClaim, Inner: fmt.Errorf("missing claim=%s", v.required[i])}
+		}
+	}
+
+	return nil
+}
+
+// ClaimsSigner is an implementation of rkentry.SignerJwt which wraps another signer.
+//
+// Signature is verified by delegated signer, and then claims would be validated by ClaimsValidator.
+// Rejections are logged and counted in prometheus with reason label.
+type ClaimsSigner struct {
+	rkentry.SignerJwt
+	entryName  string
+	entryType  string
+	validator  *ClaimsValidator
+	logger     *zap.Logger
+	metricsSet *rkmidprom.MetricsSet
+}
+
+// NewClaimsSigner create ClaimsSigner which wraps delegate.
+func NewClaimsSigner(delegate rkentry.SignerJwt, validator *ClaimsValidator, entryName, entryType string, logger *zap.Logger, registerer prometheus.Registerer) *ClaimsSigner {
+	if validator == nil {
+		validator = NewClaimsValidator()
+	}
+
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	res := &ClaimsSigner{
+		SignerJwt:  delegate,
+		entryName:  entryName,
+		entryType:  entryType,
+		validator:  validator,
+		logger:     logger,
+		metricsSet: rkmidprom.NewMetricsSet("rk", "jwt", registerer),
+	}
+
+	// counter may already be registered by another middleware with same registerer, ignore error
+	res.metricsSet.RegisterCounter(metricsNameRejected, "entryName", "entryType", "reason")
+
+	return res
+}
+
+// VerifyJwt verify signature with delegated signer and validate claims.
+// Returned error is *ClaimsError.
+func (s *ClaimsSigner) VerifyJwt(raw string) (*jwt.Token, error) {
+	token, err := s.SignerJwt.VerifyJwt(raw)
+	if err != nil {
+		var vErr *jwt.ValidationError
+		if !errors.As(err, &vErr) || vErr.Errors&^timeValidationErrors != 0 {
+			return nil, s.reject(&ClaimsError{Reason: ReasonInvalidToken, Inner: err})
+		}
+
+		// signature is valid, registered time claims would be validated again with leeway
+		if token, _, err = new(jwt.Parser).ParseUnverified(raw, jwt.MapClaims{}); err != nil {
+			return nil, s.reject(&ClaimsError{Reason: ReasonInvalidToken, Inner: err})
+		}
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, s.reject(&ClaimsError{Reason: ReasonInvalidToken, Inner: errors.New("unexpected claims type")})
+	}
+
+	if cErr := s.validator.Validate(claims, jwt.TimeFunc()); cErr != nil {
+		return nil, s.reject(cErr)
+	}
+
+	token.Valid = true
+	return token, nil
+}
+
+// reject log and count rejection
+func (s *ClaimsSigner) reject(err *ClaimsError) error {
+	s.logger.Warn("Jwt rejected.",
+		zap.String("entryName", s.entryName),
+		zap.String("reason", err.Reason),
+		zap.Error(err.Inner))
+
+	if counter := s.metricsSet.GetCounterWithValues(metricsNameRejected, s.entryName, s.entryType, err.Reason); counter != nil {
+		counter.Inc()
+	}
+
+	return err
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberjwt
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"github.com/rookie-ninja/rk-entry/v2/middleware/jwt"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClaimsValidator_Validate(t *testing.T) {
+	now := time.Now()
+	validator := NewClaimsValidator(
+		WithIssuers("ut-issuer"),
+		WithAudiences("ut-aud"),
+		WithRequiredClaims("tenant"),
+		WithLeeway(time.Minute))
+
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":    "ut-issuer",
+			"aud":    []interface{}{"other-aud", "ut-aud"},
+			"tenant": "ut-tenant",
+			"exp":    float64(now.Add(time.Hour).Unix()),
+		}
+	}
+
+	// happy case
+	assert.Nil(t, validator.Validate(valid(), now))
+
+	// expired within leeway
+	claims := valid()
+	claims["exp"] = float64(now.Add(-30 * time.Second).Unix())
+	assert.Nil(t, validator.Validate(claims, now))
+
+	// expired
+	claims["exp"] = float64(now.Add(-2 * time.Minute).Unix())
+	assert.Equal(t, ReasonExpired, validator.Validate(claims, now).Reason)
+
+	// not yet valid
+	claims = valid()
+	claims["nbf"] = float64(now.Add(2 * time.Minute).Unix())
+	assert.Equal(t, ReasonNotYetValid, validator.Validate(claims, now).Reason)
+
+	// issued in future
+	claims = valid()
+	claims["iat"] = float64(now.Add(2 * time.Minute).Unix())
+	assert.Equal(t, ReasonIssuedInFuture, validator.Validate(claims, now).Reason)
+
+	// bad issuer
+	claims = valid()
+	claims["iss"] = "other-issuer"
+	assert.Equal(t, ReasonBadIssuer, validator.Validate(claims, now).Reason)
+
+	// bad audience
+	claims = valid()
+	claims["aud"] = "other-aud"
+	assert.Equal(t, ReasonBadAudience, validator.Validate(claims, now).Reason)
+
+	// missing claim
+	claims = valid()
+	delete(claims, "tenant")
+	assert.Equal(t, ReasonMissingClaim, validator.Validate(claims, now).Reason)
+}
+
+func TestClaimsSigner_VerifyJwt(t *testing.T) {
+	delegate := rkentry.RegisterSymmetricJwtSigner("ut-claims", jwt.SigningMethodHS256.Name, []byte("ut-key"))
+	registry := prometheus.NewRegistry()
+
+	signer := NewClaimsSigner(delegate,
+		NewClaimsValidator(WithAudiences("ut-aud"), WithLeeway(time.Minute)),
+		"ut-entry", "ut-type", nil, registry)
+
+	sign := func(claims jwt.MapClaims) string {
+		raw, _ := delegate.SignJwt(claims)
+		return raw
+	}
+
+	// happy case
+	token, err := signer.VerifyJwt(sign(jwt.MapClaims{"aud": "ut-aud"}))
+	assert.Nil(t, err)
+	assert.True(t, token.Valid)
+
+	// expired within leeway would be accepted, although delegate rejects it
+	raw := sign(jwt.MapClaims{"aud": "ut-aud", "exp": time.Now().Add(-30 * time.Second).Unix()})
+	_, err = delegate.VerifyJwt(raw)
+	assert.NotNil(t, err)
+	_, err = signer.VerifyJwt(raw)
+	assert.Nil(t, err)
+
+	// expired
+	_, err = signer.VerifyJwt(sign(jwt.MapClaims{"aud": "ut-aud", "exp": time.Now().Add(-time.Hour).Unix()}))
+	cErr := &ClaimsError{}
+	assert.True(t, errors.As(err, &cErr))
+	assert.Equal(t, ReasonExpired, cErr.Reason)
+
+	// expired and signed with other key
+	other := rkentry.RegisterSymmetricJwtSigner("ut-other", jwt.SigningMethodHS256.Name, []byte("ut-other-key"))
+	raw, _ = other.SignJwt(jwt.MapClaims{"aud": "ut-aud", "exp": time.Now().Add(-30 * time.Second).Unix()})
+	_, err = signer.VerifyJwt(raw)
+	assert.True(t, errors.As(err, &cErr))
+	assert.Equal(t, ReasonInvalidToken, cErr.Reason)
+
+	// bad audience
+	_, err = signer.VerifyJwt(sign(jwt.MapClaims{"aud": "other-aud"}))
+	assert.True(t, errors.As(err, &cErr))
+	assert.Equal(t, ReasonBadAudience, cErr.Reason)
+
+	// rejections are counted by reason
+	assert.Equal(t, float64(1), testutil.ToFloat64(
+		signer.metricsSet.GetCounter(metricsNameRejected).WithLabelValues("ut-entry", "ut-type", ReasonExpired)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(
+		signer.metricsSet.GetCounter(metricsNameRejected).WithLabelValues("ut-entry", "ut-type", ReasonBadAudience)))
+}
+
+func TestMiddleware_WithClaims(t *testing.T) {
+	config := &BootConfig{}
+	config.Enabled = true
+	config.Symmetric = &rkmidjwt.SymmetricConfig{
+		Algorithm: jwt.SigningMethodHS256.Name,
+		Token:     "ut-key",
+	}
+	config.Claims = &ClaimsConfig{
+		Issuers:  []string{"ut-issuer"},
+		Required: []string{"tenant"},
+	}
+
+	app := fiber.New()
+	app.Use(Middleware(ToOptions(config, "ut-entry", "ut-type", prometheus.NewRegistry())...))
+	app.Get("/ut-path", func(ctx *fiber.Ctx) error {
+		claims, ok := rkfiberctx.GetJwtClaims[struct {
+			Tenant string `json:"tenant"`
+		}](ctx)
+		assert.True(t, ok)
+		return ctx.SendString(claims.Tenant)
+	})
+
+	signer := rkentry.GlobalAppCtx.GetSignerJwtEntry("ut-entry")
+
+	// happy case
+	raw, _ := signer.SignJwt(jwt.MapClaims{"iss": "ut-issuer", "tenant": "ut-tenant"})
+	req := httptest.NewRequest(http.MethodGet, "/ut-path", nil)
+	req.Header.Set("Authorization", "Bearer "+raw)
+	resp, err := app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "ut-tenant", string(body))
+
+	// missing claim
+	raw, _ = signer.SignJwt(jwt.MapClaims{"iss": "ut-issuer"})
+	req = httptest.NewRequest(http.MethodGet, "/ut-path", nil)
+	req.Header.Set("Authorization", "Bearer "+raw)
+	resp, err = app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,500 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberjwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"go.uber.org/zap"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultJwksRefreshInterval is the interval after which cached keys would be fetched again
+	DefaultJwksRefreshInterval = time.Hour
+	// DefaultJwksMinRefetchInterval is the minimum interval between two fetches triggered by unknown kid
+	DefaultJwksMinRefetchInterval = 30 * time.Second
+	// DefaultJwksTimeout is the timeout of a single fetch
+	DefaultJwksTimeout = 5 * time.Second
+)
+
+var (
+	errJwksSignNotSupported = errors.New("jwks signer can not sign jwt")
+	errJwksKeyNotFound      = errors.New("no matching key found in jwks")
+)
+
+// JwksSigner is an implementation of rkentry.SignerJwt which verifies jwt with keys published at a JWKS URL.
+//
+// Keys are cached by kid and fetched again after refresh interval.
+// A token signed with an unknown kid triggers a fetch, but not more than once per min refetch interval.
+// If the JWKS endpoint is unreachable, the last known keys would be used.
+//
+// Only asymmetric keys (RSA, EC and OKP) are accepted, since a symmetric key published at a JWKS URL is public,
+// anyone who fetches it could sign tokens.
+type JwksSigner struct {
+	entryName          string
+	url                string
+	client             *http.Client
+	refreshInterval    time.Duration
+	minRefetchInterval time.Duration
+	logger             *zap.Logger
+
+	lock        sync.RWMutex
+	keys        map[string]*jwksKey
+	lastFetch   time.Time
+	lastAttempt time.Time
+	fetchLock   sync.Mutex
+}
+
+// jwksKey is a parsed key from JWKS document
+type jwksKey struct {
+	kid string
+	alg string
+	key interface{}
+}
+
+// jwksDocument is the JSON document published at JWKS URL
+type jwksDocument struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	} `json:"keys"`
+}
+
+// JwksOption option for JwksSigner
+type JwksOption func(*JwksSigner)
+
+// WithJwksUrl provide url of JWKS document.
+func WithJwksUrl(url string) JwksOption {
+	return func(s *JwksSigner) {
+		s.url = url
+	}
+}
+
+// WithJwksHttpClient provide http.Client used to fetch JWKS document.
+func WithJwksHttpClient(client *http.Client) JwksOption {
+	return func(s *JwksSigner) {
+		if client != nil {
+			s.client = client
+		}
+	}
+}
+
+// WithJwksRefreshInterval provide interval after which cached keys would be fetched again.
+func WithJwksRefreshInterval(interval time.Duration) JwksOption {
+	return func(s *JwksSigner) {
+		if interval > 0 {
+			s.refreshInterval = interval
+		}
+	}
+}
+
+// WithJwksMinRefetchInterval provide minimum interval between two fetches triggered by unknown kid.
+func WithJwksMinRefetchInterval(interval time.Duration) JwksOption {
+	return func(s *JwksSigner) {
+		if interval > 0 {
+			s.minRefetchInterval = interval
+		}
+	}
+}
+
+// WithJwksLogger provide zap.Logger which logs fetch failures.
+func WithJwksLogger(logger *zap.Logger) JwksOption {
+	return func(s *JwksSigner) {
+		if logger != nil {
+			s.logger = logger
+		}
+	}
+}
+
+// RegisterJwksSigner create JwksSigner and register it into rkentry.GlobalAppCtx.
+func RegisterJwksSigner(entryName string, opts ...JwksOption) *JwksSigner {
+	res := &JwksSigner{
+		entryName:          entryName,
+		client:             &http.Client{Timeout: DefaultJwksTimeout},
+		refreshInterval:    DefaultJwksRefreshInterval,
+		minRefetchInterval: DefaultJwksMinRefetchInterval,
+		logger:             zap.NewNop(),
+		keys:               make(map[string]*jwksKey),
+	}
+
+	for i := range opts {
+		opts[i](res)
+	}
+
+	rkentry.GlobalAppCtx.AddEntry(res)
+
+	return res
+}
+
+// Bootstrap fetch keys in advance, failures would be retried while verifying.
+func (s *JwksSigner) Bootstrap(ctx context.Context) {
+	s.refresh(true)
+}
+
+// Interrupt noop
+func (s *JwksSigner) Interrupt(ctx context.Context) {}
+
+// GetName returns entry name
+func (s *JwksSigner) GetName() string {
+	return s.entryName
+}
+
+// GetType returns entry type
+func (s *JwksSigner) GetType() string {
+	return rkentry.SignerJwtEntryType
+}
+
+// GetDescription returns entry description
+func (s *JwksSigner) GetDescription() string {
+	return "JWKS jwt signer"
+}
+
+// String stringfy signer
+func (s *JwksSigner) String() string {
+	s.lock.RLock()
+	kids := make([]string, 0, len(s.keys))
+	for k := range s.keys {
+		kids = append(kids, k)
+	}
+	s.lock.RUnlock()
+
+	m := map[string]string{
+		"name":                s.entryName,
+		"url":                 s.url,
+		"kids":                strings.Join(kids, ","),
+		"supportedAlgorithms": strings.Join(s.Algorithms(), ","),
+	}
+
+	bytes, _ := json.Marshal(m)
+	return string(bytes)
+}
+
+// SignJwt is not supported since JWKS only contains public keys
+func (s *JwksSigner) SignJwt(jwt.Claims) (string, error) {
+	return "", errJwksSignNotSupported
+}
+
+// VerifyJwt verify jwt with key matches kid in header
+func (s *JwksSigner) VerifyJwt(raw string) (*jwt.Token, error) {
+	parser := &jwt.Parser{
+		ValidMethods: s.Algorithms(),
+	}
+
+	token, err := parser.Parse(raw, s.keyFunc)
+
+	// return error
+	if err != nil {
+		return nil, err
+	}
+
+	// invalid token
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	return token, nil
+}
+
+// PubKey returns nil since there could be multiple keys
+func (s *JwksSigner) PubKey() []byte {
+	return nil
+}
+
+// Algorithms supported algorithms
+func (s *JwksSigner) Algorithms() []string {
+	return []string{
+		jwt.SigningMethodRS256.Name,
+		jwt.SigningMethodRS384.Name,
+		jwt.SigningMethodRS512.Name,
+		jwt.SigningMethodPS256.Name,
+		jwt.SigningMethodPS384.Name,
+		jwt.SigningMethodPS512.Name,
+		jwt.SigningMethodES256.Name,
+		jwt.SigningMethodES384.Name,
+		jwt.SigningMethodES512.Name,
+		jwt.SigningMethodEdDSA.Alg(),
+	}
+}
+
+// keyFunc lookup key by kid, fetch JWKS document again if kid is unknown or keys are stale
+func (s *JwksSigner) keyFunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+
+	if s.isStale() {
+		s.refresh(false)
+	}
+
+	key := s.getKey(kid)
+	if key == nil && s.canRefetch() {
+		s.refresh(true)
+		key = s.getKey(kid)
+	}
+
+	if key == nil {
+		return nil, errJwksKeyNotFound
+	}
+
+	if len(key.alg) > 0 && key.alg != t.Method.Alg() {
+		return nil, fmt.Errorf("unexpected jwt signing algorithm=%v", t.Header["alg"])
+	}
+
+	switch t.Method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		if _, ok := key.key.(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("unexpected jwt signing algorithm=%v", t.Header["alg"])
+		}
+	case *jwt.SigningMethodECDSA:
+		if _, ok := key.key.(*ecdsa.PublicKey); !ok {
+			return nil, fmt.Errorf("unexpected jwt signing algorithm=%v", t.Header["alg"])
+		}
+	case *jwt.SigningMethodEd25519:
+		if _, ok := key.key.(ed25519.PublicKey); !ok {
+			return nil, fmt.Errorf("unexpected jwt signing algorithm=%v", t.Header["alg"])
+		}
+	default:
+		return nil, fmt.Errorf("unexpected jwt signing algorithm=%v", t.Header["alg"])
+	}
+
+	return key.key, nil
+}
+
+// getKey returns key by kid, if kid is empty and there is only one key, then return it
+func (s *JwksSigner) getKey(kid string) *jwksKey {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if len(kid) < 1 && len(s.keys) == 1 {
+		for _, v := range s.keys {
+			return v
+		}
+	}
+
+	return s.keys[kid]
+}
+
+// isStale returns true if keys were never fetched or refresh interval passed
+func (s *JwksSigner) isStale() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return time.Since(s.lastFetch) > s.refreshInterval && time.Since(s.lastAttempt) > s.minRefetchInterval
+}
+
+// canRefetch returns true if min refetch interval passed since last attempt
+func (s *JwksSigner) canRefetch() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return time.Since(s.lastAttempt) > s.minRefetchInterval
+}
+
+// refresh fetch JWKS document and replace cached keys.
+//
+// Only one goroutine would fetch at a time. If block is false, other goroutines would use cached keys,
+// otherwise, they would wait for the ongoing fetch instead of fetching again.
+// Cached keys would be kept if fetch failed.
+func (s *JwksSigner) refresh(block bool) {
+	start := time.Now()
+
+	if !block {
+		if !s.fetchLock.TryLock() {
+			return
+		}
+	} else {
+		s.fetchLock.Lock()
+	}
+	defer s.fetchLock.Unlock()
+
+	// someone fetched while we were waiting
+	s.lock.RLock()
+	fetched := s.lastAttempt.After(start)
+	s.lock.RUnlock()
+	if fetched {
+		return
+	}
+
+	s.lock.Lock()
+	s.lastAttempt = time.Now()
+	s.lock.Unlock()
+
+	keys, err := s.fetch()
+	if err != nil {
+		s.logger.Warn("Failed to fetch jwks, use last known keys.",
+			zap.String("entryName", s.entryName),
+			zap.String("url", s.url),
+			zap.Error(err))
+		return
+	}
+
+	s.lock.Lock()
+	s.keys = keys
+	s.lastFetch = time.Now()
+	s.lock.Unlock()
+}
+
+// fetch JWKS document and parse keys
+func (s *JwksSigner) fetch() (map[string]*jwksKey, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d from jwks url", resp.StatusCode)
+	}
+
+	doc := &jwksDocument{}
+	if err := json.NewDecoder(resp.Body).Decode(doc); err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]*jwksKey)
+	for _, v := range doc.Keys {
+		// skip encryption keys
+		if len(v.Use) > 0 && v.Use != "sig" {
+			continue
+		}
+
+		var key interface{}
+		var err error
+
+		// symmetric keys (kty oct) and HMAC algorithms are rejected, keys of JWKS are public
+		switch v.Kty {
+		case "RSA":
+			key, err = parseRSAPublicKey(v.N, v.E)
+		case "EC":
+			key, err = parseECPublicKey(v.Crv, v.X, v.Y)
+		case "OKP":
+			key, err = parseOKPPublicKey(v.Crv, v.X)
+		default:
+			err = fmt.Errorf("unsupported key type %s", v.Kty)
+		}
+
+		if err == nil && strings.HasPrefix(strings.ToUpper(v.Alg), "HS") {
+			err = fmt.Errorf("unsupported algorithm %s", v.Alg)
+		}
+
+		if err != nil {
+			s.logger.Warn("Skip invalid key in jwks.",
+				zap.String("entryName", s.entryName),
+				zap.String("kid", v.Kid),
+				zap.Error(err))
+			continue
+		}
+
+		res[v.Kid] = &jwksKey{
+			kid: v.Kid,
+			alg: v.Alg,
+			key: key,
+		}
+	}
+
+	if len(res) < 1 {
+		return nil, errors.New("no valid key found in jwks")
+	}
+
+	return res, nil
+}
+
+// parseRSAPublicKey parse RSA public key from base64url encoded modulus and exponent
+func parseRSAPublicKey(n, e string) (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+
+	eBytes, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+
+	exp := new(big.Int).SetBytes(eBytes)
+	if !exp.IsInt64() || exp.Int64() > int64(^uint32(0)>>1) {
+		return nil, errors.New("invalid rsa exponent")
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: int(exp.Int64()),
+	}, nil
+}
+
+// parseOKPPublicKey parse Ed25519 public key from curve name and base64url encoded public key
+func parseOKPPublicKey(crv, x string) (ed25519.PublicKey, error) {
+	if crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported curve %s", crv)
+	}
+
+	xBytes, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(xBytes) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+
+	return ed25519.PublicKey(xBytes), nil
+}
+
+// parseECPublicKey parse EC public key from curve name and base64url encoded coordinates
+func parseECPublicKey(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %s", crv)
+	}
+
+	xBytes, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+
+	yBytes, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(xBytes),
+		Y:     new(big.Int).SetBytes(yBytes),
+	}
+
+	if !curve.IsOnCurve(res.X, res.Y) {
+		return nil, errors.New("invalid ec point")
+	}
+
+	return res, nil
+}
@@ -0,0 +1,291 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberjwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rookie-ninja/rk-entry/v2/middleware/jwt"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type jwksServer struct {
+	*httptest.Server
+	lock sync.Mutex
+	keys []map[string]string
+	hits int32
+}
+
+func newJwksServer() *jwksServer {
+	res := &jwksServer{}
+	res.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&res.hits, 1)
+		res.lock.Lock()
+		defer res.lock.Unlock()
+		bytes, _ := json.Marshal(map[string]interface{}{"keys": res.keys})
+		w.Write(bytes)
+	}))
+	return res
+}
+
+func (s *jwksServer) setRSAKeys(kid string, key *rsa.PrivateKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys = []map[string]string{{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}
+}
+
+func (s *jwksServer) getHits() int32 {
+	return atomic.LoadInt32(&s.hits)
+}
+
+func signRSA(t *testing.T, kid string, key *rsa.PrivateKey) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "ut-user",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = kid
+	raw, err := token.SignedString(key)
+	assert.Nil(t, err)
+	return raw
+}
+
+func TestJwksSigner_VerifyJwt(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := newJwksServer()
+	defer server.Close()
+	server.setRSAKeys("kid-1", key)
+
+	signer := RegisterJwksSigner("ut-jwks", WithJwksUrl(server.URL))
+
+	// happy case
+	token, err := signer.VerifyJwt(signRSA(t, "kid-1", key))
+	assert.Nil(t, err)
+	assert.Equal(t, "ut-user", token.Claims.(jwt.MapClaims)["sub"])
+
+	// keys are cached
+	_, err = signer.VerifyJwt(signRSA(t, "kid-1", key))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), server.getHits())
+
+	// signed with different key
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, err = signer.VerifyJwt(signRSA(t, "kid-1", otherKey))
+	assert.NotNil(t, err)
+
+	// sign is not supported
+	_, err = signer.SignJwt(jwt.MapClaims{})
+	assert.NotNil(t, err)
+	assert.NotEmpty(t, signer.String())
+}
+
+func TestJwksSigner_KeyRotation(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := newJwksServer()
+	defer server.Close()
+	server.setRSAKeys("kid-1", key)
+
+	signer := RegisterJwksSigner("ut-jwks",
+		WithJwksUrl(server.URL),
+		WithJwksMinRefetchInterval(time.Millisecond))
+	signer.Bootstrap(context.TODO())
+	assert.Equal(t, int32(1), server.getHits())
+
+	// rotate key, unknown kid should trigger refetch
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server.setRSAKeys("kid-2", newKey)
+	time.Sleep(5 * time.Millisecond)
+
+	_, err := signer.VerifyJwt(signRSA(t, "kid-2", newKey))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), server.getHits())
+}
+
+func TestJwksSigner_RefetchRateLimited(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := newJwksServer()
+	defer server.Close()
+	server.setRSAKeys("kid-1", key)
+
+	signer := RegisterJwksSigner("ut-jwks",
+		WithJwksUrl(server.URL),
+		WithJwksMinRefetchInterval(time.Hour))
+	signer.Bootstrap(context.TODO())
+
+	// unknown kid would not trigger refetch within min refetch interval
+	for i := 0; i < 10; i++ {
+		_, err := signer.VerifyJwt(signRSA(t, "kid-unknown", key))
+		assert.NotNil(t, err)
+	}
+	assert.Equal(t, int32(1), server.getHits())
+}
+
+func TestJwksSigner_FallbackToLastKnownKeys(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := newJwksServer()
+	server.setRSAKeys("kid-1", key)
+
+	signer := RegisterJwksSigner("ut-jwks",
+		WithJwksUrl(server.URL),
+		WithJwksRefreshInterval(time.Millisecond),
+		WithJwksMinRefetchInterval(time.Millisecond))
+	signer.Bootstrap(context.TODO())
+
+	// endpoint is unreachable
+	server.Close()
+	time.Sleep(5 * time.Millisecond)
+
+	_, err := signer.VerifyJwt(signRSA(t, "kid-1", key))
+	assert.Nil(t, err)
+}
+
+func TestJwksSigner_ECKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server := newJwksServer()
+	defer server.Close()
+	server.keys = []map[string]string{{
+		"kty": "EC",
+		"kid": "kid-ec",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}}
+
+	signer := RegisterJwksSigner("ut-jwks", WithJwksUrl(server.URL))
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"sub": "ut-user"})
+	token.Header["kid"] = "kid-ec"
+	raw, _ := token.SignedString(key)
+
+	_, err := signer.VerifyJwt(raw)
+	assert.Nil(t, err)
+
+	// algorithm confusion, HS256 signed with nothing should fail
+	token = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "ut-user"})
+	token.Header["kid"] = "kid-ec"
+	raw, _ = token.SignedString([]byte("ut-key"))
+	_, err = signer.VerifyJwt(raw)
+	assert.NotNil(t, err)
+}
+
+func TestJwksSigner_OKPKey(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	server := newJwksServer()
+	defer server.Close()
+	server.keys = []map[string]string{{
+		"kty": "OKP",
+		"kid": "kid-okp",
+		"crv": "Ed25519",
+		"x":   base64.RawURLEncoding.EncodeToString(pub),
+	}}
+
+	signer := RegisterJwksSigner("ut-jwks", WithJwksUrl(server.URL))
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{"sub": "ut-user"})
+	token.Header["kid"] = "kid-okp"
+	raw, _ := token.SignedString(priv)
+
+	_, err := signer.VerifyJwt(raw)
+	assert.Nil(t, err)
+}
+
+func TestJwksSigner_SymmetricKeyRejected(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := newJwksServer()
+	defer server.Close()
+	server.setRSAKeys("kid-rsa", key)
+	server.keys = append(server.keys,
+		map[string]string{
+			"kty": "oct",
+			"kid": "kid-oct",
+			"alg": "HS256",
+			"k":   base64.RawURLEncoding.EncodeToString([]byte("ut-key")),
+		},
+		map[string]string{
+			"kty": "RSA",
+			"kid": "kid-hs",
+			"alg": "HS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+
+	signer := RegisterJwksSigner("ut-jwks", WithJwksUrl(server.URL))
+
+	// symmetric key published in jwks could not be used to mint tokens
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "ut-user"})
+	token.Header["kid"] = "kid-oct"
+	raw, _ := token.SignedString([]byte("ut-key"))
+	_, err := signer.VerifyJwt(raw)
+	assert.NotNil(t, err)
+
+	// key with HMAC algorithm is skipped
+	signer.Bootstrap(context.Background())
+	assert.Nil(t, signer.getKey("kid-oct"))
+	assert.Nil(t, signer.getKey("kid-hs"))
+	assert.NotNil(t, signer.getKey("kid-rsa"))
+	assert.NotContains(t, signer.Algorithms(), jwt.SigningMethodHS256.Name)
+}
+
+func TestMiddleware_WithJwks(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := newJwksServer()
+	defer server.Close()
+	server.setRSAKeys("kid-1", key)
+
+	config := &BootConfig{}
+	config.Enabled = true
+	config.Jwks = &JwksConfig{Url: server.URL}
+
+	app := fiber.New()
+	app.Use(Middleware(ToOptions(config, "ut-entry", "ut-type", nil)...))
+	app.Get("/ut-path", userHandler)
+
+	// with valid token
+	req := httptest.NewRequest(http.MethodGet, "/ut-path", nil)
+	req.Header.Set("Authorization", "Bearer "+signRSA(t, "kid-1", key))
+	resp, err := app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// with invalid token
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	req = httptest.NewRequest(http.MethodGet, "/ut-path", nil)
+	req.Header.Set("Authorization", "Bearer "+signRSA(t, "kid-1", otherKey))
+	resp, err = app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// with signer option directly
+	app = fiber.New()
+	app.Use(Middleware(rkmidjwt.WithSigner(RegisterJwksSigner("ut-entry", WithJwksUrl(server.URL)))))
+	app.Get("/ut-path", userHandler)
+	req = httptest.NewRequest(http.MethodGet, "/ut-path", nil)
+	req.Header.Set("Authorization", "Bearer "+signRSA(t, "kid-1", key))
+	resp, err = app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberjwt
+
+import (
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"github.com/rookie-ninja/rk-entry/v2/middleware/jwt"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+// ***************** BootConfig *****************
+
+// BootConfig for YAML, extends rkmidjwt.BootConfig with fiber specific configs
+type BootConfig struct {
+	rkmidjwt.BootConfig `yaml:",inline" json:",inline" mapstructure:",squash"`
+	Jwks                *JwksConfig   `yaml:"jwks" json:"jwks"`
+	Claims              *ClaimsConfig `yaml:"claims" json:"claims"`
+}
+
+// JwksConfig for YAML
+type JwksConfig struct {
+	Url                   string `yaml:"url" json:"url"`
+	RefreshIntervalSec    int    `yaml:"refreshIntervalSec" json:"refreshIntervalSec"`
+	MinRefetchIntervalSec int    `yaml:"minRefetchIntervalSec" json:"minRefetchIntervalSec"`
+	TimeoutMs             int    `yaml:"timeoutMs" json:"timeoutMs"`
+}
+
+// ClaimsConfig for YAML
+type ClaimsConfig struct {
+	Issuers   []string `yaml:"issuers" json:"issuers"`
+	Audiences []string `yaml:"audiences" json:"audiences"`
+	Required  []string `yaml:"required" json:"required"`
+	LeewaySec int      `yaml:"leewaySec" json:"leewaySec"`
+}
+
+// ToOptions convert BootConfig into rkmidjwt.Option list
+func ToOptions(config *BootConfig, entryName, entryType string, registerer prometheus.Registerer) []rkmidjwt.Option {
+	midConfig := config.BootConfig
+
+	// jwks takes place of signer configs
+	if config.Jwks != nil && len(config.Jwks.Url) > 0 {
+		midConfig.SignerEntry = ""
+		midConfig.Symmetric = nil
+		midConfig.Asymmetric = nil
+	}
+
+	opts := rkmidjwt.ToOptions(&midConfig, entryName, entryType)
+	if !config.Enabled {
+		return opts
+	}
+
+	logger := zap.NewNop()
+	if loggerEntry := rkentry.GlobalAppCtx.GetLoggerEntryDefault(); loggerEntry != nil {
+		logger = loggerEntry.Logger
+	}
+
+	var signer rkentry.SignerJwt
+
+	if config.Jwks != nil && len(config.Jwks.Url) > 0 {
+		jwksOpts := []JwksOption{
+			WithJwksUrl(config.Jwks.Url),
+			WithJwksRefreshInterval(time.Duration(config.Jwks.RefreshIntervalSec) * time.Second),
+			WithJwksMinRefetchInterval(time.Duration(config.Jwks.MinRefetchIntervalSec) * time.Second),
+			WithJwksLogger(logger),
+		}
+
+		if config.Jwks.TimeoutMs > 0 {
+			jwksOpts = append(jwksOpts, WithJwksHttpClient(&http.Client{Timeout: time.Duration(config.Jwks.TimeoutMs) * time.Millisecond}))
+		}
+
+		signer = RegisterJwksSigner(entryName, jwksOpts...)
+	}
+
+	if config.Claims != nil && !config.SkipVerify {
+		if signer == nil {
+			signer = lookupSigner(config.SignerEntry, entryName)
+		}
+
+		validator := NewClaimsValidator(
+			WithIssuers(config.Claims.Issuers...),
+			WithAudiences(config.Claims.Audiences...),
+			WithRequiredClaims(config.Claims.Required...),
+			WithLeeway(time.Duration(config.Claims.LeewaySec)*time.Second))
+
+		signer = NewClaimsSigner(signer, validator, entryName, entryType, logger, registerer)
+	}
+
+	if signer != nil {
+		opts = append(opts, rkmidjwt.WithSigner(signer))
+	}
+
+	return opts
+}
+
+// lookupSigner returns signer registered by rkmidjwt.ToOptions, or the default one as rkmidjwt.NewOptionSet does
+func lookupSigner(signerEntry, entryName string) rkentry.SignerJwt {
+	if signer := rkentry.GlobalAppCtx.GetSignerJwtEntry(signerEntry); len(signerEntry) > 0 && signer != nil {
+		return signer
+	}
+
+	if signer := rkentry.GlobalAppCtx.GetSignerJwtEntry(entryName); signer != nil {
+		return signer
+	}
+
+	return rkentry.RegisterSymmetricJwtSigner(entryName, jwt.SigningMethodHS256.Name, []byte("rk jwt key"))
+}
@@ -24,6 +24,11 @@ func Middleware(opts ...rkmidlog.Option) fiber.Handler {
 	return func(ctx *fiber.Ctx) error {
 		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, set.GetEntryName()))
 
+		// request issued by middleware was already logged as original request
+		if rkfiberctx.IsInternalRequest(ctx) {
+			return ctx.Next()
+		}
+
 		req := &http.Request{}
 		fasthttpadaptor.ConvertRequest(ctx.Context(), req, true)
 
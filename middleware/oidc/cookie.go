@@ -0,0 +1,139 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberoidc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const (
+	// maxCookieValueSize is max size of value of a cookie, browsers drop cookies larger than 4096 bytes
+	// including name and attributes
+	maxCookieValueSize = 3800
+	// maxCookieChunks is max number of cookies which session is split into
+	maxCookieChunks = 8
+)
+
+var (
+	// errSessionTooLarge is returned if encrypted session does not fit into maxCookieChunks cookies
+	errSessionTooLarge = errors.New("oidc session is too large for cookies")
+	// errSessionMissing is returned if session referred by cookie is missing in session store
+	errSessionMissing = errors.New("oidc session is missing in store")
+)
+
+// session stored in encrypted cookie, or in session store
+type session struct {
+	IdToken      string `json:"it"`
+	AccessToken  string `json:"at"`
+	RefreshToken string `json:"rt,omitempty"`
+	ExpiresAt    int64  `json:"exp"`
+
+	// id of session in session store
+	id string
+}
+
+// sessionRef stored in encrypted cookie if session is kept in session store
+type sessionRef struct {
+	Id string `json:"id"`
+}
+
+// loginState stored in encrypted cookie between login and callback
+type loginState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	ReturnTo string `json:"r"`
+}
+
+// cookieCodec encrypts and decrypts cookie values with AES-GCM
+type cookieCodec struct {
+	aead cipher.AEAD
+}
+
+// newCookieCodec create cookieCodec, key is derived from secret with sha256
+func newCookieCodec(secret []byte) *cookieCodec {
+	key := sha256.Sum256(secret)
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+
+	return &cookieCodec{
+		aead: aead,
+	}
+}
+
+// encode marshal value into json, encrypt it with cookie name as additional data
+func (c *cookieCodec) encode(name string, value interface{}) (string, error) {
+	plain, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(c.aead.Seal(nonce, nonce, plain, []byte(name))), nil
+}
+
+// decode decrypt cookie value and unmarshal it into value
+func (c *cookieCodec) decode(name, raw string, value interface{}) error {
+	bytes, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return err
+	}
+
+	if len(bytes) < c.aead.NonceSize() {
+		return errors.New("cookie value too short")
+	}
+
+	plain, err := c.aead.Open(nil, bytes[:c.aead.NonceSize()], bytes[c.aead.NonceSize():], []byte(name))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(plain, value)
+}
+
+// chunkName returns name of i-th cookie of value, first chunk keeps name as is
+func chunkName(name string, i int) string {
+	if i < 1 {
+		return name
+	}
+
+	return name + "_" + strconv.Itoa(i)
+}
+
+// splitValue splits cookie value into chunks of maxCookieValueSize
+func splitValue(value string) ([]string, error) {
+	res := make([]string, 0, len(value)/maxCookieValueSize+1)
+	for len(value) > maxCookieValueSize {
+		res = append(res, value[:maxCookieValueSize])
+		value = value[maxCookieValueSize:]
+	}
+	res = append(res, value)
+
+	if len(res) > maxCookieChunks {
+		return nil, errSessionTooLarge
+	}
+
+	return res, nil
+}
+
+// randomString returns url safe random string with n bytes of entropy
+func randomString(n int) string {
+	bytes := make([]byte, n)
+	rand.Read(bytes)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
@@ -0,0 +1,594 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+// Package rkfiberoidc is OpenID Connect login middleware for fiber framework
+package rkfiberoidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"github.com/rookie-ninja/rk-fiber/middleware/jwt"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stateCookieMaxAge is the max age of state cookie between login and callback
+const stateCookieMaxAge = 10 * time.Minute
+
+// Middleware handles OpenID Connect authorization code flow with PKCE.
+//
+// 1: login path redirects user to authorization endpoint of identity provider with state, nonce and PKCE challenge.
+// 2: callback path validates state, exchanges code for tokens, verifies id_token and stores session in encrypted cookie,
+// or in session store with encrypted session id in cookie if store is provided.
+// 3: logout path clears session cookie and redirects user to end_session_endpoint of identity provider if exists.
+//
+// Expired session would be refreshed with refresh token. Logged-in user could be retrieved with rkfiberctx.GetOidcUser().
+// Requests without session are redirected to login path if method is GET, otherwise 401 would be returned.
+func Middleware(opts ...Option) fiber.Handler {
+	set := newOptionSet(opts...)
+	mid := newMiddleware(set)
+
+	return func(ctx *fiber.Ctx) error {
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, set.entryName))
+
+		switch ctx.Path() {
+		case set.loginPath:
+			return mid.login(ctx)
+		case set.callbackPath:
+			return mid.callback(ctx)
+		case set.logoutPath:
+			return mid.logout(ctx)
+		}
+
+		// ignored paths like health checks never refresh or clear session
+		if set.ShouldIgnore(ctx.Path()) {
+			return ctx.Next()
+		}
+
+		if user := mid.authenticate(ctx); user != nil {
+			ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkfiberctx.OidcUserKey, user))
+			return ctx.Next()
+		}
+
+		if ctx.Method() == http.MethodGet || ctx.Method() == http.MethodHead {
+			return ctx.Redirect(set.loginPath+"?returnTo="+url.QueryEscape(ctx.OriginalURL()), http.StatusFound)
+		}
+
+		return abort(ctx, http.StatusUnauthorized, "Login required")
+	}
+}
+
+// middleware holds states shared across requests
+type middleware struct {
+	set      *optionSet
+	provider *provider
+	codec    *cookieCodec
+	logger   *zap.Logger
+	lock     sync.Mutex
+	verifier rkentry.SignerJwt
+
+	// refreshes in progress by session
+	refreshLock sync.Mutex
+	refreshes   map[string]*refreshCall
+}
+
+// refreshCall is a refresh in progress, concurrent requests of same session wait for it
+type refreshCall struct {
+	done   chan struct{}
+	sess   *session
+	claims jwt.MapClaims
+	err    error
+}
+
+// newMiddleware create middleware, random cookie secret would be used if missing
+func newMiddleware(set *optionSet) *middleware {
+	logger := rkentry.GlobalAppCtx.GetLoggerEntryDefault().Logger
+
+	secret := []byte(set.cookieSecret)
+	if len(secret) < 1 {
+		logger.Warn("Cookie secret of oidc middleware is empty, using random secret, sessions would not survive restart.",
+			zap.String("entryName", set.entryName))
+		secret = []byte(randomString(32))
+	}
+
+	return &middleware{
+		set:       set,
+		provider:  &provider{set: set},
+		codec:     newCookieCodec(secret),
+		logger:    logger,
+		refreshes: make(map[string]*refreshCall),
+	}
+}
+
+// login redirects user to authorization endpoint
+func (m *middleware) login(ctx *fiber.Ctx) error {
+	disc, err := m.provider.getDiscovery()
+	if err != nil {
+		m.logger.Warn("Failed to fetch oidc discovery document.", zap.Error(err))
+		return abort(ctx, http.StatusBadGateway, "Identity provider unavailable")
+	}
+
+	state := &loginState{
+		State:    randomString(16),
+		Nonce:    randomString(16),
+		Verifier: randomString(32),
+		ReturnTo: m.set.postLoginRedirectUrl,
+	}
+
+	if returnTo := ctx.Query("returnTo"); isLocalPath(returnTo) {
+		state.ReturnTo = returnTo
+	}
+
+	value, err := m.codec.encode(m.stateCookieName(), state)
+	if err != nil {
+		return abort(ctx, http.StatusInternalServerError, "Failed to create login state")
+	}
+
+	// state cookie must be sent with top level cross site navigation from identity provider
+	ctx.Cookie(&fiber.Cookie{
+		Name:     m.stateCookieName(),
+		Value:    value,
+		Path:     m.set.cookiePath,
+		Domain:   m.set.cookieDomain,
+		MaxAge:   int(stateCookieMaxAge.Seconds()),
+		Secure:   m.set.cookieSecure,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {m.set.clientId},
+		"redirect_uri":          {m.redirectUrl(ctx)},
+		"scope":                 {strings.Join(m.set.scopes, " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	return ctx.Redirect(withQuery(disc.AuthorizationEndpoint, query), http.StatusFound)
+}
+
+// callback validates state, exchanges code and stores session
+func (m *middleware) callback(ctx *fiber.Ctx) error {
+	state := &loginState{}
+	raw := ctx.Cookies(m.stateCookieName())
+	m.clearCookie(ctx, m.stateCookieName())
+
+	if len(raw) < 1 || m.codec.decode(m.stateCookieName(), raw, state) != nil {
+		return abort(ctx, http.StatusBadRequest, "Missing or invalid login state")
+	}
+
+	if state.State != ctx.Query("state") {
+		return abort(ctx, http.StatusBadRequest, "State mismatch")
+	}
+
+	if errCode := ctx.Query("error"); len(errCode) > 0 {
+		m.logger.Warn("Identity provider returns error.",
+			zap.String("error", errCode),
+			zap.String("description", ctx.Query("error_description")))
+		return abort(ctx, http.StatusUnauthorized, "Login failed")
+	}
+
+	resp, err := m.provider.exchangeCode(ctx.Query("code"), state.Verifier, m.redirectUrl(ctx))
+	if err != nil {
+		m.logger.Warn("Failed to exchange oidc authorization code.", zap.Error(err))
+		return abort(ctx, http.StatusUnauthorized, "Login failed")
+	}
+
+	claims, err := m.verifyIdToken(resp.IdToken)
+	if err != nil {
+		m.logger.Warn("Failed to verify oidc id_token.", zap.Error(err))
+		return abort(ctx, http.StatusUnauthorized, "Login failed")
+	}
+
+	if claims["nonce"] != state.Nonce {
+		m.logger.Warn("Nonce mismatch in oidc id_token.")
+		return abort(ctx, http.StatusUnauthorized, "Login failed")
+	}
+
+	if err := m.saveSession(ctx, newSession(resp, "", claims)); err != nil {
+		return abort(ctx, http.StatusInternalServerError, "Failed to save session")
+	}
+
+	return ctx.Redirect(state.ReturnTo, http.StatusFound)
+}
+
+// logout clears session and redirects user to end_session_endpoint if exists
+func (m *middleware) logout(ctx *fiber.Ctx) error {
+	sess, err := m.loadSession(ctx)
+	if err != nil {
+		sess = nil
+	}
+	m.clearSession(ctx, sess)
+
+	redirect := m.set.postLogoutRedirectUrl
+	if len(redirect) < 1 {
+		redirect = "/"
+	}
+
+	disc, err := m.provider.getDiscovery()
+	if err != nil || len(disc.EndSessionEndpoint) < 1 {
+		return ctx.Redirect(redirect, http.StatusFound)
+	}
+
+	query := url.Values{
+		"client_id": {m.set.clientId},
+	}
+	if len(m.set.postLogoutRedirectUrl) > 0 {
+		query.Set("post_logout_redirect_uri", m.set.postLogoutRedirectUrl)
+	}
+	if sess != nil {
+		query.Set("id_token_hint", sess.IdToken)
+	}
+
+	return ctx.Redirect(withQuery(disc.EndSessionEndpoint, query), http.StatusFound)
+}
+
+// authenticate read session from cookie and refresh it if expired, returns nil if no valid session
+func (m *middleware) authenticate(ctx *fiber.Ctx) *rkfiberctx.OidcUser {
+	sess, err := m.loadSession(ctx)
+	if sess == nil {
+		if err != nil {
+			m.clearSession(ctx, nil)
+		}
+		return nil
+	}
+
+	// id_token was verified while saving session
+	token, _, err := new(jwt.Parser).ParseUnverified(sess.IdToken, jwt.MapClaims{})
+	if err != nil {
+		m.clearSession(ctx, sess)
+		return nil
+	}
+	claims := token.Claims.(jwt.MapClaims)
+
+	if time.Now().Unix() >= sess.ExpiresAt {
+		id := sess.id
+		if sess, claims, err = m.refreshOnce(sess, claims); err != nil {
+			m.logger.Info("Failed to refresh oidc session.", zap.Error(err))
+			m.clearSession(ctx, &session{id: id})
+			return nil
+		}
+		sess.id = id
+
+		if err := m.saveSession(ctx, sess); err != nil {
+			return nil
+		}
+	}
+
+	return newUser(sess, claims)
+}
+
+// refreshOnce coalesces concurrent refreshes of same session, so that rotated refresh token is used only once.
+//
+// Session is identified by id in session store, or by refresh token if session is kept in cookie.
+// Returned session is a copy which could be modified by caller.
+func (m *middleware) refreshOnce(sess *session, claims jwt.MapClaims) (*session, jwt.MapClaims, error) {
+	key := sess.id
+	if len(key) < 1 {
+		sum := sha256.Sum256([]byte(sess.RefreshToken))
+		key = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+
+	m.refreshLock.Lock()
+	call, ok := m.refreshes[key]
+	if !ok {
+		call = &refreshCall{done: make(chan struct{})}
+		m.refreshes[key] = call
+	}
+	m.refreshLock.Unlock()
+
+	if ok {
+		<-call.done
+	} else {
+		call.sess, call.claims, call.err = m.refresh(sess, claims)
+
+		m.refreshLock.Lock()
+		delete(m.refreshes, key)
+		m.refreshLock.Unlock()
+		close(call.done)
+	}
+
+	if call.err != nil {
+		return nil, nil, call.err
+	}
+
+	res := *call.sess
+	return &res, call.claims, nil
+}
+
+// refresh exchange refresh token for new tokens
+func (m *middleware) refresh(sess *session, claims jwt.MapClaims) (*session, jwt.MapClaims, error) {
+	if len(sess.RefreshToken) < 1 {
+		return nil, nil, errors.New("session expired without refresh token")
+	}
+
+	resp, err := m.provider.refresh(sess.RefreshToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// id_token is optional in refresh response
+	if len(resp.IdToken) > 0 {
+		if claims, err = m.verifyIdToken(resp.IdToken); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		resp.IdToken = sess.IdToken
+	}
+
+	return newSession(resp, sess.RefreshToken, claims), claims, nil
+}
+
+// verifyIdToken verify signature of id_token with keys from jwks_uri and validate iss, aud and sub
+func (m *middleware) verifyIdToken(raw string) (jwt.MapClaims, error) {
+	if len(raw) < 1 {
+		return nil, errors.New("missing id_token in token response")
+	}
+
+	verifier, err := m.getVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := verifier.VerifyJwt(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return token.Claims.(jwt.MapClaims), nil
+}
+
+// getVerifier create JwksSigner with jwks_uri from discovery document,
+// wrapped by ClaimsSigner which validates iss, aud and sub of id_token
+func (m *middleware) getVerifier() (rkentry.SignerJwt, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.verifier != nil {
+		return m.verifier, nil
+	}
+
+	disc, err := m.provider.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	signer := rkfiberjwt.RegisterJwksSigner(m.set.entryName+"-oidc",
+		rkfiberjwt.WithJwksUrl(disc.JwksUri),
+		rkfiberjwt.WithJwksHttpClient(m.set.httpClient),
+		rkfiberjwt.WithJwksLogger(m.logger))
+
+	validator := rkfiberjwt.NewClaimsValidator(
+		rkfiberjwt.WithIssuers(disc.Issuer),
+		rkfiberjwt.WithAudiences(m.set.clientId),
+		rkfiberjwt.WithRequiredClaims("sub"),
+		rkfiberjwt.WithLeeway(time.Minute))
+
+	m.verifier = rkfiberjwt.NewClaimsSigner(signer, validator, m.set.entryName, m.set.entryType, m.logger, m.set.registerer)
+
+	return m.verifier, nil
+}
+
+// saveSession encrypt session and set it into cookies, or into session store with encrypted session id in cookie.
+//
+// Tokens of identity provider may exceed size limit of a cookie, encrypted value is split into chunks
+// named cookieName, cookieName_1, cookieName_2 and so on, chunks left by previous larger value are cleared.
+func (m *middleware) saveSession(ctx *fiber.Ctx, sess *session) error {
+	var value string
+	var err error
+	if m.set.store == nil {
+		value, err = m.codec.encode(m.set.cookieName, sess)
+	} else {
+		value, err = m.storeSession(sess)
+	}
+	if err != nil {
+		return err
+	}
+
+	chunks, err := splitValue(value)
+	if err != nil {
+		m.logger.Warn("Oidc session exceeds max size of cookies, please provide session store.", zap.Int("size", len(value)))
+		return err
+	}
+
+	for i := range chunks {
+		ctx.Cookie(&fiber.Cookie{
+			Name:     chunkName(m.set.cookieName, i),
+			Value:    chunks[i],
+			Path:     m.set.cookiePath,
+			Domain:   m.set.cookieDomain,
+			MaxAge:   int(m.set.cookieMaxAge.Seconds()),
+			Secure:   m.set.cookieSecure,
+			HTTPOnly: true,
+			SameSite: m.set.cookieSameSite,
+		})
+	}
+
+	for i := len(chunks); i < maxCookieChunks; i++ {
+		if name := chunkName(m.set.cookieName, i); len(ctx.Cookies(name)) > 0 {
+			m.clearCookie(ctx, name)
+		}
+	}
+
+	return nil
+}
+
+// storeSession encrypt session into session store, returns encrypted reference of it which is set into cookie
+func (m *middleware) storeSession(sess *session) (string, error) {
+	if len(sess.id) < 1 {
+		sess.id = randomString(32)
+	}
+
+	data, err := m.codec.encode(m.set.cookieName, sess)
+	if err != nil {
+		return "", err
+	}
+
+	if err := m.set.store.Set(sess.id, []byte(data), m.set.cookieMaxAge); err != nil {
+		return "", err
+	}
+
+	return m.codec.encode(m.set.cookieName, &sessionRef{Id: sess.id})
+}
+
+// loadSession returns session of request, nil without error if cookie is missing
+func (m *middleware) loadSession(ctx *fiber.Ctx) (*session, error) {
+	raw := ctx.Cookies(m.set.cookieName)
+	if len(raw) < 1 {
+		return nil, nil
+	}
+
+	for i := 1; i < maxCookieChunks; i++ {
+		chunk := ctx.Cookies(chunkName(m.set.cookieName, i))
+		if len(chunk) < 1 {
+			break
+		}
+		raw += chunk
+	}
+
+	if m.set.store == nil {
+		sess := &session{}
+		if err := m.codec.decode(m.set.cookieName, raw, sess); err != nil {
+			return nil, err
+		}
+		return sess, nil
+	}
+
+	ref := &sessionRef{}
+	if err := m.codec.decode(m.set.cookieName, raw, ref); err != nil {
+		return nil, err
+	}
+
+	data, err := m.set.store.Get(ref.Id)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errSessionMissing
+	}
+
+	sess := &session{id: ref.Id}
+	if err := m.codec.decode(m.set.cookieName, string(data), sess); err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+// clearSession expire cookies of session and remove it from session store
+func (m *middleware) clearSession(ctx *fiber.Ctx, sess *session) {
+	if m.set.store != nil && sess != nil && len(sess.id) > 0 {
+		if err := m.set.store.Delete(sess.id); err != nil {
+			m.logger.Warn("Failed to delete oidc session.", zap.Error(err))
+		}
+	}
+
+	m.clearCookie(ctx, m.set.cookieName)
+	for i := 1; i < maxCookieChunks; i++ {
+		if name := chunkName(m.set.cookieName, i); len(ctx.Cookies(name)) > 0 {
+			m.clearCookie(ctx, name)
+		}
+	}
+}
+
+// clearCookie expire cookie with same path and domain
+func (m *middleware) clearCookie(ctx *fiber.Ctx, name string) {
+	ctx.Cookie(&fiber.Cookie{
+		Name:     name,
+		Path:     m.set.cookiePath,
+		Domain:   m.set.cookieDomain,
+		Expires:  fasthttp.CookieExpireDelete,
+		Secure:   m.set.cookieSecure,
+		HTTPOnly: true,
+		SameSite: m.set.cookieSameSite,
+	})
+}
+
+// stateCookieName returns name of state cookie
+func (m *middleware) stateCookieName() string {
+	return m.set.cookieName + "_state"
+}
+
+// redirectUrl returns configured redirect url or callback path on current host
+func (m *middleware) redirectUrl(ctx *fiber.Ctx) string {
+	if len(m.set.redirectUrl) > 0 {
+		return m.set.redirectUrl
+	}
+
+	return ctx.BaseURL() + m.set.callbackPath
+}
+
+// newSession create session from token response, expiry of id_token is used if expires_in is missing
+func newSession(resp *tokenResponse, refreshToken string, claims jwt.MapClaims) *session {
+	res := &session{
+		IdToken:      resp.IdToken,
+		AccessToken:  resp.AccessToken,
+		RefreshToken: resp.RefreshToken,
+	}
+
+	if len(res.RefreshToken) < 1 {
+		res.RefreshToken = refreshToken
+	}
+
+	if resp.ExpiresIn > 0 {
+		res.ExpiresAt = time.Now().Unix() + resp.ExpiresIn
+	} else if exp, ok := claims["exp"].(float64); ok {
+		res.ExpiresAt = int64(exp)
+	}
+
+	return res
+}
+
+// newUser create rkfiberctx.OidcUser from session and claims of id_token
+func newUser(sess *session, claims jwt.MapClaims) *rkfiberctx.OidcUser {
+	res := &rkfiberctx.OidcUser{
+		Claims:      claims,
+		AccessToken: sess.AccessToken,
+		ExpiresAt:   time.Unix(sess.ExpiresAt, 0),
+	}
+
+	res.Subject, _ = claims["sub"].(string)
+	res.Email, _ = claims["email"].(string)
+	res.Name, _ = claims["name"].(string)
+
+	return res
+}
+
+// isLocalPath prevents open redirect, only path on same host is allowed
+func isLocalPath(path string) bool {
+	return strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//") && !strings.HasPrefix(path, "/\\")
+}
+
+// withQuery append query to endpoint which may already contain query
+func withQuery(endpoint string, query url.Values) string {
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&" + query.Encode()
+	}
+
+	return fmt.Sprintf("%s?%s", endpoint, query.Encode())
+}
+
+// abort write error response with rk error builder
+func abort(ctx *fiber.Ctx, code int, msg string) error {
+	ctx.Response().SetStatusCode(code)
+	return ctx.JSON(rkmid.GetErrorBuilder().New(code, msg))
+}
@@ -0,0 +1,540 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberoidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"github.com/rookie-ninja/rk-fiber/middleware/session"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockProvider is a minimal OpenID provider
+type mockProvider struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+	// number of refreshes, and delay of refresh response
+	refreshes    int32
+	refreshDelay time.Duration
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	res := &mockProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 res.URL,
+			"authorization_endpoint": res.URL + "/authorize",
+			"token_endpoint":         res.URL + "/token",
+			"jwks_uri":               res.URL + "/jwks",
+			"end_session_endpoint":   res.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "ut-kid",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		id, secret, _ := r.BasicAuth()
+		if id != "ut-client" || secret != "ut-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		switch r.Form.Get("grant_type") {
+		case "authorization_code":
+			sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+			if r.Form.Get("code") != "ut-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != res.challenge {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+				return
+			}
+		case "refresh_token":
+			if r.Form.Get("refresh_token") != "ut-refresh" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+				return
+			}
+			atomic.AddInt32(&res.refreshes, 1)
+			time.Sleep(res.refreshDelay)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "ut-access",
+			"token_type":    "Bearer",
+			"refresh_token": "ut-refresh",
+			"id_token":      res.idToken(t, res.nonce),
+			"expires_in":    3600,
+		})
+	})
+
+	res.Server = httptest.NewServer(mux)
+	return res
+}
+
+func (p *mockProvider) idToken(t *testing.T, nonce string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   p.URL,
+		"aud":   "ut-client",
+		"sub":   "ut-user",
+		"email": "ut-user@example.com",
+		"nonce": nonce,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = "ut-kid"
+	raw, err := token.SignedString(p.key)
+	assert.Nil(t, err)
+	return raw
+}
+
+func newApp(p *mockProvider, opts ...Option) *fiber.App {
+	// chunked session cookies exceed default read buffer of fasthttp
+	app := fiber.New(fiber.Config{ReadBufferSize: 16 * 1024})
+	app.Use(Middleware(append([]Option{
+		WithEntryNameAndType("ut-entry", "ut-type"),
+		WithIssuer(p.URL),
+		WithClient("ut-client", "ut-secret"),
+		WithCookieSecret("ut-cookie-secret"),
+		WithPathToIgnore("/ut-public"),
+		WithPostLogoutRedirectUrl("/ut-bye")}, opts...)...))
+	app.Get("/ut-path", func(ctx *fiber.Ctx) error {
+		return ctx.SendString(rkfiberctx.GetOidcUser(ctx).Subject)
+	})
+	app.Post("/ut-path", userHandler)
+	app.Get("/ut-public", userHandler)
+	return app
+}
+
+var userHandler = func(ctx *fiber.Ctx) error {
+	return nil
+}
+
+func getCookie(resp *http.Response, name string) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestMiddleware_LoginFlow(t *testing.T) {
+	p := newMockProvider(t)
+	defer p.Close()
+	app := newApp(p)
+
+	// without session, redirect to login
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ut-path?a=b", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, DefaultLoginPath+"?returnTo="+url.QueryEscape("/ut-path?a=b"), resp.Header.Get("Location"))
+
+	// login, redirect to identity provider
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, resp.Header.Get("Location"), nil))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	assert.Equal(t, p.URL+"/authorize", location.Scheme+"://"+location.Host+location.Path)
+	assert.Equal(t, "code", location.Query().Get("response_type"))
+	assert.Equal(t, "ut-client", location.Query().Get("client_id"))
+	assert.Equal(t, "openid profile email", location.Query().Get("scope"))
+	assert.Equal(t, "S256", location.Query().Get("code_challenge_method"))
+	assert.True(t, strings.HasSuffix(location.Query().Get("redirect_uri"), DefaultCallbackPath))
+	stateCookie := getCookie(resp, DefaultCookieName+"_state")
+	assert.NotNil(t, stateCookie)
+	assert.True(t, stateCookie.HttpOnly)
+
+	// identity provider authenticates user
+	p.challenge = location.Query().Get("code_challenge")
+	p.nonce = location.Query().Get("nonce")
+
+	// callback, redirect to original url
+	req := httptest.NewRequest(http.MethodGet,
+		DefaultCallbackPath+"?code=ut-code&state="+location.Query().Get("state"), nil)
+	req.AddCookie(stateCookie)
+	resp, err = app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/ut-path?a=b", resp.Header.Get("Location"))
+	sessionCookie := getCookie(resp, DefaultCookieName)
+	assert.NotNil(t, sessionCookie)
+
+	// with session
+	req = httptest.NewRequest(http.MethodGet, "/ut-path", nil)
+	req.AddCookie(sessionCookie)
+	resp, err = app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "ut-user", string(body))
+
+	// logout, redirect to end session endpoint
+	req = httptest.NewRequest(http.MethodGet, DefaultLogoutPath, nil)
+	req.AddCookie(sessionCookie)
+	resp, err = app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	location, _ = url.Parse(resp.Header.Get("Location"))
+	assert.Equal(t, "/logout", location.Path)
+	assert.Equal(t, "/ut-bye", location.Query().Get("post_logout_redirect_uri"))
+	assert.NotEmpty(t, location.Query().Get("id_token_hint"))
+	assert.Empty(t, getCookie(resp, DefaultCookieName).Value)
+}
+
+func TestMiddleware_Callback(t *testing.T) {
+	p := newMockProvider(t)
+	defer p.Close()
+	app := newApp(p)
+	codec := newCookieCodec([]byte("ut-cookie-secret"))
+	stateName := DefaultCookieName + "_state"
+
+	newCallback := func(state *loginState, query string) *http.Request {
+		value, _ := codec.encode(stateName, state)
+		req := httptest.NewRequest(http.MethodGet, DefaultCallbackPath+"?"+query, nil)
+		req.AddCookie(&http.Cookie{Name: stateName, Value: value})
+		return req
+	}
+
+	verifier := "ut-verifier"
+	sum := sha256.Sum256([]byte(verifier))
+	p.challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+
+	// without state cookie
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, DefaultCallbackPath+"?code=ut-code&state=ut-state", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// state mismatch
+	resp, err = app.Test(newCallback(&loginState{State: "ut-state", Nonce: "ut-nonce", Verifier: verifier}, "code=ut-code&state=other"))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// state cookie encrypted with other secret
+	value, _ := newCookieCodec([]byte("other")).encode(stateName, &loginState{State: "ut-state"})
+	req := httptest.NewRequest(http.MethodGet, DefaultCallbackPath+"?code=ut-code&state=ut-state", nil)
+	req.AddCookie(&http.Cookie{Name: stateName, Value: value})
+	resp, err = app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// nonce mismatch
+	p.nonce = "other"
+	resp, err = app.Test(newCallback(&loginState{State: "ut-state", Nonce: "ut-nonce", Verifier: verifier, ReturnTo: "/"}, "code=ut-code&state=ut-state"))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// PKCE verifier mismatch
+	p.nonce = "ut-nonce"
+	resp, err = app.Test(newCallback(&loginState{State: "ut-state", Nonce: "ut-nonce", Verifier: "other", ReturnTo: "/"}, "code=ut-code&state=ut-state"))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// error from identity provider
+	resp, err = app.Test(newCallback(&loginState{State: "ut-state"}, "error=access_denied&state=ut-state"))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// happy case
+	resp, err = app.Test(newCallback(&loginState{State: "ut-state", Nonce: "ut-nonce", Verifier: verifier, ReturnTo: "/"}, "code=ut-code&state=ut-state"))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.NotNil(t, getCookie(resp, DefaultCookieName))
+}
+
+func TestMiddleware_Session(t *testing.T) {
+	p := newMockProvider(t)
+	defer p.Close()
+	app := newApp(p)
+	codec := newCookieCodec([]byte("ut-cookie-secret"))
+
+	newRequest := func(method string, sess *session) *http.Request {
+		req := httptest.NewRequest(method, "/ut-path", nil)
+		if sess != nil {
+			value, _ := codec.encode(DefaultCookieName, sess)
+			req.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: value})
+		}
+		return req
+	}
+
+	// without session, non GET request
+	resp, err := app.Test(newRequest(http.MethodPost, nil))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// ignored path
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/ut-public", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// tampered session
+	req := httptest.NewRequest(http.MethodPost, "/ut-path", nil)
+	req.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: "tampered"})
+	resp, err = app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// expired session would be refreshed
+	resp, err = app.Test(newRequest(http.MethodGet, &session{
+		IdToken:      p.idToken(t, ""),
+		AccessToken:  "ut-old-access",
+		RefreshToken: "ut-refresh",
+		ExpiresAt:    time.Now().Add(-time.Minute).Unix(),
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&p.refreshes))
+	assert.NotNil(t, getCookie(resp, DefaultCookieName))
+
+	// expired session with invalid refresh token
+	resp, err = app.Test(newRequest(http.MethodPost, &session{
+		IdToken:      p.idToken(t, ""),
+		AccessToken:  "ut-old-access",
+		RefreshToken: "other",
+		ExpiresAt:    time.Now().Add(-time.Minute).Unix(),
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Empty(t, getCookie(resp, DefaultCookieName).Value)
+}
+
+func TestMiddleware_ConcurrentRefresh(t *testing.T) {
+	p := newMockProvider(t)
+	defer p.Close()
+	p.refreshDelay = 100 * time.Millisecond
+	app := newApp(p)
+	codec := newCookieCodec([]byte("ut-cookie-secret"))
+
+	value, err := codec.encode(DefaultCookieName, &session{
+		IdToken:      p.idToken(t, ""),
+		AccessToken:  "ut-old-access",
+		RefreshToken: "ut-refresh",
+		ExpiresAt:    time.Now().Add(-time.Minute).Unix(),
+	})
+	assert.Nil(t, err)
+
+	// concurrent requests of same expired session refresh it once
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/ut-path", nil)
+			req.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: value})
+			resp, err := app.Test(req, -1)
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&p.refreshes))
+
+	// ignored path never refreshes or clears session
+	req := httptest.NewRequest(http.MethodGet, "/ut-public", nil)
+	req.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: value})
+	resp, err := app.Test(req, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, getCookie(resp, DefaultCookieName))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&p.refreshes))
+}
+
+func TestMiddleware_ChunkedSession(t *testing.T) {
+	p := newMockProvider(t)
+	defer p.Close()
+	app := newApp(p)
+	codec := newCookieCodec([]byte("ut-cookie-secret"))
+
+	// session with large tokens is split into chunks
+	sess := &session{
+		IdToken:     p.idToken(t, ""),
+		AccessToken: strings.Repeat("a", 2*maxCookieValueSize),
+		ExpiresAt:   time.Now().Add(time.Hour).Unix(),
+	}
+	value, err := codec.encode(DefaultCookieName, sess)
+	assert.Nil(t, err)
+	chunks, err := splitValue(value)
+	assert.Nil(t, err)
+	assert.Len(t, chunks, 3)
+	for i := range chunks {
+		assert.True(t, len(chunks[i]) <= maxCookieValueSize)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/ut-path", nil)
+	for i := range chunks {
+		req.AddCookie(&http.Cookie{Name: chunkName(DefaultCookieName, i), Value: chunks[i]})
+	}
+	resp, err := app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "ut-user", string(body))
+
+	// missing chunk invalidates session and clears all chunks
+	req = httptest.NewRequest(http.MethodPost, "/ut-path", nil)
+	req.AddCookie(&http.Cookie{Name: chunkName(DefaultCookieName, 0), Value: chunks[0]})
+	req.AddCookie(&http.Cookie{Name: chunkName(DefaultCookieName, 1), Value: chunks[1]})
+	resp, err = app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Empty(t, getCookie(resp, DefaultCookieName).Value)
+	assert.Empty(t, getCookie(resp, DefaultCookieName+"_1").Value)
+
+	// session exceeding max chunks is refused
+	_, err = splitValue(strings.Repeat("a", maxCookieChunks*maxCookieValueSize+1))
+	assert.Equal(t, errSessionTooLarge, err)
+}
+
+func TestMiddleware_StoreSession(t *testing.T) {
+	p := newMockProvider(t)
+	defer p.Close()
+	store := rkfibersession.NewMemoryStore()
+	app := newApp(p, WithSessionStore(store))
+	codec := newCookieCodec([]byte("ut-cookie-secret"))
+
+	// tokens are kept in store, cookie only refers to session id
+	sess := &session{
+		IdToken:     p.idToken(t, ""),
+		AccessToken: strings.Repeat("a", 4*maxCookieValueSize),
+		ExpiresAt:   time.Now().Add(time.Hour).Unix(),
+	}
+	data, err := codec.encode(DefaultCookieName, sess)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Set("ut-id", []byte(data), time.Hour))
+	ref, err := codec.encode(DefaultCookieName, &sessionRef{Id: "ut-id"})
+	assert.Nil(t, err)
+	assert.True(t, len(ref) <= maxCookieValueSize)
+
+	req := httptest.NewRequest(http.MethodGet, "/ut-path", nil)
+	req.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: ref})
+	resp, err := app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "ut-user", string(body))
+
+	// logout removes session from store
+	req = httptest.NewRequest(http.MethodGet, DefaultLogoutPath, nil)
+	req.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: ref})
+	resp, err = app.Test(req)
+	assert.Nil(t, err)
+	assert.Empty(t, getCookie(resp, DefaultCookieName).Value)
+	data2, err := store.Get("ut-id")
+	assert.Nil(t, err)
+	assert.Nil(t, data2)
+
+	// session missing in store
+	req = httptest.NewRequest(http.MethodPost, "/ut-path", nil)
+	req.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: ref})
+	resp, err = app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestMiddleware_SaveSession(t *testing.T) {
+	p := newMockProvider(t)
+	defer p.Close()
+	mid := newMiddleware(newOptionSet(WithIssuer(p.URL), WithCookieSecret("ut-cookie-secret")))
+
+	app := fiber.New()
+	app.Get("/ut-path", func(ctx *fiber.Ctx) error {
+		return mid.saveSession(ctx, &session{
+			IdToken:     p.idToken(t, ""),
+			AccessToken: strings.Repeat("a", maxCookieValueSize),
+		})
+	})
+
+	// stale chunks of previous larger session are cleared
+	req := httptest.NewRequest(http.MethodGet, "/ut-path", nil)
+	req.AddCookie(&http.Cookie{Name: DefaultCookieName + "_3", Value: "ut-stale"})
+	resp, err := app.Test(req)
+	assert.Nil(t, err)
+
+	assert.NotEmpty(t, getCookie(resp, DefaultCookieName).Value)
+	assert.NotEmpty(t, getCookie(resp, DefaultCookieName+"_1").Value)
+	assert.Empty(t, getCookie(resp, DefaultCookieName+"_3").Value)
+	for _, c := range resp.Cookies() {
+		assert.True(t, len(c.String()) < 4096)
+	}
+}
+
+func TestMiddleware_OpenRedirect(t *testing.T) {
+	p := newMockProvider(t)
+	defer p.Close()
+	app := newApp(p)
+
+	for _, returnTo := range []string{"https://evil.com", "//evil.com", "/\\evil.com"} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, DefaultLoginPath+"?returnTo="+url.QueryEscape(returnTo), nil))
+		assert.Nil(t, err)
+
+		state := &loginState{}
+		codec := newCookieCodec([]byte("ut-cookie-secret"))
+		assert.Nil(t, codec.decode(DefaultCookieName+"_state", getCookie(resp, DefaultCookieName+"_state").Value, state))
+		assert.Equal(t, "/", state.ReturnTo)
+	}
+}
+
+func TestToOptions(t *testing.T) {
+	// disabled
+	assert.Empty(t, ToOptions(&BootConfig{}, "ut-entry", "ut-type", nil))
+
+	// enabled
+	registry := prometheus.NewRegistry()
+	set := newOptionSet(ToOptions(&BootConfig{
+		Enabled:        true,
+		Issuer:         "https://ut-issuer/",
+		ClientId:       "ut-client",
+		Scopes:         []string{"groups"},
+		CookieName:     "ut-cookie",
+		CookieMaxAge:   60,
+		CookieSameSite: "Strict",
+	}, "ut-entry", "ut-type", registry)...)
+
+	assert.Equal(t, "ut-entry", set.entryName)
+	assert.Equal(t, registry, set.registerer)
+	assert.Equal(t, "https://ut-issuer", set.issuer)
+	assert.Equal(t, []string{"openid", "groups"}, set.scopes)
+	assert.Equal(t, "ut-cookie", set.cookieName)
+	assert.Equal(t, time.Minute, set.cookieMaxAge)
+	assert.Equal(t, "strict", set.cookieSameSite)
+	assert.Equal(t, DefaultLoginPath, set.loginPath)
+	assert.Nil(t, set.store)
+
+	// with session store
+	config := &BootConfig{Enabled: true, Issuer: "https://ut-issuer/"}
+	config.Store.Type = "memory"
+	set = newOptionSet(ToOptions(config, "ut-entry", "ut-type", registry)...)
+	assert.NotNil(t, set.store)
+}
@@ -0,0 +1,367 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberoidc
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-fiber/middleware/session"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultLoginPath is the path which redirects user to identity provider
+	DefaultLoginPath = "/rk/v1/oidc/login"
+	// DefaultCallbackPath is the path identity provider redirects back to
+	DefaultCallbackPath = "/rk/v1/oidc/callback"
+	// DefaultLogoutPath is the path which clears session
+	DefaultLogoutPath = "/rk/v1/oidc/logout"
+	// DefaultCookieName is the name of session cookie
+	DefaultCookieName = "rk_oidc"
+	// DefaultCookieMaxAge is the max age of session cookie
+	DefaultCookieMaxAge = 24 * time.Hour
+)
+
+// ***************** OptionSet *****************
+
+// optionSet which is used for middleware implementation
+type optionSet struct {
+	entryName    string
+	entryType    string
+	pathToIgnore []string
+
+	// identity provider
+	issuer       string
+	clientId     string
+	clientSecret string
+	redirectUrl  string
+	scopes       []string
+
+	// routes
+	loginPath             string
+	callbackPath          string
+	logoutPath            string
+	postLoginRedirectUrl  string
+	postLogoutRedirectUrl string
+
+	// session cookie
+	cookieName     string
+	cookieSecret   string
+	cookieDomain   string
+	cookiePath     string
+	cookieMaxAge   time.Duration
+	cookieSecure   bool
+	cookieSameSite string
+
+	// session store keeps tokens instead of cookie if provided
+	store rkfibersession.Store
+
+	httpClient *http.Client
+	registerer prometheus.Registerer
+}
+
+// newOptionSet Create new optionSet with options.
+func newOptionSet(opts ...Option) *optionSet {
+	set := &optionSet{
+		entryName:            "fake-entry",
+		entryType:            "",
+		pathToIgnore:         []string{},
+		scopes:               []string{"openid", "profile", "email"},
+		loginPath:            DefaultLoginPath,
+		callbackPath:         DefaultCallbackPath,
+		logoutPath:           DefaultLogoutPath,
+		postLoginRedirectUrl: "/",
+		cookieName:           DefaultCookieName,
+		cookiePath:           "/",
+		cookieMaxAge:         DefaultCookieMaxAge,
+		cookieSameSite:       "lax",
+		httpClient:           &http.Client{Timeout: 10 * time.Second},
+		registerer:           prometheus.DefaultRegisterer,
+	}
+
+	for i := range opts {
+		opts[i](set)
+	}
+
+	return set
+}
+
+// ShouldIgnore determine whether auth should be ignored based on path
+func (set *optionSet) ShouldIgnore(path string) bool {
+	for i := range set.pathToIgnore {
+		if strings.HasPrefix(path, set.pathToIgnore[i]) {
+			return true
+		}
+	}
+
+	return rkmid.ShouldIgnoreGlobal(path)
+}
+
+// ***************** BootConfig *****************
+
+// BootConfig for YAML
+type BootConfig struct {
+	Enabled               bool     `yaml:"enabled" json:"enabled"`
+	Ignore                []string `yaml:"ignore" json:"ignore"`
+	Issuer                string   `yaml:"issuer" json:"issuer"`
+	ClientId              string   `yaml:"clientId" json:"clientId"`
+	ClientSecret          string   `yaml:"clientSecret" json:"clientSecret"`
+	RedirectUrl           string   `yaml:"redirectUrl" json:"redirectUrl"`
+	Scopes                []string `yaml:"scopes" json:"scopes"`
+	LoginPath             string   `yaml:"loginPath" json:"loginPath"`
+	CallbackPath          string   `yaml:"callbackPath" json:"callbackPath"`
+	LogoutPath            string   `yaml:"logoutPath" json:"logoutPath"`
+	PostLoginRedirectUrl  string   `yaml:"postLoginRedirectUrl" json:"postLoginRedirectUrl"`
+	PostLogoutRedirectUrl string   `yaml:"postLogoutRedirectUrl" json:"postLogoutRedirectUrl"`
+	CookieName            string   `yaml:"cookieName" json:"cookieName"`
+	CookieSecret          string   `yaml:"cookieSecret" json:"cookieSecret"`
+	CookieDomain          string   `yaml:"cookieDomain" json:"cookieDomain"`
+	CookiePath            string   `yaml:"cookiePath" json:"cookiePath"`
+	CookieMaxAge          int      `yaml:"cookieMaxAge" json:"cookieMaxAge"`
+	CookieSecure          bool     `yaml:"cookieSecure" json:"cookieSecure"`
+	CookieSameSite        string   `yaml:"cookieSameSite" json:"cookieSameSite"`
+	Store                 struct {
+		Type string `yaml:"type" json:"type"`
+		Path string `yaml:"path" json:"path"`
+	} `yaml:"store" json:"store"`
+}
+
+// ToOptions convert BootConfig into Option list
+func ToOptions(config *BootConfig, entryName, entryType string, registerer prometheus.Registerer) []Option {
+	opts := make([]Option, 0)
+
+	if config.Enabled {
+		opts = append(opts,
+			WithEntryNameAndType(entryName, entryType),
+			WithPathToIgnore(config.Ignore...),
+			WithIssuer(config.Issuer),
+			WithClient(config.ClientId, config.ClientSecret),
+			WithRedirectUrl(config.RedirectUrl),
+			WithScopes(config.Scopes...),
+			WithLoginPath(config.LoginPath),
+			WithCallbackPath(config.CallbackPath),
+			WithLogoutPath(config.LogoutPath),
+			WithPostLoginRedirectUrl(config.PostLoginRedirectUrl),
+			WithPostLogoutRedirectUrl(config.PostLogoutRedirectUrl),
+			WithCookieName(config.CookieName),
+			WithCookieSecret(config.CookieSecret),
+			WithCookieDomain(config.CookieDomain),
+			WithCookiePath(config.CookiePath),
+			WithCookieMaxAge(time.Duration(config.CookieMaxAge)*time.Second),
+			WithCookieSecure(config.CookieSecure),
+			WithCookieSameSite(config.CookieSameSite),
+			WithRegisterer(registerer))
+
+		switch strings.ToLower(config.Store.Type) {
+		case rkfibersession.StoreTypeMemory:
+			opts = append(opts, WithSessionStore(rkfibersession.NewMemoryStore()))
+		case rkfibersession.StoreTypeFile:
+			store, err := rkfibersession.NewFileStore(config.Store.Path)
+			if err != nil {
+				rkentry.ShutdownWithError(err)
+			}
+			opts = append(opts, WithSessionStore(store))
+		}
+	}
+
+	return opts
+}
+
+// ***************** Option *****************
+
+// Option if for middleware options while creating middleware
+type Option func(*optionSet)
+
+// WithEntryNameAndType provide entry name and entry type.
+func WithEntryNameAndType(entryName, entryType string) Option {
+	return func(opt *optionSet) {
+		opt.entryName = entryName
+		opt.entryType = entryType
+	}
+}
+
+// WithPathToIgnore provide paths prefix that will ignore.
+func WithPathToIgnore(paths ...string) Option {
+	return func(set *optionSet) {
+		for i := range paths {
+			if len(paths[i]) > 0 {
+				set.pathToIgnore = append(set.pathToIgnore, paths[i])
+			}
+		}
+	}
+}
+
+// WithIssuer provide issuer of identity provider, discovery document would be fetched from
+// <issuer>/.well-known/openid-configuration
+func WithIssuer(issuer string) Option {
+	return func(opt *optionSet) {
+		opt.issuer = strings.TrimSuffix(issuer, "/")
+	}
+}
+
+// WithClient provide client id and client secret registered in identity provider.
+func WithClient(clientId, clientSecret string) Option {
+	return func(opt *optionSet) {
+		opt.clientId = clientId
+		opt.clientSecret = clientSecret
+	}
+}
+
+// WithRedirectUrl provide full url of callback path registered in identity provider.
+func WithRedirectUrl(url string) Option {
+	return func(opt *optionSet) {
+		opt.redirectUrl = url
+	}
+}
+
+// WithScopes provide scopes, openid would be added if missing.
+func WithScopes(scopes ...string) Option {
+	return func(opt *optionSet) {
+		if len(scopes) < 1 {
+			return
+		}
+
+		opt.scopes = []string{"openid"}
+		for i := range scopes {
+			if len(scopes[i]) > 0 && scopes[i] != "openid" {
+				opt.scopes = append(opt.scopes, scopes[i])
+			}
+		}
+	}
+}
+
+// WithLoginPath provide login path.
+func WithLoginPath(path string) Option {
+	return func(opt *optionSet) {
+		if len(path) > 0 {
+			opt.loginPath = path
+		}
+	}
+}
+
+// WithCallbackPath provide callback path.
+func WithCallbackPath(path string) Option {
+	return func(opt *optionSet) {
+		if len(path) > 0 {
+			opt.callbackPath = path
+		}
+	}
+}
+
+// WithLogoutPath provide logout path.
+func WithLogoutPath(path string) Option {
+	return func(opt *optionSet) {
+		if len(path) > 0 {
+			opt.logoutPath = path
+		}
+	}
+}
+
+// WithPostLoginRedirectUrl provide url to redirect after login if original url is unknown.
+func WithPostLoginRedirectUrl(url string) Option {
+	return func(opt *optionSet) {
+		if len(url) > 0 {
+			opt.postLoginRedirectUrl = url
+		}
+	}
+}
+
+// WithPostLogoutRedirectUrl provide url to redirect after logout.
+func WithPostLogoutRedirectUrl(url string) Option {
+	return func(opt *optionSet) {
+		if len(url) > 0 {
+			opt.postLogoutRedirectUrl = url
+		}
+	}
+}
+
+// WithCookieName provide name of session cookie.
+func WithCookieName(name string) Option {
+	return func(opt *optionSet) {
+		if len(name) > 0 {
+			opt.cookieName = name
+		}
+	}
+}
+
+// WithCookieSecret provide secret which encrypts session cookie.
+func WithCookieSecret(secret string) Option {
+	return func(opt *optionSet) {
+		opt.cookieSecret = secret
+	}
+}
+
+// WithCookieDomain provide domain of session cookie.
+func WithCookieDomain(domain string) Option {
+	return func(opt *optionSet) {
+		opt.cookieDomain = domain
+	}
+}
+
+// WithCookiePath provide path of session cookie.
+func WithCookiePath(path string) Option {
+	return func(opt *optionSet) {
+		if len(path) > 0 {
+			opt.cookiePath = path
+		}
+	}
+}
+
+// WithCookieMaxAge provide max age of session cookie.
+func WithCookieMaxAge(maxAge time.Duration) Option {
+	return func(opt *optionSet) {
+		if maxAge > 0 {
+			opt.cookieMaxAge = maxAge
+		}
+	}
+}
+
+// WithCookieSecure provide secure attribute of session cookie.
+func WithCookieSecure(secure bool) Option {
+	return func(opt *optionSet) {
+		opt.cookieSecure = secure
+	}
+}
+
+// WithCookieSameSite provide same site attribute of session cookie, one of lax, strict, none.
+func WithCookieSameSite(sameSite string) Option {
+	return func(opt *optionSet) {
+		if len(sameSite) > 0 {
+			opt.cookieSameSite = strings.ToLower(sameSite)
+		}
+	}
+}
+
+// WithHttpClient provide http.Client used to call identity provider.
+func WithHttpClient(client *http.Client) Option {
+	return func(opt *optionSet) {
+		if client != nil {
+			opt.httpClient = client
+		}
+	}
+}
+
+// WithRegisterer provide prometheus.Registerer of id_token validation metrics, prometheus.DefaultRegisterer would be used by default.
+func WithRegisterer(registerer prometheus.Registerer) Option {
+	return func(opt *optionSet) {
+		if registerer != nil {
+			opt.registerer = registerer
+		}
+	}
+}
+
+// WithSessionStore provide rkfibersession.Store which keeps tokens of session, only encrypted session id is set into cookie.
+// Without store, tokens are encrypted into cookies, which may exceed header size limit of server with large tokens.
+func WithSessionStore(store rkfibersession.Store) Option {
+	return func(opt *optionSet) {
+		if store != nil {
+			opt.store = store
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberoidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// discovery is part of OpenID provider metadata we care about
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// tokenResponse is response of token endpoint
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	IdToken      string `json:"id_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+	ErrorDesc    string `json:"error_description"`
+}
+
+// provider talks to OpenID provider, discovery document is fetched lazily and cached
+type provider struct {
+	set       *optionSet
+	lock      sync.Mutex
+	discovery *discovery
+}
+
+// getDiscovery fetch discovery document if not cached yet, failed fetch would be retried at next call
+func (p *provider) getDiscovery() (*discovery, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	resp, err := p.set.httpClient.Get(p.set.issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d from discovery endpoint", resp.StatusCode)
+	}
+
+	res := &discovery{}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return nil, err
+	}
+
+	if res.Issuer != p.set.issuer {
+		return nil, fmt.Errorf("issuer mismatch, expected %s, got %s", p.set.issuer, res.Issuer)
+	}
+
+	if len(res.AuthorizationEndpoint) < 1 || len(res.TokenEndpoint) < 1 || len(res.JwksUri) < 1 {
+		return nil, fmt.Errorf("incomplete discovery document from %s", p.set.issuer)
+	}
+
+	p.discovery = res
+	return res, nil
+}
+
+// exchangeCode exchange authorization code with PKCE verifier for tokens
+func (p *provider) exchangeCode(code, verifier, redirectUrl string) (*tokenResponse, error) {
+	return p.token(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"code_verifier": {verifier},
+		"redirect_uri":  {redirectUrl},
+	})
+}
+
+// refresh exchange refresh token for new tokens
+func (p *provider) refresh(refreshToken string) (*tokenResponse, error) {
+	return p.token(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+}
+
+// token call token endpoint, client is authenticated with client_secret_basic if secret exists
+func (p *provider) token(form url.Values) (*tokenResponse, error) {
+	disc, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	form.Set("client_id", p.set.clientId)
+	req, err := http.NewRequest(http.MethodPost, disc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if len(p.set.clientSecret) > 0 {
+		req.SetBasicAuth(url.QueryEscape(p.set.clientId), url.QueryEscape(p.set.clientSecret))
+	}
+
+	resp, err := p.set.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &tokenResponse{}
+	if err := json.Unmarshal(bytes, res); err != nil {
+		return nil, fmt.Errorf("invalid response from token endpoint, status code %d", resp.StatusCode)
+	}
+
+	if resp.StatusCode != http.StatusOK || len(res.Error) > 0 {
+		return nil, fmt.Errorf("token endpoint returns error %s, %s", res.Error, res.ErrorDesc)
+	}
+
+	if len(res.AccessToken) < 1 {
+		return nil, fmt.Errorf("missing access_token in token response")
+	}
+
+	return res, nil
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+// Package rkfiberotelmetric is a middleware for fiber framework which records HTTP server metrics
+// with OpenTelemetry following HTTP semantic conventions
+package rkfiberotelmetric
+
+import (
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-fiber/internal/route"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// attribute keys of OpenTelemetry HTTP semantic conventions
+const (
+	attrMethod          = attribute.Key("http.request.method")
+	attrRoute           = attribute.Key("http.route")
+	attrStatusCode      = attribute.Key("http.response.status_code")
+	attrScheme          = attribute.Key("url.scheme")
+	attrProtocolName    = attribute.Key("network.protocol.name")
+	attrProtocolVersion = attribute.Key("network.protocol.version")
+	attrErrorType       = attribute.Key("error.type")
+
+	// otherMethod is recorded for methods out of known methods so that cardinality is bounded
+	otherMethod = "_OTHER"
+)
+
+// knownMethods maps method of request to constant, since strings of fiber.Ctx are reused after request
+var knownMethods = map[string]string{
+	http.MethodGet:     http.MethodGet,
+	http.MethodHead:    http.MethodHead,
+	http.MethodPost:    http.MethodPost,
+	http.MethodPut:     http.MethodPut,
+	http.MethodPatch:   http.MethodPatch,
+	http.MethodDelete:  http.MethodDelete,
+	http.MethodConnect: http.MethodConnect,
+	http.MethodOptions: http.MethodOptions,
+	http.MethodTrace:   http.MethodTrace,
+}
+
+// Middleware create a new OpenTelemetry metrics middleware with options.
+//
+// It records http.server.request.duration, http.server.active_requests, http.server.request.body.size and
+// http.server.response.body.size, it could be used together with or instead of prometheus middleware.
+func Middleware(opts ...Option) fiber.Handler {
+	set := newOptionSet(opts...)
+
+	return func(ctx *fiber.Ctx) error {
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, set.entryName))
+
+		// request issued by middleware was already recorded as original request
+		if set.ShouldIgnore(ctx.Path()) || rkfiberctx.IsInternalRequest(ctx) {
+			return ctx.Next()
+		}
+
+		startTime := time.Now()
+		method, ok := knownMethods[ctx.Method()]
+		if !ok {
+			method = otherMethod
+		}
+		scheme := "http"
+		if ctx.Protocol() == "https" {
+			scheme = "https"
+		}
+
+		activeAttrs := metric.WithAttributes(attrMethod.String(method), attrScheme.String(scheme))
+		set.active.Add(ctx.UserContext(), 1, activeAttrs)
+
+		err := ctx.Next()
+
+		// use context before Next, which may be canceled by timeout middleware
+		set.active.Add(context.Background(), -1, activeAttrs)
+
+		code := rkfiberroute.StatusOf(ctx, err)
+		attrs := []attribute.KeyValue{
+			attrMethod.String(method),
+			attrScheme.String(scheme),
+			attrStatusCode.Int(code),
+			attrProtocolName.String("http"),
+			attrProtocolVersion.String(protocolVersion(ctx)),
+		}
+		if route := rkfiberroute.Matched(ctx); route != nil {
+			attrs = append(attrs, attrRoute.String(route.Path))
+		}
+		if code >= http.StatusInternalServerError {
+			attrs = append(attrs, attrErrorType.String(strconv.Itoa(code)))
+		}
+		bag := rkfiberctx.GetBaggage(ctx)
+		for _, key := range set.baggageKeys {
+			if member := bag.Member(key); len(member.Key()) > 0 {
+				attrs = append(attrs, attribute.String(key, member.Value()))
+			}
+		}
+
+		// user context carries span of trace middleware, exemplars are sampled by it if enabled in provider
+		recordAttrs := metric.WithAttributes(attrs...)
+		set.duration.Record(ctx.UserContext(), time.Since(startTime).Seconds(), recordAttrs)
+		set.requestSize.Record(ctx.UserContext(), requestSizeOf(ctx), recordAttrs)
+		set.responseSize.Record(ctx.UserContext(), int64(len(ctx.Response().Body())), recordAttrs)
+
+		return err
+	}
+}
+
+// protocolVersion returns version of HTTP protocol like 1.1
+func protocolVersion(ctx *fiber.Ctx) string {
+	if ctx.Request().Header.IsHTTP11() {
+		return "1.1"
+	}
+
+	return "1.0"
+}
+
+// requestSizeOf returns size of request body, Content-Length is preferred so that streamed body is not read
+func requestSizeOf(ctx *fiber.Ctx) int64 {
+	if length := ctx.Request().Header.ContentLength(); length > 0 {
+		return int64(length)
+	}
+
+	return int64(len(ctx.Request().Body()))
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberotelmetric
+
+import (
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"github.com/stretchr/testify/assert"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	collectormetric "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is a stand-in of OTLP collector over HTTP which keeps received metrics
+type collector struct {
+	lock    sync.Mutex
+	metrics map[string]*metricpb.Metric
+}
+
+// ServeHTTP implements http.Handler
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	req := &collectormetric.ExportMetricsServiceRequest{}
+	if r.URL.Path != "/v1/metrics" || proto.Unmarshal(body, req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				c.metrics[m.Name] = m
+			}
+		}
+	}
+
+	res, _ := proto.Marshal(&collectormetric.ExportMetricsServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(res)
+}
+
+func TestMiddleware(t *testing.T) {
+	c := &collector{metrics: make(map[string]*metricpb.Metric)}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	exporter, err := NewOTLPExporter(strings.TrimPrefix(server.URL, "http://"), true, "", nil)
+	assert.Nil(t, err)
+
+	app := fiber.New()
+	app.Use(Middleware(
+		WithEntryNameAndType("ut-entry", "ut-type"),
+		WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(time.Hour)))))
+	app.Post("/ut-users/:id", func(ctx *fiber.Ctx) error {
+		return ctx.SendString("ut-response")
+	})
+	app.Get("/ut-error", func(ctx *fiber.Ctx) error {
+		return fiber.ErrBadGateway
+	})
+	app.Get("/ut-not-found", func(ctx *fiber.Ctx) error {
+		return fiber.ErrNotFound
+	})
+
+	app.Test(httptest.NewRequest(http.MethodPost, "/ut-users/1", strings.NewReader("ut-request")))
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-error", nil))
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-missing", nil))
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-not-found", nil))
+
+	// shutdown hook flushes metrics to collector
+	rkentry.GlobalAppCtx.GetShutdownHook("otel-metric-ut-entry")()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	duration := c.metrics["http.server.request.duration"]
+	assert.NotNil(t, duration)
+	assert.Equal(t, "s", duration.GetUnit())
+
+	// attributes of data points keyed by status code and route
+	points := make(map[string]map[string]string)
+	for _, point := range duration.GetHistogram().GetDataPoints() {
+		attrs := make(map[string]string)
+		code := int64(0)
+		for _, kv := range point.Attributes {
+			if kv.Key == "http.response.status_code" {
+				code = kv.Value.GetIntValue()
+			} else {
+				attrs[kv.Key] = kv.Value.GetStringValue()
+			}
+		}
+		points[strconv.FormatInt(code, 10)+" "+attrs["http.route"]] = attrs
+	}
+	assert.Len(t, points, 4)
+	assert.Equal(t, "POST", points["200 /ut-users/:id"]["http.request.method"])
+	assert.Equal(t, "502", points["502 /ut-error"]["error.type"])
+	// not found returned by handler keeps route
+	assert.Contains(t, points, "404 /ut-not-found")
+	assert.Contains(t, points, "404 ")
+
+	requestSize := c.metrics["http.server.request.body.size"].GetHistogram().GetDataPoints()
+	responseSize := c.metrics["http.server.response.body.size"].GetHistogram().GetDataPoints()
+	assert.Len(t, requestSize, 4)
+	assert.Len(t, responseSize, 4)
+
+	sum := float64(0)
+	for i := range requestSize {
+		sum += requestSize[i].GetSum()
+	}
+	assert.Equal(t, float64(len("ut-request")), sum)
+
+	active := c.metrics["http.server.active_requests"]
+	assert.NotNil(t, active)
+	for _, point := range active.GetSum().GetDataPoints() {
+		assert.Equal(t, int64(0), point.GetAsInt())
+	}
+}
+
+func TestMiddleware_BaggageAttributes(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+
+	app := fiber.New()
+	app.Use(Middleware(
+		WithMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))),
+		WithBaggageAttributes("tenant.id", "ut-missing")))
+	app.Get("/ut-path", func(ctx *fiber.Ctx) error {
+		// baggage is extracted by tracing middleware in front of handler
+		assert.Nil(t, rkfiberctx.SetBaggage(ctx, "tenant.id", "acme"))
+		assert.Nil(t, rkfiberctx.SetBaggage(ctx, "experiment", "blue"))
+		return nil
+	})
+
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-path", nil))
+
+	rm := metricdata.ResourceMetrics{}
+	assert.Nil(t, reader.Collect(context.Background(), &rm))
+
+	found := false
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "http.server.request.duration" {
+				continue
+			}
+			found = true
+			points := m.Data.(metricdata.Histogram[float64]).DataPoints
+			assert.Len(t, points, 1)
+			tenant, ok := points[0].Attributes.Value("tenant.id")
+			assert.True(t, ok)
+			assert.Equal(t, "acme", tenant.AsString())
+			assert.False(t, points[0].Attributes.HasValue("experiment"))
+			assert.False(t, points[0].Attributes.HasValue("ut-missing"))
+		}
+	}
+	assert.True(t, found)
+}
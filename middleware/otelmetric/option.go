@@ -0,0 +1,258 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberotelmetric
+
+import (
+	"context"
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.uber.org/zap"
+	"strings"
+	"time"
+)
+
+const (
+	// ScopeName is instrumentation scope name of meter
+	ScopeName = "github.com/rookie-ninja/rk-fiber/middleware/otelmetric"
+	// DefaultInterval is interval of periodic reader which exports metrics
+	DefaultInterval = time.Minute
+
+	// metric names follow OpenTelemetry HTTP semantic conventions
+	metricsNameDuration     = "http.server.request.duration"
+	metricsNameActive       = "http.server.active_requests"
+	metricsNameRequestSize  = "http.server.request.body.size"
+	metricsNameResponseSize = "http.server.response.body.size"
+)
+
+// DefaultDurationBuckets are buckets of duration histogram in seconds advised by semantic conventions,
+// they are applied only to MeterProvider created by middleware
+var DefaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10}
+
+// ***************** OptionSet *****************
+
+// optionSet which is used for middleware implementation
+type optionSet struct {
+	entryName    string
+	entryType    string
+	pathToIgnore []string
+	provider     metric.MeterProvider
+	reader       sdkmetric.Reader
+	baggageKeys  []string
+
+	duration     metric.Float64Histogram
+	active       metric.Int64UpDownCounter
+	requestSize  metric.Int64Histogram
+	responseSize metric.Int64Histogram
+}
+
+// newOptionSet Create new optionSet with options.
+func newOptionSet(opts ...Option) *optionSet {
+	set := &optionSet{
+		entryName:    "fake-entry",
+		entryType:    "",
+		pathToIgnore: []string{},
+	}
+
+	for i := range opts {
+		opts[i](set)
+	}
+
+	// reader takes precedence over global provider
+	if set.provider == nil && set.reader != nil {
+		provider := set.newMeterProvider()
+		rkentry.GlobalAppCtx.AddShutdownHook("otel-metric-"+set.entryName, func() {
+			if err := provider.Shutdown(context.Background()); err != nil {
+				rkentry.GlobalAppCtx.GetLoggerEntryDefault().Warn("Failed to shutdown meter provider",
+					zap.String("entryName", set.entryName), zap.Error(err))
+			}
+		})
+		set.provider = provider
+	}
+
+	if set.provider == nil {
+		set.provider = otel.GetMeterProvider()
+	}
+
+	meter := set.provider.Meter(ScopeName)
+	// instruments are noop if failed to create
+	set.duration, _ = meter.Float64Histogram(metricsNameDuration,
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of HTTP server requests."))
+	set.active, _ = meter.Int64UpDownCounter(metricsNameActive,
+		metric.WithUnit("{request}"),
+		metric.WithDescription("Number of active HTTP server requests."))
+	set.requestSize, _ = meter.Int64Histogram(metricsNameRequestSize,
+		metric.WithUnit("By"),
+		metric.WithDescription("Size of HTTP server request bodies."))
+	set.responseSize, _ = meter.Int64Histogram(metricsNameResponseSize,
+		metric.WithUnit("By"),
+		metric.WithDescription("Size of HTTP server response bodies."))
+
+	return set
+}
+
+// newMeterProvider create MeterProvider with reader, resource of application and buckets advised by semantic conventions
+func (set *optionSet) newMeterProvider() *sdkmetric.MeterProvider {
+	res, _ := sdkresource.New(context.Background(),
+		sdkresource.WithFromEnv(),
+		sdkresource.WithProcess(),
+		sdkresource.WithTelemetrySDK(),
+		sdkresource.WithHost(),
+		sdkresource.WithAttributes(
+			semconv.ServiceNameKey.String(rkentry.GlobalAppCtx.GetAppInfoEntry().AppName),
+			semconv.ServiceVersionKey.String(rkentry.GlobalAppCtx.GetAppInfoEntry().Version),
+			attribute.String("rk.entry.name", set.entryName),
+			attribute.String("rk.entry.type", set.entryType),
+		))
+
+	return sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(set.reader),
+		sdkmetric.WithView(sdkmetric.NewView(
+			sdkmetric.Instrument{Name: metricsNameDuration},
+			sdkmetric.Stream{Aggregation: sdkmetric.AggregationExplicitBucketHistogram{Boundaries: DefaultDurationBuckets}})))
+}
+
+// ShouldIgnore determine whether metrics should be ignored based on path
+func (set *optionSet) ShouldIgnore(path string) bool {
+	for i := range set.pathToIgnore {
+		if strings.HasPrefix(path, set.pathToIgnore[i]) {
+			return true
+		}
+	}
+
+	return rkmid.ShouldIgnoreGlobal(path)
+}
+
+// ***************** BootConfig *****************
+
+// BootConfig for YAML
+type BootConfig struct {
+	Enabled    bool     `yaml:"enabled" json:"enabled"`
+	Ignore     []string `yaml:"ignore" json:"ignore"`
+	IntervalMs int      `yaml:"intervalMs" json:"intervalMs"`
+	Exporter   struct {
+		Otlp struct {
+			Enabled  bool              `yaml:"enabled" json:"enabled"`
+			Endpoint string            `yaml:"endpoint" json:"endpoint"`
+			Insecure bool              `yaml:"insecure" json:"insecure"`
+			UrlPath  string            `yaml:"urlPath" json:"urlPath"`
+			Headers  map[string]string `yaml:"headers" json:"headers"`
+		} `yaml:"otlp" json:"otlp"`
+	} `yaml:"exporter" json:"exporter"`
+}
+
+// ToOptions convert BootConfig into Option list
+func ToOptions(config *BootConfig, entryName, entryType string) []Option {
+	opts := make([]Option, 0)
+
+	if config.Enabled {
+		opts = append(opts,
+			WithEntryNameAndType(entryName, entryType),
+			WithPathToIgnore(config.Ignore...))
+
+		if config.Exporter.Otlp.Enabled {
+			exporter, err := NewOTLPExporter(config.Exporter.Otlp.Endpoint, config.Exporter.Otlp.Insecure,
+				config.Exporter.Otlp.UrlPath, config.Exporter.Otlp.Headers)
+			if err != nil {
+				rkentry.ShutdownWithError(err)
+			}
+
+			interval := time.Duration(config.IntervalMs) * time.Millisecond
+			if interval <= 0 {
+				interval = DefaultInterval
+			}
+
+			opts = append(opts, WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(interval))))
+		}
+	}
+
+	return opts
+}
+
+// NewOTLPExporter create OTLP exporter over HTTP, endpoint is form of host:port and OTLP environment variables
+// would be used if endpoint is empty.
+func NewOTLPExporter(endpoint string, insecure bool, urlPath string, headers map[string]string) (sdkmetric.Exporter, error) {
+	opts := make([]otlpmetrichttp.Option, 0)
+	if len(endpoint) > 0 {
+		opts = append(opts, otlpmetrichttp.WithEndpoint(endpoint))
+	}
+	if insecure {
+		opts = append(opts, otlpmetrichttp.WithInsecure())
+	}
+	if len(urlPath) > 0 {
+		opts = append(opts, otlpmetrichttp.WithURLPath(urlPath))
+	}
+	if len(headers) > 0 {
+		opts = append(opts, otlpmetrichttp.WithHeaders(headers))
+	}
+
+	return otlpmetrichttp.New(context.Background(), opts...)
+}
+
+// ***************** Option *****************
+
+// Option if for middleware options while creating middleware
+type Option func(*optionSet)
+
+// WithEntryNameAndType provide entry name and entry type.
+func WithEntryNameAndType(entryName, entryType string) Option {
+	return func(opt *optionSet) {
+		opt.entryName = entryName
+		opt.entryType = entryType
+	}
+}
+
+// WithPathToIgnore provide paths prefix that will ignore.
+func WithPathToIgnore(paths ...string) Option {
+	return func(set *optionSet) {
+		for i := range paths {
+			if len(paths[i]) > 0 {
+				set.pathToIgnore = append(set.pathToIgnore, paths[i])
+			}
+		}
+	}
+}
+
+// WithBaggageAttributes provide keys of baggage members which are recorded as attributes of request duration and
+// size histograms. Baggage is extracted by tracing middleware, members missing in request are not recorded.
+//
+// Values are provided by client, keep keys with bounded values only, like tenant.
+func WithBaggageAttributes(keys ...string) Option {
+	return func(opt *optionSet) {
+		for i := range keys {
+			if key := strings.TrimSpace(keys[i]); len(key) > 0 {
+				opt.baggageKeys = append(opt.baggageKeys, key)
+			}
+		}
+	}
+}
+
+// WithMeterProvider provide metric.MeterProvider, global MeterProvider would be used by default.
+func WithMeterProvider(provider metric.MeterProvider) Option {
+	return func(opt *optionSet) {
+		if provider != nil {
+			opt.provider = provider
+		}
+	}
+}
+
+// WithReader provide sdkmetric.Reader like periodic reader of OTLP exporter, MeterProvider of reader is
+// created and shutdown with application. It is ignored if MeterProvider is provided.
+func WithReader(reader sdkmetric.Reader) Option {
+	return func(opt *optionSet) {
+		if reader != nil {
+			opt.reader = reader
+		}
+	}
+}
@@ -9,31 +9,187 @@ package rkfiberprom
 import (
 	"context"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rookie-ninja/rk-entry/v2/middleware"
 	"github.com/rookie-ninja/rk-entry/v2/middleware/prom"
+	"github.com/rookie-ninja/rk-fiber/internal/route"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
 	"github.com/valyala/fasthttp/fasthttpadaptor"
 	"net/http"
 	"strconv"
+	"time"
 )
 
+const (
+	// LabelEntry keeps entryName, entryType, domain and instance labels, they are constant per entry and always kept
+	LabelEntry = "entry"
+	// LabelMethod keeps restMethod label
+	LabelMethod = "method"
+	// LabelRoute keeps restPath label with matched route pattern like /v1/users/:id
+	LabelRoute = "route"
+	// LabelStatus keeps resCode label with status code
+	LabelStatus = "status"
+	// LabelStatusClass keeps resCode label with status class like 2xx, takes precedence over LabelStatus
+	LabelStatusClass = "statusClass"
+
+	// UnmatchedRoute is restPath label of requests which match no route
+	UnmatchedRoute = "unmatched"
+)
+
+// DefaultLabels are labels kept by default
+var DefaultLabels = []string{LabelEntry, LabelMethod, LabelRoute, LabelStatus}
+
 // Middleware create a new prometheus metrics interceptor with options.
+//
+// Requests are labeled with matched route pattern instead of raw path, and requests which match no route
+// are collapsed into UnmatchedRoute, so that path parameters would not blow up cardinality.
 func Middleware(opts ...rkmidprom.Option) fiber.Handler {
-	set := rkmidprom.NewOptionSet(opts...)
+	return MiddlewareWithLabels(DefaultLabels, opts...)
+}
+
+// MiddlewareWithLabels create a new prometheus metrics interceptor which keeps labels in allow list only,
+// labels out of it are recorded with empty value. DefaultLabels would be used if labels is empty.
+func MiddlewareWithLabels(labels []string, opts ...rkmidprom.Option) fiber.Handler {
+	return newMiddleware(opts, newOptionSet(WithLabels(labels...)))
+}
+
+// MiddlewareWithOptions create a new prometheus metrics interceptor with options of rkmidprom and options
+// of extended metrics.
+//
+// In addition to metrics of rkmidprom, request size, response size and latency histograms, and in-flight gauge
+// are recorded under rk_http namespace. Latency observations carry exemplars with trace id if request is traced.
+func MiddlewareWithOptions(promOpts []rkmidprom.Option, opts ...Option) fiber.Handler {
+	set := newOptionSet(opts...)
+	set.register()
+
+	return newMiddleware(promOpts, set)
+}
+
+// newMiddleware create middleware, extended metrics are recorded only if registered in optionSet
+func newMiddleware(promOpts []rkmidprom.Option, set *optionSet) fiber.Handler {
+	promSet := rkmidprom.NewOptionSet(promOpts...)
+	allowed := set.labels
 
 	return func(ctx *fiber.Ctx) error {
-		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, set.GetEntryName()))
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, promSet.GetEntryName()))
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkfiberctx.PromRegistererKey, set.registerer))
+
+		// request issued by middleware was already recorded as original request
+		if promSet.ShouldIgnore(ctx.Path()) || rkfiberctx.IsInternalRequest(ctx) {
+			return ctx.Next()
+		}
+
+		startTime := time.Now()
 
 		req := &http.Request{}
 		fasthttpadaptor.ConvertRequest(ctx.Context(), req, true)
 
-		beforeCtx := set.BeforeCtx(req)
-		set.Before(beforeCtx)
+		beforeCtx := promSet.BeforeCtx(req)
+		promSet.Before(beforeCtx)
+
+		// method is kept in label of metrics, copy it since strings of fiber.Ctx are reused after request
+		method := utils.CopyString(ctx.Method())
+		if !allowed[LabelMethod] {
+			method = ""
+		}
+
+		var inFlight prometheus.Gauge
+		if set.inFlight != nil {
+			route := ""
+			if allowed[LabelRoute] {
+				route = set.routes.resolve(ctx.App(), ctx.Method(), ctx.Path())
+			}
+			if gauge, err := set.inFlight.GetMetricWithLabelValues(set.entryName, set.entryType, method, route); err == nil {
+				inFlight = gauge
+				inFlight.Inc()
+			}
+		}
 
 		err := ctx.Next()
 
-		afterCtx := set.AfterCtx(strconv.Itoa(ctx.Response().StatusCode()))
-		set.After(beforeCtx, afterCtx)
+		if inFlight != nil {
+			inFlight.Dec()
+		}
+
+		beforeCtx.Input.RestPath = routeOf(ctx)
+		if !allowed[LabelRoute] {
+			beforeCtx.Input.RestPath = ""
+		}
+		beforeCtx.Input.RestMethod = method
+
+		resCode := ""
+		switch code := rkfiberroute.StatusOf(ctx, err); {
+		case allowed[LabelStatusClass]:
+			resCode = strconv.Itoa(code/100) + "xx"
+		case allowed[LabelStatus]:
+			resCode = strconv.Itoa(code)
+		}
+
+		afterCtx := promSet.AfterCtx(resCode)
+		promSet.After(beforeCtx, afterCtx)
+
+		values := []string{set.entryName, set.entryType, method, beforeCtx.Input.RestPath, resCode}
+		bag := rkfiberctx.GetBaggage(ctx)
+		for _, key := range set.baggageKeys {
+			values = append(values, bag.Member(key).Value())
+		}
+		set.observeDuration(ctx, time.Since(startTime), values)
+		observe(set.requestSize, requestSizeOf(ctx), values)
+		observe(set.responseSize, float64(len(ctx.Response().Body())), values)
 
 		return err
 	}
 }
+
+// observeDuration observes latency with exemplar of trace id if request is traced and sampled
+func (set *optionSet) observeDuration(ctx *fiber.Ctx, elapsed time.Duration, values []string) {
+	if set.duration == nil {
+		return
+	}
+
+	observer, err := set.duration.GetMetricWithLabelValues(values...)
+	if err != nil {
+		return
+	}
+
+	if spanCtx := rkfiberctx.GetTraceSpan(ctx).SpanContext(); !set.exemplarsDisabled && spanCtx.IsSampled() {
+		if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok {
+			exemplarObserver.ObserveWithExemplar(elapsed.Seconds(), prometheus.Labels{
+				exemplarTraceId: spanCtx.TraceID().String(),
+			})
+			return
+		}
+	}
+
+	observer.Observe(elapsed.Seconds())
+}
+
+// observe observes value into histogram vector if registered
+func observe(vec *prometheus.HistogramVec, value float64, values []string) {
+	if vec == nil {
+		return
+	}
+
+	if observer, err := vec.GetMetricWithLabelValues(values...); err == nil {
+		observer.Observe(value)
+	}
+}
+
+// requestSizeOf returns size of request body, Content-Length is preferred so that streamed body is not read
+func requestSizeOf(ctx *fiber.Ctx) float64 {
+	if length := ctx.Request().Header.ContentLength(); length > 0 {
+		return float64(length)
+	}
+
+	return float64(len(ctx.Request().Body()))
+}
+
+// routeOf returns matched route pattern of request, UnmatchedRoute if none matched
+func routeOf(ctx *fiber.Ctx) string {
+	if route := rkfiberroute.Matched(ctx); route != nil {
+		return route.Path
+	}
+
+	return UnmatchedRoute
+}
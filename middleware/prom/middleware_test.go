@@ -6,12 +6,18 @@
 package rkfiberprom
 
 import (
+	"context"
 	"github.com/gofiber/fiber/v2"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
 	"github.com/rookie-ninja/rk-entry/v2/middleware/prom"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -35,6 +41,191 @@ func TestInterceptor(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
 
+// labelValues returns values of label in series of resCode counter
+func labelValues(t *testing.T, registry *prometheus.Registry, label string) []string {
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+
+	res := make([]string, 0)
+	for _, family := range families {
+		if family.GetName() != "rk_prom_resCode" {
+			continue
+		}
+		for _, m := range family.Metric {
+			for _, pair := range m.Label {
+				if pair.GetName() == label {
+					res = append(res, pair.GetValue())
+				}
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestMiddleware_Route(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	app := fiber.New()
+	app.Use(Middleware(
+		rkmidprom.WithEntryNameAndType("ut-entry-route", "ut-type"),
+		rkmidprom.WithRegisterer(registry)))
+	app.Get("/ut-users/:id", func(ctx *fiber.Ctx) error {
+		return nil
+	})
+
+	for _, path := range []string{"/ut-users/1", "/ut-users/2", "/ut-missing/1", "/ut-missing/2"} {
+		app.Test(httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	app.Test(httptest.NewRequest(http.MethodPost, "/ut-users/1", nil))
+
+	assert.Equal(t, []string{"/ut-users/:id", UnmatchedRoute, UnmatchedRoute}, labelValues(t, registry, "restPath"))
+	assert.Equal(t, []string{"200", "404", "405"}, labelValues(t, registry, "resCode"))
+}
+
+func TestMiddlewareWithLabels(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	app := fiber.New()
+	app.Use(MiddlewareWithLabels([]string{LabelEntry, LabelRoute, LabelStatusClass},
+		rkmidprom.WithEntryNameAndType("ut-entry-labels", "ut-type"),
+		rkmidprom.WithRegisterer(registry)))
+	app.Get("/ut-path", func(ctx *fiber.Ctx) error {
+		return nil
+	})
+	app.Post("/ut-path", func(ctx *fiber.Ctx) error {
+		return ctx.SendStatus(http.StatusCreated)
+	})
+
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-path", nil))
+	app.Test(httptest.NewRequest(http.MethodPost, "/ut-path", nil))
+
+	// both requests fall into single series
+	assert.Equal(t, []string{""}, labelValues(t, registry, "restMethod"))
+	assert.Equal(t, []string{"2xx"}, labelValues(t, registry, "resCode"))
+}
+
+func TestMiddlewareWithOptions(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	app := fiber.New()
+	app.Use(MiddlewareWithOptions([]rkmidprom.Option{
+		rkmidprom.WithEntryNameAndType("ut-entry-options", "ut-type"),
+		rkmidprom.WithRegisterer(registry),
+	},
+		WithEntryNameAndType("ut-entry-options", "ut-type"),
+		WithLatencyBuckets(0.1, 1),
+		WithRegisterer(registry)))
+
+	traceId, _ := trace.TraceIDFromHex("0102030405060708090a0b0c0d0e0f10")
+	spanId, _ := trace.SpanIDFromHex("0102030405060708")
+	app.Post("/ut-users/:id", func(ctx *fiber.Ctx) error {
+		// in-flight gauge is labeled with route before request is routed
+		gauge, _ := registry.Gather()
+		for _, family := range gauge {
+			if family.GetName() == "rk_http_in_flight_requests" {
+				assert.Equal(t, float64(1), family.Metric[0].GetGauge().GetValue())
+				assert.Contains(t, family.Metric[0].String(), "/ut-users/:id")
+			}
+		}
+
+		spanCtx := trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    traceId,
+			SpanID:     spanId,
+			TraceFlags: trace.FlagsSampled,
+		})
+		span := trace.SpanFromContext(trace.ContextWithSpanContext(ctx.UserContext(), spanCtx))
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.SpanKey, span))
+		return ctx.SendString("ut-response")
+	})
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodPost, "/ut-users/1", strings.NewReader("ut-request-body")))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+
+	found := make(map[string]bool)
+	for _, family := range families {
+		switch family.GetName() {
+		case "rk_http_request_size_bytes":
+			found[family.GetName()] = true
+			assert.Equal(t, float64(len("ut-request-body")), family.Metric[0].GetHistogram().GetSampleSum())
+		case "rk_http_response_size_bytes":
+			found[family.GetName()] = true
+			assert.Equal(t, float64(len("ut-response")), family.Metric[0].GetHistogram().GetSampleSum())
+		case "rk_http_in_flight_requests":
+			found[family.GetName()] = true
+			assert.Equal(t, float64(0), family.Metric[0].GetGauge().GetValue())
+		case "rk_http_request_duration_seconds":
+			found[family.GetName()] = true
+			histogram := family.Metric[0].GetHistogram()
+			assert.Len(t, histogram.Bucket, 2)
+			assert.Contains(t, histogram.String(), traceId.String())
+		}
+	}
+	assert.Len(t, found, 4)
+
+	// method label is not overwritten by following requests
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-missing", nil))
+	methods := make([]string, 0)
+	families, err = registry.Gather()
+	assert.Nil(t, err)
+	for _, family := range families {
+		if family.GetName() != "rk_http_request_duration_seconds" {
+			continue
+		}
+		for _, m := range family.Metric {
+			for _, pair := range m.Label {
+				if pair.GetName() == "restMethod" {
+					methods = append(methods, pair.GetValue())
+				}
+			}
+		}
+	}
+	sort.Strings(methods)
+	assert.Equal(t, []string{http.MethodGet, http.MethodPost}, methods)
+}
+
+func TestMiddlewareWithOptions_BaggageLabels(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	app := fiber.New()
+	app.Use(MiddlewareWithOptions([]rkmidprom.Option{
+		rkmidprom.WithEntryNameAndType("ut-entry-baggage", "ut-type"),
+		rkmidprom.WithRegisterer(registry),
+	},
+		WithEntryNameAndType("ut-entry-baggage", "ut-type"),
+		WithBaggageLabels("tenant.id"),
+		WithRegisterer(registry)))
+	app.Get("/ut-path", func(ctx *fiber.Ctx) error {
+		// baggage is extracted by tracing middleware in front of handler
+		if tenant := ctx.Query("tenant"); len(tenant) > 0 {
+			assert.Nil(t, rkfiberctx.SetBaggage(ctx, "tenant.id", tenant))
+		}
+		return nil
+	})
+
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-path?tenant=acme", nil))
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-path", nil))
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+
+	tenants := make([]string, 0)
+	for _, family := range families {
+		if family.GetName() != "rk_http_request_duration_seconds" {
+			continue
+		}
+		for _, m := range family.Metric {
+			for _, pair := range m.Label {
+				if pair.GetName() == "tenant_id" {
+					tenants = append(tenants, pair.GetValue())
+				}
+			}
+		}
+	}
+	sort.Strings(tenants)
+	assert.Equal(t, []string{"", "acme"}, tenants)
+}
+
 func assertNotPanic(t *testing.T) {
 	if r := recover(); r != nil {
 		// Expect panic to be called with non nil error
@@ -0,0 +1,320 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberprom
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rookie-ninja/rk-entry/v2/middleware/prom"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultRouteCacheSize is max number of method and path pairs whose route are cached for in-flight gauge
+	DefaultRouteCacheSize = 10000
+
+	metricsNamespace       = "rk"
+	metricsSubsystem       = "http"
+	metricsNameDuration    = "request_duration_seconds"
+	metricsNameRequestSize = "request_size_bytes"
+	metricsNameRespSize    = "response_size_bytes"
+	metricsNameInFlight    = "in_flight_requests"
+
+	// exemplarTraceId is label of exemplar which carries trace id
+	exemplarTraceId = "trace_id"
+)
+
+var (
+	// DefaultLatencyBuckets are buckets of latency histogram in seconds
+	DefaultLatencyBuckets = prometheus.DefBuckets
+	// DefaultSizeBuckets are buckets of request and response size histograms in bytes, 64B to 1MB
+	DefaultSizeBuckets = prometheus.ExponentialBuckets(64, 4, 8)
+
+	labelKeys         = []string{"entryName", "entryType", "restMethod", "restPath", "resCode"}
+	labelKeysInFlight = []string{"entryName", "entryType", "restMethod", "restPath"}
+)
+
+// ***************** OptionSet *****************
+
+// optionSet which is used for extended metrics
+type optionSet struct {
+	entryName string
+	entryType string
+	labels    map[string]bool
+
+	latencyBuckets     []float64
+	nativeBucketFactor float64
+	exemplarsDisabled  bool
+	registerer         prometheus.Registerer
+	duration           *prometheus.HistogramVec
+	requestSize        *prometheus.HistogramVec
+	responseSize       *prometheus.HistogramVec
+	inFlight           *prometheus.GaugeVec
+	routes             *routeResolver
+	baggageKeys        []string
+}
+
+// newOptionSet Create new optionSet with options.
+func newOptionSet(opts ...Option) *optionSet {
+	set := &optionSet{
+		entryName:      "fake-entry",
+		entryType:      "",
+		labels:         make(map[string]bool),
+		latencyBuckets: DefaultLatencyBuckets,
+		registerer:     prometheus.DefaultRegisterer,
+		routes:         newRouteResolver(DefaultRouteCacheSize),
+	}
+
+	for i := range opts {
+		opts[i](set)
+	}
+
+	if len(set.labels) < 1 {
+		for i := range DefaultLabels {
+			set.labels[DefaultLabels[i]] = true
+		}
+	}
+
+	return set
+}
+
+// register extended metrics, metrics already registered with same registerer would be reused
+func (set *optionSet) register() {
+	keys := append(append([]string{}, labelKeys...), set.baggageLabels()...)
+
+	set.duration = registerHistogram(set.registerer, prometheus.HistogramOpts{
+		Namespace:                   metricsNamespace,
+		Subsystem:                   metricsSubsystem,
+		Name:                        metricsNameDuration,
+		Help:                        "Latency of HTTP requests in seconds.",
+		Buckets:                     set.latencyBuckets,
+		NativeHistogramBucketFactor: set.nativeBucketFactor,
+	}, keys)
+	set.requestSize = registerHistogram(set.registerer, prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      metricsNameRequestSize,
+		Help:      "Size of HTTP request bodies in bytes.",
+		Buckets:   DefaultSizeBuckets,
+	}, keys)
+	set.responseSize = registerHistogram(set.registerer, prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      metricsNameRespSize,
+		Help:      "Size of HTTP response bodies in bytes.",
+		Buckets:   DefaultSizeBuckets,
+	}, keys)
+
+	inFlight := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      metricsNameInFlight,
+		Help:      "Number of HTTP requests in flight.",
+	}, labelKeysInFlight)
+	if err := set.registerer.Register(inFlight); err != nil {
+		if exist, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			inFlight, _ = exist.ExistingCollector.(*prometheus.GaugeVec)
+		} else {
+			inFlight = nil
+		}
+	}
+	set.inFlight = inFlight
+}
+
+// baggageLabels returns label names of baggage keys, characters not allowed in label name are replaced with underscore
+func (set *optionSet) baggageLabels() []string {
+	res := make([]string, 0, len(set.baggageKeys))
+	for _, key := range set.baggageKeys {
+		res = append(res, strings.Map(func(r rune) rune {
+			if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+				return r
+			}
+			return '_'
+		}, key))
+	}
+
+	return res
+}
+
+// registerHistogram register histogram vector, returns existing one if already registered and nil on failure
+func registerHistogram(registerer prometheus.Registerer, opts prometheus.HistogramOpts, keys []string) *prometheus.HistogramVec {
+	vec := prometheus.NewHistogramVec(opts, keys)
+	if err := registerer.Register(vec); err != nil {
+		if exist, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			res, _ := exist.ExistingCollector.(*prometheus.HistogramVec)
+			return res
+		}
+		return nil
+	}
+
+	return vec
+}
+
+// ***************** Route resolver *****************
+
+// routeResolver resolves route pattern of request before it is routed, it is used by in-flight gauge
+// since route of request is unknown until handler is called
+type routeResolver struct {
+	lock     sync.RWMutex
+	handlers uint32
+	routes   []fiber.Route
+	cache    map[string]string
+	maxSize  int
+}
+
+// newRouteResolver create a new routeResolver which caches at most maxSize results
+func newRouteResolver(maxSize int) *routeResolver {
+	return &routeResolver{
+		cache:   make(map[string]string),
+		maxSize: maxSize,
+	}
+}
+
+// resolve returns route pattern which matches method and path, UnmatchedRoute if none matched
+func (r *routeResolver) resolve(app *fiber.App, method, path string) string {
+	key := method + " " + path
+
+	r.lock.RLock()
+	route, ok := r.cache[key]
+	fresh := r.handlers == app.HandlersCount()
+	r.lock.RUnlock()
+
+	if ok && fresh {
+		return route
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// routes registered after last resolving invalidates cache
+	if r.handlers != app.HandlersCount() || r.routes == nil {
+		r.handlers = app.HandlersCount()
+		r.routes = app.GetRoutes(true)
+		r.cache = make(map[string]string)
+	}
+
+	route = UnmatchedRoute
+	config := app.Config()
+	for i := range r.routes {
+		if r.routes[i].Method == method && fiber.RoutePatternMatch(path, r.routes[i].Path, config) {
+			route = r.routes[i].Path
+			break
+		}
+	}
+
+	if len(r.cache) >= r.maxSize {
+		r.cache = make(map[string]string)
+	}
+	r.cache[key] = route
+
+	return route
+}
+
+// ***************** BootConfig *****************
+
+// BootConfig for YAML
+type BootConfig struct {
+	rkmidprom.BootConfig `yaml:",inline" json:",inline" mapstructure:",squash"`
+	Labels               []string `yaml:"labels" json:"labels"`
+	Histogram            struct {
+		Buckets            []float64 `yaml:"buckets" json:"buckets"`
+		NativeBucketFactor float64   `yaml:"nativeBucketFactor" json:"nativeBucketFactor"`
+	} `yaml:"histogram" json:"histogram"`
+	DisableExemplars bool `yaml:"disableExemplars" json:"disableExemplars"`
+}
+
+// ToOptions convert BootConfig into Option list
+func ToOptions(config *BootConfig, entryName, entryType string, registerer prometheus.Registerer) []Option {
+	opts := make([]Option, 0)
+
+	if config.Enabled {
+		opts = append(opts,
+			WithEntryNameAndType(entryName, entryType),
+			WithLabels(config.Labels...),
+			WithLatencyBuckets(config.Histogram.Buckets...),
+			WithNativeHistogram(config.Histogram.NativeBucketFactor),
+			WithExemplars(!config.DisableExemplars),
+			WithRegisterer(registerer))
+	}
+
+	return opts
+}
+
+// ***************** Option *****************
+
+// Option if for extended metrics options while creating middleware
+type Option func(*optionSet)
+
+// WithEntryNameAndType provide entry name and entry type.
+func WithEntryNameAndType(entryName, entryType string) Option {
+	return func(opt *optionSet) {
+		opt.entryName = entryName
+		opt.entryType = entryType
+	}
+}
+
+// WithLabels provide labels to keep, labels out of it are recorded with empty value. DefaultLabels would be used by default.
+func WithLabels(labels ...string) Option {
+	return func(opt *optionSet) {
+		for i := range labels {
+			if label := strings.TrimSpace(labels[i]); len(label) > 0 {
+				opt.labels[label] = true
+			}
+		}
+	}
+}
+
+// WithLatencyBuckets provide buckets of latency histogram in seconds, DefaultLatencyBuckets would be used by default.
+func WithLatencyBuckets(buckets ...float64) Option {
+	return func(opt *optionSet) {
+		if len(buckets) > 0 {
+			opt.latencyBuckets = buckets
+		}
+	}
+}
+
+// WithNativeHistogram provide bucket factor of native histogram for latency, it must be greater than one.
+// Native histogram is exposed in addition to classic buckets to scrapers which negotiate protobuf format.
+func WithNativeHistogram(factor float64) Option {
+	return func(opt *optionSet) {
+		if factor > 1 {
+			opt.nativeBucketFactor = factor
+		}
+	}
+}
+
+// WithExemplars enable or disable exemplars with trace id on latency observations, enabled by default.
+// Exemplars are attached only if request is traced and sampled.
+func WithExemplars(enabled bool) Option {
+	return func(opt *optionSet) {
+		opt.exemplarsDisabled = !enabled
+	}
+}
+
+// WithBaggageLabels provide keys of baggage members which are recorded as labels of request duration and size
+// histograms, characters not allowed in label name like dot are replaced with underscore.
+//
+// Baggage is extracted by tracing middleware, members missing in request are recorded with empty value.
+// Values are provided by client, keep keys with bounded values only, like tenant.
+func WithBaggageLabels(keys ...string) Option {
+	return func(opt *optionSet) {
+		for i := range keys {
+			if key := strings.TrimSpace(keys[i]); len(key) > 0 {
+				opt.baggageKeys = append(opt.baggageKeys, key)
+			}
+		}
+	}
+}
+
+// WithRegisterer provide prometheus.Registerer, prometheus.DefaultRegisterer would be used by default.
+func WithRegisterer(registerer prometheus.Registerer) Option {
+	return func(opt *optionSet) {
+		if registerer != nil {
+			opt.registerer = registerer
+		}
+	}
+}
@@ -0,0 +1,732 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberlimit
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"github.com/rookie-ninja/rk-entry/v2/error"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-entry/v2/middleware/prom"
+	"github.com/rookie-ninja/rk-entry/v2/middleware/ratelimit"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// KeyIp limits by client IP, fiber.Config.ProxyHeader is respected
+	KeyIp = "ip"
+	// KeyHeader limits by value of header, format: header:<name>
+	KeyHeader = "header"
+	// KeyApiKey limits by API key in X-API-Key header
+	KeyApiKey = "apiKey"
+	// KeyJwt limits by claim of jwt token validated by jwt middleware, format: jwt:<claim>, default claim is sub
+	KeyJwt = "jwt"
+
+	// DefaultMaxKeys is max number of keys tracked in memory
+	DefaultMaxKeys = 10000
+
+	// HeaderLimit is IETF header of max requests allowed at once
+	HeaderLimit = "RateLimit-Limit"
+	// HeaderRemaining is IETF header of requests allowed immediately
+	HeaderRemaining = "RateLimit-Remaining"
+	// HeaderReset is IETF header of seconds until limit is fully available again
+	HeaderReset = "RateLimit-Reset"
+	// HeaderLegacyLimit is legacy form of HeaderLimit
+	HeaderLegacyLimit = "X-RateLimit-Limit"
+	// HeaderLegacyRemaining is legacy form of HeaderRemaining
+	HeaderLegacyRemaining = "X-RateLimit-Remaining"
+	// HeaderLegacyReset is legacy form of HeaderReset, value is unix timestamp in seconds
+	HeaderLegacyReset = "X-RateLimit-Reset"
+	// HeaderQuotaLimit is header of max cost allowed in quota window
+	HeaderQuotaLimit = "X-Quota-Limit"
+	// HeaderQuotaRemaining is header of cost still allowed in quota window
+	HeaderQuotaRemaining = "X-Quota-Remaining"
+	// HeaderQuotaReset is header of seconds until quota window ends
+	HeaderQuotaReset = "X-Quota-Reset"
+
+	// DefaultQuotaWindow is window of quota
+	DefaultQuotaWindow = 24 * time.Hour
+
+	// metrics name of store latency histogram
+	metricsNameStoreLatency = "store_latency_seconds"
+	// metrics name of store errors counter
+	metricsNameStoreErrors = "store_errors_total"
+)
+
+// storeLatencyBuckets are buckets of store latency histogram in seconds
+var storeLatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25}
+
+// KeyFunc extracts key of request, empty key falls back to client IP
+type KeyFunc func(ctx *fiber.Ctx) string
+
+// AuthFunc returns true if request is allowed to access admin path
+type AuthFunc func(ctx *fiber.Ctx) bool
+
+// KeyedMiddleware limits rate per key extracted from request, requests exceeding limit are rejected with 429.
+//
+// Each key is limited with GCRA in Store, MemoryStore bounds number of keys with LRU eviction.
+// RedisStore shares limit across replicas, requests are allowed if store is unavailable unless fail closed.
+//
+// RateLimit-* headers are written from state of key on every limited response, and Retry-After on 429.
+//
+// Requests consume cost of route instead of one token. With quota, cost is consumed from long window quota of key
+// as well after burst limit allows, and X-Quota-* headers are written. Quota is checked before burst limit, so that
+// requests of exhausted quota do not consume tokens. Quota of key could be inspected with GET and reset with DELETE
+// on admin path with key query parameter, admin path is served only with auth.
+func KeyedMiddleware(opts ...Option) fiber.Handler {
+	set := newOptionSet(opts...)
+
+	return func(ctx *fiber.Ctx) error {
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, set.entryName))
+
+		if len(set.adminPath) > 0 && ctx.Path() == set.adminPath {
+			return set.serveAdmin(ctx)
+		}
+
+		// request issued by middleware was already limited as original request
+		if rkfiberctx.IsInternalRequest(ctx) {
+			return ctx.Next()
+		}
+
+		if set.ShouldIgnore(ctx.Path()) {
+			return ctx.Next()
+		}
+
+		// key is kept by store, copy it since strings of fiber.Ctx are reused after request
+		key := utils.CopyString(set.keyFunc(ctx))
+		if len(key) < 1 {
+			key = ctx.IP()
+		}
+
+		limit := set.limit
+		if v, ok := set.overrides[key]; ok {
+			limit = v
+		}
+
+		cost := set.costOf(ctx.Path())
+
+		// quota is checked before burst limit, so that requests rejected by exhausted quota do not consume tokens
+		quota := set.quotaOf(key)
+		if quota.enabled() {
+			quotaRes, err := set.getQuota(key, quota)
+			if err != nil {
+				return set.unavailable(ctx)
+			}
+
+			if quotaRes.Remaining < cost {
+				quotaRes.Allowed = false
+				return set.rejectQuota(ctx, quotaRes)
+			}
+		}
+
+		res, err := set.allow(key, limit, cost)
+		if err != nil {
+			return set.unavailable(ctx)
+		}
+
+		set.writeHeaders(ctx, res)
+
+		if !res.Allowed {
+			resp := rkmid.GetErrorBuilder().New(http.StatusTooManyRequests, "slow down your request")
+			ctx.Response().SetStatusCode(resp.Code())
+			return ctx.JSON(resp)
+		}
+
+		// quota is consumed atomically, concurrent requests may still exhaust it after check
+		if quota.enabled() {
+			quotaRes, err := set.consumeQuota(key, quota, cost)
+			if err != nil {
+				return set.unavailable(ctx)
+			}
+
+			if !quotaRes.Allowed {
+				return set.rejectQuota(ctx, quotaRes)
+			}
+
+			set.writeQuotaHeaders(ctx, quotaRes)
+		}
+
+		return ctx.Next()
+	}
+}
+
+// rejectQuota rejects request with 429 since quota is exceeded
+func (set *optionSet) rejectQuota(ctx *fiber.Ctx, res QuotaResult) error {
+	set.writeQuotaHeaders(ctx, res)
+	ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(ceilSeconds(res.ResetAfter)))
+
+	resp := rkmid.GetErrorBuilder().New(http.StatusTooManyRequests, "quota exceeded")
+	ctx.Response().SetStatusCode(resp.Code())
+	return ctx.JSON(resp)
+}
+
+// unavailable rejects request with 503 if fail closed, otherwise request is allowed
+func (set *optionSet) unavailable(ctx *fiber.Ctx) error {
+	if set.failClosed {
+		resp := rkmid.GetErrorBuilder().New(http.StatusServiceUnavailable, "rate limit unavailable")
+		ctx.Response().SetStatusCode(resp.Code())
+		return ctx.JSON(resp)
+	}
+
+	return ctx.Next()
+}
+
+// quotaResp is response of admin path
+type quotaResp struct {
+	Key           string `json:"key"`
+	Limit         int    `json:"limit"`
+	Used          int    `json:"used"`
+	Remaining     int    `json:"remaining"`
+	ResetAfterSec int    `json:"resetAfterSec"`
+}
+
+// serveAdmin inspects quota of key with GET and resets it with DELETE
+func (set *optionSet) serveAdmin(ctx *fiber.Ctx) error {
+	key := ctx.Query("key")
+	quota := set.quotaOf(key)
+
+	var errResp rkerror.ErrorInterface
+	switch {
+	case !set.adminAuth(ctx):
+		errResp = rkmid.GetErrorBuilder().New(http.StatusUnauthorized, "unauthorized")
+	case !quota.enabled():
+		errResp = rkmid.GetErrorBuilder().New(http.StatusNotFound, "quota is disabled")
+	case len(key) < 1:
+		errResp = rkmid.GetErrorBuilder().New(http.StatusBadRequest, "missing key")
+	case ctx.Method() != http.MethodGet && ctx.Method() != http.MethodDelete:
+		errResp = rkmid.GetErrorBuilder().New(http.StatusMethodNotAllowed, "method not allowed")
+	case ctx.Method() == http.MethodDelete:
+		if err := set.store.ResetQuota(key, quota); err != nil {
+			errResp = rkmid.GetErrorBuilder().New(http.StatusServiceUnavailable, "rate limit unavailable", err)
+		}
+	}
+
+	if errResp == nil {
+		res, err := set.store.GetQuota(key, quota)
+		if err == nil {
+			return ctx.JSON(&quotaResp{
+				Key:           key,
+				Limit:         res.Limit,
+				Used:          res.Used,
+				Remaining:     res.Remaining,
+				ResetAfterSec: ceilSeconds(res.ResetAfter),
+			})
+		}
+		errResp = rkmid.GetErrorBuilder().New(http.StatusServiceUnavailable, "rate limit unavailable", err)
+	}
+
+	ctx.Response().SetStatusCode(errResp.Code())
+	return ctx.JSON(errResp)
+}
+
+// costOf returns cost of path, longest prefix wins
+func (set *optionSet) costOf(path string) int {
+	for i := range set.costs {
+		if strings.HasPrefix(path, set.costs[i].prefix) {
+			return set.costs[i].cost
+		}
+	}
+
+	return 1
+}
+
+// quotaOf returns quota of key
+func (set *optionSet) quotaOf(key string) Quota {
+	quota := set.quota
+	if v, ok := set.quotaOverrides[key]; ok {
+		quota.Limit = v
+	}
+
+	return quota
+}
+
+// allow consumes cost of key from store
+func (set *optionSet) allow(key string, limit Limit, cost int) (Result, error) {
+	start := time.Now()
+	res, err := set.store.Allow(key, limit, cost)
+	set.observe(start, err)
+
+	return res, err
+}
+
+// getQuota returns usage of key in quota from store
+func (set *optionSet) getQuota(key string, quota Quota) (QuotaResult, error) {
+	start := time.Now()
+	res, err := set.store.GetQuota(key, quota)
+	set.observe(start, err)
+
+	return res, err
+}
+
+// consumeQuota consumes cost of key from quota in store
+func (set *optionSet) consumeQuota(key string, quota Quota, cost int) (QuotaResult, error) {
+	start := time.Now()
+	res, err := set.store.ConsumeQuota(key, quota, cost)
+	set.observe(start, err)
+
+	return res, err
+}
+
+// observe records latency and errors of store
+func (set *optionSet) observe(start time.Time, err error) {
+	if observer := set.metricsSet.GetHistogramWithValues(metricsNameStoreLatency, set.entryName, set.entryType); observer != nil {
+		observer.Observe(time.Since(start).Seconds())
+	}
+
+	if err != nil {
+		if counter := set.metricsSet.GetCounterWithValues(metricsNameStoreErrors, set.entryName, set.entryType); counter != nil {
+			counter.Inc()
+		}
+	}
+}
+
+// writeHeaders writes rate limit headers from result.
+// Retry-After is omitted for blocked key since no request would be allowed.
+func (set *optionSet) writeHeaders(ctx *fiber.Ctx, res Result) {
+	if !res.Allowed && res.Limit > 0 {
+		ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(ceilSeconds(res.RetryAfter)))
+	}
+
+	if set.headers {
+		ctx.Set(HeaderLimit, strconv.Itoa(res.Limit))
+		ctx.Set(HeaderRemaining, strconv.Itoa(res.Remaining))
+		ctx.Set(HeaderReset, strconv.Itoa(ceilSeconds(res.ResetAfter)))
+	}
+
+	if set.legacyHeaders {
+		ctx.Set(HeaderLegacyLimit, strconv.Itoa(res.Limit))
+		ctx.Set(HeaderLegacyRemaining, strconv.Itoa(res.Remaining))
+		ctx.Set(HeaderLegacyReset, strconv.FormatInt(time.Now().Add(res.ResetAfter).Unix(), 10))
+	}
+}
+
+// writeQuotaHeaders writes quota headers from result
+func (set *optionSet) writeQuotaHeaders(ctx *fiber.Ctx, res QuotaResult) {
+	if set.headers {
+		ctx.Set(HeaderQuotaLimit, strconv.Itoa(res.Limit))
+		ctx.Set(HeaderQuotaRemaining, strconv.Itoa(res.Remaining))
+		ctx.Set(HeaderQuotaReset, strconv.Itoa(ceilSeconds(res.ResetAfter)))
+	}
+}
+
+// ceilSeconds rounds duration up to seconds, so that clients never retry too early
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// ***************** OptionSet *****************
+
+// optionSet which is used for keyed middleware implementation
+type optionSet struct {
+	entryName      string
+	entryType      string
+	pathToIgnore   []string
+	keyFunc        KeyFunc
+	limit          Limit
+	overrides      map[string]Limit
+	maxKeys        int
+	store          Store
+	failClosed     bool
+	headers        bool
+	legacyHeaders  bool
+	costs          []routeCost
+	quota          Quota
+	quotaOverrides map[string]int
+	adminPath      string
+	adminAuth      AuthFunc
+	registerer     prometheus.Registerer
+	metricsSet     *rkmidprom.MetricsSet
+}
+
+// routeCost is cost of requests with path prefix
+type routeCost struct {
+	prefix string
+	cost   int
+}
+
+// newOptionSet Create new optionSet with options.
+func newOptionSet(opts ...Option) *optionSet {
+	set := &optionSet{
+		entryName:      "fake-entry",
+		entryType:      "",
+		pathToIgnore:   []string{},
+		keyFunc:        KeyFuncFromLookup(KeyIp),
+		limit:          Limit{ReqPerSec: rkmidlimit.DefaultLimit},
+		overrides:      make(map[string]Limit),
+		maxKeys:        DefaultMaxKeys,
+		headers:        true,
+		quota:          Quota{Window: DefaultQuotaWindow},
+		quotaOverrides: make(map[string]int),
+	}
+
+	for i := range opts {
+		opts[i](set)
+	}
+
+	// longest prefix matches first
+	sort.SliceStable(set.costs, func(i, j int) bool {
+		return len(set.costs[i].prefix) > len(set.costs[j].prefix)
+	})
+
+	if set.store == nil {
+		set.store = NewMemoryStore(set.maxKeys)
+	}
+
+	// admin path resets quota of any key, refuse to serve it without auth
+	if len(set.adminPath) > 0 && set.adminAuth == nil {
+		rkentry.GlobalAppCtx.GetLoggerEntryDefault().Logger.Warn(
+			fmt.Sprintf("Quota admin path %s is disabled since neither admin auth nor admin token is provided.", set.adminPath))
+		set.adminPath = ""
+	}
+
+	set.metricsSet = rkmidprom.NewMetricsSet("rk", "ratelimit", set.registerer)
+	// metrics may already be registered by another middleware with same registerer, ignore error
+	set.metricsSet.RegisterHistogram(metricsNameStoreLatency, storeLatencyBuckets, "entryName", "entryType")
+	set.metricsSet.RegisterCounter(metricsNameStoreErrors, "entryName", "entryType")
+
+	return set
+}
+
+// ShouldIgnore determine whether rate limit should be ignored based on path
+func (set *optionSet) ShouldIgnore(path string) bool {
+	for i := range set.pathToIgnore {
+		if strings.HasPrefix(path, set.pathToIgnore[i]) {
+			return true
+		}
+	}
+
+	return rkmid.ShouldIgnoreGlobal(path)
+}
+
+// ***************** BootConfig *****************
+
+// BootConfig for YAML, extends rkmidlimit.BootConfig with keyed rate limit
+type BootConfig struct {
+	rkmidlimit.BootConfig `yaml:",inline" json:",inline" mapstructure:",squash"`
+	Keyed                 KeyedConfig `yaml:"keyed" json:"keyed"`
+}
+
+// KeyedConfig for YAML
+type KeyedConfig struct {
+	Enabled    bool             `yaml:"enabled" json:"enabled"`
+	Key        string           `yaml:"key" json:"key"`
+	ReqPerSec  *int             `yaml:"reqPerSec" json:"reqPerSec"`
+	Burst      int              `yaml:"burst" json:"burst"`
+	MaxKeys    int              `yaml:"maxKeys" json:"maxKeys"`
+	FailClosed bool             `yaml:"failClosed" json:"failClosed"`
+	Headers    HeadersConfig    `yaml:"headers" json:"headers"`
+	Store      StoreConfig      `yaml:"store" json:"store"`
+	Costs      []CostConfig     `yaml:"costs" json:"costs"`
+	Quota      QuotaConfig      `yaml:"quota" json:"quota"`
+	Overrides  []OverrideConfig `yaml:"overrides" json:"overrides"`
+}
+
+// CostConfig for YAML, cost of requests with path prefix
+type CostConfig struct {
+	Path string `yaml:"path" json:"path"`
+	Cost int    `yaml:"cost" json:"cost"`
+}
+
+// QuotaConfig for YAML, long window quota of every key
+type QuotaConfig struct {
+	Limit      int    `yaml:"limit" json:"limit"`
+	WindowSec  int    `yaml:"windowSec" json:"windowSec"`
+	AdminPath  string `yaml:"adminPath" json:"adminPath"`
+	AdminToken string `yaml:"adminToken" json:"adminToken"`
+}
+
+// StoreConfig for YAML, store of rate limit state
+type StoreConfig struct {
+	Type      string `yaml:"type" json:"type"`
+	Addr      string `yaml:"addr" json:"addr"`
+	Password  string `yaml:"password" json:"password"`
+	DB        int    `yaml:"db" json:"db"`
+	Prefix    string `yaml:"prefix" json:"prefix"`
+	TimeoutMs int    `yaml:"timeoutMs" json:"timeoutMs"`
+	PoolSize  int    `yaml:"poolSize" json:"poolSize"`
+}
+
+// HeadersConfig for YAML, rate limit response headers
+type HeadersConfig struct {
+	Disabled bool `yaml:"disabled" json:"disabled"`
+	Legacy   bool `yaml:"legacy" json:"legacy"`
+}
+
+// OverrideConfig for YAML, limit of specific key
+type OverrideConfig struct {
+	Key       string `yaml:"key" json:"key"`
+	ReqPerSec int    `yaml:"reqPerSec" json:"reqPerSec"`
+	Burst     int    `yaml:"burst" json:"burst"`
+	Quota     *int   `yaml:"quota" json:"quota"`
+}
+
+// ToOptions convert BootConfig into Option list of KeyedMiddleware
+func ToOptions(config *BootConfig, entryName, entryType string, registerer prometheus.Registerer) []Option {
+	opts := make([]Option, 0)
+
+	if config.Enabled && config.Keyed.Enabled {
+		opts = append(opts,
+			WithEntryNameAndType(entryName, entryType),
+			WithPathToIgnore(config.Ignore...),
+			WithKeyFunc(KeyFuncFromLookup(config.Keyed.Key)),
+			WithMaxKeys(config.Keyed.MaxKeys),
+			WithFailClosed(config.Keyed.FailClosed),
+			WithHeaders(!config.Keyed.Headers.Disabled),
+			WithLegacyHeaders(config.Keyed.Headers.Legacy),
+			WithRegisterer(registerer),
+			WithQuota(Quota{Limit: config.Keyed.Quota.Limit, Window: time.Duration(config.Keyed.Quota.WindowSec) * time.Second}),
+			WithQuotaAdminPath(config.Keyed.Quota.AdminPath),
+			WithQuotaAdminToken(config.Keyed.Quota.AdminToken))
+
+		for i := range config.Keyed.Costs {
+			opts = append(opts, WithCost(config.Keyed.Costs[i].Path, config.Keyed.Costs[i].Cost))
+		}
+
+		if strings.ToLower(config.Keyed.Store.Type) == StoreTypeRedis {
+			store := config.Keyed.Store
+			opts = append(opts, WithStore(NewRedisStore(
+				WithRedisAddr(store.Addr),
+				WithRedisPassword(store.Password),
+				WithRedisDB(store.DB),
+				WithRedisPrefix(store.Prefix),
+				WithRedisTimeout(time.Duration(store.TimeoutMs)*time.Millisecond),
+				WithRedisPoolSize(store.PoolSize))))
+		}
+
+		if config.Keyed.ReqPerSec != nil {
+			opts = append(opts, WithLimit(Limit{ReqPerSec: *config.Keyed.ReqPerSec, Burst: config.Keyed.Burst}))
+		}
+
+		for i := range config.Keyed.Overrides {
+			e := config.Keyed.Overrides[i]
+			// override with quota only keeps default limit
+			if e.ReqPerSec > 0 {
+				opts = append(opts, WithLimitByKey(e.Key, Limit{ReqPerSec: e.ReqPerSec, Burst: e.Burst}))
+			}
+			if e.Quota != nil {
+				opts = append(opts, WithQuotaByKey(e.Key, *e.Quota))
+			}
+		}
+	}
+
+	return opts
+}
+
+// ***************** Option *****************
+
+// Option is for keyed middleware options while creating middleware
+type Option func(*optionSet)
+
+// WithEntryNameAndType provide entry name and entry type.
+func WithEntryNameAndType(entryName, entryType string) Option {
+	return func(opt *optionSet) {
+		opt.entryName = entryName
+		opt.entryType = entryType
+	}
+}
+
+// WithPathToIgnore provide paths prefix that will ignore.
+func WithPathToIgnore(paths ...string) Option {
+	return func(set *optionSet) {
+		for i := range paths {
+			if len(paths[i]) > 0 {
+				set.pathToIgnore = append(set.pathToIgnore, paths[i])
+			}
+		}
+	}
+}
+
+// WithKeyFunc provide KeyFunc, client IP would be used by default.
+func WithKeyFunc(f KeyFunc) Option {
+	return func(opt *optionSet) {
+		if f != nil {
+			opt.keyFunc = f
+		}
+	}
+}
+
+// WithLimit provide default limit of every key.
+func WithLimit(limit Limit) Option {
+	return func(opt *optionSet) {
+		opt.limit = limit
+	}
+}
+
+// WithLimitByKey provide limit of specific key, which overrides default limit.
+func WithLimitByKey(key string, limit Limit) Option {
+	return func(opt *optionSet) {
+		if len(key) > 0 {
+			opt.overrides[key] = limit
+		}
+	}
+}
+
+// WithMaxKeys provide max number of keys tracked in memory.
+func WithMaxKeys(maxKeys int) Option {
+	return func(opt *optionSet) {
+		if maxKeys > 0 {
+			opt.maxKeys = maxKeys
+		}
+	}
+}
+
+// WithStore provide Store, MemoryStore would be used by default.
+func WithStore(store Store) Option {
+	return func(opt *optionSet) {
+		if store != nil {
+			opt.store = store
+		}
+	}
+}
+
+// WithFailClosed reject requests with 503 if store is unavailable, requests are allowed by default.
+func WithFailClosed(failClosed bool) Option {
+	return func(opt *optionSet) {
+		opt.failClosed = failClosed
+	}
+}
+
+// WithCost provide cost of requests with path prefix, requests cost 1 by default.
+func WithCost(path string, cost int) Option {
+	return func(opt *optionSet) {
+		if len(path) > 0 && cost > 0 {
+			opt.costs = append(opt.costs, routeCost{prefix: path, cost: cost})
+		}
+	}
+}
+
+// WithQuota provide long window quota of every key, window is 24 hours by default.
+func WithQuota(quota Quota) Option {
+	return func(opt *optionSet) {
+		opt.quota.Limit = quota.Limit
+		if quota.Window > 0 {
+			opt.quota.Window = quota.Window
+		}
+	}
+}
+
+// WithQuotaByKey provide quota limit of specific key, which overrides default quota limit.
+func WithQuotaByKey(key string, limit int) Option {
+	return func(opt *optionSet) {
+		if len(key) > 0 {
+			opt.quotaOverrides[key] = limit
+		}
+	}
+}
+
+// WithQuotaAdminPath provide path to inspect and reset quota of key.
+// Admin path is disabled unless WithQuotaAdminAuth or WithQuotaAdminToken is provided.
+func WithQuotaAdminPath(path string) Option {
+	return func(opt *optionSet) {
+		opt.adminPath = path
+	}
+}
+
+// WithQuotaAdminAuth provide AuthFunc which decides whether request could access admin path.
+func WithQuotaAdminAuth(auth AuthFunc) Option {
+	return func(opt *optionSet) {
+		if auth != nil {
+			opt.adminAuth = auth
+		}
+	}
+}
+
+// WithQuotaAdminToken provide token of admin path, requests must carry it with Authorization: Bearer <token>.
+func WithQuotaAdminToken(token string) Option {
+	return func(opt *optionSet) {
+		if len(token) < 1 {
+			return
+		}
+
+		expected := []byte("Bearer " + token)
+		opt.adminAuth = func(ctx *fiber.Ctx) bool {
+			return subtle.ConstantTimeCompare(ctx.Request().Header.Peek(fiber.HeaderAuthorization), expected) == 1
+		}
+	}
+}
+
+// WithHeaders enable RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers, enabled by default.
+func WithHeaders(enabled bool) Option {
+	return func(opt *optionSet) {
+		opt.headers = enabled
+	}
+}
+
+// WithLegacyHeaders enable X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers.
+func WithLegacyHeaders(enabled bool) Option {
+	return func(opt *optionSet) {
+		opt.legacyHeaders = enabled
+	}
+}
+
+// WithRegisterer provide prometheus.Registerer, prometheus.DefaultRegisterer would be used by default.
+func WithRegisterer(registerer prometheus.Registerer) Option {
+	return func(opt *optionSet) {
+		if registerer != nil {
+			opt.registerer = registerer
+		}
+	}
+}
+
+// ***************** KeyFunc *****************
+
+// KeyFuncFromLookup create KeyFunc from lookup scheme.
+//
+// Possible values:
+// - "ip"
+// - "header:<name>"
+// - "apiKey"
+// - "jwt:<claim>"
+//
+// Unknown scheme falls back to client IP.
+func KeyFuncFromLookup(lookup string) KeyFunc {
+	parts := strings.SplitN(strings.TrimSpace(lookup), ":", 2)
+	scheme, name := parts[0], ""
+	if len(parts) > 1 {
+		name = strings.TrimSpace(parts[1])
+	}
+
+	switch scheme {
+	case KeyHeader:
+		return func(ctx *fiber.Ctx) string {
+			return ctx.Get(name)
+		}
+	case KeyApiKey:
+		return func(ctx *fiber.Ctx) string {
+			return ctx.Get(rkmid.HeaderApiKey)
+		}
+	case KeyJwt:
+		if len(name) < 1 {
+			name = "sub"
+		}
+		return func(ctx *fiber.Ctx) string {
+			token := rkfiberctx.GetJwtToken(ctx)
+			if token == nil {
+				return ""
+			}
+			if claims, ok := token.Claims.(jwt.MapClaims); ok && claims[name] != nil {
+				return fmt.Sprintf("%v", claims[name])
+			}
+			return ""
+		}
+	default:
+		return func(ctx *fiber.Ctx) string {
+			return ctx.IP()
+		}
+	}
+}
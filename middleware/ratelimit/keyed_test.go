@@ -0,0 +1,475 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberlimit
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sendWithHeader(t *testing.T, app *fiber.App, key, value string) int {
+	req := httptest.NewRequest(http.MethodGet, "/ut-path", nil)
+	if len(key) > 0 {
+		req.Header.Set(key, value)
+	}
+	resp, err := app.Test(req)
+	assert.Nil(t, err)
+	return resp.StatusCode
+}
+
+func TestKeyedMiddleware(t *testing.T) {
+	app := fiber.New()
+	app.Use(KeyedMiddleware(
+		WithKeyFunc(KeyFuncFromLookup("header:X-Tenant")),
+		WithLimit(Limit{ReqPerSec: 1, Burst: 2}),
+		WithLimitByKey("ut-premium", Limit{ReqPerSec: 1, Burst: 5}),
+		WithLimitByKey("ut-blocked", Limit{ReqPerSec: 0})))
+	app.Get("/ut-path", func(*fiber.Ctx) error {
+		return nil
+	})
+
+	// each key owns a bucket
+	assert.Equal(t, http.StatusOK, sendWithHeader(t, app, "X-Tenant", "ut-a"))
+	assert.Equal(t, http.StatusOK, sendWithHeader(t, app, "X-Tenant", "ut-a"))
+	assert.Equal(t, http.StatusTooManyRequests, sendWithHeader(t, app, "X-Tenant", "ut-a"))
+	assert.Equal(t, http.StatusOK, sendWithHeader(t, app, "X-Tenant", "ut-b"))
+
+	// missing key falls back to client IP
+	assert.Equal(t, http.StatusOK, sendWithHeader(t, app, "", ""))
+	assert.Equal(t, http.StatusOK, sendWithHeader(t, app, "", ""))
+	assert.Equal(t, http.StatusTooManyRequests, sendWithHeader(t, app, "", ""))
+
+	// override
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, sendWithHeader(t, app, "X-Tenant", "ut-premium"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, sendWithHeader(t, app, "X-Tenant", "ut-premium"))
+	assert.Equal(t, http.StatusTooManyRequests, sendWithHeader(t, app, "X-Tenant", "ut-blocked"))
+}
+
+func TestKeyedMiddleware_KeyCopied(t *testing.T) {
+	app := fiber.New()
+	app.Use(KeyedMiddleware(
+		WithKeyFunc(KeyFuncFromLookup("header:X-Tenant")),
+		WithLimit(Limit{ReqPerSec: 1, Burst: 1})))
+	app.Get("/ut-path", func(*fiber.Ctx) error {
+		return nil
+	})
+
+	// buffers of request are reused by following requests, bucket of key must not be lost
+	assert.Equal(t, http.StatusOK, sendWithHeader(t, app, "X-Tenant", "ut-a"))
+	for i := 0; i < 10; i++ {
+		sendWithHeader(t, app, "X-Tenant", "ut-"+string(rune('b'+i)))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, sendWithHeader(t, app, "X-Tenant", "ut-a"))
+}
+
+func TestKeyedMiddleware_Ignore(t *testing.T) {
+	app := fiber.New()
+	app.Use(KeyedMiddleware(
+		WithLimit(Limit{ReqPerSec: 0}),
+		WithPathToIgnore("/ut-path")))
+	app.Get("/ut-path", func(*fiber.Ctx) error {
+		return nil
+	})
+
+	assert.Equal(t, http.StatusOK, sendWithHeader(t, app, "", ""))
+}
+
+func TestKeyedMiddleware_Headers(t *testing.T) {
+	app := fiber.New()
+	app.Use(KeyedMiddleware(
+		WithKeyFunc(KeyFuncFromLookup("header:X-Tenant")),
+		WithLimit(Limit{ReqPerSec: 1, Burst: 2}),
+		WithLimitByKey("ut-blocked", Limit{ReqPerSec: 0}),
+		WithLegacyHeaders(true)))
+	app.Get("/ut-path", func(*fiber.Ctx) error {
+		return nil
+	})
+
+	send := func(tenant string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/ut-path", nil)
+		req.Header.Set("X-Tenant", tenant)
+		resp, err := app.Test(req)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	resp := send("ut-a")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get(HeaderLimit))
+	assert.Equal(t, "1", resp.Header.Get(HeaderRemaining))
+	assert.Equal(t, "1", resp.Header.Get(HeaderReset))
+	assert.Equal(t, "2", resp.Header.Get(HeaderLegacyLimit))
+	assert.Equal(t, "1", resp.Header.Get(HeaderLegacyRemaining))
+	assert.NotEmpty(t, resp.Header.Get(HeaderLegacyReset))
+	assert.Empty(t, resp.Header.Get(fiber.HeaderRetryAfter))
+
+	resp = send("ut-a")
+	assert.Equal(t, "0", resp.Header.Get(HeaderRemaining))
+	assert.Equal(t, "2", resp.Header.Get(HeaderReset))
+
+	// rejected
+	resp = send("ut-a")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get(HeaderRemaining))
+	assert.Equal(t, "1", resp.Header.Get(fiber.HeaderRetryAfter))
+
+	// blocked key never retries
+	resp = send("ut-blocked")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get(HeaderLimit))
+	assert.Empty(t, resp.Header.Get(fiber.HeaderRetryAfter))
+
+	// disabled
+	app = fiber.New()
+	app.Use(KeyedMiddleware(WithLimit(Limit{ReqPerSec: 1}), WithHeaders(false)))
+	app.Get("/ut-path", func(*fiber.Ctx) error {
+		return nil
+	})
+	resp = send("")
+	assert.Empty(t, resp.Header.Get(HeaderLimit))
+	assert.Empty(t, resp.Header.Get(HeaderLegacyLimit))
+	resp = send("")
+	assert.Equal(t, "1", resp.Header.Get(fiber.HeaderRetryAfter))
+}
+
+func TestKeyFuncFromLookup(t *testing.T) {
+	app := fiber.New()
+	ctx := app.AcquireCtx(&fasthttp.RequestCtx{})
+	defer app.ReleaseCtx(ctx)
+
+	ctx.Request().Header.Set("X-Tenant", "ut-tenant")
+	ctx.Request().Header.Set(rkmid.HeaderApiKey, "ut-api-key")
+
+	assert.Equal(t, ctx.IP(), KeyFuncFromLookup("ip")(ctx))
+	assert.Equal(t, ctx.IP(), KeyFuncFromLookup("unknown")(ctx))
+	assert.Equal(t, "ut-tenant", KeyFuncFromLookup("header:X-Tenant")(ctx))
+	assert.Equal(t, "ut-api-key", KeyFuncFromLookup("apiKey")(ctx))
+
+	// without jwt token
+	assert.Empty(t, KeyFuncFromLookup("jwt")(ctx))
+
+	// with jwt token
+	ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.JwtTokenKey,
+		&jwt.Token{Claims: jwt.MapClaims{"sub": "ut-user", "tenant": "ut-tenant"}}))
+	assert.Equal(t, "ut-user", KeyFuncFromLookup("jwt")(ctx))
+	assert.Equal(t, "ut-tenant", KeyFuncFromLookup("jwt:tenant")(ctx))
+	assert.Empty(t, KeyFuncFromLookup("jwt:missing")(ctx))
+}
+
+func TestKeyedMiddleware_StoreUnavailable(t *testing.T) {
+	newApp := func(failClosed bool) (*fiber.App, *prometheus.Registry) {
+		registry := prometheus.NewRegistry()
+		app := fiber.New()
+		app.Use(KeyedMiddleware(
+			WithStore(NewRedisStore(WithRedisAddr("127.0.0.1:1"))),
+			WithFailClosed(failClosed),
+			WithRegisterer(registry)))
+		app.Get("/ut-path", func(*fiber.Ctx) error {
+			return nil
+		})
+		return app, registry
+	}
+
+	// fail open
+	app, registry := newApp(false)
+	assert.Equal(t, http.StatusOK, sendWithHeader(t, app, "", ""))
+	assert.Equal(t, 1, testutil.CollectAndCount(registry, "rk_ratelimit_store_errors_total"))
+	assert.Equal(t, 1, testutil.CollectAndCount(registry, "rk_ratelimit_store_latency_seconds"))
+
+	// fail closed
+	app, _ = newApp(true)
+	assert.Equal(t, http.StatusServiceUnavailable, sendWithHeader(t, app, "", ""))
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore(2)
+	limit := Limit{ReqPerSec: 10, Burst: 1}
+
+	res, err := store.Allow("ut-a", limit, 1)
+	assert.Nil(t, err)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 1, res.Limit)
+	assert.Equal(t, 0, res.Remaining)
+
+	res, _ = store.Allow("ut-a", limit, 1)
+	assert.False(t, res.Allowed)
+	assert.True(t, res.RetryAfter > 0 && res.RetryAfter <= 100*time.Millisecond)
+
+	// refill
+	time.Sleep(110 * time.Millisecond)
+	res, _ = store.Allow("ut-a", limit, 1)
+	assert.True(t, res.Allowed)
+
+	// keys are bounded, least recently used one is evicted
+	store.Allow("ut-b", limit, 1)
+	store.Allow("ut-c", limit, 1)
+	assert.Equal(t, 2, store.size())
+	res, _ = store.Allow("ut-a", limit, 1)
+	assert.True(t, res.Allowed)
+}
+
+func TestGcra(t *testing.T) {
+	now := time.Now()
+	limit := Limit{ReqPerSec: 10, Burst: 3}
+
+	// burst
+	tat := now
+	for i := 2; i >= 0; i-- {
+		var res Result
+		tat, res = gcra(tat, now, limit, 1)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, 3, res.Limit)
+		assert.Equal(t, i, res.Remaining)
+	}
+	assert.Equal(t, 300*time.Millisecond, tat.Sub(now))
+
+	// exceeded
+	newTat, res := gcra(tat, now, limit, 1)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, tat, newTat)
+	assert.Equal(t, 100*time.Millisecond, res.RetryAfter)
+	assert.Equal(t, 300*time.Millisecond, res.ResetAfter)
+
+	// one request is allowed after emission interval
+	_, res = gcra(tat, now.Add(100*time.Millisecond), limit, 1)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+
+	// cost
+	newTat, res = gcra(now, now, limit, 2)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 1, res.Remaining)
+	assert.Equal(t, 200*time.Millisecond, newTat.Sub(now))
+	_, res = gcra(now, now, limit, 4)
+	assert.False(t, res.Allowed)
+
+	// blocked
+	_, res = gcra(now, now, Limit{}, 1)
+	assert.False(t, res.Allowed)
+}
+
+func TestKeyedMiddleware_CostAndQuota(t *testing.T) {
+	app := fiber.New()
+	app.Use(KeyedMiddleware(
+		WithKeyFunc(KeyFuncFromLookup("header:X-Tenant")),
+		WithLimit(Limit{ReqPerSec: 100, Burst: 100}),
+		WithCost("/ut-export", 5),
+		WithQuota(Quota{Limit: 6, Window: time.Hour}),
+		WithQuotaByKey("ut-premium", 100),
+		WithQuotaAdminPath("/ut-admin/quota"),
+		WithQuotaAdminToken("ut-token")))
+	app.Get("/ut-path", func(*fiber.Ctx) error {
+		return nil
+	})
+	app.Get("/ut-export", func(*fiber.Ctx) error {
+		return nil
+	})
+
+	send := func(method, path, tenant string) *http.Response {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-Tenant", tenant)
+		if strings.HasPrefix(path, "/ut-admin") {
+			req.Header.Set(fiber.HeaderAuthorization, "Bearer ut-token")
+		}
+		resp, err := app.Test(req)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	// export costs 5 tokens of burst and quota
+	resp := send(http.MethodGet, "/ut-export", "ut-a")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "95", resp.Header.Get(HeaderRemaining))
+	assert.Equal(t, "6", resp.Header.Get(HeaderQuotaLimit))
+	assert.Equal(t, "1", resp.Header.Get(HeaderQuotaRemaining))
+	assert.NotEmpty(t, resp.Header.Get(HeaderQuotaReset))
+
+	// quota is not enough for another export, tokens of burst are not consumed
+	resp = send(http.MethodGet, "/ut-export", "ut-a")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get(fiber.HeaderRetryAfter))
+	assert.Equal(t, "1", resp.Header.Get(HeaderQuotaRemaining))
+	resp = send(http.MethodGet, "/ut-path", "ut-a")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "94", resp.Header.Get(HeaderRemaining))
+	assert.Equal(t, http.StatusTooManyRequests, send(http.MethodGet, "/ut-path", "ut-a").StatusCode)
+
+	// override
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/ut-export", "ut-premium").StatusCode)
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/ut-export", "ut-premium").StatusCode)
+
+	// inspect
+	resp = send(http.MethodGet, "/ut-admin/quota?key=ut-a", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body := &quotaResp{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(body))
+	assert.Equal(t, quotaResp{Key: "ut-a", Limit: 6, Used: 6, Remaining: 0, ResetAfterSec: body.ResetAfterSec}, *body)
+
+	// reset
+	resp = send(http.MethodDelete, "/ut-admin/quota?key=ut-a", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(body))
+	assert.Equal(t, 6, body.Remaining)
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/ut-export", "ut-a").StatusCode)
+
+	// invalid admin requests
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodGet, "/ut-admin/quota", "").StatusCode)
+	assert.Equal(t, http.StatusMethodNotAllowed, send(http.MethodPost, "/ut-admin/quota?key=ut-a", "").StatusCode)
+
+	// admin requests without token
+	for _, token := range []string{"", "Bearer ut-wrong"} {
+		req := httptest.NewRequest(http.MethodDelete, "/ut-admin/quota?key=ut-a", nil)
+		req.Header.Set(fiber.HeaderAuthorization, token)
+		resp, err := app.Test(req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+func TestKeyedMiddleware_AdminPathWithoutAuth(t *testing.T) {
+	set := newOptionSet(
+		WithQuota(Quota{Limit: 1, Window: time.Hour}),
+		WithQuotaAdminPath("/ut-admin/quota"))
+	assert.Empty(t, set.adminPath)
+
+	// admin path is served with auth func
+	app := fiber.New()
+	app.Use(KeyedMiddleware(
+		WithQuota(Quota{Limit: 1, Window: time.Hour}),
+		WithQuotaAdminPath("/ut-admin/quota"),
+		WithQuotaAdminAuth(func(ctx *fiber.Ctx) bool {
+			return ctx.Get("X-Ut-Admin") == "true"
+		})))
+
+	req := httptest.NewRequest(http.MethodGet, "/ut-admin/quota?key=ut-a", nil)
+	resp, err := app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req.Header.Set("X-Ut-Admin", "true")
+	resp, err = app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestMemoryStore_Quota(t *testing.T) {
+	store := NewMemoryStore(10)
+	quota := Quota{Limit: 3, Window: time.Hour}
+
+	res, err := store.ConsumeQuota("ut-a", quota, 2)
+	assert.Nil(t, err)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 2, res.Used)
+	assert.Equal(t, 1, res.Remaining)
+	assert.True(t, res.ResetAfter > 0 && res.ResetAfter <= time.Hour)
+
+	// nothing is consumed if not allowed
+	res, _ = store.ConsumeQuota("ut-a", quota, 2)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 2, res.Used)
+
+	res, _ = store.GetQuota("ut-a", quota)
+	assert.Equal(t, 2, res.Used)
+	res, _ = store.GetQuota("ut-missing", quota)
+	assert.Equal(t, 0, res.Used)
+	assert.Equal(t, 3, res.Remaining)
+
+	assert.Nil(t, store.ResetQuota("ut-a", quota))
+	res, _ = store.GetQuota("ut-a", quota)
+	assert.Equal(t, 0, res.Used)
+
+	// window rotation
+	shortQuota := Quota{Limit: 1, Window: 50 * time.Millisecond}
+	res, _ = store.ConsumeQuota("ut-b", shortQuota, 1)
+	assert.True(t, res.Allowed)
+	time.Sleep(60 * time.Millisecond)
+	res, _ = store.ConsumeQuota("ut-b", shortQuota, 1)
+	assert.True(t, res.Allowed)
+}
+
+func TestToOptions_QuotaOnlyOverride(t *testing.T) {
+	reqPerSec := 10
+	quota := 2
+	config := &BootConfig{}
+	config.Enabled = true
+	config.Keyed.Enabled = true
+	config.Keyed.Key = "header:X-Tenant"
+	config.Keyed.ReqPerSec = &reqPerSec
+	config.Keyed.Burst = 10
+	config.Keyed.Overrides = []OverrideConfig{{Key: "ut-premium", Quota: &quota}}
+
+	app := fiber.New()
+	app.Use(KeyedMiddleware(ToOptions(config, "ut-entry", "ut-type", prometheus.NewRegistry())...))
+	app.Get("/ut-path", func(*fiber.Ctx) error {
+		return nil
+	})
+
+	// default limit applies, requests are rejected by quota only
+	assert.Equal(t, http.StatusOK, sendWithHeader(t, app, "X-Tenant", "ut-premium"))
+	assert.Equal(t, http.StatusOK, sendWithHeader(t, app, "X-Tenant", "ut-premium"))
+	assert.Equal(t, http.StatusTooManyRequests, sendWithHeader(t, app, "X-Tenant", "ut-premium"))
+}
+
+func TestToOptions(t *testing.T) {
+	// disabled
+	assert.Empty(t, ToOptions(&BootConfig{}, "ut-entry", "ut-type", nil))
+
+	// enabled
+	reqPerSec := 5
+	config := &BootConfig{}
+	config.Enabled = true
+	config.Keyed.Enabled = true
+	config.Keyed.Key = "header:X-Tenant"
+	config.Keyed.ReqPerSec = &reqPerSec
+	config.Keyed.Burst = 10
+	config.Keyed.MaxKeys = 100
+	config.Keyed.Overrides = []OverrideConfig{{Key: "ut-premium", ReqPerSec: 50}, {Key: "ut-quota-only"}}
+	config.Keyed.FailClosed = true
+	config.Keyed.Headers.Disabled = true
+	config.Keyed.Headers.Legacy = true
+	config.Keyed.Store.Type = StoreTypeRedis
+	config.Keyed.Store.Addr = "ut-addr:6379"
+	config.Keyed.Costs = []CostConfig{{Path: "/ut-export", Cost: 10}, {Path: "/ut-export/large", Cost: 50}}
+	config.Keyed.Quota = QuotaConfig{Limit: 1000, AdminPath: "/ut-admin", AdminToken: "ut-token"}
+	quota := 5000
+	config.Keyed.Overrides[0].Quota = &quota
+	config.Keyed.Overrides[1].Quota = &quota
+
+	set := newOptionSet(ToOptions(config, "ut-entry", "ut-type", prometheus.NewRegistry())...)
+	assert.Equal(t, "ut-entry", set.entryName)
+	assert.Equal(t, Limit{ReqPerSec: 5, Burst: 10}, set.limit)
+	assert.Equal(t, Limit{ReqPerSec: 50}, set.overrides["ut-premium"])
+	assert.Equal(t, 100, set.maxKeys)
+	assert.True(t, set.failClosed)
+	assert.False(t, set.headers)
+	assert.True(t, set.legacyHeaders)
+	assert.Equal(t, "ut-addr:6379", set.store.(*RedisStore).addr)
+	assert.Equal(t, 50, set.costOf("/ut-export/large/csv"))
+	assert.Equal(t, 10, set.costOf("/ut-export/csv"))
+	assert.Equal(t, 1, set.costOf("/ut-path"))
+	assert.Equal(t, Quota{Limit: 1000, Window: DefaultQuotaWindow}, set.quotaOf("ut-a"))
+	assert.Equal(t, 5000, set.quotaOf("ut-premium").Limit)
+
+	// override with quota only keeps default limit
+	_, ok := set.overrides["ut-quota-only"]
+	assert.False(t, ok)
+	assert.Equal(t, 5000, set.quotaOf("ut-quota-only").Limit)
+	assert.Equal(t, "/ut-admin", set.adminPath)
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/rookie-ninja/rk-entry/v2/middleware"
 	"github.com/rookie-ninja/rk-entry/v2/middleware/ratelimit"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
 	"github.com/valyala/fasthttp/fasthttpadaptor"
 	"net/http"
 )
@@ -22,6 +23,11 @@ func Middleware(opts ...rkmidlimit.Option) fiber.Handler {
 	return func(ctx *fiber.Ctx) error {
 		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, set.GetEntryName()))
 
+		// request issued by middleware was already limited as original request
+		if rkfiberctx.IsInternalRequest(ctx) {
+			return ctx.Next()
+		}
+
 		req := &http.Request{}
 		fasthttpadaptor.ConvertRequest(ctx.Context(), req, true)
 
@@ -0,0 +1,412 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberlimit
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gcraScript applies GCRA in Redis atomically, clock of Redis is used so that replicas share the same clock.
+//
+// KEYS[1]: key
+// ARGV[1]: emission interval in microseconds
+// ARGV[2]: burst
+// ARGV[3]: cost
+//
+// Returns {allowed, remaining, resetAfterUs, retryAfterUs}
+const gcraScript = `
+if redis.replicate_commands then redis.replicate_commands() end
+local interval = tonumber(ARGV[1])
+local offset = interval * tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then tat = now end
+local newTat = tat + interval * tonumber(ARGV[3])
+local allowAt = newTat - offset
+if now < allowAt then
+  return {0, 0, tat - now, allowAt - now}
+end
+redis.call('SET', KEYS[1], newTat, 'PX', math.ceil((newTat - now) / 1000))
+return {1, math.floor((offset - (newTat - now)) / interval), newTat - now, 0}
+`
+
+// quotaScript consumes cost of quota in window atomically, nothing is consumed if limit would be exceeded.
+//
+// KEYS[1]: key of window
+// ARGV[1]: limit
+// ARGV[2]: cost
+// ARGV[3]: ttl in milliseconds
+//
+// Returns {allowed, used}
+const quotaScript = `
+local used = tonumber(redis.call('GET', KEYS[1]) or '0')
+if used + tonumber(ARGV[2]) > tonumber(ARGV[1]) then
+  return {0, used}
+end
+used = redis.call('INCRBY', KEYS[1], ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return {1, used}
+`
+
+var (
+	gcraScriptSha  = scriptSha(gcraScript)
+	quotaScriptSha = scriptSha(quotaScript)
+)
+
+// scriptSha returns sha1 of script which is used by EVALSHA
+func scriptSha(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+// RedisOption is option of RedisStore
+type RedisOption func(*RedisStore)
+
+// WithRedisAddr provide address of Redis, default is localhost:6379.
+func WithRedisAddr(addr string) RedisOption {
+	return func(s *RedisStore) {
+		if len(addr) > 0 {
+			s.addr = addr
+		}
+	}
+}
+
+// WithRedisPassword provide password of Redis.
+func WithRedisPassword(password string) RedisOption {
+	return func(s *RedisStore) {
+		s.password = password
+	}
+}
+
+// WithRedisDB provide database index of Redis.
+func WithRedisDB(db int) RedisOption {
+	return func(s *RedisStore) {
+		s.db = db
+	}
+}
+
+// WithRedisPrefix provide prefix of keys, default is rk:ratelimit:.
+func WithRedisPrefix(prefix string) RedisOption {
+	return func(s *RedisStore) {
+		if len(prefix) > 0 {
+			s.prefix = prefix
+		}
+	}
+}
+
+// WithRedisTimeout provide timeout of dial, read and write, default is 100ms.
+func WithRedisTimeout(timeout time.Duration) RedisOption {
+	return func(s *RedisStore) {
+		if timeout > 0 {
+			s.timeout = timeout
+		}
+	}
+}
+
+// WithRedisPoolSize provide max idle connections, default is 16.
+func WithRedisPoolSize(size int) RedisOption {
+	return func(s *RedisStore) {
+		if size > 0 {
+			s.pool = make(chan *redisConn, size)
+		}
+	}
+}
+
+// RedisStore is a Store backed by Redis protocol compatible server, GCRA is applied with lua script.
+type RedisStore struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+	timeout  time.Duration
+	pool     chan *redisConn
+}
+
+// NewRedisStore create RedisStore, connections are established lazily.
+func NewRedisStore(opts ...RedisOption) *RedisStore {
+	res := &RedisStore{
+		addr:    "localhost:6379",
+		prefix:  "rk:ratelimit:",
+		timeout: 100 * time.Millisecond,
+		pool:    make(chan *redisConn, 16),
+	}
+
+	for i := range opts {
+		opts[i](res)
+	}
+
+	return res
+}
+
+// Allow consumes cost of key with limit
+func (s *RedisStore) Allow(key string, limit Limit, cost int) (Result, error) {
+	res := Result{Limit: limit.capacity()}
+	if limit.blocked() {
+		res.Limit = 0
+		return res, nil
+	}
+
+	if cost < 1 {
+		cost = 1
+	}
+
+	ints, err := s.eval(gcraScript, gcraScriptSha, 4, s.prefix+key,
+		strconv.FormatInt(limit.interval().Microseconds(), 10),
+		strconv.Itoa(res.Limit),
+		strconv.Itoa(cost))
+	if err != nil {
+		return res, err
+	}
+
+	res.Allowed = ints[0] == 1
+	res.Remaining = int(ints[1])
+	res.ResetAfter = time.Duration(ints[2]) * time.Microsecond
+	res.RetryAfter = time.Duration(ints[3]) * time.Microsecond
+
+	return res, nil
+}
+
+// ConsumeQuota consumes cost of key in current window of quota, nothing is consumed if not allowed.
+// Window is decided with local clock, clocks of replicas are expected to be synchronized.
+func (s *RedisStore) ConsumeQuota(key string, quota Quota, cost int) (QuotaResult, error) {
+	now := time.Now()
+	res := newQuotaResult(quota, 0, now)
+
+	ints, err := s.eval(quotaScript, quotaScriptSha, 2, s.quotaKey(key, quota, now),
+		strconv.Itoa(quota.Limit),
+		strconv.Itoa(cost),
+		strconv.FormatInt(res.ResetAfter.Milliseconds()+1000, 10))
+	if err != nil {
+		return res, err
+	}
+
+	res = newQuotaResult(quota, int(ints[1]), now)
+	res.Allowed = ints[0] == 1
+
+	return res, nil
+}
+
+// GetQuota returns usage of key in current window of quota
+func (s *RedisStore) GetQuota(key string, quota Quota) (QuotaResult, error) {
+	now := time.Now()
+
+	reply, err := s.do("GET", s.quotaKey(key, quota, now))
+	if err != nil {
+		return newQuotaResult(quota, 0, now), err
+	}
+
+	used := 0
+	if str, ok := reply.(string); ok {
+		if used, err = strconv.Atoi(str); err != nil {
+			return newQuotaResult(quota, 0, now), err
+		}
+	}
+
+	res := newQuotaResult(quota, used, now)
+	res.Allowed = used < quota.Limit
+
+	return res, nil
+}
+
+// ResetQuota clears usage of key in current window of quota
+func (s *RedisStore) ResetQuota(key string, quota Quota) error {
+	_, err := s.do("DEL", s.quotaKey(key, quota, time.Now()))
+	return err
+}
+
+// quotaKey returns key of current window of quota
+func (s *RedisStore) quotaKey(key string, quota Quota, now time.Time) string {
+	return s.prefix + "quota:" + key + ":" + strconv.FormatInt(quota.windowStart(now).Unix(), 10)
+}
+
+// eval runs script with single key, script is loaded with EVAL if missing in server.
+// Reply is expected to be an array of size integers.
+func (s *RedisStore) eval(script, sha string, size int, key string, args ...string) ([]int64, error) {
+	reply, err := s.do(append([]string{"EVALSHA", sha, "1", key}, args...)...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		reply, err = s.do(append([]string{"EVAL", script, "1", key}, args...)...)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != size {
+		return nil, fmt.Errorf("unexpected reply %v", reply)
+	}
+
+	ints := make([]int64, size)
+	for i := range values {
+		if ints[i], ok = values[i].(int64); !ok {
+			return nil, fmt.Errorf("unexpected reply %v", reply)
+		}
+	}
+
+	return ints, nil
+}
+
+// do send command with pooled connection
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	conn, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.do(args...)
+	s.put(conn, err)
+
+	return reply, err
+}
+
+// get idle connection from pool or dial a new one
+func (s *RedisStore) get() (*redisConn, error) {
+	select {
+	case conn := <-s.pool:
+		return conn, nil
+	default:
+	}
+
+	raw, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &redisConn{
+		conn:    raw,
+		reader:  bufio.NewReader(raw),
+		timeout: s.timeout,
+	}
+
+	if len(s.password) > 0 {
+		if _, err := conn.do("AUTH", s.password); err != nil {
+			raw.Close()
+			return nil, err
+		}
+	}
+
+	if s.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(s.db)); err != nil {
+			raw.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// put connection back to pool, connection is closed if broken or pool is full
+func (s *RedisStore) put(conn *redisConn, err error) {
+	var rErr redisError
+	if err != nil && !errors.As(err, &rErr) {
+		conn.conn.Close()
+		return
+	}
+
+	select {
+	case s.pool <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// redisError is error reply from server, connection is still usable
+type redisError string
+
+// Error returns error message
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// redisConn is a connection speaks RESP
+type redisConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+// do send command and read reply
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for i := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(args[i])), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, args[i]...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return readReply(c.reader)
+}
+
+// readReply reads one RESP reply
+func readReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		bytes := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, bytes); err != nil {
+			return nil, err
+		}
+		return string(bytes[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		res := make([]interface{}, size)
+		for i := range res {
+			if res[i], err = readReply(reader); err != nil {
+				var rErr redisError
+				if !errors.As(err, &rErr) {
+					return nil, err
+				}
+				res[i] = rErr
+			}
+		}
+		return res, nil
+	}
+
+	return nil, fmt.Errorf("malformed reply %q", line)
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberlimit
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRedis starts in-memory Redis which runs lua scripts, so that gcraScript and quotaScript are tested as is
+func newRedis(t *testing.T) *miniredis.Miniredis {
+	server, err := miniredis.Run()
+	assert.Nil(t, err)
+	return server
+}
+
+func TestRedisStore_Allow(t *testing.T) {
+	server := newRedis(t)
+	defer server.Close()
+	server.RequireAuth("ut-pass")
+	now := time.Now()
+	server.SetTime(now)
+
+	store := NewRedisStore(
+		WithRedisAddr(server.Addr()),
+		WithRedisPassword("ut-pass"),
+		WithRedisDB(1),
+		WithRedisPrefix("ut:"))
+	limit := Limit{ReqPerSec: 10, Burst: 2}
+
+	res, err := store.Allow("ut-key", limit, 1)
+	assert.Nil(t, err)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 2, res.Limit)
+	assert.Equal(t, 1, res.Remaining)
+	assert.Equal(t, 100*time.Millisecond, res.ResetAfter)
+
+	res, err = store.Allow("ut-key", limit, 1)
+	assert.Nil(t, err)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+
+	res, err = store.Allow("ut-key", limit, 1)
+	assert.Nil(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 100*time.Millisecond, res.RetryAfter)
+
+	// theoretical arrival time is stored in selected db with expiration
+	assert.True(t, server.DB(1).Exists("ut:ut-key"))
+	assert.True(t, server.DB(1).TTL("ut:ut-key") > 0)
+
+	// one token is emitted after interval with clock of Redis
+	server.SetTime(now.Add(100 * time.Millisecond))
+	res, err = store.Allow("ut-key", limit, 1)
+	assert.Nil(t, err)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+
+	// cost exceeding burst is never allowed
+	res, err = store.Allow("ut-other", limit, 3)
+	assert.Nil(t, err)
+	assert.False(t, res.Allowed)
+
+	// script is loaded with EVAL after NOSCRIPT of EVALSHA, connection is reused
+	assert.Equal(t, 1, server.TotalConnectionCount())
+
+	// blocked limit does not reach server
+	count := server.CommandCount()
+	res, err = store.Allow("ut-key", Limit{}, 1)
+	assert.Nil(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, count, server.CommandCount())
+}
+
+func TestRedisStore_Quota(t *testing.T) {
+	server := newRedis(t)
+	defer server.Close()
+
+	store := NewRedisStore(WithRedisAddr(server.Addr()))
+	quota := Quota{Limit: 3, Window: time.Hour}
+
+	res, err := store.ConsumeQuota("ut-key", quota, 2)
+	assert.Nil(t, err)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 1, res.Remaining)
+
+	res, err = store.ConsumeQuota("ut-key", quota, 2)
+	assert.Nil(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 2, res.Used)
+
+	res, err = store.GetQuota("ut-key", quota)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res.Used)
+
+	// usage is kept per window and expires after it
+	key := "rk:ratelimit:quota:ut-key:" + strconv.FormatInt(quota.windowStart(time.Now()).Unix(), 10)
+	assert.True(t, server.Exists(key))
+	assert.True(t, server.TTL(key) > 0 && server.TTL(key) <= time.Hour+time.Second)
+
+	assert.Nil(t, store.ResetQuota("ut-key", quota))
+	res, err = store.GetQuota("ut-key", quota)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, res.Used)
+}
+
+func TestRedisStore_Error(t *testing.T) {
+	server := newRedis(t)
+	defer server.Close()
+	server.RequireAuth("ut-pass")
+
+	// wrong password
+	store := NewRedisStore(WithRedisAddr(server.Addr()), WithRedisPassword("wrong"))
+	_, err := store.Allow("ut-key", Limit{ReqPerSec: 1}, 1)
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "WRONGPASS"))
+
+	// unreachable
+	store = NewRedisStore(WithRedisAddr("127.0.0.1:1"), WithRedisTimeout(10*time.Millisecond))
+	_, err = store.Allow("ut-key", Limit{ReqPerSec: 1}, 1)
+	assert.NotNil(t, err)
+}
+
+func TestKeyedMiddleware_WithRedisStore(t *testing.T) {
+	server := newRedis(t)
+	defer server.Close()
+
+	newApp := func() *fiber.App {
+		app := fiber.New()
+		app.Use(KeyedMiddleware(
+			WithStore(NewRedisStore(WithRedisAddr(server.Addr()))),
+			WithLimit(Limit{ReqPerSec: 1, Burst: 2})))
+		app.Get("/ut-path", func(*fiber.Ctx) error {
+			return nil
+		})
+		return app
+	}
+
+	// limit is shared across replicas
+	replicaA, replicaB := newApp(), newApp()
+	assert.Equal(t, http.StatusOK, sendWithHeader(t, replicaA, "", ""))
+	assert.Equal(t, http.StatusOK, sendWithHeader(t, replicaB, "", ""))
+	assert.Equal(t, http.StatusTooManyRequests, sendWithHeader(t, replicaA, "", ""))
+	assert.Equal(t, http.StatusTooManyRequests, sendWithHeader(t, replicaB, "", ""))
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberlimit
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// StoreTypeMemory keeps state in memory of current process
+	StoreTypeMemory = "memory"
+	// StoreTypeRedis keeps state in Redis protocol compatible store shared across replicas
+	StoreTypeRedis = "redis"
+)
+
+// Limit is allowed rate of a key.
+//
+// ReqPerSec is sustained rate, Burst is max requests allowed at once. ReqPerSec less than 1 blocks all requests.
+type Limit struct {
+	ReqPerSec int
+	Burst     int
+}
+
+// capacity returns burst, or ReqPerSec if burst is missing
+func (l Limit) capacity() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+
+	return l.ReqPerSec
+}
+
+// interval returns emission interval of GCRA
+func (l Limit) interval() time.Duration {
+	return time.Second / time.Duration(l.ReqPerSec)
+}
+
+// blocked returns true if no request is allowed
+func (l Limit) blocked() bool {
+	return l.ReqPerSec < 1 || l.capacity() < 1
+}
+
+// Result is decision of limiter for one request
+type Result struct {
+	// Allowed whether request is allowed
+	Allowed bool
+	// Limit is max requests allowed at once
+	Limit int
+	// Remaining is number of requests allowed immediately after this one
+	Remaining int
+	// ResetAfter is duration until limit is fully available again
+	ResetAfter time.Duration
+	// RetryAfter is duration until next request would be allowed, zero if allowed
+	RetryAfter time.Duration
+}
+
+// Quota is max cost allowed for a key in a fixed window, windows are aligned to unix epoch.
+//
+// Limit less than 1 disables quota.
+type Quota struct {
+	Limit  int
+	Window time.Duration
+}
+
+// enabled returns true if quota should be applied
+func (q Quota) enabled() bool {
+	return q.Limit > 0 && q.Window > 0
+}
+
+// windowStart returns start of window which now belongs to
+func (q Quota) windowStart(now time.Time) time.Time {
+	return now.Truncate(q.Window)
+}
+
+// QuotaResult is usage of quota in current window
+type QuotaResult struct {
+	// Allowed whether request is allowed
+	Allowed bool
+	// Limit is max cost allowed in window
+	Limit int
+	// Used is cost consumed in window
+	Used int
+	// Remaining is cost still allowed in window
+	Remaining int
+	// ResetAfter is duration until current window ends
+	ResetAfter time.Duration
+}
+
+// newQuotaResult create QuotaResult from usage
+func newQuotaResult(quota Quota, used int, now time.Time) QuotaResult {
+	res := QuotaResult{
+		Limit:      quota.Limit,
+		Used:       used,
+		Remaining:  quota.Limit - used,
+		ResetAfter: quota.windowStart(now).Add(quota.Window).Sub(now),
+	}
+
+	if res.Remaining < 0 {
+		res.Remaining = 0
+	}
+
+	return res
+}
+
+// Store keeps rate limit state of keys and makes decision atomically.
+//
+// Implementations shared across replicas make limit global instead of per process.
+type Store interface {
+	// Allow consumes cost of key with limit
+	Allow(key string, limit Limit, cost int) (Result, error)
+	// ConsumeQuota consumes cost of key in current window of quota, nothing is consumed if not allowed
+	ConsumeQuota(key string, quota Quota, cost int) (QuotaResult, error)
+	// GetQuota returns usage of key in current window of quota
+	GetQuota(key string, quota Quota) (QuotaResult, error)
+	// ResetQuota clears usage of key in current window of quota
+	ResetQuota(key string, quota Quota) error
+}
+
+// gcra applies generic cell rate algorithm, tat is theoretical arrival time of key.
+// Request with cost is treated as cost requests arriving at once.
+// Returns new tat which should be stored if request is allowed.
+func gcra(tat, now time.Time, limit Limit, cost int) (time.Time, Result) {
+	res := Result{Limit: limit.capacity()}
+	if limit.blocked() {
+		res.Limit = 0
+		return tat, res
+	}
+
+	if cost < 1 {
+		cost = 1
+	}
+
+	interval := limit.interval()
+	offset := interval * time.Duration(res.Limit)
+
+	if tat.Before(now) {
+		tat = now
+	}
+
+	newTat := tat.Add(interval * time.Duration(cost))
+	allowAt := newTat.Add(-offset)
+
+	if now.Before(allowAt) {
+		res.ResetAfter = tat.Sub(now)
+		res.RetryAfter = allowAt.Sub(now)
+		return tat, res
+	}
+
+	res.Allowed = true
+	res.ResetAfter = newTat.Sub(now)
+	res.Remaining = int((offset - res.ResetAfter) / interval)
+
+	return newTat, res
+}
+
+// ***************** MemoryStore *****************
+
+// memoryEntry is state of a key
+type memoryEntry struct {
+	key         string
+	tat         time.Time
+	windowStart time.Time
+	used        int
+}
+
+// MemoryStore keeps GCRA state and quota usage per key in memory of current process.
+//
+// Number of keys is bounded with LRU eviction, evicted key would be allowed to burst again once it comes back,
+// and its quota usage would be lost as well.
+type MemoryStore struct {
+	lock    sync.Mutex
+	maxKeys int
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// NewMemoryStore create MemoryStore with max number of keys
+func NewMemoryStore(maxKeys int) *MemoryStore {
+	if maxKeys < 1 {
+		maxKeys = DefaultMaxKeys
+	}
+
+	return &MemoryStore{
+		maxKeys: maxKeys,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Allow consumes cost of key with limit
+func (s *MemoryStore) Allow(key string, limit Limit, cost int) (Result, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	entry := s.get(key, now)
+	tat, res := gcra(entry.tat, now, limit, cost)
+	entry.tat = tat
+
+	return res, nil
+}
+
+// ConsumeQuota consumes cost of key in current window of quota, nothing is consumed if not allowed
+func (s *MemoryStore) ConsumeQuota(key string, quota Quota, cost int) (QuotaResult, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	entry := s.get(key, now)
+	s.rotate(entry, quota, now)
+
+	if entry.used+cost > quota.Limit {
+		return newQuotaResult(quota, entry.used, now), nil
+	}
+
+	entry.used += cost
+	res := newQuotaResult(quota, entry.used, now)
+	res.Allowed = true
+
+	return res, nil
+}
+
+// GetQuota returns usage of key in current window of quota
+func (s *MemoryStore) GetQuota(key string, quota Quota) (QuotaResult, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	used := 0
+	if elem, ok := s.entries[key]; ok {
+		entry := elem.Value.(*memoryEntry)
+		s.rotate(entry, quota, now)
+		used = entry.used
+	}
+
+	res := newQuotaResult(quota, used, now)
+	res.Allowed = used < quota.Limit
+
+	return res, nil
+}
+
+// ResetQuota clears usage of key in current window of quota
+func (s *MemoryStore) ResetQuota(key string, _ Quota) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if elem, ok := s.entries[key]; ok {
+		elem.Value.(*memoryEntry).used = 0
+	}
+
+	return nil
+}
+
+// get entry of key and mark it as recently used, caller must hold lock
+func (s *MemoryStore) get(key string, now time.Time) *memoryEntry {
+	elem, ok := s.entries[key]
+	if ok {
+		s.lru.MoveToFront(elem)
+		return elem.Value.(*memoryEntry)
+	}
+
+	for s.lru.Len() >= s.maxKeys {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryEntry).key)
+	}
+
+	entry := &memoryEntry{key: key, tat: now}
+	s.entries[key] = s.lru.PushFront(entry)
+
+	return entry
+}
+
+// rotate resets usage of entry once window of quota ends, caller must hold lock
+func (s *MemoryStore) rotate(entry *memoryEntry, quota Quota, now time.Time) {
+	if start := quota.windowStart(now); !entry.windowStart.Equal(start) {
+		entry.windowStart = start
+		entry.used = 0
+	}
+}
+
+// size returns number of keys
+func (s *MemoryStore) size() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.lru.Len()
+}
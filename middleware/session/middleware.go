@@ -0,0 +1,254 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+// Package rkfibersession is server side session middleware for fiber framework
+package rkfibersession
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Middleware loads session from Store with id in cookie and saves it back after handler returns.
+//
+// Session could be retrieved with rkfiberctx.GetSession(). Cookie is only issued once session contains values.
+// Session expires after idle timeout without requests, or absolute timeout after creation.
+func Middleware(opts ...Option) fiber.Handler {
+	set := newOptionSet(opts...)
+
+	return func(ctx *fiber.Ctx) error {
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, set.entryName))
+
+		if set.ShouldIgnore(ctx.Path()) {
+			return ctx.Next()
+		}
+
+		sess := set.load(ctx)
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkfiberctx.SessionKey, sess))
+
+		err := ctx.Next()
+
+		set.save(ctx, sess)
+
+		return err
+	}
+}
+
+// record is serialized session in Store, times are in unix milliseconds
+type record struct {
+	Values       map[string]interface{} `json:"values"`
+	CreatedAtMs  int64                  `json:"createdAtMs"`
+	LastAccessMs int64                  `json:"lastAccessMs"`
+}
+
+// load session from Store, new session would be created if missing or expired
+func (set *optionSet) load(ctx *fiber.Ctx) *session {
+	now := time.Now()
+	id := ctx.Cookies(set.cookieName)
+
+	if len(id) > 0 {
+		data, err := set.store.Get(id)
+		if err != nil {
+			set.logger().Warn("Failed to load session.", zap.Error(err))
+		}
+
+		rec := &record{}
+		if len(data) > 0 && json.Unmarshal(data, rec) == nil {
+			idle := now.Sub(time.UnixMilli(rec.LastAccessMs)) > set.idleTimeout
+			absolute := now.Sub(time.UnixMilli(rec.CreatedAtMs)) > set.absoluteTimeout
+
+			if !idle && !absolute {
+				if rec.Values == nil {
+					rec.Values = make(map[string]interface{})
+				}
+
+				return &session{
+					id:        id,
+					values:    rec.Values,
+					createdAt: time.UnixMilli(rec.CreatedAtMs),
+					persisted: true,
+				}
+			}
+
+			set.store.Delete(id)
+		}
+	}
+
+	return &session{
+		id:        newSessionId(),
+		values:    make(map[string]interface{}),
+		createdAt: now,
+		// cookie with unknown id should be cleared
+		persisted: len(id) > 0,
+	}
+}
+
+// save session into Store and issue cookie
+func (set *optionSet) save(ctx *fiber.Ctx, sess *session) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+
+	for i := range sess.staleIds {
+		set.store.Delete(sess.staleIds[i])
+	}
+
+	if len(sess.values) < 1 {
+		if sess.persisted {
+			set.store.Delete(sess.id)
+			set.clearCookie(ctx)
+		}
+		return
+	}
+
+	now := time.Now()
+	ttl := set.idleTimeout
+	if remaining := sess.createdAt.Add(set.absoluteTimeout).Sub(now); remaining < ttl {
+		ttl = remaining
+	}
+
+	data, err := json.Marshal(&record{
+		Values:       sess.values,
+		CreatedAtMs:  sess.createdAt.UnixMilli(),
+		LastAccessMs: now.UnixMilli(),
+	})
+	if err != nil {
+		set.logger().Warn("Failed to marshal session.", zap.Error(err))
+		return
+	}
+
+	if err := set.store.Set(sess.id, data, ttl); err != nil {
+		set.logger().Warn("Failed to save session.", zap.Error(err))
+		return
+	}
+
+	ctx.Cookie(&fiber.Cookie{
+		Name:     set.cookieName,
+		Value:    sess.id,
+		Path:     set.cookiePath,
+		Domain:   set.cookieDomain,
+		MaxAge:   int(sess.createdAt.Add(set.absoluteTimeout).Sub(now).Seconds()),
+		Secure:   set.cookieSecure,
+		HTTPOnly: true,
+		SameSite: set.cookieSameSite,
+	})
+}
+
+// clearCookie expire session cookie
+func (set *optionSet) clearCookie(ctx *fiber.Ctx) {
+	ctx.Cookie(&fiber.Cookie{
+		Name:     set.cookieName,
+		Path:     set.cookiePath,
+		Domain:   set.cookieDomain,
+		Expires:  fasthttp.CookieExpireDelete,
+		Secure:   set.cookieSecure,
+		HTTPOnly: true,
+		SameSite: set.cookieSameSite,
+	})
+}
+
+// logger returns default logger
+func (set *optionSet) logger() *zap.Logger {
+	return rkentry.GlobalAppCtx.GetLoggerEntryDefault().Logger
+}
+
+// session is implementation of rkfiberctx.Session
+type session struct {
+	lock      sync.Mutex
+	id        string
+	values    map[string]interface{}
+	createdAt time.Time
+	// ids replaced by Regenerate or Destroy, which should be removed from Store
+	staleIds []string
+	// whether cookie was issued before
+	persisted bool
+}
+
+// ID returns session id
+func (s *session) ID() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.id
+}
+
+// Get returns value of key
+func (s *session) Get(key string) interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.values[key]
+}
+
+// Set value of key
+func (s *session) Set(key string, val interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.values[key] = val
+}
+
+// Delete value of key
+func (s *session) Delete(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.values, key)
+}
+
+// Keys returns sorted keys in session
+func (s *session) Keys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res := make([]string, 0, len(s.values))
+	for k := range s.values {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+// Regenerate rotates session id and keeps values
+func (s *session) Regenerate() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.persisted {
+		s.staleIds = append(s.staleIds, s.id)
+	}
+	s.id = newSessionId()
+}
+
+// Destroy removes all values, session would be removed from Store and cookie would be cleared.
+// Values set afterwards would be stored with a new session id.
+func (s *session) Destroy() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.persisted {
+		s.staleIds = append(s.staleIds, s.id)
+	}
+	s.id = newSessionId()
+	s.values = make(map[string]interface{})
+}
+
+// newSessionId returns random session id with 256 bits entropy
+func newSessionId() string {
+	bytes := make([]byte, 32)
+	rand.Read(bytes)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
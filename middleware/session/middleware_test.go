@@ -0,0 +1,250 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibersession
+
+import (
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func newApp(store Store, opts ...Option) *fiber.App {
+	app := fiber.New()
+	app.Use(Middleware(append([]Option{WithStore(store), WithPathToIgnore("/ut-ignore")}, opts...)...))
+	app.Get("/ut-login", func(ctx *fiber.Ctx) error {
+		sess := rkfiberctx.GetSession(ctx)
+		sess.Regenerate()
+		sess.Set("user", "ut-user")
+		return nil
+	})
+	app.Get("/ut-user", func(ctx *fiber.Ctx) error {
+		user, _ := rkfiberctx.GetSession(ctx).Get("user").(string)
+		return ctx.SendString(user)
+	})
+	app.Get("/ut-logout", func(ctx *fiber.Ctx) error {
+		rkfiberctx.GetSession(ctx).Destroy()
+		return nil
+	})
+	app.Get("/ut-ignore", func(ctx *fiber.Ctx) error {
+		if rkfiberctx.GetSession(ctx) != nil {
+			return ctx.SendStatus(http.StatusInternalServerError)
+		}
+		return nil
+	})
+	return app
+}
+
+func newFileStore(t *testing.T) *FileStore {
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "ut-session"))
+	assert.Nil(t, err)
+	return store
+}
+
+func getCookie(resp *http.Response) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == DefaultCookieName {
+			return c
+		}
+	}
+	return nil
+}
+
+func sendWithCookie(t *testing.T, app *fiber.App, path string, cookie *http.Cookie) *http.Response {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	resp, err := app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	return resp
+}
+
+func TestMiddleware(t *testing.T) {
+	for _, store := range []Store{NewMemoryStore(), newFileStore(t)} {
+		app := newApp(store)
+
+		// session without value would not issue cookie
+		resp := sendWithCookie(t, app, "/ut-user", nil)
+		assert.Nil(t, getCookie(resp))
+
+		// login
+		resp = sendWithCookie(t, app, "/ut-login", nil)
+		cookie := getCookie(resp)
+		assert.NotNil(t, cookie)
+		assert.True(t, cookie.HttpOnly)
+		assert.Equal(t, "/", cookie.Path)
+
+		// with session
+		resp = sendWithCookie(t, app, "/ut-user", cookie)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "ut-user", string(body))
+
+		// login again would rotate session id and remove old one
+		resp = sendWithCookie(t, app, "/ut-login", cookie)
+		rotated := getCookie(resp)
+		assert.NotEqual(t, cookie.Value, rotated.Value)
+		data, _ := store.Get(cookie.Value)
+		assert.Nil(t, data)
+
+		// logout would remove session and clear cookie
+		resp = sendWithCookie(t, app, "/ut-logout", rotated)
+		assert.Empty(t, getCookie(resp).Value)
+		data, _ = store.Get(rotated.Value)
+		assert.Nil(t, data)
+
+		// unknown session id from client would not be accepted
+		resp = sendWithCookie(t, app, "/ut-login", &http.Cookie{Name: DefaultCookieName, Value: "ut-fixed"})
+		assert.NotEqual(t, "ut-fixed", getCookie(resp).Value)
+
+		// ignored path
+		resp = sendWithCookie(t, app, "/ut-ignore", nil)
+		assert.Nil(t, getCookie(resp))
+	}
+}
+
+func TestMiddleware_Timeout(t *testing.T) {
+	store := NewMemoryStore()
+
+	// idle timeout
+	app := newApp(store, WithIdleTimeout(time.Second))
+	cookie := getCookie(sendWithCookie(t, app, "/ut-login", nil))
+	time.Sleep(2100 * time.Millisecond)
+	body, _ := io.ReadAll(sendWithCookie(t, app, "/ut-user", cookie).Body)
+	assert.Empty(t, string(body))
+
+	// absolute timeout, session expires although it is active
+	app = newApp(store, WithIdleTimeout(time.Hour), WithAbsoluteTimeout(2*time.Second))
+	cookie = getCookie(sendWithCookie(t, app, "/ut-login", nil))
+	assert.True(t, cookie.MaxAge <= 2)
+	time.Sleep(1100 * time.Millisecond)
+	body, _ = io.ReadAll(sendWithCookie(t, app, "/ut-user", cookie).Body)
+	assert.Equal(t, "ut-user", string(body))
+	time.Sleep(2100 * time.Millisecond)
+	body, _ = io.ReadAll(sendWithCookie(t, app, "/ut-user", cookie).Body)
+	assert.Empty(t, string(body))
+}
+
+func TestMiddleware_SubSecondTimeout(t *testing.T) {
+	for _, store := range []Store{NewMemoryStore(), newFileStore(t)} {
+		// times are kept in milliseconds, so timeout under one second is honored
+		app := newApp(store, WithIdleTimeout(300*time.Millisecond), WithAbsoluteTimeout(time.Hour))
+		cookie := getCookie(sendWithCookie(t, app, "/ut-login", nil))
+
+		data, err := store.Get(cookie.Value)
+		assert.Nil(t, err)
+		rec := &record{}
+		assert.Nil(t, json.Unmarshal(data, rec))
+		assert.InDelta(t, time.Now().UnixMilli(), rec.CreatedAtMs, 1000)
+		assert.InDelta(t, time.Now().UnixMilli(), rec.LastAccessMs, 1000)
+
+		time.Sleep(100 * time.Millisecond)
+		body, _ := io.ReadAll(sendWithCookie(t, app, "/ut-user", cookie).Body)
+		assert.Equal(t, "ut-user", string(body))
+
+		time.Sleep(400 * time.Millisecond)
+		body, _ = io.ReadAll(sendWithCookie(t, app, "/ut-user", cookie).Body)
+		assert.Empty(t, string(body))
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	store := newFileStore(t)
+
+	// missing
+	data, err := store.Get("ut-id")
+	assert.Nil(t, err)
+	assert.Nil(t, data)
+
+	// happy case
+	assert.Nil(t, store.Set("../ut-id", []byte("ut-data"), time.Minute))
+	data, err = store.Get("../ut-id")
+	assert.Nil(t, err)
+	assert.Equal(t, "ut-data", string(data))
+
+	// expired
+	assert.Nil(t, store.Set("ut-id", []byte("ut-data"), -time.Second))
+	data, err = store.Get("ut-id")
+	assert.Nil(t, err)
+	assert.Nil(t, data)
+
+	// delete
+	assert.Nil(t, store.Delete("../ut-id"))
+	assert.Nil(t, store.Delete("../ut-id"))
+	data, _ = store.Get("../ut-id")
+	assert.Nil(t, data)
+}
+
+func TestFileStore_Sweep(t *testing.T) {
+	store := newFileStore(t)
+	store.sweepEvery = time.Millisecond
+
+	// abandoned session which is never read again is swept while writing
+	assert.Nil(t, store.Set("ut-abandoned", []byte("ut-data"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	assert.Nil(t, store.Set("ut-id", []byte("ut-data"), time.Minute))
+
+	entries, err := os.ReadDir(store.dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	data, _ := store.Get("ut-id")
+	assert.Equal(t, "ut-data", string(data))
+}
+
+func TestNewFileStore(t *testing.T) {
+	// directory is required
+	_, err := NewFileStore("")
+	assert.NotNil(t, err)
+
+	// missing directory is created with mode 0700
+	dir := filepath.Join(t.TempDir(), "ut-session")
+	_, err = NewFileStore(dir)
+	assert.Nil(t, err)
+	info, err := os.Stat(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	// existing directory accessible by others is refused
+	if runtime.GOOS != "windows" {
+		shared := filepath.Join(t.TempDir(), "ut-shared")
+		assert.Nil(t, os.Mkdir(shared, 0777))
+		assert.Nil(t, os.Chmod(shared, 0777))
+		_, err = NewFileStore(shared)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestToOptions(t *testing.T) {
+	// disabled
+	assert.Empty(t, ToOptions(&BootConfig{}, "ut-entry", "ut-type"))
+
+	// enabled with file store
+	config := &BootConfig{
+		Enabled:        true,
+		IdleTimeoutSec: 60,
+		CookieName:     "ut-cookie",
+		CookieSameSite: "Strict",
+	}
+	config.Store.Type = StoreTypeFile
+	config.Store.Path = filepath.Join(t.TempDir(), "ut-session")
+
+	set := newOptionSet(ToOptions(config, "ut-entry", "ut-type")...)
+	assert.Equal(t, "ut-entry", set.entryName)
+	assert.Equal(t, time.Minute, set.idleTimeout)
+	assert.Equal(t, DefaultAbsoluteTimeout, set.absoluteTimeout)
+	assert.Equal(t, "ut-cookie", set.cookieName)
+	assert.Equal(t, "strict", set.cookieSameSite)
+	assert.IsType(t, &FileStore{}, set.store)
+}
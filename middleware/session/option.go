@@ -0,0 +1,218 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibersession
+
+import (
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultCookieName is the name of session cookie
+	DefaultCookieName = "rk_session"
+	// DefaultIdleTimeout is the duration after which inactive session expires
+	DefaultIdleTimeout = 30 * time.Minute
+	// DefaultAbsoluteTimeout is the duration after which session expires regardless of activity
+	DefaultAbsoluteTimeout = 24 * time.Hour
+)
+
+// ***************** OptionSet *****************
+
+// optionSet which is used for middleware implementation
+type optionSet struct {
+	entryName    string
+	entryType    string
+	pathToIgnore []string
+
+	store           Store
+	idleTimeout     time.Duration
+	absoluteTimeout time.Duration
+
+	cookieName     string
+	cookieDomain   string
+	cookiePath     string
+	cookieSecure   bool
+	cookieSameSite string
+}
+
+// newOptionSet Create new optionSet with options.
+func newOptionSet(opts ...Option) *optionSet {
+	set := &optionSet{
+		entryName:       "fake-entry",
+		entryType:       "",
+		pathToIgnore:    []string{},
+		idleTimeout:     DefaultIdleTimeout,
+		absoluteTimeout: DefaultAbsoluteTimeout,
+		cookieName:      DefaultCookieName,
+		cookiePath:      "/",
+		cookieSameSite:  "lax",
+	}
+
+	for i := range opts {
+		opts[i](set)
+	}
+
+	if set.store == nil {
+		set.store = NewMemoryStore()
+	}
+
+	return set
+}
+
+// ShouldIgnore determine whether session should be ignored based on path
+func (set *optionSet) ShouldIgnore(path string) bool {
+	for i := range set.pathToIgnore {
+		if strings.HasPrefix(path, set.pathToIgnore[i]) {
+			return true
+		}
+	}
+
+	return rkmid.ShouldIgnoreGlobal(path)
+}
+
+// ***************** BootConfig *****************
+
+// BootConfig for YAML
+type BootConfig struct {
+	Enabled            bool     `yaml:"enabled" json:"enabled"`
+	Ignore             []string `yaml:"ignore" json:"ignore"`
+	IdleTimeoutSec     int      `yaml:"idleTimeoutSec" json:"idleTimeoutSec"`
+	AbsoluteTimeoutSec int      `yaml:"absoluteTimeoutSec" json:"absoluteTimeoutSec"`
+	CookieName         string   `yaml:"cookieName" json:"cookieName"`
+	CookieDomain       string   `yaml:"cookieDomain" json:"cookieDomain"`
+	CookiePath         string   `yaml:"cookiePath" json:"cookiePath"`
+	CookieSecure       bool     `yaml:"cookieSecure" json:"cookieSecure"`
+	CookieSameSite     string   `yaml:"cookieSameSite" json:"cookieSameSite"`
+	Store              struct {
+		Type string `yaml:"type" json:"type"`
+		Path string `yaml:"path" json:"path"`
+	} `yaml:"store" json:"store"`
+}
+
+// ToOptions convert BootConfig into Option list
+func ToOptions(config *BootConfig, entryName, entryType string) []Option {
+	opts := make([]Option, 0)
+
+	if config.Enabled {
+		opts = append(opts,
+			WithEntryNameAndType(entryName, entryType),
+			WithPathToIgnore(config.Ignore...),
+			WithIdleTimeout(time.Duration(config.IdleTimeoutSec)*time.Second),
+			WithAbsoluteTimeout(time.Duration(config.AbsoluteTimeoutSec)*time.Second),
+			WithCookieName(config.CookieName),
+			WithCookieDomain(config.CookieDomain),
+			WithCookiePath(config.CookiePath),
+			WithCookieSecure(config.CookieSecure),
+			WithCookieSameSite(config.CookieSameSite))
+
+		switch strings.ToLower(config.Store.Type) {
+		case StoreTypeFile:
+			store, err := NewFileStore(config.Store.Path)
+			if err != nil {
+				rkentry.ShutdownWithError(err)
+			}
+			opts = append(opts, WithStore(store))
+		default:
+			opts = append(opts, WithStore(NewMemoryStore()))
+		}
+	}
+
+	return opts
+}
+
+// ***************** Option *****************
+
+// Option if for middleware options while creating middleware
+type Option func(*optionSet)
+
+// WithEntryNameAndType provide entry name and entry type.
+func WithEntryNameAndType(entryName, entryType string) Option {
+	return func(opt *optionSet) {
+		opt.entryName = entryName
+		opt.entryType = entryType
+	}
+}
+
+// WithPathToIgnore provide paths prefix that will ignore.
+func WithPathToIgnore(paths ...string) Option {
+	return func(set *optionSet) {
+		for i := range paths {
+			if len(paths[i]) > 0 {
+				set.pathToIgnore = append(set.pathToIgnore, paths[i])
+			}
+		}
+	}
+}
+
+// WithStore provide Store, MemoryStore would be used by default.
+func WithStore(store Store) Option {
+	return func(opt *optionSet) {
+		if store != nil {
+			opt.store = store
+		}
+	}
+}
+
+// WithIdleTimeout provide duration after which inactive session expires.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(opt *optionSet) {
+		if timeout > 0 {
+			opt.idleTimeout = timeout
+		}
+	}
+}
+
+// WithAbsoluteTimeout provide duration after which session expires regardless of activity.
+func WithAbsoluteTimeout(timeout time.Duration) Option {
+	return func(opt *optionSet) {
+		if timeout > 0 {
+			opt.absoluteTimeout = timeout
+		}
+	}
+}
+
+// WithCookieName provide name of session cookie.
+func WithCookieName(name string) Option {
+	return func(opt *optionSet) {
+		if len(name) > 0 {
+			opt.cookieName = name
+		}
+	}
+}
+
+// WithCookieDomain provide domain of session cookie.
+func WithCookieDomain(domain string) Option {
+	return func(opt *optionSet) {
+		opt.cookieDomain = domain
+	}
+}
+
+// WithCookiePath provide path of session cookie.
+func WithCookiePath(path string) Option {
+	return func(opt *optionSet) {
+		if len(path) > 0 {
+			opt.cookiePath = path
+		}
+	}
+}
+
+// WithCookieSecure provide secure attribute of session cookie.
+func WithCookieSecure(secure bool) Option {
+	return func(opt *optionSet) {
+		opt.cookieSecure = secure
+	}
+}
+
+// WithCookieSameSite provide same site attribute of session cookie, one of lax, strict, none.
+func WithCookieSameSite(sameSite string) Option {
+	return func(opt *optionSet) {
+		if len(sameSite) > 0 {
+			opt.cookieSameSite = strings.ToLower(sameSite)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibersession
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rookie-ninja/rk-fiber/internal/memstore"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// StoreTypeMemory stores sessions in memory of current process
+	StoreTypeMemory = "memory"
+	// StoreTypeFile stores sessions in files under a directory
+	StoreTypeFile = "file"
+)
+
+// Store persists serialized sessions by session id.
+//
+// Implementations must be safe for concurrent use. Sessions must be expired by implementation after ttl,
+// which maps naturally to SET with EX in Redis like backends.
+type Store interface {
+	// Get returns serialized session, nil without error if missing or expired
+	Get(id string) ([]byte, error)
+
+	// Set stores serialized session with ttl
+	Set(id string, data []byte, ttl time.Duration) error
+
+	// Delete removes session, no error if missing
+	Delete(id string) error
+}
+
+// ***************** MemoryStore *****************
+
+// MemoryStore is a Store which keeps sessions in memory of current process, sessions are lost after restart.
+type MemoryStore struct {
+	store *rkfibermemstore.Store
+}
+
+// NewMemoryStore create MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		store: rkfibermemstore.New(0, 0),
+	}
+}
+
+// Get returns serialized session
+func (s *MemoryStore) Get(id string) ([]byte, error) {
+	return s.store.Get(id), nil
+}
+
+// Set stores serialized session with ttl
+func (s *MemoryStore) Set(id string, data []byte, ttl time.Duration) error {
+	s.store.Set(id, data, ttl)
+	return nil
+}
+
+// Delete removes session
+func (s *MemoryStore) Delete(id string) error {
+	s.store.Delete(id)
+	return nil
+}
+
+// ***************** FileStore *****************
+
+// fileRecord is a session stored in FileStore
+type fileRecord struct {
+	ExpiresAtMs int64  `json:"expiresAtMs"`
+	Data        []byte `json:"data"`
+}
+
+// FileStore is a Store which keeps one file per session under a directory.
+//
+// File name is hash of session id, so that id from client could not escape the directory.
+// Expired files are removed while reading, and swept at most once per sweep interval while writing,
+// so that files of abandoned sessions do not pile up.
+type FileStore struct {
+	dir        string
+	lock       sync.Mutex
+	sweepEvery time.Duration
+	lastSweep  time.Time
+}
+
+// NewFileStore create FileStore, directory would be created with mode 0700 if missing.
+//
+// Directory must be provided explicitly, and existing one must be owned by current user with mode 0700,
+// since sessions in a directory shared with other users could be read or planted.
+func NewFileStore(dir string) (*FileStore, error) {
+	if len(dir) < 1 {
+		return nil, errors.New("directory of session file store is required")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	if err := checkPrivateDir(info); err != nil {
+		return nil, fmt.Errorf("directory %s of session file store is not private: %w", dir, err)
+	}
+
+	return &FileStore{
+		dir:        dir,
+		sweepEvery: rkfibermemstore.DefaultSweepEvery,
+		lastSweep:  time.Now(),
+	}, nil
+}
+
+// Get returns serialized session
+func (s *FileStore) Get(id string) ([]byte, error) {
+	bytes, err := os.ReadFile(s.path(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	record := &fileRecord{}
+	if err := json.Unmarshal(bytes, record); err != nil {
+		return nil, err
+	}
+
+	if time.Now().UnixMilli() >= record.ExpiresAtMs {
+		os.Remove(s.path(id))
+		return nil, nil
+	}
+
+	return record.Data, nil
+}
+
+// Set stores serialized session with ttl, file is written atomically with rename
+func (s *FileStore) Set(id string, data []byte, ttl time.Duration) error {
+	s.lock.Lock()
+	now := time.Now()
+	due := now.Sub(s.lastSweep) > s.sweepEvery
+	if due {
+		s.lastSweep = now
+	}
+	s.lock.Unlock()
+
+	if due {
+		s.sweep(now)
+	}
+
+	bytes, err := json.Marshal(&fileRecord{
+		ExpiresAtMs: time.Now().Add(ttl).UnixMilli(),
+		Data:        data,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(bytes); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path(id))
+}
+
+// Delete removes session
+func (s *FileStore) Delete(id string) error {
+	if err := os.Remove(s.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// sweep removes files of expired sessions, files being written are skipped
+func (s *FileStore) sweep(now time.Time) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+
+	for i := range entries {
+		if entries[i].IsDir() || strings.HasPrefix(entries[i].Name(), ".tmp-") {
+			continue
+		}
+
+		path := filepath.Join(s.dir, entries[i].Name())
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		record := &fileRecord{}
+		if json.Unmarshal(bytes, record) == nil && now.UnixMilli() >= record.ExpiresAtMs {
+			os.Remove(path)
+		}
+	}
+}
+
+// path returns file path of session
+func (s *FileStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
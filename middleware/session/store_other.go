@@ -0,0 +1,15 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+//go:build windows || plan9
+
+package rkfibersession
+
+import "os"
+
+// checkPrivateDir is noop since ownership and mode bits are not reported on this platform
+func checkPrivateDir(info os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,27 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+
+package rkfibersession
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkPrivateDir returns error if directory is not owned by current user or accessible by others
+func checkPrivateDir(info os.FileInfo) error {
+	if perm := info.Mode().Perm(); perm != 0700 {
+		return fmt.Errorf("mode is %#o instead of 0700", perm)
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("owned by uid %d instead of %d", stat.Uid, os.Getuid())
+	}
+
+	return nil
+}
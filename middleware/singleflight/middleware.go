@@ -0,0 +1,173 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+// Package rkfibersingleflight is a middleware of fiber framework for coalescing identical in-flight requests
+package rkfibersingleflight
+
+import (
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"go.opentelemetry.io/otel/attribute"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headers which are never copied since they are generated per response
+var skippedHeaders = map[string]bool{
+	fiber.HeaderContentLength: true,
+	fiber.HeaderDate:          true,
+	fiber.HeaderConnection:    true,
+}
+
+// call is an in-flight execution of handler, response is filled before done is closed
+type call struct {
+	done    chan struct{}
+	shared  bool
+	status  int
+	headers map[string][]string
+	body    []byte
+}
+
+// group tracks in-flight calls by key
+type group struct {
+	lock  sync.Mutex
+	calls map[string]*call
+}
+
+// newGroup create group
+func newGroup() *group {
+	return &group{
+		calls: make(map[string]*call),
+	}
+}
+
+// join returns in-flight call of key, and true if caller is the first one and must call leave once done
+func (g *group) join(key string) (*call, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if c, ok := g.calls[key]; ok {
+		return c, false
+	}
+
+	c := &call{done: make(chan struct{})}
+	g.calls[key] = c
+	return c, true
+}
+
+// leave removes call of key and wakes up waiters, later requests start a new call
+func (g *group) leave(key string, c *call) {
+	g.lock.Lock()
+	delete(g.calls, key)
+	g.lock.Unlock()
+
+	close(c.done)
+}
+
+// Middleware coalesces identical in-flight GET and HEAD requests of paths provided by WithPaths.
+//
+// The first request of key calls handler, identical requests arriving meanwhile wait for it and receive copy
+// of its status, headers and body with header X-Coalesced: true. Headers written by outer middlewares like
+// request id and trace id are kept per request. Waiters call handler by themselves if handler failed with error,
+// response sets cookie, or wait timed out.
+func Middleware(opts ...Option) fiber.Handler {
+	set := newOptionSet(opts...)
+
+	return func(ctx *fiber.Ctx) error {
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, set.entryName))
+
+		if !set.isApplied(ctx.Method(), ctx.Path()) {
+			return ctx.Next()
+		}
+
+		// key is kept in group while handler runs, custom key may refer to strings of fiber.Ctx which are reused
+		key := utils.CopyString(set.keyFunc(ctx))
+		if len(key) < 1 {
+			return ctx.Next()
+		}
+
+		c, leader := set.group.join(key)
+		if leader {
+			set.observe(resultLeader)
+			return set.execute(ctx, key, c)
+		}
+
+		timer := time.NewTimer(set.maxWait)
+		defer timer.Stop()
+
+		select {
+		case <-c.done:
+			if c.shared {
+				set.observe(resultCoalesced)
+				return set.copy(ctx, c)
+			}
+		case <-timer.C:
+		}
+
+		set.observe(resultFallback)
+		return ctx.Next()
+	}
+}
+
+// execute calls handler and shares its response with waiters
+func (set *optionSet) execute(ctx *fiber.Ctx, key string, c *call) error {
+	defer set.group.leave(key, c)
+
+	// headers written by outer middlewares are excluded from shared response
+	before := make(map[string]string)
+	ctx.Response().Header.VisitAll(func(k, v []byte) {
+		before[string(k)] += string(v) + "\n"
+	})
+
+	if err := ctx.Next(); err != nil {
+		return err
+	}
+
+	resp := ctx.Response()
+	if len(resp.Header.Peek(fiber.HeaderSetCookie)) > 0 || resp.IsBodyStream() {
+		return nil
+	}
+
+	after := make(map[string][]string)
+	resp.Header.VisitAll(func(k, v []byte) {
+		name := string(k)
+		if !skippedHeaders[name] {
+			after[name] = append(after[name], string(v))
+		}
+	})
+
+	c.headers = make(map[string][]string)
+	for name, values := range after {
+		if strings.Join(values, "\n")+"\n" != before[name] {
+			c.headers[name] = values
+		}
+	}
+	c.status = resp.StatusCode()
+	c.body = append([]byte{}, resp.Body()...)
+	c.shared = true
+
+	return nil
+}
+
+// copy response of call into request
+func (set *optionSet) copy(ctx *fiber.Ctx, c *call) error {
+	for k, values := range c.headers {
+		ctx.Response().Header.Del(k)
+		for i := range values {
+			ctx.Response().Header.Add(k, values[i])
+		}
+	}
+	ctx.Set(HeaderCoalesced, "true")
+	ctx.Response().SetStatusCode(c.status)
+	ctx.Response().SetBody(c.body)
+
+	rkfiberctx.GetTraceSpan(ctx).SetAttributes(attribute.Bool("rk.coalesced", true))
+
+	return nil
+}
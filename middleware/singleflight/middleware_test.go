@@ -0,0 +1,252 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibersingleflight
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newBlockingApp create app whose handler blocks until release is closed, handle decides response of n-th call
+func newBlockingApp(counter *int32, release chan struct{}, handle func(ctx *fiber.Ctx, n int32) error, opts ...Option) *fiber.App {
+	var requestId int32
+	app := fiber.New()
+	// emulates meta middleware which writes request id before handler
+	app.Use(func(ctx *fiber.Ctx) error {
+		ctx.Set(rkmid.HeaderRequestId, strconv.Itoa(int(atomic.AddInt32(&requestId, 1))))
+		return ctx.Next()
+	})
+	app.Use(Middleware(append([]Option{WithPaths("/ut-path")}, opts...)...))
+	app.Get("/ut-path", func(ctx *fiber.Ctx) error {
+		n := atomic.AddInt32(counter, 1)
+		<-release
+		return handle(ctx, n)
+	})
+	return app
+}
+
+// sendAsync sends identical requests in background and returns responses once all of them returned
+func sendAsync(t *testing.T, app *fiber.App, path string, count int) func() []*http.Response {
+	wg := &sync.WaitGroup{}
+	res := make([]*http.Response, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil), -1)
+			assert.Nil(t, err)
+			res[i] = resp
+		}(i)
+		// make sure the first request is leader
+		if i == 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	return func() []*http.Response {
+		wg.Wait()
+		return res
+	}
+}
+
+// counterValue returns value of requests counter with result
+func counterValue(registry *prometheus.Registry, result string) float64 {
+	families, _ := registry.Gather()
+	for _, family := range families {
+		if family.GetName() != "rk_singleflight_requests_total" {
+			continue
+		}
+		for _, m := range family.Metric {
+			for _, label := range m.Label {
+				if label.GetName() == "result" && label.GetValue() == result {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestMiddleware(t *testing.T) {
+	var counter int32
+	release := make(chan struct{})
+	registry := prometheus.NewRegistry()
+	app := newBlockingApp(&counter, release, func(ctx *fiber.Ctx, n int32) error {
+		ctx.Set("X-Ut-Header", "ut-value")
+		ctx.Status(http.StatusAccepted)
+		return ctx.JSON(map[string]int32{"call": n})
+	}, WithRegisterer(registry))
+
+	wait := sendAsync(t, app, "/ut-path?a=1&b=2", 5)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	requestIds := make(map[string]bool)
+	coalesced := 0
+	for _, resp := range wait() {
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		assert.Equal(t, `{"call":1}`, string(body))
+		assert.Equal(t, "ut-value", resp.Header.Get("X-Ut-Header"))
+		assert.Equal(t, fiber.MIMEApplicationJSON, resp.Header.Get(fiber.HeaderContentType))
+		requestIds[resp.Header.Get(rkmid.HeaderRequestId)] = true
+		if resp.Header.Get(HeaderCoalesced) == "true" {
+			coalesced++
+		}
+	}
+
+	// handler is called once while every request keeps its own request id
+	assert.Equal(t, int32(1), atomic.LoadInt32(&counter))
+	assert.Len(t, requestIds, 5)
+	assert.Equal(t, 4, coalesced)
+	assert.Equal(t, float64(1), counterValue(registry, resultLeader))
+	assert.Equal(t, float64(4), counterValue(registry, resultCoalesced))
+
+	// later request starts a new call
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ut-path", nil), -1)
+	assert.Nil(t, err)
+	assert.Empty(t, resp.Header.Get(HeaderCoalesced))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&counter))
+}
+
+func TestMiddleware_Fallback(t *testing.T) {
+	// handler error and cookie are not shared
+	for _, handle := range []func(ctx *fiber.Ctx, n int32) error{
+		func(ctx *fiber.Ctx, n int32) error {
+			if n == 1 {
+				return fiber.ErrInternalServerError
+			}
+			return nil
+		},
+		func(ctx *fiber.Ctx, n int32) error {
+			ctx.Cookie(&fiber.Cookie{Name: "ut-cookie", Value: strconv.Itoa(int(n))})
+			return nil
+		},
+	} {
+		var counter int32
+		release := make(chan struct{})
+		registry := prometheus.NewRegistry()
+		app := newBlockingApp(&counter, release, handle, WithRegisterer(registry))
+
+		wait := sendAsync(t, app, "/ut-path", 3)
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wait()
+
+		assert.Equal(t, int32(3), atomic.LoadInt32(&counter))
+		assert.Equal(t, float64(2), counterValue(registry, resultFallback))
+	}
+
+	// wait timed out
+	var counter int32
+	release := make(chan struct{})
+	app := newBlockingApp(&counter, release, func(*fiber.Ctx, int32) error {
+		return nil
+	}, WithMaxWait(10*time.Millisecond), WithRegisterer(prometheus.NewRegistry()))
+
+	wait := sendAsync(t, app, "/ut-path", 2)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&counter))
+	close(release)
+	wait()
+}
+
+func TestMiddleware_Key(t *testing.T) {
+	set := newOptionSet(WithKeyHeaders("X-Ut-Tenant"), WithRegisterer(prometheus.NewRegistry()))
+
+	app := fiber.New()
+	keys := make([]string, 0)
+	app.Get("/ut-path", func(ctx *fiber.Ctx) error {
+		keys = append(keys, set.keyFunc(ctx))
+		return nil
+	})
+
+	for _, path := range []string{"/ut-path?a=1&b=2", "/ut-path?b=2&a=1", "/ut-path?a=2"} {
+		app.Test(httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	req := httptest.NewRequest(http.MethodGet, "/ut-path?a=1&b=2", nil)
+	req.Header.Set("X-Ut-Tenant", "ut-tenant")
+	app.Test(req)
+
+	// requests of different callers never share key
+	for _, header := range []string{fiber.HeaderAuthorization, fiber.HeaderCookie, rkmid.HeaderApiKey} {
+		req = httptest.NewRequest(http.MethodGet, "/ut-path?a=1&b=2", nil)
+		req.Header.Set(header, "ut-credential")
+		app.Test(req)
+	}
+
+	// virtual hosts never share key
+	req = httptest.NewRequest(http.MethodGet, "/ut-path?a=1&b=2", nil)
+	req.Host = "ut-other-host"
+	app.Test(req)
+
+	assert.Equal(t, keys[0], keys[1])
+	assert.NotEqual(t, keys[0], keys[2])
+	assert.NotEqual(t, keys[0], keys[3])
+	assert.NotEqual(t, keys[0], keys[4])
+	assert.NotEqual(t, keys[0], keys[5])
+	assert.NotEqual(t, keys[0], keys[6])
+	assert.NotEqual(t, keys[4], keys[5])
+	assert.NotEqual(t, keys[5], keys[6])
+	assert.NotEqual(t, keys[0], keys[7])
+
+	// custom key
+	set = newOptionSet(WithKeyFunc(func(ctx *fiber.Ctx) string {
+		return "ut-key"
+	}), WithRegisterer(prometheus.NewRegistry()))
+	assert.Equal(t, "ut-key", set.keyFunc(nil))
+}
+
+func TestMiddleware_WithoutPaths(t *testing.T) {
+	var counter int32
+	release := make(chan struct{})
+	app := fiber.New()
+	app.Use(Middleware(WithRegisterer(prometheus.NewRegistry())))
+	app.Get("/ut-path", func(ctx *fiber.Ctx) error {
+		atomic.AddInt32(&counter, 1)
+		<-release
+		return nil
+	})
+
+	// nothing is coalesced unless paths provided
+	wait := sendAsync(t, app, "/ut-path", 3)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&counter))
+	close(release)
+	for _, resp := range wait() {
+		assert.Empty(t, resp.Header.Get(HeaderCoalesced))
+	}
+}
+
+func TestToOptions(t *testing.T) {
+	// disabled
+	assert.Empty(t, ToOptions(&BootConfig{}, "ut-entry", "ut-type", nil))
+
+	// enabled
+	set := newOptionSet(ToOptions(&BootConfig{
+		Enabled:    true,
+		Paths:      []string{"/ut-path"},
+		KeyHeaders: []string{"X-Ut-Tenant"},
+		MaxWaitMs:  100,
+	}, "ut-entry", "ut-type", prometheus.NewRegistry())...)
+
+	assert.Equal(t, "ut-entry", set.entryName)
+	assert.Equal(t, []string{"X-Ut-Tenant"}, set.keyHeaders)
+	assert.Equal(t, 100*time.Millisecond, set.maxWait)
+	assert.True(t, set.isApplied(http.MethodGet, "/ut-path/1"))
+	assert.False(t, set.isApplied(http.MethodPost, "/ut-path/1"))
+	assert.False(t, set.isApplied(http.MethodGet, "/ut-other"))
+}
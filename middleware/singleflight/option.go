@@ -0,0 +1,248 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibersingleflight
+
+import (
+	"bytes"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-entry/v2/middleware/prom"
+	"github.com/valyala/fasthttp"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// HeaderCoalesced is set to true on responses copied from concurrent identical request
+	HeaderCoalesced = "X-Coalesced"
+	// DefaultMaxWait is max duration a request waits for concurrent identical request
+	DefaultMaxWait = 5 * time.Second
+
+	resultLeader    = "leader"
+	resultCoalesced = "coalesced"
+	resultFallback  = "fallback"
+
+	metricsNameRequests = "requests_total"
+)
+
+// KeyFunc returns key of request, identical requests share same key, empty key disables coalescing of request
+type KeyFunc func(ctx *fiber.Ctx) string
+
+// ***************** OptionSet *****************
+
+// optionSet which is used for middleware implementation
+type optionSet struct {
+	entryName    string
+	entryType    string
+	pathToIgnore []string
+
+	paths      []string
+	keyHeaders []string
+	keyFunc    KeyFunc
+	maxWait    time.Duration
+
+	registerer prometheus.Registerer
+	metricsSet *rkmidprom.MetricsSet
+
+	group *group
+}
+
+// newOptionSet Create new optionSet with options.
+func newOptionSet(opts ...Option) *optionSet {
+	set := &optionSet{
+		entryName:    "fake-entry",
+		entryType:    "",
+		pathToIgnore: []string{},
+		paths:        []string{},
+		keyHeaders:   []string{},
+		maxWait:      DefaultMaxWait,
+		group:        newGroup(),
+	}
+
+	for i := range opts {
+		opts[i](set)
+	}
+
+	if set.keyFunc == nil {
+		set.keyFunc = set.defaultKey
+	}
+
+	set.metricsSet = rkmidprom.NewMetricsSet("rk", "singleflight", set.registerer)
+	// metrics may already be registered by another middleware with same registerer, ignore error
+	set.metricsSet.RegisterCounter(metricsNameRequests, "entryName", "entryType", "result")
+
+	return set
+}
+
+// ShouldIgnore determine whether singleflight should be ignored based on path
+func (set *optionSet) ShouldIgnore(path string) bool {
+	for i := range set.pathToIgnore {
+		if strings.HasPrefix(path, set.pathToIgnore[i]) {
+			return true
+		}
+	}
+
+	return rkmid.ShouldIgnoreGlobal(path)
+}
+
+// isApplied returns true if request with method and path should be coalesced
+func (set *optionSet) isApplied(method, path string) bool {
+	if (method != http.MethodGet && method != http.MethodHead) || set.ShouldIgnore(path) {
+		return false
+	}
+
+	for i := range set.paths {
+		if strings.HasPrefix(path, set.paths[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// credentialHeaders are always part of default key, so that responses are never shared across callers
+var credentialHeaders = []string{fiber.HeaderAuthorization, fiber.HeaderCookie, rkmid.HeaderApiKey}
+
+// defaultKey returns key of method, host, path, sorted query, credentials and key headers
+func (set *optionSet) defaultKey(ctx *fiber.Ctx) string {
+	args := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(args)
+	ctx.Request().URI().QueryArgs().CopyTo(args)
+	args.Sort(bytes.Compare)
+
+	builder := &strings.Builder{}
+	builder.WriteString(ctx.Method())
+	builder.WriteByte(0)
+	builder.Write(ctx.Request().Host())
+	builder.WriteByte(0)
+	builder.WriteString(ctx.Path())
+	builder.WriteByte(0)
+	builder.Write(args.QueryString())
+	for i := range credentialHeaders {
+		builder.WriteByte(0)
+		builder.Write(ctx.Request().Header.Peek(credentialHeaders[i]))
+	}
+	for i := range set.keyHeaders {
+		builder.WriteByte(0)
+		builder.Write(ctx.Request().Header.Peek(set.keyHeaders[i]))
+	}
+
+	return builder.String()
+}
+
+// observe increases counter of request with result
+func (set *optionSet) observe(result string) {
+	if counter := set.metricsSet.GetCounterWithValues(metricsNameRequests, set.entryName, set.entryType, result); counter != nil {
+		counter.Inc()
+	}
+}
+
+// ***************** BootConfig *****************
+
+// BootConfig for YAML
+type BootConfig struct {
+	Enabled    bool     `yaml:"enabled" json:"enabled"`
+	Ignore     []string `yaml:"ignore" json:"ignore"`
+	Paths      []string `yaml:"paths" json:"paths"`
+	KeyHeaders []string `yaml:"keyHeaders" json:"keyHeaders"`
+	MaxWaitMs  int      `yaml:"maxWaitMs" json:"maxWaitMs"`
+}
+
+// ToOptions convert BootConfig into Option list
+func ToOptions(config *BootConfig, entryName, entryType string, registerer prometheus.Registerer) []Option {
+	opts := make([]Option, 0)
+
+	if config.Enabled {
+		opts = append(opts,
+			WithEntryNameAndType(entryName, entryType),
+			WithPathToIgnore(config.Ignore...),
+			WithPaths(config.Paths...),
+			WithKeyHeaders(config.KeyHeaders...),
+			WithMaxWait(time.Duration(config.MaxWaitMs)*time.Millisecond),
+			WithRegisterer(registerer))
+	}
+
+	return opts
+}
+
+// ***************** Option *****************
+
+// Option if for middleware options while creating middleware
+type Option func(*optionSet)
+
+// WithEntryNameAndType provide entry name and entry type.
+func WithEntryNameAndType(entryName, entryType string) Option {
+	return func(opt *optionSet) {
+		opt.entryName = entryName
+		opt.entryType = entryType
+	}
+}
+
+// WithPathToIgnore provide paths prefix that will ignore.
+func WithPathToIgnore(paths ...string) Option {
+	return func(set *optionSet) {
+		for i := range paths {
+			if len(paths[i]) > 0 {
+				set.pathToIgnore = append(set.pathToIgnore, paths[i])
+			}
+		}
+	}
+}
+
+// WithPaths provide path prefixes of GET and HEAD requests which are coalesced, no request would be coalesced without
+// paths, since responses of personalized routes must not be shared.
+func WithPaths(paths ...string) Option {
+	return func(set *optionSet) {
+		for i := range paths {
+			if len(paths[i]) > 0 {
+				set.paths = append(set.paths, paths[i])
+			}
+		}
+	}
+}
+
+// WithKeyHeaders provide request headers which are part of default key in addition to method, path, query,
+// Authorization and Cookie.
+func WithKeyHeaders(headers ...string) Option {
+	return func(opt *optionSet) {
+		for i := range headers {
+			if len(headers[i]) > 0 {
+				opt.keyHeaders = append(opt.keyHeaders, headers[i])
+			}
+		}
+	}
+}
+
+// WithKeyFunc provide KeyFunc, key of method, path, sorted query, Authorization, Cookie and key headers would be
+// used by default. Requests of different callers must not share key if response is personalized.
+func WithKeyFunc(f KeyFunc) Option {
+	return func(opt *optionSet) {
+		if f != nil {
+			opt.keyFunc = f
+		}
+	}
+}
+
+// WithMaxWait provide max duration a request waits for concurrent identical request, default is five seconds.
+// Request calls handler by itself once wait timed out.
+func WithMaxWait(maxWait time.Duration) Option {
+	return func(opt *optionSet) {
+		if maxWait > 0 {
+			opt.maxWait = maxWait
+		}
+	}
+}
+
+// WithRegisterer provide prometheus.Registerer, prometheus.DefaultRegisterer would be used by default.
+func WithRegisterer(registerer prometheus.Registerer) Option {
+	return func(opt *optionSet) {
+		if registerer != nil {
+			opt.registerer = registerer
+		}
+	}
+}
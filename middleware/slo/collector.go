@@ -0,0 +1,87 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberslo
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"time"
+)
+
+// collector is prometheus.Collector of objectives, gauges are computed while collecting
+type collector struct {
+	set *optionSet
+
+	good            *prometheus.Desc
+	total           *prometheus.Desc
+	burnRate        *prometheus.Desc
+	compliance      *prometheus.Desc
+	budgetRemaining *prometheus.Desc
+}
+
+// newCollector create a new collector of objectives in optionSet
+func newCollector(set *optionSet) *collector {
+	labels := prometheus.Labels{
+		"entryName": set.entryName,
+		"entryType": set.entryType,
+	}
+
+	return &collector{
+		set: set,
+		good: prometheus.NewDesc("rk_slo_good_requests_total",
+			"Number of good requests of objective.", []string{"slo"}, labels),
+		total: prometheus.NewDesc("rk_slo_requests_total",
+			"Number of requests of objective.", []string{"slo"}, labels),
+		burnRate: prometheus.NewDesc("rk_slo_burn_rate",
+			"Rate which error budget is consumed at over window.", []string{"slo", "window"}, labels),
+		compliance: prometheus.NewDesc("rk_slo_compliance",
+			"Ratio of good requests over window of objective.", []string{"slo"}, labels),
+		budgetRemaining: prometheus.NewDesc("rk_slo_error_budget_remaining",
+			"Ratio of error budget remaining over window of objective.", []string{"slo"}, labels),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.good
+	ch <- c.total
+	ch <- c.burnRate
+	ch <- c.compliance
+	ch <- c.budgetRemaining
+}
+
+// Collect implements prometheus.Collector
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	now := c.set.now()
+
+	for _, t := range c.set.trackers {
+		good, total := t.counts()
+		ch <- prometheus.MustNewConstMetric(c.good, prometheus.CounterValue, float64(good), t.Name)
+		ch <- prometheus.MustNewConstMetric(c.total, prometheus.CounterValue, float64(total), t.Name)
+
+		report := c.set.report(t, now)
+		for i := range c.set.burnRateWindows {
+			window := formatWindow(c.set.burnRateWindows[i])
+			if rate, ok := report.BurnRates[window]; ok {
+				ch <- prometheus.MustNewConstMetric(c.burnRate, prometheus.GaugeValue, rate, t.Name, window)
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(c.compliance, prometheus.GaugeValue, report.Compliance, t.Name)
+		ch <- prometheus.MustNewConstMetric(c.budgetRemaining, prometheus.GaugeValue, report.ErrorBudgetRemaining, t.Name)
+	}
+}
+
+// formatWindow formats window like 5m, 6h and 3d
+func formatWindow(window time.Duration) string {
+	switch {
+	case window%(24*time.Hour) == 0:
+		return strconv.FormatInt(int64(window/(24*time.Hour)), 10) + "d"
+	case window%time.Hour == 0:
+		return strconv.FormatInt(int64(window/time.Hour), 10) + "h"
+	default:
+		return strconv.FormatInt(int64(window/time.Minute), 10) + "m"
+	}
+}
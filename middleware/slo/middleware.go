@@ -0,0 +1,112 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+// Package rkfiberslo is a middleware for fiber framework which tracks service level objectives of routes
+package rkfiberslo
+
+import (
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
+	"github.com/rookie-ninja/rk-fiber/internal/route"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"net/http"
+	"time"
+)
+
+// Report is compliance of Objective over its window
+type Report struct {
+	Name                 string             `json:"name" yaml:"name"`
+	Method               string             `json:"method" yaml:"method"`
+	Route                string             `json:"route" yaml:"route"`
+	Objective            float64            `json:"objective" yaml:"objective"`
+	LatencyThresholdMs   int64              `json:"latencyThresholdMs" yaml:"latencyThresholdMs"`
+	Window               string             `json:"window" yaml:"window"`
+	Good                 uint64             `json:"good" yaml:"good"`
+	Total                uint64             `json:"total" yaml:"total"`
+	Compliance           float64            `json:"compliance" yaml:"compliance"`
+	ErrorBudgetRemaining float64            `json:"errorBudgetRemaining" yaml:"errorBudgetRemaining"`
+	BurnRates            map[string]float64 `json:"burnRates" yaml:"burnRates"`
+}
+
+// Middleware create a new slo middleware with options.
+//
+// Requests whose path matches route pattern of objective are counted, including requests rejected by following
+// middlewares, and GET request of path reports compliance and remaining error budget of each objective.
+func Middleware(opts ...Option) fiber.Handler {
+	set := newOptionSet(opts...)
+
+	return func(ctx *fiber.Ctx) error {
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EntryNameKey, set.entryName))
+
+		if ctx.Method() == http.MethodGet && ctx.Path() == set.path {
+			return ctx.JSON(set.reports(set.now()))
+		}
+
+		// request issued by middleware was already counted as original request
+		if rkfiberctx.IsInternalRequest(ctx) {
+			return ctx.Next()
+		}
+
+		// objectives are matched before Next(), so that requests rejected by following middlewares before
+		// routing are counted
+		trackers := set.trackersOf(ctx.App(), ctx.Method(), ctx.Path())
+		if len(trackers) < 1 {
+			return ctx.Next()
+		}
+
+		startTime := set.now()
+		err := ctx.Next()
+
+		now := set.now()
+		good := rkfiberroute.StatusOf(ctx, err) < http.StatusInternalServerError
+		for _, t := range trackers {
+			t.observe(now, good && (t.LatencyThreshold <= 0 || now.Sub(startTime) <= t.LatencyThreshold))
+		}
+
+		return err
+	}
+}
+
+// reports returns Report of each objective
+func (set *optionSet) reports(now time.Time) []*Report {
+	res := make([]*Report, 0, len(set.trackers))
+	for _, t := range set.trackers {
+		res = append(res, set.report(t, now))
+	}
+
+	return res
+}
+
+// report returns Report of objective, burn rate windows longer than objective window are skipped
+func (set *optionSet) report(t *tracker, now time.Time) *Report {
+	windows := []time.Duration{t.Window}
+	for _, window := range set.burnRateWindows {
+		if window <= t.Window {
+			windows = append(windows, window)
+		}
+	}
+	good, total := t.windowCounts(now, windows...)
+
+	report := &Report{
+		Name:                 t.Name,
+		Method:               t.Method,
+		Route:                t.Route,
+		Objective:            t.Target,
+		LatencyThresholdMs:   t.LatencyThreshold.Milliseconds(),
+		Window:               formatWindow(t.Window),
+		Good:                 good[0],
+		Total:                total[0],
+		Compliance:           compliance(good[0], total[0]),
+		ErrorBudgetRemaining: t.budgetRemaining(good[0], total[0]),
+		BurnRates:            make(map[string]float64),
+	}
+
+	for i := 1; i < len(windows); i++ {
+		report.BurnRates[formatWindow(windows[i])] = t.burnRate(good[i], total[i])
+	}
+
+	return report
+}
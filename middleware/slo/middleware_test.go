@@ -0,0 +1,224 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberslo
+
+import (
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// gaugeValue returns value of metric with label slo and window
+func gaugeValue(t *testing.T, registry *prometheus.Registry, name, window string) float64 {
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.Metric {
+			matched := len(window) < 1
+			for _, pair := range m.Label {
+				if pair.GetName() == "window" && pair.GetValue() == window {
+					matched = true
+				}
+			}
+			if matched && m.Gauge != nil {
+				return m.GetGauge().GetValue()
+			}
+			if matched && m.Counter != nil {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+
+	return -1
+}
+
+func TestMiddleware(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	registry := prometheus.NewRegistry()
+
+	app := fiber.New()
+	app.Use(Middleware(
+		WithEntryNameAndType("ut-entry", "ut-type"),
+		WithObjective(Objective{
+			Name:   "ut-users",
+			Method: http.MethodGet,
+			Route:  "/ut-users/:id",
+			Target: 0.9,
+			Window: time.Hour,
+		}),
+		WithBurnRateWindows(5*time.Minute),
+		WithRegisterer(registry),
+		func(set *optionSet) {
+			set.now = func() time.Time { return now }
+		}))
+	app.Get("/ut-users/:id", func(ctx *fiber.Ctx) error {
+		if ctx.Params("id") == "0" {
+			return fiber.ErrServiceUnavailable
+		}
+		return nil
+	})
+	app.Get("/ut-other", func(ctx *fiber.Ctx) error {
+		return fiber.ErrInternalServerError
+	})
+
+	// 8 good and 2 bad requests, other route is not tracked
+	for i := 1; i < 9; i++ {
+		app.Test(httptest.NewRequest(http.MethodGet, "/ut-users/1", nil))
+	}
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-users/0", nil))
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-users/0", nil))
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-other", nil))
+
+	assert.Equal(t, float64(10), gaugeValue(t, registry, "rk_slo_requests_total", ""))
+	assert.Equal(t, float64(8), gaugeValue(t, registry, "rk_slo_good_requests_total", ""))
+	assert.InDelta(t, 2, gaugeValue(t, registry, "rk_slo_burn_rate", "5m"), 1e-9)
+	assert.InDelta(t, -1, gaugeValue(t, registry, "rk_slo_error_budget_remaining", ""), 1e-9)
+
+	// requests out of burn rate window are excluded
+	now = now.Add(10 * time.Minute)
+	assert.Equal(t, float64(0), gaugeValue(t, registry, "rk_slo_burn_rate", "5m"))
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, DefaultPath, nil))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	reports := make([]*Report, 0)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&reports))
+	assert.Len(t, reports, 1)
+	assert.Equal(t, "1h", reports[0].Window)
+	assert.Equal(t, uint64(10), reports[0].Total)
+	assert.InDelta(t, 0.8, reports[0].Compliance, 1e-9)
+
+	// requests out of objective window are excluded
+	now = now.Add(time.Hour)
+	assert.Equal(t, float64(1), gaugeValue(t, registry, "rk_slo_compliance", ""))
+}
+
+func TestMiddleware_LatencyThreshold(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	registry := prometheus.NewRegistry()
+
+	app := fiber.New()
+	app.Use(Middleware(
+		WithObjective(Objective{
+			Route:            "/ut-slow",
+			Target:           0.99,
+			LatencyThreshold: time.Second,
+		}),
+		WithRegisterer(registry),
+		func(set *optionSet) {
+			set.now = func() time.Time { return now }
+		}))
+	app.Get("/ut-slow", func(ctx *fiber.Ctx) error {
+		now = now.Add(2 * time.Second)
+		return nil
+	})
+
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-slow", nil))
+
+	assert.Equal(t, float64(1), gaugeValue(t, registry, "rk_slo_requests_total", ""))
+	assert.Equal(t, float64(0), gaugeValue(t, registry, "rk_slo_good_requests_total", ""))
+}
+
+func TestWithObjective(t *testing.T) {
+	set := newOptionSet(
+		WithObjective(Objective{Route: "/ut-path", Target: 0.99, Method: "get"}),
+		WithObjective(Objective{Route: "/ut-path", Target: 2}),
+		WithObjective(Objective{Target: 0.99}),
+		// duplicated name
+		WithObjective(Objective{Name: "GET /ut-path", Route: "/ut-other", Target: 0.9}),
+		WithRegisterer(prometheus.NewRegistry()))
+
+	assert.Len(t, set.trackers, 1)
+	assert.Equal(t, "/ut-path", set.trackers[0].Route)
+	assert.Equal(t, "GET /ut-path", set.trackers[0].Name)
+	assert.Equal(t, DefaultWindow, set.trackers[0].Window)
+}
+
+func TestMiddleware_Rejected(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	app := fiber.New()
+	app.Use(Middleware(
+		WithObjective(Objective{Route: "/ut-users/:id", Target: 0.99}),
+		WithRegisterer(registry)))
+	// emulates middleware which sheds load before routing
+	app.Use(func(ctx *fiber.Ctx) error {
+		if len(ctx.Get("X-Ut-Shed")) > 0 {
+			return fiber.ErrServiceUnavailable
+		}
+		return ctx.Next()
+	})
+	app.Get("/ut-users/:id", func(ctx *fiber.Ctx) error {
+		return nil
+	})
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/ut-users/1", nil)
+		req.Header.Set("X-Ut-Shed", "true")
+		app.Test(req)
+	}
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-users/1", nil))
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-other", nil))
+
+	assert.Equal(t, float64(4), gaugeValue(t, registry, "rk_slo_requests_total", ""))
+	assert.Equal(t, float64(1), gaugeValue(t, registry, "rk_slo_good_requests_total", ""))
+	assert.InDelta(t, 0.25, gaugeValue(t, registry, "rk_slo_compliance", ""), 1e-9)
+}
+
+func TestMiddleware_BurnRateWindowLongerThanObjective(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	set := newOptionSet(
+		WithObjective(Objective{Name: "ut-slo", Route: "/ut-path", Target: 0.99, Window: 24 * time.Hour}),
+		WithObjective(Objective{Name: "ut-slo", Route: "/ut-other", Target: 0.99}),
+		WithRegisterer(registry))
+	assert.Len(t, set.trackers, 1)
+
+	// windows longer than objective window are skipped
+	report := set.report(set.trackers[0], time.Now())
+	assert.Contains(t, report.BurnRates, "1d")
+	assert.NotContains(t, report.BurnRates, "3d")
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	for _, family := range families {
+		if family.GetName() == "rk_slo_burn_rate" {
+			assert.Len(t, family.Metric, len(DefaultBurnRateWindows)-1)
+		}
+	}
+	assert.Equal(t, float64(-1), gaugeValue(t, registry, "rk_slo_burn_rate", "3d"))
+}
+
+func TestTracker_LongWindow(t *testing.T) {
+	tracker := newTracker(Objective{Route: "/ut-path", Target: 0.99, Window: DefaultWindow})
+	assert.Equal(t, int(fineSpan/time.Minute), len(tracker.fine.buckets))
+	assert.Equal(t, maxCoarseBuckets, len(tracker.coarse.buckets))
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	tracker.observe(now.Add(-10*24*time.Hour), true)
+	tracker.observe(now.Add(-2*24*time.Hour), false)
+	tracker.observe(now.Add(-time.Hour), true)
+	tracker.observe(now.Add(-time.Minute), false)
+
+	good, total := tracker.windowCounts(now, DefaultWindow, 3*24*time.Hour, time.Hour, 5*time.Minute)
+	assert.Equal(t, []uint64{2, 1, 0, 0}, good)
+	assert.Equal(t, []uint64{4, 3, 1, 1}, total)
+
+	// requests out of window are excluded
+	good, total = tracker.windowCounts(now.Add(25*24*time.Hour), DefaultWindow)
+	assert.Equal(t, []uint64{1}, good)
+	assert.Equal(t, []uint64{3}, total)
+}
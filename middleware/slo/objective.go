@@ -0,0 +1,235 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberslo
+
+import (
+	"sync"
+	"time"
+)
+
+// Objective is a service level objective of route.
+//
+// Request is good if it is not failed with 5xx status and it finished within LatencyThreshold.
+// Latency is not checked if LatencyThreshold is zero.
+type Objective struct {
+	// Name of objective, it is used as slo label of metrics
+	Name string
+	// Method of request, requests of all methods are tracked if empty
+	Method string
+	// Route pattern like /v1/users/:id
+	Route string
+	// Target is ratio of good requests like 0.999
+	Target float64
+	// LatencyThreshold is max latency of good request
+	LatencyThreshold time.Duration
+	// Window is rolling window of objective
+	Window time.Duration
+}
+
+const (
+	// fineSpan is span of minute buckets, windows up to it are counted at minute granularity
+	fineSpan = 6 * time.Hour
+	// maxCoarseBuckets is number of buckets covering window longer than fineSpan
+	maxCoarseBuckets = 720
+)
+
+// bucket counts requests in a slot of ring
+type bucket struct {
+	slot  int64
+	good  uint64
+	total uint64
+}
+
+// ring counts requests in buckets of width over span
+type ring struct {
+	width   time.Duration
+	buckets []bucket
+}
+
+// newRing create a ring of buckets of width which covers span
+func newRing(width, span time.Duration) *ring {
+	size := int(span / width)
+	if size < 1 {
+		size = 1
+	}
+
+	return &ring{
+		width:   width,
+		buckets: make([]bucket, size),
+	}
+}
+
+// observe records request at now
+func (r *ring) observe(now time.Time, good bool) {
+	slot := now.UnixNano() / int64(r.width)
+
+	b := &r.buckets[slot%int64(len(r.buckets))]
+	if b.slot != slot {
+		*b = bucket{slot: slot}
+	}
+
+	b.total++
+	if good {
+		b.good++
+	}
+}
+
+// counts adds good and total requests in each window ending at now
+func (r *ring) counts(now time.Time, windows []time.Duration, good, total []uint64) {
+	current := now.UnixNano() / int64(r.width)
+
+	for i := range r.buckets {
+		b := r.buckets[i]
+		age := current - b.slot
+		if b.total < 1 || age < 0 || age >= int64(len(r.buckets)) {
+			continue
+		}
+
+		for j := range windows {
+			// bucket of current slot is always included
+			if age*int64(r.width) < int64(windows[j]) || age == 0 {
+				good[j] += b.good
+				total[j] += b.total
+			}
+		}
+	}
+}
+
+// tracker tracks good and total requests of Objective over rolling window.
+//
+// Requests are counted in minute buckets up to fineSpan, and in at most maxCoarseBuckets buckets over window if
+// window is longer, so that long windows are reported without scanning a bucket per minute.
+type tracker struct {
+	Objective
+
+	lock   sync.Mutex
+	fine   *ring
+	coarse *ring
+	// cumulative counts since started
+	good  uint64
+	total uint64
+}
+
+// newTracker create a new tracker of objective
+func newTracker(objective Objective) *tracker {
+	res := &tracker{
+		Objective: objective,
+	}
+
+	if objective.Window <= fineSpan {
+		res.fine = newRing(time.Minute, objective.Window)
+		return res
+	}
+
+	res.fine = newRing(time.Minute, fineSpan)
+	width := (objective.Window / maxCoarseBuckets).Truncate(time.Minute)
+	if width < time.Minute {
+		width = time.Minute
+	}
+	res.coarse = newRing(width, objective.Window)
+
+	return res
+}
+
+// matches returns true if request with method is tracked
+func (t *tracker) matches(method string) bool {
+	return len(t.Method) < 1 || method == t.Method
+}
+
+// observe records request at now
+func (t *tracker) observe(now time.Time, good bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.fine.observe(now, good)
+	if t.coarse != nil {
+		t.coarse.observe(now, good)
+	}
+
+	t.total++
+	if good {
+		t.good++
+	}
+}
+
+// counts returns cumulative good and total requests since started
+func (t *tracker) counts() (good, total uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.good, t.total
+}
+
+// windowCounts returns good and total requests in each window ending at now, windows longer than
+// objective window are capped at objective window, report skips them before counting
+func (t *tracker) windowCounts(now time.Time, windows ...time.Duration) (good, total []uint64) {
+	good = make([]uint64, len(windows))
+	total = make([]uint64, len(windows))
+
+	fine, coarse := make([]time.Duration, 0), make([]time.Duration, 0)
+	fineIndex, coarseIndex := make([]int, 0), make([]int, 0)
+	for i := range windows {
+		if t.coarse != nil && windows[i] > fineSpan {
+			coarse, coarseIndex = append(coarse, windows[i]), append(coarseIndex, i)
+		} else {
+			fine, fineIndex = append(fine, windows[i]), append(fineIndex, i)
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, pair := range []struct {
+		r       *ring
+		windows []time.Duration
+		index   []int
+	}{{t.fine, fine, fineIndex}, {t.coarse, coarse, coarseIndex}} {
+		if len(pair.windows) < 1 {
+			continue
+		}
+		g, c := make([]uint64, len(pair.windows)), make([]uint64, len(pair.windows))
+		pair.r.counts(now, pair.windows, g, c)
+		for i, j := range pair.index {
+			good[j], total[j] = g[i], c[i]
+		}
+	}
+
+	return good, total
+}
+
+// burnRate returns rate which error budget is consumed at, 1 means budget would be exhausted exactly at end of window
+func (t *tracker) burnRate(good, total uint64) float64 {
+	if total < 1 || t.Target >= 1 {
+		return 0
+	}
+
+	return (float64(total-good) / float64(total)) / (1 - t.Target)
+}
+
+// compliance returns ratio of good requests, 1 if no request
+func compliance(good, total uint64) float64 {
+	if total < 1 {
+		return 1
+	}
+
+	return float64(good) / float64(total)
+}
+
+// budgetRemaining returns ratio of error budget remaining, it would be negative if budget is exhausted
+func (t *tracker) budgetRemaining(good, total uint64) float64 {
+	if total < 1 {
+		return 1
+	}
+
+	if t.Target >= 1 {
+		if good == total {
+			return 1
+		}
+		return 0
+	}
+
+	return 1 - t.burnRate(good, total)
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfiberslo
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPath is the path which reports compliance and remaining error budget of objectives
+	DefaultPath = "/rk/v1/slo"
+	// DefaultWindow is rolling window of objective
+	DefaultWindow = 30 * 24 * time.Hour
+
+	// maxMatchCacheSize is max number of method and path pairs whose matched objectives are cached
+	maxMatchCacheSize = 10000
+)
+
+// DefaultBurnRateWindows are windows of burn rate gauges, they are pairs of long and short windows of
+// multi-window burn rate alerts
+var DefaultBurnRateWindows = []time.Duration{
+	5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour, 24 * time.Hour, 3 * 24 * time.Hour,
+}
+
+// ***************** OptionSet *****************
+
+// optionSet which is used for middleware implementation
+type optionSet struct {
+	entryName       string
+	entryType       string
+	path            string
+	trackers        []*tracker
+	burnRateWindows []time.Duration
+	registerer      prometheus.Registerer
+	now             func() time.Time
+
+	matchLock  sync.RWMutex
+	matchCache map[string][]*tracker
+}
+
+// newOptionSet Create new optionSet with options.
+func newOptionSet(opts ...Option) *optionSet {
+	set := &optionSet{
+		entryName:       "fake-entry",
+		entryType:       "",
+		path:            DefaultPath,
+		trackers:        make([]*tracker, 0),
+		burnRateWindows: DefaultBurnRateWindows,
+		registerer:      prometheus.DefaultRegisterer,
+		now:             time.Now,
+		matchCache:      make(map[string][]*tracker),
+	}
+
+	for i := range opts {
+		opts[i](set)
+	}
+
+	// collector may already be registered by another middleware with same registerer, ignore error
+	set.registerer.Register(newCollector(set))
+
+	return set
+}
+
+// trackersOf returns trackers whose method and route pattern match request
+func (set *optionSet) trackersOf(app *fiber.App, method, path string) []*tracker {
+	if len(set.trackers) < 1 {
+		return nil
+	}
+
+	key := method + " " + path
+
+	set.matchLock.RLock()
+	res, ok := set.matchCache[key]
+	set.matchLock.RUnlock()
+
+	if ok {
+		return res
+	}
+
+	config := app.Config()
+	for _, t := range set.trackers {
+		if t.matches(method) && fiber.RoutePatternMatch(path, t.Route, config) {
+			res = append(res, t)
+		}
+	}
+
+	set.matchLock.Lock()
+	if len(set.matchCache) >= maxMatchCacheSize {
+		set.matchCache = make(map[string][]*tracker)
+	}
+	set.matchCache[key] = res
+	set.matchLock.Unlock()
+
+	return res
+}
+
+// ***************** BootConfig *****************
+
+// BootConfig for YAML
+type BootConfig struct {
+	Enabled    bool                  `yaml:"enabled" json:"enabled"`
+	Path       string                `yaml:"path" json:"path"`
+	Objectives []ObjectiveBootConfig `yaml:"objectives" json:"objectives"`
+}
+
+// ObjectiveBootConfig is YAML config of Objective
+type ObjectiveBootConfig struct {
+	Name               string  `yaml:"name" json:"name"`
+	Method             string  `yaml:"method" json:"method"`
+	Route              string  `yaml:"route" json:"route"`
+	Objective          float64 `yaml:"objective" json:"objective"`
+	LatencyThresholdMs int     `yaml:"latencyThresholdMs" json:"latencyThresholdMs"`
+	WindowDays         int     `yaml:"windowDays" json:"windowDays"`
+}
+
+// ToOptions convert BootConfig into Option list
+func ToOptions(config *BootConfig, entryName, entryType string, registerer prometheus.Registerer) []Option {
+	opts := make([]Option, 0)
+
+	if config.Enabled {
+		opts = append(opts,
+			WithEntryNameAndType(entryName, entryType),
+			WithPath(config.Path),
+			WithRegisterer(registerer))
+
+		for _, element := range config.Objectives {
+			opts = append(opts, WithObjective(Objective{
+				Name:             element.Name,
+				Method:           element.Method,
+				Route:            element.Route,
+				Target:           element.Objective,
+				LatencyThreshold: time.Duration(element.LatencyThresholdMs) * time.Millisecond,
+				Window:           time.Duration(element.WindowDays) * 24 * time.Hour,
+			}))
+		}
+	}
+
+	return opts
+}
+
+// ***************** Option *****************
+
+// Option if for middleware options while creating middleware
+type Option func(*optionSet)
+
+// WithEntryNameAndType provide entry name and entry type.
+func WithEntryNameAndType(entryName, entryType string) Option {
+	return func(opt *optionSet) {
+		opt.entryName = entryName
+		opt.entryType = entryType
+	}
+}
+
+// WithPath provide path which reports objectives, DefaultPath would be used by default.
+func WithPath(path string) Option {
+	return func(opt *optionSet) {
+		if len(path) > 0 {
+			opt.path = path
+		}
+	}
+}
+
+// WithObjective provide Objective to track, objective without route, with target out of (0, 1] or with
+// name of objective provided before is ignored, since name is used as slo label of metrics.
+// Name would be method and route if empty, and DefaultWindow would be used if window is zero.
+func WithObjective(objective Objective) Option {
+	return func(opt *optionSet) {
+		if len(objective.Route) < 1 || objective.Target <= 0 || objective.Target > 1 {
+			return
+		}
+
+		objective.Method = strings.ToUpper(objective.Method)
+		if len(objective.Name) < 1 {
+			objective.Name = strings.TrimSpace(objective.Method + " " + objective.Route)
+		}
+		for i := range opt.trackers {
+			if opt.trackers[i].Name == objective.Name {
+				return
+			}
+		}
+		if objective.Window <= 0 {
+			objective.Window = DefaultWindow
+		}
+
+		opt.trackers = append(opt.trackers, newTracker(objective))
+	}
+}
+
+// WithBurnRateWindows provide windows of burn rate gauges, DefaultBurnRateWindows would be used by default.
+func WithBurnRateWindows(windows ...time.Duration) Option {
+	return func(opt *optionSet) {
+		res := make([]time.Duration, 0)
+		for i := range windows {
+			if windows[i] >= time.Minute {
+				res = append(res, windows[i])
+			}
+		}
+
+		if len(res) > 0 {
+			opt.burnRateWindows = res
+		}
+	}
+}
+
+// WithRegisterer provide prometheus.Registerer, prometheus.DefaultRegisterer would be used by default.
+func WithRegisterer(registerer prometheus.Registerer) Option {
+	return func(opt *optionSet) {
+		if registerer != nil {
+			opt.registerer = registerer
+		}
+	}
+}
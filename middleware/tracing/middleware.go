@@ -9,22 +9,76 @@ package rkfibertrace
 import (
 	"context"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
 	"github.com/rookie-ninja/rk-entry/v2/middleware"
 	"github.com/rookie-ninja/rk-entry/v2/middleware/tracing"
+	"github.com/rookie-ninja/rk-fiber/internal/route"
 	"github.com/rookie-ninja/rk-fiber/middleware/context"
 	"github.com/valyala/fasthttp/fasthttpadaptor"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 	"net/http"
+	"strconv"
 )
 
+// attribute keys of OpenTelemetry HTTP semantic conventions
+const (
+	AttrMethod           = attribute.Key("http.request.method")
+	AttrRoute            = attribute.Key("http.route")
+	AttrStatusCode       = attribute.Key("http.response.status_code")
+	AttrRequestBodySize  = attribute.Key("http.request.body.size")
+	AttrResponseBodySize = attribute.Key("http.response.body.size")
+	AttrUrlScheme        = attribute.Key("url.scheme")
+	AttrUrlPath          = attribute.Key("url.path")
+	AttrServerAddress    = attribute.Key("server.address")
+	AttrClientAddress    = attribute.Key("client.address")
+	AttrUserAgent        = attribute.Key("user_agent.original")
+	AttrProtocolVersion  = attribute.Key("network.protocol.version")
+	AttrErrorType        = attribute.Key("error.type")
+)
+
+// baggageHeader is header of W3C baggage
+const baggageHeader = "baggage"
+
 // Middleware create a interceptor with opentelemetry.
+//
+// Span is named after method before routing, and renamed as method and matched route like GET /v1/users/:id
+// after routing, so that span names keep low cardinality. Attributes follow OpenTelemetry HTTP semantic conventions.
 func Middleware(opts ...rkmidtrace.Option) fiber.Handler {
-	set := rkmidtrace.NewOptionSet(opts...)
+	return MiddlewareWithOptions(opts)
+}
+
+// MiddlewareWithOptions create a interceptor with options of rkmidtrace and options of this package.
+//
+// Baggage of request is extracted into user context, members of keys provided by WithBaggageKeys are copied into
+// logger returned by rkfiberctx.GetLogger, payloads of event and attributes of span.
+func MiddlewareWithOptions(traceOpts []rkmidtrace.Option, opts ...Option) fiber.Handler {
+	set := rkmidtrace.NewOptionSet(traceOpts...)
+	extra := newOptionSet(opts...)
 
 	return func(ctx *fiber.Ctx) error {
+		// request issued by middleware was already traced as original request
+		if rkfiberctx.IsInternalRequest(ctx) {
+			return ctx.Next()
+		}
+
 		req := &http.Request{}
 		fasthttpadaptor.ConvertRequest(ctx.Context(), req, true)
+		// span is started from user context, so that values of outer middlewares like logger and event are kept
+		req = req.WithContext(ctx.UserContext())
+
+		// strings of fiber.Ctx are reused after request, copy them since span is exported asynchronously
+		method := utils.CopyString(ctx.Method())
 
 		beforeCtx := set.BeforeCtx(req, false)
+		beforeCtx.Input.SpanName = method
+		beforeCtx.Input.Attributes = append([]attribute.KeyValue{
+			attribute.String(rkmid.Domain.Key, rkmid.Domain.String),
+		}, requestAttributes(ctx, method)...)
 		set.Before(beforeCtx)
 
 		ctx.SetUserContext(beforeCtx.Output.NewCtx)
@@ -32,20 +86,123 @@ func Middleware(opts ...rkmidtrace.Option) fiber.Handler {
 		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.TracerKey, set.GetTracer()))
 		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.TracerProviderKey, set.GetProvider()))
 		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.PropagatorKey, set.GetPropagator()))
+		extra.extractBaggage(ctx, set.GetPropagator())
 
 		// add to context
-		if beforeCtx.Output.Span != nil {
-			traceId := beforeCtx.Output.Span.SpanContext().TraceID().String()
-			rkfiberctx.GetEvent(ctx).SetTraceId(traceId)
-			ctx.Response().Header.Set(rkmid.HeaderTraceId, traceId)
-			ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.SpanKey, beforeCtx.Output.Span))
+		if beforeCtx.Output.Span == nil {
+			err := ctx.Next()
+			extra.copyBaggage(ctx, nil)
+			return err
 		}
 
+		span := beforeCtx.Output.Span
+		traceId := span.SpanContext().TraceID().String()
+		rkfiberctx.GetEvent(ctx).SetTraceId(traceId)
+		ctx.Response().Header.Set(rkmid.HeaderTraceId, traceId)
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.SpanKey, span))
+
 		err := ctx.Next()
 
-		afterCtx := set.AfterCtx(ctx.Response().StatusCode(), "")
-		set.After(beforeCtx, afterCtx)
+		if route := rkfiberroute.Matched(ctx); route != nil {
+			span.SetName(method + " " + route.Path)
+			span.SetAttributes(AttrRoute.String(route.Path))
+		}
+
+		code := rkfiberroute.StatusOf(ctx, err)
+		span.SetAttributes(
+			AttrStatusCode.Int(code),
+			AttrResponseBodySize.Int(len(ctx.Response().Body())))
+
+		extra.copyBaggage(ctx, span)
+
+		if err != nil {
+			span.RecordError(err)
+		}
+
+		// server spans are failed with 5xx only, client errors are not failures of server, status is left
+		// unset otherwise as http semantic conventions require
+		if code >= http.StatusInternalServerError {
+			span.SetAttributes(AttrErrorType.String(strconv.Itoa(code)))
+			desc := http.StatusText(code)
+			if err != nil {
+				desc = err.Error()
+			}
+			span.SetStatus(codes.Error, desc)
+		}
+
+		span.End()
 
 		return err
 	}
 }
+
+// extractBaggage extract baggage of request into user context, existing baggage is kept if request has none
+func (set *optionSet) extractBaggage(ctx *fiber.Ctx, propagator propagation.TextMapPropagator) {
+	// header is copied since strings of fiber.Ctx are reused after request
+	carrier := propagation.MapCarrier{
+		baggageHeader: utils.CopyString(ctx.Get(baggageHeader)),
+	}
+
+	if bag := baggage.FromContext(propagator.Extract(context.Background(), carrier)); bag.Len() > 0 {
+		ctx.SetUserContext(baggage.ContextWithBaggage(ctx.UserContext(), bag))
+	}
+
+	if len(set.baggageKeys) > 0 {
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkfiberctx.BaggageKeysKey, set.baggageKeys))
+	}
+}
+
+// copyBaggage copy baggage members of configured keys into payloads of event and attributes of span,
+// members set by handler are included
+func (set *optionSet) copyBaggage(ctx *fiber.Ctx, span trace.Span) {
+	bag := rkfiberctx.GetBaggage(ctx)
+	event := rkfiberctx.GetEvent(ctx)
+
+	for _, key := range set.baggageKeys {
+		member := bag.Member(key)
+		if len(member.Key()) < 1 {
+			continue
+		}
+
+		event.AddPayloads(zap.String(key, member.Value()))
+		if span != nil {
+			span.SetAttributes(attribute.String(key, member.Value()))
+		}
+	}
+}
+
+// requestAttributes returns attributes of request following HTTP semantic conventions
+func requestAttributes(ctx *fiber.Ctx, method string) []attribute.KeyValue {
+	scheme := "http"
+	if ctx.Protocol() == "https" {
+		scheme = "https"
+	}
+
+	version := "1.0"
+	if ctx.Request().Header.IsHTTP11() {
+		version = "1.1"
+	}
+
+	res := []attribute.KeyValue{
+		AttrMethod.String(method),
+		AttrUrlScheme.String(scheme),
+		AttrUrlPath.String(utils.CopyString(ctx.Path())),
+		AttrServerAddress.String(utils.CopyString(ctx.Hostname())),
+		AttrClientAddress.String(ctx.IP()),
+		AttrProtocolVersion.String(version),
+	}
+
+	if userAgent := ctx.Get(fiber.HeaderUserAgent); len(userAgent) > 0 {
+		res = append(res, AttrUserAgent.String(utils.CopyString(userAgent)))
+	}
+
+	size := ctx.Request().Header.ContentLength()
+	if size < 0 {
+		size = len(ctx.Request().Body())
+	}
+	if size > 0 {
+		res = append(res, AttrRequestBodySize.Int(size))
+	}
+
+	return res
+}
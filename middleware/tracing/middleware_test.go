@@ -6,11 +6,23 @@
 package rkfibertrace
 
 import (
+	"context"
+	"errors"
 	"github.com/gofiber/fiber/v2"
+	"github.com/rookie-ninja/rk-entry/v2/middleware"
 	"github.com/rookie-ninja/rk-entry/v2/middleware/tracing"
+	"github.com/rookie-ninja/rk-fiber/middleware/context"
+	"github.com/rookie-ninja/rk-query"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -31,3 +43,141 @@ func TestMiddleware(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
+
+// attributesOf returns attributes of span as map
+func attributesOf(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	res := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		res[kv.Key] = kv.Value
+	}
+	return res
+}
+
+func TestMiddleware_SpanNameAndAttributes(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	app := fiber.New()
+	app.Use(Middleware(
+		rkmidtrace.WithEntryNameAndType("ut-entry", "ut-type"),
+		rkmidtrace.WithSpanProcessor(recorder)))
+	app.Post("/ut-users/:id", func(ctx *fiber.Ctx) error {
+		return ctx.SendString("ut-response")
+	})
+	app.Get("/ut-error", func(ctx *fiber.Ctx) error {
+		return errors.New("ut-error")
+	})
+	app.Get("/ut-orders/:id", func(ctx *fiber.Ctx) error {
+		return fiber.NewError(http.StatusNotFound, "Cannot find order")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/ut-users/1", strings.NewReader("ut-request"))
+	req.Header.Set(fiber.HeaderUserAgent, "ut-agent")
+	app.Test(req)
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-error", nil))
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-missing", nil))
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-orders/1", nil))
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 4)
+
+	// matched route
+	assert.Equal(t, "POST /ut-users/:id", spans[0].Name())
+	attrs := attributesOf(spans[0])
+	assert.Equal(t, "/ut-users/:id", attrs[AttrRoute].AsString())
+	assert.Equal(t, "/ut-users/1", attrs[AttrUrlPath].AsString())
+	assert.Equal(t, "http", attrs[AttrUrlScheme].AsString())
+	assert.Equal(t, "ut-agent", attrs[AttrUserAgent].AsString())
+	assert.Equal(t, "0.0.0.0", attrs[AttrClientAddress].AsString())
+	assert.Equal(t, int64(http.StatusOK), attrs[AttrStatusCode].AsInt64())
+	assert.Equal(t, int64(len("ut-request")), attrs[AttrRequestBodySize].AsInt64())
+	assert.Equal(t, int64(len("ut-response")), attrs[AttrResponseBodySize].AsInt64())
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+
+	// handler error is recorded
+	assert.Equal(t, "GET /ut-error", spans[1].Name())
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+	assert.Equal(t, "ut-error", spans[1].Status().Description)
+	assert.Equal(t, "500", attributesOf(spans[1])[AttrErrorType].AsString())
+	assert.Len(t, spans[1].Events(), 1)
+	assert.Equal(t, "exception", spans[1].Events()[0].Name)
+
+	// unmatched request is named after method only
+	assert.Equal(t, "GET", spans[2].Name())
+	assert.NotContains(t, attributesOf(spans[2]), AttrRoute)
+	assert.Equal(t, codes.Unset, spans[2].Status().Code)
+
+	// not found error returned by handler keeps route whatever its message is
+	assert.Equal(t, "GET /ut-orders/:id", spans[3].Name())
+	assert.Equal(t, int64(http.StatusNotFound), attributesOf(spans[3])[AttrStatusCode].AsInt64())
+	assert.Equal(t, codes.Unset, spans[3].Status().Code)
+}
+
+func TestMiddlewareWithOptions_Baggage(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	event := rkquery.NewEventFactory().CreateEvent()
+
+	app := fiber.New()
+	app.Use(func(ctx *fiber.Ctx) error {
+		ctx.SetUserContext(context.WithValue(ctx.UserContext(), rkmid.EventKey, event))
+		return ctx.Next()
+	})
+	app.Use(MiddlewareWithOptions([]rkmidtrace.Option{
+		rkmidtrace.WithEntryNameAndType("ut-entry", "ut-type"),
+		rkmidtrace.WithSpanProcessor(recorder),
+	}, WithBaggageKeys("tenant.id", "user.tier", "ut-missing")))
+
+	outbound := &http.Request{Header: http.Header{}}
+	app.Get("/ut-path", func(ctx *fiber.Ctx) error {
+		assert.Equal(t, "acme", rkfiberctx.GetBaggageValue(ctx, "tenant.id"))
+		assert.Equal(t, "blue-green", rkfiberctx.GetBaggageValue(ctx, "experiment"))
+		assert.Nil(t, rkfiberctx.SetBaggage(ctx, "user.tier", ctx.Get("X-Tier")))
+		rkfiberctx.InjectSpanToHttpRequest(ctx, outbound)
+		return nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/ut-path", nil)
+	req.Header.Set("baggage", "tenant.id=acme,experiment=blue-green")
+	req.Header.Set("X-Tier", "gold")
+	resp, err := app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// baggage set by handler is propagated together with baggage of request
+	bag, err := baggage.Parse(outbound.Header.Get("baggage"))
+	assert.Nil(t, err)
+	assert.Equal(t, "acme", bag.Member("tenant.id").Value())
+	assert.Equal(t, "blue-green", bag.Member("experiment").Value())
+	assert.Equal(t, "gold", bag.Member("user.tier").Value())
+	assert.NotEmpty(t, outbound.Header.Get("traceparent"))
+
+	// configured keys only
+	spans := recorder.Ended()
+	assert.Len(t, spans, 1)
+	attrs := attributesOf(spans[0])
+	assert.Equal(t, "acme", attrs["tenant.id"].AsString())
+	assert.Equal(t, "gold", attrs["user.tier"].AsString())
+	assert.NotContains(t, attrs, attribute.Key("experiment"))
+	assert.NotContains(t, attrs, attribute.Key("ut-missing"))
+
+	payloads := make(map[string]string)
+	for _, field := range event.ListPayloads() {
+		payloads[field.Key] = field.String
+	}
+	assert.Equal(t, map[string]string{"tenant.id": "acme", "user.tier": "gold"}, payloads)
+}
+
+func TestMiddleware_BaggageOfContextKept(t *testing.T) {
+	app := fiber.New()
+	app.Use(func(ctx *fiber.Ctx) error {
+		assert.Nil(t, rkfiberctx.SetBaggage(ctx, "tenant.id", "acme"))
+		return ctx.Next()
+	})
+	app.Use(Middleware(rkmidtrace.WithExporter(&rkmidtrace.NoopExporter{})))
+	app.Get("/ut-path", func(ctx *fiber.Ctx) error {
+		return ctx.SendString(rkfiberctx.GetBaggageValue(ctx, "tenant.id"))
+	})
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ut-path", nil))
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "acme", string(body))
+}
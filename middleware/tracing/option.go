@@ -0,0 +1,181 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibertrace
+
+import (
+	"context"
+	"github.com/rookie-ninja/rk-entry/v2/entry"
+	"github.com/rookie-ninja/rk-entry/v2/middleware/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"strings"
+	"time"
+)
+
+// BootConfig for YAML
+type BootConfig struct {
+	rkmidtrace.BootConfig `yaml:",inline" json:",inline" mapstructure:",squash"`
+	Sampling              SamplingConfig `yaml:"sampling" json:"sampling"`
+	Baggage               BaggageConfig  `yaml:"baggage" json:"baggage"`
+}
+
+// SamplingConfig is YAML config of Sampler
+type SamplingConfig struct {
+	Ratio       *float64 `yaml:"ratio" json:"ratio"`
+	ParentBased bool     `yaml:"parentBased" json:"parentBased"`
+	RateLimit   float64  `yaml:"rateLimit" json:"rateLimit"`
+	Rules       []struct {
+		Route    string  `yaml:"route" json:"route"`
+		Path     string  `yaml:"path" json:"path"`
+		Decision string  `yaml:"decision" json:"decision"`
+		Ratio    float64 `yaml:"ratio" json:"ratio"`
+	} `yaml:"rules" json:"rules"`
+}
+
+// BaggageConfig is YAML config of baggage keys copied into logger, event, span and metrics
+type BaggageConfig struct {
+	Keys         []string `yaml:"keys" json:"keys"`
+	MetricLabels bool     `yaml:"metricLabels" json:"metricLabels"`
+}
+
+// ToOptions convert BootConfig into rkmidtrace.Option list.
+//
+// Exporter is chosen as same as rkmidtrace.ToOptions, and TracerProvider is created with Sampler of sampling config.
+func ToOptions(config *BootConfig, entryName, entryType string) []rkmidtrace.Option {
+	opts := make([]rkmidtrace.Option, 0)
+
+	if config.Enabled {
+		provider := sdktrace.NewTracerProvider(
+			sdktrace.WithSampler(NewSampler(SamplerOptions(&config.Sampling)...)),
+			sdktrace.WithSpanProcessor(sdktrace.NewBatchSpanProcessor(newExporter(&config.BootConfig))),
+			sdktrace.WithResource(newResource(entryName, entryType)))
+
+		opts = append(opts,
+			rkmidtrace.WithEntryNameAndType(entryName, entryType),
+			rkmidtrace.WithTracerProvider(provider),
+			rkmidtrace.WithPathToIgnore(config.Ignore...))
+	}
+
+	return opts
+}
+
+// SamplerOptions convert SamplingConfig into SamplerOption list
+func SamplerOptions(config *SamplingConfig) []SamplerOption {
+	opts := []SamplerOption{
+		WithParentBased(config.ParentBased),
+		WithRateLimit(config.RateLimit),
+	}
+
+	if config.Ratio != nil {
+		opts = append(opts, WithDefaultRatio(*config.Ratio))
+	}
+
+	for _, rule := range config.Rules {
+		opts = append(opts, WithSamplingRule(SamplingRule{
+			Route:    rule.Route,
+			Path:     rule.Path,
+			Decision: rule.Decision,
+			Ratio:    rule.Ratio,
+		}))
+	}
+
+	return opts
+}
+
+// BaggageOptions convert BaggageConfig into Option list
+func BaggageOptions(config *BaggageConfig) []Option {
+	return []Option{
+		WithBaggageKeys(config.Keys...),
+	}
+}
+
+// newExporter create exporter of config, noop exporter would be used if none enabled
+func newExporter(config *rkmidtrace.BootConfig) sdktrace.SpanExporter {
+	var exporter sdktrace.SpanExporter
+
+	if config.Exporter.File.Enabled {
+		exporter = rkmidtrace.NewFileExporter(config.Exporter.File.OutputPath)
+	}
+
+	if config.Exporter.Otlp.Enabled {
+		var opts []otlptracegrpc.Option
+		if len(config.Exporter.Otlp.Endpoint) > 0 {
+			opts = []otlptracegrpc.Option{
+				otlptracegrpc.WithInsecure(),
+				otlptracegrpc.WithEndpoint(config.Exporter.Otlp.Endpoint),
+				otlptracegrpc.WithReconnectionPeriod(50 * time.Millisecond),
+			}
+		}
+		exporter = rkmidtrace.NewOTLPTraceExporter(otlptracegrpc.NewClient(opts...))
+	}
+
+	if config.Exporter.Zipkin.Enabled {
+		exporter = rkmidtrace.NewZipkinExporter(config.Exporter.Zipkin.Endpoint)
+	}
+
+	if exporter == nil {
+		exporter = rkmidtrace.NewNoopExporter()
+	}
+
+	return exporter
+}
+
+// newResource create resource of application and entry as same as rkmidtrace
+func newResource(entryName, entryType string) *sdkresource.Resource {
+	res, _ := sdkresource.New(context.Background(),
+		sdkresource.WithFromEnv(),
+		sdkresource.WithProcess(),
+		sdkresource.WithTelemetrySDK(),
+		sdkresource.WithHost(),
+		sdkresource.WithAttributes(
+			semconv.ServiceNameKey.String(rkentry.GlobalAppCtx.GetAppInfoEntry().AppName),
+			semconv.ServiceVersionKey.String(rkentry.GlobalAppCtx.GetAppInfoEntry().Version),
+			attribute.String("service.entryName", entryName),
+			attribute.String("service.entryType", entryType),
+			semconv.TelemetrySDKLanguageGo,
+		),
+	)
+
+	return res
+}
+
+// ***************** Option *****************
+
+// optionSet of options which are not supported by rkmidtrace
+type optionSet struct {
+	baggageKeys []string
+}
+
+// newOptionSet Create new optionSet with options.
+func newOptionSet(opts ...Option) *optionSet {
+	set := &optionSet{
+		baggageKeys: []string{},
+	}
+
+	for i := range opts {
+		opts[i](set)
+	}
+
+	return set
+}
+
+// Option if for middleware options which are not supported by rkmidtrace
+type Option func(*optionSet)
+
+// WithBaggageKeys provide keys of baggage members which are copied into logger returned by rkfiberctx.GetLogger,
+// payloads of event and attributes of span.
+func WithBaggageKeys(keys ...string) Option {
+	return func(opt *optionSet) {
+		for i := range keys {
+			if key := strings.TrimSpace(keys[i]); len(key) > 0 {
+				opt.baggageKeys = append(opt.baggageKeys, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibertrace
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DecisionAlways samples every matched request regardless of parent
+	DecisionAlways = "always"
+	// DecisionNever drops every matched request regardless of parent
+	DecisionNever = "never"
+)
+
+// SamplingRule decides sampling of server spans whose path matches Route pattern like /v1/users/:id, or starts with Path.
+//
+// Decision of always or never takes precedence over parent, otherwise requests are sampled with Ratio.
+type SamplingRule struct {
+	Route    string
+	Path     string
+	Decision string
+	Ratio    float64
+
+	ratioSampler sdktrace.Sampler
+}
+
+// matches returns true if path matches rule
+func (rule *SamplingRule) matches(path string) bool {
+	if len(rule.Route) > 0 && fiber.RoutePatternMatch(path, rule.Route) {
+		return true
+	}
+
+	return len(rule.Path) > 0 && strings.HasPrefix(path, rule.Path)
+}
+
+// Sampler is sdktrace.Sampler which applies SamplingRule to server spans started by Middleware.
+//
+// Spans are decided in following order:
+//  1. child spans of local parent follow parent
+//  2. rules with decision of always or never
+//  3. sampled flag of remote parent if parent based
+//  4. ratio of first matched rule, or default ratio
+//
+// Rate limit caps number of sampled root spans per second, spans which follow parent are not limited.
+type Sampler struct {
+	rules        []*SamplingRule
+	ratioSampler sdktrace.Sampler
+	parentBased  bool
+	limiter      *rateLimiter
+	description  string
+}
+
+// SamplerOption is option of Sampler
+type SamplerOption func(*Sampler)
+
+// NewSampler create a new Sampler with options, requests are sampled with ratio of one by default.
+func NewSampler(opts ...SamplerOption) *Sampler {
+	sampler := &Sampler{
+		rules:        make([]*SamplingRule, 0),
+		ratioSampler: sdktrace.AlwaysSample(),
+	}
+
+	for i := range opts {
+		opts[i](sampler)
+	}
+
+	sampler.description = fmt.Sprintf("RkFiberSampler{rules:%d,default:%s,parentBased:%t,rateLimit:%v}",
+		len(sampler.rules), sampler.ratioSampler.Description(), sampler.parentBased, sampler.limiter != nil)
+
+	return sampler
+}
+
+// WithSamplingRule provide SamplingRule, rules are matched in order, rule without Route and Path is ignored.
+func WithSamplingRule(rule SamplingRule) SamplerOption {
+	return func(sampler *Sampler) {
+		if len(rule.Route) < 1 && len(rule.Path) < 1 {
+			return
+		}
+
+		rule.ratioSampler = sdktrace.TraceIDRatioBased(rule.Ratio)
+		sampler.rules = append(sampler.rules, &rule)
+	}
+}
+
+// WithDefaultRatio provide ratio of requests which match no rule, default is one.
+func WithDefaultRatio(ratio float64) SamplerOption {
+	return func(sampler *Sampler) {
+		sampler.ratioSampler = sdktrace.TraceIDRatioBased(ratio)
+	}
+}
+
+// WithParentBased provide whether sampled flag of incoming traceparent is followed.
+func WithParentBased(parentBased bool) SamplerOption {
+	return func(sampler *Sampler) {
+		sampler.parentBased = parentBased
+	}
+}
+
+// WithRateLimit provide max number of sampled root spans per second, zero means no limit.
+func WithRateLimit(perSecond float64) SamplerOption {
+	return func(sampler *Sampler) {
+		if perSecond > 0 {
+			sampler.limiter = newRateLimiter(perSecond)
+		}
+	}
+}
+
+// ShouldSample implements sdktrace.Sampler
+func (s *Sampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	parent := oteltrace.SpanContextFromContext(p.ParentContext)
+
+	// 1: child span of local parent
+	if parent.IsValid() && !parent.IsRemote() {
+		return s.follow(parent)
+	}
+
+	path, ok := "", false
+	for _, kv := range p.Attributes {
+		if kv.Key == AttrUrlPath {
+			path, ok = kv.Value.AsString(), true
+			break
+		}
+	}
+
+	var rule *SamplingRule
+	if ok {
+		for i := range s.rules {
+			if s.rules[i].matches(path) {
+				rule = s.rules[i]
+				break
+			}
+		}
+	}
+
+	// 2: rules with decision
+	if rule != nil {
+		switch rule.Decision {
+		case DecisionNever:
+			return s.result(parent, false)
+		case DecisionAlways:
+			return s.result(parent, s.allow())
+		}
+	}
+
+	// 3: remote parent
+	if s.parentBased && parent.IsValid() {
+		return s.follow(parent)
+	}
+
+	// 4: ratio
+	ratioSampler := s.ratioSampler
+	if rule != nil {
+		ratioSampler = rule.ratioSampler
+	}
+
+	sampled := ratioSampler.ShouldSample(p).Decision == sdktrace.RecordAndSample
+	return s.result(parent, sampled && s.allow())
+}
+
+// Description implements sdktrace.Sampler
+func (s *Sampler) Description() string {
+	return s.description
+}
+
+// follow returns result which follows sampled flag of parent
+func (s *Sampler) follow(parent oteltrace.SpanContext) sdktrace.SamplingResult {
+	return s.result(parent, parent.IsSampled())
+}
+
+// result returns result with trace state of parent
+func (s *Sampler) result(parent oteltrace.SpanContext, sampled bool) sdktrace.SamplingResult {
+	decision := sdktrace.Drop
+	if sampled {
+		decision = sdktrace.RecordAndSample
+	}
+
+	return sdktrace.SamplingResult{
+		Decision:   decision,
+		Tracestate: parent.TraceState(),
+	}
+}
+
+// allow returns true if rate limit is not exceeded
+func (s *Sampler) allow() bool {
+	return s.limiter == nil || s.limiter.allow(time.Now())
+}
+
+// rateLimiter is token bucket which refills perSecond tokens every second with burst of perSecond, at least one
+type rateLimiter struct {
+	lock      sync.Mutex
+	perSecond float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+}
+
+// newRateLimiter create a new rateLimiter
+func newRateLimiter(perSecond float64) *rateLimiter {
+	burst := perSecond
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		perSecond: perSecond,
+		burst:     burst,
+		tokens:    burst,
+	}
+}
+
+// allow takes a token at now if available
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.perSecond
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2021 rookie-ninja
+//
+// Use of this source code is governed by an Apache-style
+// license that can be found in the LICENSE file.
+
+package rkfibertrace
+
+import (
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rookie-ninja/rk-entry/v2/middleware/tracing"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// sample returns true if span of path with parent is sampled
+func sample(sampler sdktrace.Sampler, parent context.Context, path string) bool {
+	traceId, _ := oteltrace.TraceIDFromHex("0102030405060708090a0b0c0d0e0f10")
+	return sampler.ShouldSample(sdktrace.SamplingParameters{
+		ParentContext: parent,
+		TraceID:       traceId,
+		Name:          "GET",
+		Kind:          oteltrace.SpanKindServer,
+		Attributes:    []attribute.KeyValue{AttrUrlPath.String(path)},
+	}).Decision == sdktrace.RecordAndSample
+}
+
+// remoteParent returns context with remote parent
+func remoteParent(sampled bool, remote bool) context.Context {
+	traceId, _ := oteltrace.TraceIDFromHex("0102030405060708090a0b0c0d0e0f10")
+	spanId, _ := oteltrace.SpanIDFromHex("0102030405060708")
+	flags := oteltrace.TraceFlags(0)
+	if sampled {
+		flags = oteltrace.FlagsSampled
+	}
+
+	return oteltrace.ContextWithSpanContext(context.Background(), oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+		TraceID:    traceId,
+		SpanID:     spanId,
+		TraceFlags: flags,
+		Remote:     remote,
+	}))
+}
+
+func TestSampler(t *testing.T) {
+	sampler := NewSampler(
+		WithDefaultRatio(0),
+		WithParentBased(true),
+		WithSamplingRule(SamplingRule{Path: "/rk/v1/ready", Decision: DecisionNever}),
+		WithSamplingRule(SamplingRule{Path: "/ut-debug", Decision: DecisionAlways}),
+		WithSamplingRule(SamplingRule{Route: "/ut-users/:id", Ratio: 1}))
+
+	// rules
+	assert.False(t, sample(sampler, context.Background(), "/rk/v1/ready"))
+	assert.True(t, sample(sampler, context.Background(), "/ut-debug/1"))
+	assert.True(t, sample(sampler, context.Background(), "/ut-users/1"))
+	assert.False(t, sample(sampler, context.Background(), "/ut-users/1/orders"))
+
+	// decision of rule takes precedence over remote parent
+	assert.False(t, sample(sampler, remoteParent(true, true), "/rk/v1/ready"))
+
+	// parent based
+	assert.True(t, sample(sampler, remoteParent(true, true), "/ut-other"))
+	assert.False(t, sample(sampler, remoteParent(false, true), "/ut-users/1"))
+
+	// local parent is always followed
+	assert.True(t, sample(sampler, remoteParent(true, false), "/rk/v1/ready"))
+
+	// remote parent is ignored if not parent based
+	sampler = NewSampler(WithDefaultRatio(0))
+	assert.False(t, sample(sampler, remoteParent(true, true), "/ut-other"))
+}
+
+func TestSampler_RateLimit(t *testing.T) {
+	sampler := NewSampler(WithRateLimit(2))
+	assert.True(t, sample(sampler, context.Background(), "/ut-path"))
+	assert.True(t, sample(sampler, context.Background(), "/ut-path"))
+	assert.False(t, sample(sampler, context.Background(), "/ut-path"))
+
+	// parent based spans are not limited
+	sampler = NewSampler(WithRateLimit(1), WithParentBased(true))
+	for i := 0; i < 3; i++ {
+		assert.True(t, sample(sampler, remoteParent(true, true), "/ut-path"))
+	}
+
+	// tokens are refilled
+	limiter := newRateLimiter(0.5)
+	now := time.Now()
+	assert.True(t, limiter.allow(now))
+	assert.False(t, limiter.allow(now.Add(time.Second)))
+	assert.True(t, limiter.allow(now.Add(2*time.Second)))
+}
+
+func TestMiddleware_Sampler(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(NewSampler(WithSamplingRule(SamplingRule{Path: "/ut-health", Decision: DecisionNever}))),
+		sdktrace.WithSpanProcessor(recorder))
+
+	app := fiber.New()
+	app.Use(Middleware(
+		rkmidtrace.WithEntryNameAndType("ut-entry", "ut-type"),
+		rkmidtrace.WithTracerProvider(provider)))
+	app.Get("/ut-health", func(ctx *fiber.Ctx) error {
+		return nil
+	})
+	app.Get("/ut-path", func(ctx *fiber.Ctx) error {
+		return nil
+	})
+
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-health", nil))
+	app.Test(httptest.NewRequest(http.MethodGet, "/ut-path", nil))
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "GET /ut-path", spans[0].Name())
+}
+
+func TestToOptions(t *testing.T) {
+	ratio := 0.5
+	config := &BootConfig{}
+	config.Enabled = true
+	config.Sampling.Ratio = &ratio
+	config.Sampling.ParentBased = true
+
+	assert.NotEmpty(t, ToOptions(config, "ut-entry", "ut-type"))
+	assert.Len(t, SamplerOptions(&config.Sampling), 3)
+
+	config.Enabled = false
+	assert.Empty(t, ToOptions(config, "ut-entry", "ut-type"))
+}